@@ -0,0 +1,970 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Purchase order statuses. An open order is drafted line by line, then
+// placed with its vendor, which commits (encumbers) its funds until the
+// copies are received. An order is received once every copy has come in.
+const (
+	orderOpen      = "open"
+	orderPlaced    = "ordered"
+	orderReceived  = "received"
+	orderCancelled = "cancelled"
+)
+
+var (
+	errVendorNotFound    = errors.New("vendor not found")
+	errVendorInUse       = errors.New("vendor has purchase orders")
+	errUnknownVendor     = errors.New("unknown vendor")
+	errFundNotFound      = errors.New("fund not found")
+	errFundInUse         = errors.New("fund has order lines")
+	errUnknownFund       = errors.New("unknown fund")
+	errFundExceeded      = errors.New("order exceeds what is left in the fund")
+	errFundOvercommitted = errors.New("allocation is less than the fund has committed and spent")
+	errOrderNotFound     = errors.New("purchase order not found")
+	errOrderLineNotFound = errors.New("order line not found")
+	errOrderState        = errors.New("purchase order is not in a state to allow this")
+	errOrderEmpty        = errors.New("purchase order has no lines")
+	errOverReceived      = errors.New("more copies than are outstanding")
+)
+
+// Responses for the errors acquisitions refuses a request with
+var acquisitionErrors = errorResponses{
+	errVendorNotFound:    {http.StatusNotFound, "Vendor not found"},
+	errVendorInUse:       {http.StatusConflict, "Vendor has purchase orders"},
+	errUnknownVendor:     {http.StatusBadRequest, "Unknown vendor"},
+	errFundNotFound:      {http.StatusNotFound, "Fund not found"},
+	errFundInUse:         {http.StatusConflict, "Fund has order lines"},
+	errUnknownFund:       {http.StatusBadRequest, "Unknown fund"},
+	errFundExceeded:      {http.StatusConflict, "Order exceeds what is left in the fund"},
+	errFundOvercommitted: {http.StatusConflict, "Allocation is less than the fund has committed and spent"},
+	errOrderNotFound:     {http.StatusNotFound, "Purchase order not found"},
+	errOrderLineNotFound: {http.StatusNotFound, "Order line not found"},
+	errOrderState:        {http.StatusConflict, "Purchase order cannot make that change in its status"},
+	errOrderEmpty:        {http.StatusConflict, "Purchase order has no lines"},
+	errOverReceived:      {http.StatusConflict, "More copies than are outstanding on the line"},
+}
+
+// Respond with the matching acquisitions error, falling back to the
+// circulation and branch errors of the books, items and branches orders
+// touch
+func respondAcquisitionError(c *gin.Context, err error, fallback string) {
+	respondError(c, err, fallback, acquisitionErrors, circulationErrors, branchErrors)
+}
+
+// A supplier books are bought from
+type Vendor struct {
+	ID            uint   `json:"id"`
+	Code          string `json:"code"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	Address       string `json:"address"`
+	AccountNumber string `json:"account_number"`
+}
+
+// A budget line for one fiscal year. Amounts are in cents. Encumbered is
+// what placed orders still have to come in, expended what has been
+// received, and available what is left of the allocation.
+type Fund struct {
+	ID         uint   `json:"id"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	FiscalYear int    `json:"fiscal_year"`
+	Allocated  int64  `json:"allocated"`
+	Encumbered int64  `json:"encumbered"`
+	Expended   int64  `json:"expended"`
+	Available  int64  `json:"available"`
+}
+
+type PurchaseOrder struct {
+	ID        uint        `json:"id"`
+	VendorID  uint        `json:"vendor_id"`
+	Status    string      `json:"status"`
+	Note      string      `json:"note"`
+	Total     int64       `json:"total"`
+	CreatedAt time.Time   `json:"created_at"`
+	OrderedAt *time.Time  `json:"ordered_at,omitempty"`
+	ClosedAt  *time.Time  `json:"closed_at,omitempty"`
+	Lines     []OrderLine `json:"lines"`
+}
+
+// Copies of a book ordered for a branch and paid from a fund, at a unit
+// price in cents
+type OrderLine struct {
+	ID        uint   `json:"id"`
+	OrderID   uint   `json:"order_id"`
+	BookID    uint   `json:"book_id"`
+	FundID    uint   `json:"fund_id"`
+	BranchID  uint   `json:"branch_id"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int64  `json:"unit_price"`
+	Received  int    `json:"received"`
+	Note      string `json:"note"`
+}
+
+// An order line still to come in, as the encumbrance report lists it
+type Encumbrance struct {
+	OrderID     uint      `json:"order_id"`
+	LineID      uint      `json:"line_id"`
+	VendorID    uint      `json:"vendor_id"`
+	FundID      uint      `json:"fund_id"`
+	BookID      uint      `json:"book_id"`
+	Title       string    `json:"title"`
+	Outstanding int       `json:"outstanding"`
+	Amount      int64     `json:"amount"`
+	OrderedAt   time.Time `json:"ordered_at"`
+}
+
+type EncumbranceReport struct {
+	FiscalYear   int           `json:"fiscal_year"`
+	Allocated    int64         `json:"allocated"`
+	Encumbered   int64         `json:"encumbered"`
+	Expended     int64         `json:"expended"`
+	Available    int64         `json:"available"`
+	Funds        []Fund        `json:"funds"`
+	Encumbrances []Encumbrance `json:"encumbrances"`
+}
+
+// Create the vendor, fund and purchase order tables
+func createAcquisitionTables() {
+	acquisitionTablesSQL := `
+		CREATE TABLE IF NOT EXISTS vendors (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			address TEXT NOT NULL DEFAULT '',
+			account_number TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS funds (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code TEXT NOT NULL,
+			name TEXT NOT NULL,
+			fiscal_year INTEGER NOT NULL,
+			allocated INTEGER NOT NULL,
+			UNIQUE (code, fiscal_year)
+		);
+		CREATE TABLE IF NOT EXISTS purchase_orders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			vendor_id INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			ordered_at DATETIME,
+			closed_at DATETIME,
+			FOREIGN KEY (vendor_id) REFERENCES vendors (id)
+		);
+		CREATE TABLE IF NOT EXISTS order_lines (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id INTEGER NOT NULL,
+			book_id INTEGER NOT NULL,
+			fund_id INTEGER NOT NULL,
+			branch_id INTEGER NOT NULL,
+			quantity INTEGER NOT NULL,
+			unit_price INTEGER NOT NULL,
+			received INTEGER NOT NULL DEFAULT 0,
+			note TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (order_id) REFERENCES purchase_orders (id),
+			FOREIGN KEY (book_id) REFERENCES books (id),
+			FOREIGN KEY (fund_id) REFERENCES funds (id),
+			FOREIGN KEY (branch_id) REFERENCES branches (id)
+		);
+		CREATE INDEX IF NOT EXISTS order_lines_order ON order_lines (order_id);
+		CREATE INDEX IF NOT EXISTS order_lines_fund ON order_lines (fund_id);`
+	_, err = db.Exec(acquisitionTablesSQL)
+	if err != nil {
+		log.Fatal("Failed to create acquisition tables:", err)
+	}
+}
+
+const vendorColumns = "id, code, name, email, address, account_number"
+
+func scanVendor(row interface{ Scan(...interface{}) error }) (Vendor, error) {
+	var vendor Vendor
+	err := row.Scan(&vendor.ID, &vendor.Code, &vendor.Name, &vendor.Email, &vendor.Address, &vendor.AccountNumber)
+	return vendor, err
+}
+
+func queryVendor(q querier, id interface{}) (Vendor, error) {
+	vendor, err := scanVendor(q.QueryRow("SELECT "+vendorColumns+" FROM vendors WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return vendor, errVendorNotFound
+	}
+	return vendor, err
+}
+
+// Funds with what placed orders have committed and received copies spent
+const fundColumns = `f.id, f.code, f.name, f.fiscal_year, f.allocated,
+						COALESCE((SELECT SUM(l.unit_price * (l.quantity - l.received)) FROM order_lines AS l
+							INNER JOIN purchase_orders AS o ON o.id = l.order_id WHERE l.fund_id = f.id AND o.status = '` + orderPlaced + `'), 0),
+						COALESCE((SELECT SUM(l.unit_price * l.received) FROM order_lines AS l WHERE l.fund_id = f.id), 0)
+						FROM funds AS f`
+
+func scanFund(row interface{ Scan(...interface{}) error }) (Fund, error) {
+	var fund Fund
+	err := row.Scan(&fund.ID, &fund.Code, &fund.Name, &fund.FiscalYear, &fund.Allocated, &fund.Encumbered, &fund.Expended)
+	fund.Available = fund.Allocated - fund.Encumbered - fund.Expended
+	return fund, err
+}
+
+func queryFund(q querier, id interface{}) (Fund, error) {
+	fund, err := scanFund(q.QueryRow("SELECT "+fundColumns+" WHERE f.id = ?", id))
+	if err == sql.ErrNoRows {
+		return fund, errFundNotFound
+	}
+	return fund, err
+}
+
+func queryFunds(q querier, where string, args ...interface{}) ([]Fund, error) {
+	rows, err := q.Query("SELECT "+fundColumns+" "+where+" ORDER BY f.fiscal_year DESC, f.code", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	funds := []Fund{}
+	for rows.Next() {
+		fund, err := scanFund(rows)
+		if err != nil {
+			return nil, err
+		}
+		funds = append(funds, fund)
+	}
+	return funds, rows.Err()
+}
+
+const orderLineColumns = "id, order_id, book_id, fund_id, branch_id, quantity, unit_price, received, note"
+
+func scanOrderLine(row interface{ Scan(...interface{}) error }) (OrderLine, error) {
+	var line OrderLine
+	err := row.Scan(&line.ID, &line.OrderID, &line.BookID, &line.FundID, &line.BranchID, &line.Quantity, &line.UnitPrice,
+		&line.Received, &line.Note)
+	return line, err
+}
+
+const purchaseOrderColumns = "id, vendor_id, status, note, created_at, ordered_at, closed_at"
+
+func scanPurchaseOrder(row interface{ Scan(...interface{}) error }) (PurchaseOrder, error) {
+	var (
+		order               PurchaseOrder
+		orderedAt, closedAt sql.NullTime
+	)
+	err := row.Scan(&order.ID, &order.VendorID, &order.Status, &order.Note, &order.CreatedAt, &orderedAt, &closedAt)
+	order.OrderedAt = nullTimePtr(orderedAt)
+	order.ClosedAt = nullTimePtr(closedAt)
+	return order, err
+}
+
+// Fill in the lines of an order and its total
+func loadOrderLines(q querier, order *PurchaseOrder) error {
+	rows, err := q.Query("SELECT "+orderLineColumns+" FROM order_lines WHERE order_id = ? ORDER BY id", order.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	order.Lines = []OrderLine{}
+	order.Total = 0
+	for rows.Next() {
+		line, err := scanOrderLine(rows)
+		if err != nil {
+			return err
+		}
+		order.Lines = append(order.Lines, line)
+		order.Total += line.UnitPrice * int64(line.Quantity)
+	}
+	return rows.Err()
+}
+
+func queryPurchaseOrder(q querier, id interface{}) (PurchaseOrder, error) {
+	order, err := scanPurchaseOrder(q.QueryRow("SELECT "+purchaseOrderColumns+" FROM purchase_orders WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return order, errOrderNotFound
+	}
+	if err != nil {
+		return order, err
+	}
+	return order, loadOrderLines(q, &order)
+}
+
+// Check an order line from a request body against the catalogue, funds
+// and branches
+func checkOrderLine(q querier, line OrderLine) error {
+	if _, err := queryBook(q, line.BookID); err != nil {
+		if err == sql.ErrNoRows {
+			return errBookNotFound
+		}
+		return err
+	}
+	if _, err := queryFund(q, line.FundID); err != nil {
+		if err == errFundNotFound {
+			return errUnknownFund
+		}
+		return err
+	}
+	return checkBranch(q, line.BranchID)
+}
+
+func validOrderLine(line OrderLine) bool {
+	return line.BookID != 0 && line.FundID != 0 && line.BranchID != 0 && line.Quantity > 0 && line.UnitPrice >= 0
+}
+
+func addOrderLine(tx *sql.Tx, order PurchaseOrder, line OrderLine) error {
+	if order.Status != orderOpen {
+		return errOrderState
+	}
+	if err := checkOrderLine(tx, line); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO order_lines (order_id, book_id, fund_id, branch_id, quantity, unit_price, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		order.ID, line.BookID, line.FundID, line.BranchID, line.Quantity, line.UnitPrice, line.Note)
+	return err
+}
+
+// Place an open order with its vendor, as long as each fund it draws on
+// has enough left to cover it
+func placeOrder(tx *sql.Tx, order PurchaseOrder) error {
+	if order.Status != orderOpen {
+		return errOrderState
+	}
+	if len(order.Lines) == 0 {
+		return errOrderEmpty
+	}
+
+	costs := map[uint]int64{}
+	for _, line := range order.Lines {
+		costs[line.FundID] += line.UnitPrice * int64(line.Quantity)
+	}
+	for fundID, cost := range costs {
+		fund, err := queryFund(tx, fundID)
+		if err != nil {
+			return err
+		}
+		if cost > fund.Available {
+			return errFundExceeded
+		}
+	}
+
+	_, err := tx.Exec("UPDATE purchase_orders SET status = ?, ordered_at = ? WHERE id = ?", orderPlaced, now(), order.ID)
+	return err
+}
+
+// Take in copies of an order line under the given barcodes, adding them to
+// the collection at the line's branch. The order is received once nothing
+// is outstanding.
+func receiveOrderLine(tx *sql.Tx, c *gin.Context, order PurchaseOrder, lineID string, barcodes []string, shelf, itemType string) error {
+	if order.Status != orderPlaced {
+		return errOrderState
+	}
+	var line *OrderLine
+	outstanding := 0
+	for i := range order.Lines {
+		if strconv.Itoa(int(order.Lines[i].ID)) == lineID {
+			line = &order.Lines[i]
+		}
+		outstanding += order.Lines[i].Quantity - order.Lines[i].Received
+	}
+	if line == nil {
+		return errOrderLineNotFound
+	}
+	if len(barcodes) > line.Quantity-line.Received {
+		return errOverReceived
+	}
+
+	for _, barcode := range barcodes {
+		item := Item{BookID: line.BookID, Barcode: barcode, HomeBranchID: line.BranchID, Shelf: shelf, ItemType: itemType}
+		validateItem(&item)
+		r, err := tx.Exec(`INSERT INTO items (book_id, barcode, home_branch_id, current_branch_id, shelf, item_type, status)
+						VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			item.BookID, item.Barcode, item.HomeBranchID, item.CurrentBranchID, item.Shelf, item.ItemType, item.Status)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return errBarcodeInUse
+			}
+			return err
+		}
+		id, _ := r.LastInsertId()
+		item.ID = uint(id)
+
+		// A new copy goes to the first patron waiting for the book
+		hold, err := trapItemForHold(tx, item)
+		if err != nil {
+			return err
+		}
+		if hold != nil {
+			item.Status = itemOnHold
+		}
+		if err := recordAudit(tx, c, auditCreate, "item", item.ID, nil, item); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE order_lines SET received = received + ? WHERE id = ?", len(barcodes), line.ID); err != nil {
+		return err
+	}
+	if outstanding == len(barcodes) {
+		_, err := tx.Exec("UPDATE purchase_orders SET status = ?, closed_at = ? WHERE id = ?", orderReceived, now(), order.ID)
+		return err
+	}
+	return nil
+}
+
+// Drop an order, releasing what it still has committed. Copies already
+// received stay spent.
+func cancelOrder(tx *sql.Tx, order PurchaseOrder) error {
+	if order.Status != orderOpen && order.Status != orderPlaced {
+		return errOrderState
+	}
+
+	_, err := tx.Exec("UPDATE purchase_orders SET status = ?, closed_at = ? WHERE id = ?", orderCancelled, now(), order.ID)
+	return err
+}
+
+// What placed orders still have to come in for the funds of a fiscal year
+func queryEncumbrances(q querier, fiscalYear int) ([]Encumbrance, error) {
+	rows, err := q.Query(`SELECT o.id, l.id, o.vendor_id, l.fund_id, l.book_id, b.title, l.quantity - l.received,
+							l.unit_price * (l.quantity - l.received), o.ordered_at
+							FROM order_lines AS l INNER JOIN purchase_orders AS o ON o.id = l.order_id
+							INNER JOIN funds AS f ON f.id = l.fund_id INNER JOIN books AS b ON b.id = l.book_id
+							WHERE o.status = ? AND f.fiscal_year = ? AND l.received < l.quantity
+							ORDER BY o.ordered_at, l.id`, orderPlaced, fiscalYear)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	encumbrances := []Encumbrance{}
+	for rows.Next() {
+		var e Encumbrance
+		if err := rows.Scan(&e.OrderID, &e.LineID, &e.VendorID, &e.FundID, &e.BookID, &e.Title, &e.Outstanding,
+			&e.Amount, &e.OrderedAt); err != nil {
+			return nil, err
+		}
+		encumbrances = append(encumbrances, e)
+	}
+	return encumbrances, rows.Err()
+}
+
+// Handlers
+
+func getVendors(c *gin.Context) {
+	rows, err := db.Query("SELECT " + vendorColumns + " FROM vendors ORDER BY name")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve vendors"})
+		return
+	}
+	defer rows.Close()
+
+	vendors := []Vendor{}
+	for rows.Next() {
+		vendor, err := scanVendor(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve vendors"})
+			return
+		}
+		vendors = append(vendors, vendor)
+	}
+
+	c.JSON(http.StatusOK, vendors)
+}
+
+func getVendor(c *gin.Context) {
+	vendor, err := queryVendor(db, c.Param("id"))
+	if err != nil {
+		respondAcquisitionError(c, err, "Failed to retrieve vendor")
+		return
+	}
+
+	c.JSON(http.StatusOK, vendor)
+}
+
+// Respond with the error of a vendor or fund change
+func respondVendorFundError(c *gin.Context, err error, conflict, fallback string) {
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": conflict})
+		return
+	}
+	respondAcquisitionError(c, err, fallback)
+}
+
+func createVendor(c *gin.Context) {
+	var vendor Vendor
+	if err := c.ShouldBindJSON(&vendor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if vendor.Code == "" || vendor.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		r, err := tx.Exec("INSERT INTO vendors (code, name, email, address, account_number) VALUES (?, ?, ?, ?, ?)",
+			vendor.Code, vendor.Name, vendor.Email, vendor.Address, vendor.AccountNumber)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		vendor.ID = uint(id)
+		return recordAudit(tx, c, auditCreate, "vendor", vendor.ID, nil, vendor)
+	})
+	if err != nil {
+		respondVendorFundError(c, err, "Vendor code already in use", "Failed to create vendor")
+		return
+	}
+
+	c.JSON(http.StatusCreated, vendor)
+}
+
+func updateVendor(c *gin.Context) {
+	var vendor Vendor
+	if err := c.ShouldBindJSON(&vendor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if vendor.Code == "" || vendor.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryVendor(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		vendor.ID = before.ID
+
+		_, err = tx.Exec("UPDATE vendors SET code = ?, name = ?, email = ?, address = ?, account_number = ? WHERE id = ?",
+			vendor.Code, vendor.Name, vendor.Email, vendor.Address, vendor.AccountNumber, vendor.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "vendor", vendor.ID, before, vendor)
+	})
+	if err != nil {
+		respondVendorFundError(c, err, "Vendor code already in use", "Failed to update vendor")
+		return
+	}
+
+	c.JSON(http.StatusOK, vendor)
+}
+
+func deleteVendor(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryVendor(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		var orders int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM purchase_orders WHERE vendor_id = ?", before.ID).Scan(&orders); err != nil {
+			return err
+		}
+		if orders > 0 {
+			return errVendorInUse
+		}
+
+		if _, err := tx.Exec("DELETE FROM vendors WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "vendor", before.ID, before, nil)
+	})
+	if err != nil {
+		respondAcquisitionError(c, err, "Failed to delete vendor")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// List funds, latest fiscal year first, narrowed by fiscal year
+func getFunds(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	if year := c.Query("fiscal_year"); year != "" {
+		where += " AND f.fiscal_year = ?"
+		args = append(args, year)
+	}
+
+	funds, err := queryFunds(db, where, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve funds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, funds)
+}
+
+func getFund(c *gin.Context) {
+	fund, err := queryFund(db, c.Param("id"))
+	if err != nil {
+		respondAcquisitionError(c, err, "Failed to retrieve fund")
+		return
+	}
+
+	c.JSON(http.StatusOK, fund)
+}
+
+func createFund(c *gin.Context) {
+	var fund Fund
+	if err := c.ShouldBindJSON(&fund); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if fund.Code == "" || fund.Name == "" || fund.FiscalYear == 0 || fund.Allocated < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		r, err := tx.Exec("INSERT INTO funds (code, name, fiscal_year, allocated) VALUES (?, ?, ?, ?)",
+			fund.Code, fund.Name, fund.FiscalYear, fund.Allocated)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		if fund, err = queryFund(tx, id); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "fund", fund.ID, nil, fund)
+	})
+	if err != nil {
+		respondVendorFundError(c, err, "Fund code already in use for that fiscal year", "Failed to create fund")
+		return
+	}
+
+	c.JSON(http.StatusCreated, fund)
+}
+
+func updateFund(c *gin.Context) {
+	var fund Fund
+	if err := c.ShouldBindJSON(&fund); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if fund.Code == "" || fund.Name == "" || fund.FiscalYear == 0 || fund.Allocated < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryFund(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		// Order lines are charged to the year of their fund, so it stays put
+		// once there are any, and the fund cannot shrink below what they took
+		if fund.Allocated < before.Encumbered+before.Expended {
+			return errFundOvercommitted
+		}
+		if fund.FiscalYear != before.FiscalYear {
+			var lines int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM order_lines WHERE fund_id = ?", before.ID).Scan(&lines); err != nil {
+				return err
+			}
+			if lines > 0 {
+				return errFundInUse
+			}
+		}
+
+		_, err = tx.Exec("UPDATE funds SET code = ?, name = ?, fiscal_year = ?, allocated = ? WHERE id = ?",
+			fund.Code, fund.Name, fund.FiscalYear, fund.Allocated, before.ID)
+		if err != nil {
+			return err
+		}
+		if fund, err = queryFund(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "fund", fund.ID, before, fund)
+	})
+	if err != nil {
+		respondVendorFundError(c, err, "Fund code already in use for that fiscal year", "Failed to update fund")
+		return
+	}
+
+	c.JSON(http.StatusOK, fund)
+}
+
+func deleteFund(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryFund(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		var lines int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM order_lines WHERE fund_id = ?", before.ID).Scan(&lines); err != nil {
+			return err
+		}
+		if lines > 0 {
+			return errFundInUse
+		}
+
+		if _, err := tx.Exec("DELETE FROM funds WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "fund", before.ID, before, nil)
+	})
+	if err != nil {
+		respondAcquisitionError(c, err, "Failed to delete fund")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Report the funds of a fiscal year, this year unless given, with the
+// order lines still committing them
+func getEncumbranceReport(c *gin.Context) {
+	report := EncumbranceReport{FiscalYear: now().Year()}
+	if year := c.Query("fiscal_year"); year != "" {
+		v, err := strconv.Atoi(year)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fiscal year"})
+			return
+		}
+		report.FiscalYear = v
+	}
+
+	var err error
+	if report.Funds, err = queryFunds(db, "WHERE f.fiscal_year = ?", report.FiscalYear); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build encumbrance report"})
+		return
+	}
+	if report.Encumbrances, err = queryEncumbrances(db, report.FiscalYear); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build encumbrance report"})
+		return
+	}
+	for _, fund := range report.Funds {
+		report.Allocated += fund.Allocated
+		report.Encumbered += fund.Encumbered
+		report.Expended += fund.Expended
+		report.Available += fund.Available
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func createPurchaseOrder(c *gin.Context) {
+	var body struct {
+		VendorID uint        `json:"vendor_id"`
+		Note     string      `json:"note"`
+		Lines    []OrderLine `json:"lines"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.VendorID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+	for _, line := range body.Lines {
+		if !validOrderLine(line) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+			return
+		}
+	}
+
+	var order PurchaseOrder
+	err := withTx(func(tx *sql.Tx) error {
+		if _, err := queryVendor(tx, body.VendorID); err != nil {
+			if err == errVendorNotFound {
+				return errUnknownVendor
+			}
+			return err
+		}
+		r, err := tx.Exec("INSERT INTO purchase_orders (vendor_id, status, note, created_at) VALUES (?, ?, ?, ?)",
+			body.VendorID, orderOpen, body.Note, now())
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		order = PurchaseOrder{ID: uint(id), Status: orderOpen}
+		for _, line := range body.Lines {
+			if err := addOrderLine(tx, order, line); err != nil {
+				return err
+			}
+		}
+
+		if order, err = queryPurchaseOrder(tx, id); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "purchase_order", order.ID, nil, order)
+	})
+	if err != nil {
+		respondAcquisitionError(c, err, "Failed to create purchase order")
+		return
+	}
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// Run a change to an existing order and respond with the result
+func respondOrderChange(c *gin.Context, change func(tx *sql.Tx, order PurchaseOrder) error, fallback string) {
+	var after PurchaseOrder
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryPurchaseOrder(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := change(tx, before); err != nil {
+			return err
+		}
+		if after, err = queryPurchaseOrder(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "purchase_order", after.ID, before, after)
+	})
+	if err != nil {
+		respondAcquisitionError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func addOrderLineHandler(c *gin.Context) {
+	var line OrderLine
+	if err := c.ShouldBindJSON(&line); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if !validOrderLine(line) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	respondOrderChange(c, func(tx *sql.Tx, order PurchaseOrder) error {
+		return addOrderLine(tx, order, line)
+	}, "Failed to add order line")
+}
+
+func deleteOrderLine(c *gin.Context) {
+	respondOrderChange(c, func(tx *sql.Tx, order PurchaseOrder) error {
+		if order.Status != orderOpen {
+			return errOrderState
+		}
+		result, err := tx.Exec("DELETE FROM order_lines WHERE id = ? AND order_id = ?", c.Param("line_id"), order.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errOrderLineNotFound
+		}
+		return nil
+	}, "Failed to remove order line")
+}
+
+func placeOrderHandler(c *gin.Context) {
+	respondOrderChange(c, placeOrder, "Failed to place purchase order")
+}
+
+func receiveOrderLineHandler(c *gin.Context) {
+	var body struct {
+		Barcodes []string `json:"barcodes"`
+		Shelf    string   `json:"shelf"`
+		ItemType string   `json:"item_type"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if len(body.Barcodes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+	for _, barcode := range body.Barcodes {
+		if barcode == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+			return
+		}
+	}
+
+	respondOrderChange(c, func(tx *sql.Tx, order PurchaseOrder) error {
+		return receiveOrderLine(tx, c, order, c.Param("line_id"), body.Barcodes, body.Shelf, body.ItemType)
+	}, "Failed to receive order line")
+}
+
+func cancelOrderHandler(c *gin.Context) {
+	respondOrderChange(c, cancelOrder, "Failed to cancel purchase order")
+}
+
+func getPurchaseOrder(c *gin.Context) {
+	order, err := queryPurchaseOrder(db, c.Param("id"))
+	if err != nil {
+		respondAcquisitionError(c, err, "Failed to retrieve purchase order")
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// List orders, newest first, narrowed by status and vendor
+func getPurchaseOrders(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	for _, filter := range []string{"status", "vendor_id"} {
+		if value := c.Query(filter); value != "" {
+			where += " AND " + filter + " = ?"
+			args = append(args, value)
+		}
+	}
+
+	rows, err := db.Query("SELECT "+purchaseOrderColumns+" FROM purchase_orders "+where+" ORDER BY id DESC", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase orders"})
+		return
+	}
+	orders := []PurchaseOrder{}
+	for rows.Next() {
+		order, err := scanPurchaseOrder(rows)
+		if err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase orders"})
+			return
+		}
+		orders = append(orders, order)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase orders"})
+		return
+	}
+
+	// Lines are loaded once the list is read, as the connection is shared
+	for i := range orders {
+		if err := loadOrderLines(db, &orders[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase orders"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, orders)
+}
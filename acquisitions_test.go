@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVendorsAndFunds(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	member := tokenFor(t, "member", roleMember)
+
+	if recorder := doJSON("GET", "/api/vendors", member, nil); recorder.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", recorder.Code)
+	}
+	recorder := doJSON("POST", "/api/vendors", librarian, Vendor{Code: "BKS", Name: "Books Inc", AccountNumber: "A-100"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", "/api/vendors", librarian, Vendor{Code: "BKS", Name: "Other"}); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("PUT", "/api/vendors/1", librarian, Vendor{Code: "BKS", Name: "Books Incorporated"})
+	var vendor Vendor
+	json.NewDecoder(recorder.Body).Decode(&vendor)
+	if recorder.Code != http.StatusOK || vendor.Name != "Books Incorporated" {
+		t.Fatalf("Unexpected vendor %d %+v", recorder.Code, vendor)
+	}
+
+	// Fund codes repeat from one fiscal year to the next
+	for _, year := range []int{2024, 2025} {
+		recorder := doJSON("POST", "/api/funds", librarian, Fund{Code: "ADULT", Name: "Adult fiction", FiscalYear: year, Allocated: 100000})
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, but got %d", recorder.Code)
+		}
+	}
+	if recorder := doJSON("POST", "/api/funds", librarian, Fund{Code: "ADULT", Name: "Again", FiscalYear: 2024}); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", "/api/funds", librarian, Fund{Code: "KIDS", Name: "Children"}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", "/api/funds?fiscal_year=2025", librarian, nil)
+	var funds []Fund
+	json.NewDecoder(recorder.Body).Decode(&funds)
+	if len(funds) != 1 || funds[0].FiscalYear != 2025 || funds[0].Available != 100000 {
+		t.Fatalf("Unexpected funds %+v", funds)
+	}
+
+	if recorder := doJSON("DELETE", "/api/funds/2", librarian, nil); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("DELETE", "/api/vendors/1", librarian, nil); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("GET", "/api/vendors/1", librarian, nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+}
+
+func TestPurchaseOrders(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian)
+	alice := createTestPatron(t, "alice", 0)
+	year := now().Year()
+	doJSON("POST", "/api/vendors", librarian, Vendor{Code: "BKS", Name: "Books Inc"})
+	doJSON("POST", "/api/funds", librarian, Fund{Code: "ADULT", Name: "Adult fiction", FiscalYear: year, Allocated: 10000})
+
+	line := gin.H{"book_id": 1, "fund_id": 1, "branch_id": 1, "quantity": 3, "unit_price": 2500}
+	if recorder := doJSON("POST", "/api/purchase-orders", librarian, gin.H{"vendor_id": 2}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder := doJSON("POST", "/api/purchase-orders", librarian, gin.H{"vendor_id": 1, "lines": []gin.H{line}})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	var order PurchaseOrder
+	json.NewDecoder(recorder.Body).Decode(&order)
+	if order.Status != orderOpen || len(order.Lines) != 1 || order.Total != 7500 {
+		t.Fatalf("Unexpected order %+v", order)
+	}
+
+	// Orders may not spend more than is left in a fund
+	recorder = doJSON("POST", "/api/purchase-orders/1/lines", librarian, gin.H{"book_id": 1, "fund_id": 1, "branch_id": 1, "quantity": 1, "unit_price": 5000})
+	json.NewDecoder(recorder.Body).Decode(&order)
+	if recorder.Code != http.StatusOK || len(order.Lines) != 2 {
+		t.Fatalf("Unexpected order %d %+v", recorder.Code, order)
+	}
+	if recorder := doJSON("POST", "/api/purchase-orders/1/place", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("DELETE", "/api/purchase-orders/1/lines/2", librarian, nil); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/purchase-orders/1/place", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&order)
+	if recorder.Code != http.StatusOK || order.Status != orderPlaced || order.OrderedAt == nil {
+		t.Fatalf("Unexpected order %d %+v", recorder.Code, order)
+	}
+	if recorder := doJSON("POST", "/api/purchase-orders/1/lines", librarian, line); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	fund, _ := queryFund(db, 1)
+	if fund.Encumbered != 7500 || fund.Expended != 0 || fund.Available != 2500 {
+		t.Fatalf("Unexpected fund %+v", fund)
+	}
+
+	// Received copies join the collection, the first going to a waiting patron
+	db.Exec("INSERT INTO holds (book_id, patron_id, status, placed_at) VALUES (1, ?, ?, ?)", alice.ID, holdWaiting, now())
+	if recorder := doJSON("POST", "/api/purchase-orders/1/lines/1/receive", librarian, gin.H{"barcodes": []string{"a", "b", "c", "d"}}); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/purchase-orders/1/lines/1/receive", librarian, gin.H{"barcodes": []string{"60001", "60002"}, "shelf": "NEW"})
+	json.NewDecoder(recorder.Body).Decode(&order)
+	if recorder.Code != http.StatusOK || order.Status != orderPlaced || order.Lines[0].Received != 2 {
+		t.Fatalf("Unexpected order %d %+v", recorder.Code, order)
+	}
+	first, _ := lookupItem(db, 0, "60001")
+	second, _ := lookupItem(db, 0, "60002")
+	if first.BookID != 1 || first.HomeBranchID != 1 || first.Shelf != "NEW" || first.Status != itemOnHold || second.Status != itemAvailable {
+		t.Fatalf("Unexpected items %+v %+v", first, second)
+	}
+	if recorder := doJSON("POST", "/api/purchase-orders/1/lines/1/receive", librarian, gin.H{"barcodes": []string{"60001"}}); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("GET", "/api/funds/encumbrances", librarian, nil)
+	var report EncumbranceReport
+	json.NewDecoder(recorder.Body).Decode(&report)
+	if report.FiscalYear != year || report.Encumbered != 2500 || report.Expended != 5000 || report.Available != 2500 ||
+		len(report.Encumbrances) != 1 || report.Encumbrances[0].Outstanding != 1 || report.Encumbrances[0].Title != "Book 1" {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	recorder = doJSON("POST", "/api/purchase-orders/1/lines/1/receive", librarian, gin.H{"barcodes": []string{"60003"}})
+	json.NewDecoder(recorder.Body).Decode(&order)
+	if order.Status != orderReceived || order.ClosedAt == nil {
+		t.Fatalf("Unexpected order %+v", order)
+	}
+	if recorder := doJSON("POST", "/api/purchase-orders/1/cancel", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	fund, _ = queryFund(db, 1)
+	if fund.Encumbered != 0 || fund.Expended != 7500 {
+		t.Fatalf("Unexpected fund %+v", fund)
+	}
+
+	// Cancelling releases what an order committed
+	doJSON("POST", "/api/purchase-orders", librarian, gin.H{"vendor_id": 1, "lines": []gin.H{{"book_id": 1, "fund_id": 1, "branch_id": 1, "quantity": 1, "unit_price": 2000}}})
+	doJSON("POST", "/api/purchase-orders/2/place", librarian, nil)
+	if fund, _ := queryFund(db, 1); fund.Available != 500 {
+		t.Fatalf("Expected 500 available, but got %+v", fund)
+	}
+	doJSON("POST", "/api/purchase-orders/2/cancel", librarian, nil)
+	if fund, _ := queryFund(db, 1); fund.Available != 2500 {
+		t.Fatalf("Expected 2500 available, but got %+v", fund)
+	}
+
+	recorder = doJSON("GET", "/api/purchase-orders?status=received", librarian, nil)
+	var orders []PurchaseOrder
+	json.NewDecoder(recorder.Body).Decode(&orders)
+	if len(orders) != 1 || orders[0].ID != 1 || len(orders[0].Lines) != 1 {
+		t.Fatalf("Unexpected orders %+v", orders)
+	}
+	if recorder := doJSON("DELETE", "/api/vendors/1", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("DELETE", "/api/funds/1", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	// A fund with orders keeps its year and at least what they spent
+	update := Fund{Code: "ADULT", Name: "Adult fiction", FiscalYear: year, Allocated: 7000}
+	if recorder := doJSON("PUT", "/api/funds/1", librarian, update); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	update.Allocated, update.FiscalYear = 7500, year+1
+	if recorder := doJSON("PUT", "/api/funds/1", librarian, update); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	update.FiscalYear = year
+	if recorder := doJSON("PUT", "/api/funds/1", librarian, update); recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+}
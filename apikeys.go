@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API keys look like olk_<prefix>_<secret>; the prefix finds the stored
+// hash and is safe to show in listings
+const apiKeyPrefix = "olk_"
+
+type APIKey struct {
+	ID         uint       `json:"id"`
+	UserID     uint       `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Create the api_keys table
+func createAPIKeyTables() {
+	apiKeysTableSQL := `
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL UNIQUE,
+			key_hash TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(apiKeysTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create api_keys table:", err)
+	}
+}
+
+// Read a key from X-API-Key or "Authorization: ApiKey <key>"
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if authorization := c.GetHeader("Authorization"); strings.HasPrefix(authorization, "ApiKey ") {
+		return strings.TrimPrefix(authorization, "ApiKey ")
+	}
+	return ""
+}
+
+// Authenticate the request as the owner of an API key, limited to the key's
+// scopes, and record when the key was used
+func authenticateAPIKey(c *gin.Context, key string) {
+	prefix, _, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		c.Abort()
+		return
+	}
+
+	var (
+		id        uint
+		keyHash   string
+		scopes    string
+		expiresAt sql.NullTime
+		revokedAt sql.NullTime
+		user      User
+	)
+	err := db.QueryRow(`SELECT k.id, k.key_hash, k.scopes, k.expires_at, k.revoked_at, u.id, u.username, u.role, u.disabled
+						FROM api_keys AS k
+						INNER JOIN users AS u ON u.id = k.user_id
+						WHERE k.prefix = ?`, prefix).
+		Scan(&id, &keyHash, &scopes, &expiresAt, &revokedAt, &user.ID, &user.Username, &user.Role, &user.Disabled)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+		c.Abort()
+		return
+	}
+
+	if err == sql.ErrNoRows || subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashToken(key))) != 1 ||
+		revokedAt.Valid || (expiresAt.Valid && !expiresAt.Time.After(now())) || user.Disabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		c.Abort()
+		return
+	}
+
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now(), id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", strconv.FormatUint(uint64(user.ID), 10))
+	c.Set("username", user.Username)
+	c.Set("role", user.Role)
+	c.Set("scopes", strings.Fields(scopes))
+	c.Set("api_key_id", id)
+	c.Next()
+}
+
+func queryAPIKeys(q querier, query string, args ...interface{}) ([]APIKey, error) {
+	rows, err := q.Query(`SELECT id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at
+							FROM api_keys `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var (
+			key                              APIKey
+			scopes                           string
+			expiresAt, lastUsedAt, revokedAt sql.NullTime
+		)
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt,
+			&expiresAt, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Fields(scopes)
+		key.ExpiresAt = nullTimePtr(expiresAt)
+		key.LastUsedAt = nullTimePtr(lastUsedAt)
+		key.RevokedAt = nullTimePtr(revokedAt)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Keys cannot manage keys or other account security, so a leaked key
+// cannot mint replacements or lock its owner out
+func rejectAPIKeyCaller(c *gin.Context) bool {
+	if _, ok := c.Get("api_key_id"); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed with an API key"})
+		return true
+	}
+	return false
+}
+
+// Handlers
+
+func createAPIKey(c *gin.Context) {
+	if rejectAPIKeyCaller(c) {
+		return
+	}
+
+	var body struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.Name == "" || len(body.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !roleHasPermission(c.GetString("role"), scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Scope not allowed: " + scope})
+			return
+		}
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	prefix, err1 := randomToken(4)
+	secret, err2 := randomToken(32)
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	userID, _ := strconv.ParseUint(c.GetString("user_id"), 10, 64)
+	key := APIKey{
+		UserID:    uint(userID),
+		Name:      body.Name,
+		Prefix:    prefix,
+		Scopes:    body.Scopes,
+		Key:       apiKeyPrefix + prefix + "_" + secret,
+		CreatedAt: now(),
+	}
+	var expiresAt sql.NullTime
+	if body.ExpiresAt != nil {
+		key.ExpiresAt = body.ExpiresAt
+		expiresAt = sql.NullTime{Time: body.ExpiresAt.UTC(), Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	defer tx.Rollback()
+
+	r, err := tx.Exec(`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at, expires_at)
+						VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.UserID, key.Name, key.Prefix, hashToken(key.Key), strings.Join(key.Scopes, " "), key.CreatedAt, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	id, _ := r.LastInsertId()
+	key.ID = uint(id)
+
+	// The audit log must not leak the key
+	logged := key
+	logged.Key = ""
+	if err := recordAudit(tx, c, auditCreate, "api_key", key.ID, nil, logged); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	// The key itself is only ever shown here
+	c.JSON(http.StatusCreated, key)
+}
+
+func getAPIKeys(c *gin.Context) {
+	keys, err := queryAPIKeys(db, "WHERE user_id = ? ORDER BY id", c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func getAllAPIKeys(c *gin.Context) {
+	keys, err := queryAPIKeys(db, "ORDER BY id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func respondRevokeAPIKey(c *gin.Context, query string, args ...interface{}) {
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	defer tx.Rollback()
+
+	keys, err := queryAPIKeys(tx, "WHERE revoked_at IS NULL AND "+query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if len(keys) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	before := keys[0]
+	after := before
+	revokedAt := now()
+	after.RevokedAt = &revokedAt
+	if _, err := tx.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ?", revokedAt, before.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	if err := recordAudit(tx, c, auditUpdate, "api_key", before.ID, before, after); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+func revokeAPIKey(c *gin.Context) {
+	if rejectAPIKeyCaller(c) {
+		return
+	}
+
+	respondRevokeAPIKey(c, "id = ? AND user_id = ?", c.Param("id"), c.GetString("user_id"))
+}
+
+func revokeAnyAPIKey(c *gin.Context) {
+	respondRevokeAPIKey(c, "id = ?", c.Param("id"))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Helper function to send a request authenticated with an API key header
+func doWithAPIKey(method, path, header, value string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, path, nil)
+	request.Header.Set(header, value)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+
+	// Scopes must be within the caller's role
+	recorder := doJSON("POST", "/api/account/api-keys", librarian, map[string]interface{}{
+		"name": "nightly sync", "scopes": []string{permCatalogRead, permCatalogDelete},
+	})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/api/account/api-keys", librarian, map[string]interface{}{
+		"name": "nightly sync", "scopes": []string{permCatalogRead},
+	})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	var key APIKey
+	json.NewDecoder(recorder.Body).Decode(&key)
+	if key.Key == "" || key.Prefix == "" {
+		t.Fatalf("Expected the new key in the response, but got %+v", key)
+	}
+
+	// Both header forms are accepted
+	recorder = doWithAPIKey("GET", "/api/books", "X-API-Key", key.Key)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doWithAPIKey("GET", "/api/books", "Authorization", "ApiKey "+key.Key)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	// The key is limited to its scopes even though the owner may write
+	recorder = doWithAPIKey("POST", "/api/books", "X-API-Key", key.Key)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+
+	// Keys cannot create keys
+	recorder = doWithAPIKey("POST", "/api/account/api-keys", "X-API-Key", key.Key)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+
+	// Listing shows when the key was used but never the key itself
+	recorder = doJSON("GET", "/api/account/api-keys", librarian, nil)
+	var keys []APIKey
+	json.NewDecoder(recorder.Body).Decode(&keys)
+	if len(keys) != 1 || keys[0].Key != "" || keys[0].LastUsedAt == nil {
+		t.Errorf("Unexpected listing %+v", keys)
+	}
+
+	recorder = doJSON("DELETE", "/api/account/api-keys/1", librarian, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+	recorder = doWithAPIKey("GET", "/api/books", "X-API-Key", key.Key)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
+
+func TestAPIKeyRejected(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	member := tokenFor(t, "member", roleMember)
+
+	expiresAt := now().Add(time.Hour)
+	recorder := doJSON("POST", "/api/account/api-keys", member, map[string]interface{}{
+		"name": "reader", "scopes": []string{permCatalogRead}, "expires_at": expiresAt,
+	})
+	var key APIKey
+	json.NewDecoder(recorder.Body).Decode(&key)
+
+	for _, value := range []string{"olk_unknown_secret", key.Key[:len(key.Key)-1] + "x", "garbage"} {
+		recorder = doWithAPIKey("GET", "/api/books", "X-API-Key", value)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for %q, but got %d", value, recorder.Code)
+		}
+	}
+
+	// Other users cannot revoke the key, admins can
+	recorder = doJSON("DELETE", "/api/account/api-keys/1", admin, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+
+	// Expired keys stop working
+	realNow := now
+	now = func() time.Time { return realNow().Add(2 * time.Hour) }
+	recorder = doWithAPIKey("GET", "/api/books", "X-API-Key", key.Key)
+	now = realNow
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("DELETE", "/api/admin/api-keys/1", admin, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+}
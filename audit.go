@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audited actions
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	auditLink   = "link"
+)
+
+// One change made through the API. Before is absent for creations and
+// After for deletions.
+type AuditEntry struct {
+	ID         uint            `json:"id"`
+	UserID     *uint           `json:"user_id"`
+	Username   string          `json:"username,omitempty"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// Create the audit_log table. The triggers keep it append-only.
+func createAuditTables() {
+	auditLogTableSQL := `
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			username TEXT,
+			action TEXT NOT NULL,
+			entity_type TEXT NOT NULL,
+			entity_id TEXT NOT NULL,
+			before TEXT,
+			after TEXT,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log (entity_type, entity_id);
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_log is append-only');
+		END;
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit_log is append-only');
+		END;`
+	_, err = db.Exec(auditLogTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create audit_log table:", err)
+	}
+}
+
+func auditSnapshot(v interface{}) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// Record a change made by the caller. Pass the transaction making the change
+// so the entry is only kept if the change is.
+func recordAudit(q querier, c *gin.Context, action, entityType string, entityID interface{}, before, after interface{}) error {
+	// Calls without a logged in user, such as /register, have no actor
+	var userID, username sql.NullString
+	if id := c.GetString("user_id"); id != "" {
+		userID = sql.NullString{String: id, Valid: true}
+		username = sql.NullString{String: c.GetString("username"), Valid: true}
+	}
+	return insertAuditEntry(q, userID, username, action, entityType, entityID, before, after)
+}
+
+// Record a change made by an account outside an HTTP request, such as a
+// self-check machine over SIP2
+func recordUserAudit(q querier, user User, action, entityType string, entityID interface{}, before, after interface{}) error {
+	userID := sql.NullString{String: strconv.FormatUint(uint64(user.ID), 10), Valid: true}
+	username := sql.NullString{String: user.Username, Valid: true}
+	return insertAuditEntry(q, userID, username, action, entityType, entityID, before, after)
+}
+
+func insertAuditEntry(q querier, userID, username sql.NullString, action, entityType string, entityID interface{}, before, after interface{}) error {
+	beforeJSON, err := auditSnapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditSnapshot(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO audit_log (user_id, username, action, entity_type, entity_id, before, after, created_at)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, username, action, entityType, fmt.Sprint(entityID), beforeJSON, afterJSON, now())
+	return err
+}
+
+// Handlers
+
+func getAuditLog(c *gin.Context) {
+	query := `SELECT id, user_id, COALESCE(username, ''), action, entity_type, entity_id, before, after, created_at
+				FROM audit_log WHERE 1 = 1`
+	var args []interface{}
+
+	if user := c.Query("user"); user != "" {
+		query += " AND username = ?"
+		args = append(args, user)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	if entityType := c.Query("entity_type"); entityType != "" {
+		query += " AND entity_type = ?"
+		args = append(args, entityType)
+	}
+	if entityID := c.Query("entity_id"); entityID != "" {
+		query += " AND entity_id = ?"
+		args = append(args, entityID)
+	}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + bound.param + " time, expected RFC 3339"})
+			return
+		}
+		query += " AND created_at " + bound.op + " ?"
+		args = append(args, t.UTC())
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve audit log"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			entry         AuditEntry
+			userID        sql.NullInt64
+			before, after sql.NullString
+		)
+		if err := rows.Scan(&entry.ID, &userID, &entry.Username, &entry.Action, &entry.EntityType, &entry.EntityID,
+			&before, &after, &entry.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve audit log"})
+			return
+		}
+		if userID.Valid {
+			id := uint(userID.Int64)
+			entry.UserID = &id
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getAudit(t *testing.T, token, query string) []AuditEntry {
+	t.Helper()
+	recorder := doJSON("GET", "/api/audit"+query, token, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var entries []AuditEntry
+	json.NewDecoder(recorder.Body).Decode(&entries)
+	return entries
+}
+
+func TestAuditCatalogChanges(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+
+	doJSON("POST", "/api/books", librarian, Book{Title: "Book 1", PublishedYear: 2022, ISBN: "123456789011x"})
+	doJSON("PUT", "/api/books/1", librarian, Book{Title: "Book 2", PublishedYear: 2023, ISBN: "123456789012x"})
+	doJSON("POST", "/api/authors", librarian, Author{Name: "Author 1", Country: "USA"})
+	doJSON("POST", "/api/books/1/authors/1", librarian, nil)
+	recorder := doJSON("DELETE", "/api/books/1", admin, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", recorder.Code)
+	}
+
+	entries := getAudit(t, admin, "?entity_type=book&entity_id=1")
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries for book 1, but got %+v", entries)
+	}
+	deleted, linked, updated, created := entries[0], entries[1], entries[2], entries[3]
+
+	if created.Action != auditCreate || created.Username != "librarian" || created.Before != nil ||
+		string(created.After) != `{"id":1,"title":"Book 1","published_year":2022,"isbn":"123456789011x"}` {
+		t.Errorf("Unexpected create entry %+v", created)
+	}
+	if updated.Action != auditUpdate || string(updated.Before) != string(created.After) ||
+		string(updated.After) != `{"id":1,"title":"Book 2","published_year":2023,"isbn":"123456789012x"}` {
+		t.Errorf("Unexpected update entry %+v", updated)
+	}
+	if linked.Action != auditLink || string(linked.After) != `{"author_id":"1","book_id":"1"}` {
+		t.Errorf("Unexpected link entry %+v", linked)
+	}
+	if deleted.Action != auditDelete || deleted.Username != "admin" || deleted.UserID == nil ||
+		string(deleted.Before) != string(updated.After) || deleted.After != nil {
+		t.Errorf("Unexpected delete entry %+v", deleted)
+	}
+
+	// Failed changes leave no trace
+	doJSON("DELETE", "/api/books/1", admin, nil)
+	doJSON("PUT", "/api/authors/9", librarian, Author{Name: "Nobody", Country: "USA"})
+	if entries := getAudit(t, admin, ""); len(entries) != 5 {
+		t.Errorf("Expected 5 entries, but got %d", len(entries))
+	}
+
+	if entries := getAudit(t, admin, "?user=admin"); len(entries) != 1 || entries[0].Action != auditDelete {
+		t.Errorf("Expected only the admin's delete, but got %+v", entries)
+	}
+}
+
+func TestAuditFilters(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+
+	start := *clock
+	doJSON("POST", "/api/authors", admin, Author{Name: "Author 1", Country: "USA"})
+	*clock = clock.Add(5 * time.Minute)
+	doJSON("POST", "/api/authors", admin, Author{Name: "Author 2", Country: "France"})
+
+	from := start.Add(time.Minute).Format(time.RFC3339)
+	entries := getAudit(t, admin, "?entity_type=author&from="+from)
+	if len(entries) != 1 || entries[0].EntityID != "2" {
+		t.Errorf("Expected only the second author, but got %+v", entries)
+	}
+	entries = getAudit(t, admin, "?entity_type=author&to="+from)
+	if len(entries) != 1 || entries[0].EntityID != "1" {
+		t.Errorf("Expected only the first author, but got %+v", entries)
+	}
+	if entries := getAudit(t, admin, "?entity_type=author&limit=1"); len(entries) != 1 {
+		t.Errorf("Expected 1 entry, but got %d", len(entries))
+	}
+
+	recorder := doJSON("GET", "/api/audit?from=yesterday", admin, nil)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	// Only admins read the log
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	recorder = doJSON("GET", "/api/audit", librarian, nil)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+}
+
+func TestAuditAccountChanges(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+
+	doJSON("POST", "/register", "", User{Username: "alice", Password: "correct horse"})
+	doJSON("PUT", "/api/admin/users/2/role", admin, map[string]string{"role": roleLibrarian})
+	recorder := doJSON("POST", "/api/account/api-keys", admin, map[string]interface{}{"name": "ci", "scopes": []string{permCatalogRead}})
+	var key APIKey
+	json.NewDecoder(recorder.Body).Decode(&key)
+
+	entries := getAudit(t, admin, "?entity_type=user&entity_id=2")
+	if len(entries) != 2 || entries[1].UserID != nil || entries[0].Username != "admin" ||
+		string(entries[0].After) != `{"id":2,"username":"alice","role":"librarian","disabled":false}` {
+		t.Errorf("Unexpected user entries %+v", entries)
+	}
+
+	entries = getAudit(t, admin, "?entity_type=api_key")
+	if len(entries) != 1 || len(entries[0].After) == 0 {
+		t.Fatalf("Expected the API key creation, but got %+v", entries)
+	}
+	var logged APIKey
+	json.Unmarshal(entries[0].After, &logged)
+	if logged.Key != "" || logged.Prefix != key.Prefix {
+		t.Errorf("Expected the key without its secret, but got %+v", logged)
+	}
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	setupIsolated(t)
+	doJSON("POST", "/authors", "", Author{Name: "Author 1", Country: "USA"})
+
+	if _, err := db.Exec("UPDATE audit_log SET username = 'someone'"); err == nil {
+		t.Error("Expected updating the audit log to fail")
+	}
+	if _, err := db.Exec("DELETE FROM audit_log"); err == nil {
+		t.Error("Expected deleting from the audit log to fail")
+	}
+}
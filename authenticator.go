@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks a username and password against a credential store
+// and returns the matching local account
+type Authenticator interface {
+	Authenticate(username, password string) (User, error)
+}
+
+var authenticator Authenticator = localAuthenticator{}
+
+// Checks passwords against the hashes in the users table
+type localAuthenticator struct{}
+
+func (localAuthenticator) Authenticate(username, password string) (User, error) {
+	user, passwordHash, err := getUserByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, errInvalidCredentials
+		}
+		return User{}, err
+	}
+
+	if !checkPassword(passwordHash, password) {
+		return User{}, errInvalidCredentials
+	}
+	return user, nil
+}
+
+// Tries each authenticator in turn until one accepts the credentials
+type chainAuthenticator []Authenticator
+
+func (chain chainAuthenticator) Authenticate(username, password string) (User, error) {
+	var firstErr error
+	for _, a := range chain {
+		user, err := a.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if err != errInvalidCredentials && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return User{}, firstErr
+	}
+	return User{}, errInvalidCredentials
+}
+
+// Select the authentication backends named in configuration, local by default
+func configureAuthenticator(c AuthConfig) error {
+	backends := c.Backends
+	if len(backends) == 0 {
+		backends = []string{"local"}
+	}
+
+	var chain chainAuthenticator
+	for _, backend := range backends {
+		switch backend {
+		case "local":
+			chain = append(chain, localAuthenticator{})
+		case "ldap":
+			ldapAuth, err := newLDAPAuthenticator(c.LDAP)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, ldapAuth)
+		default:
+			return fmt.Errorf("unknown authentication backend %q", backend)
+		}
+	}
+
+	if len(chain) == 1 {
+		authenticator = chain[0]
+	} else {
+		authenticator = chain
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errBranchNotFound = errors.New("branch not found")
+	errBranchInUse    = errors.New("branch still has copies, patrons, transfers, interlibrary loans, orders or subscriptions")
+	errUnknownBranch  = errors.New("unknown branch")
+)
+
+// A library of the consortium. Loan policies refer to branches by code.
+type Branch struct {
+	ID      uint   `json:"id"`
+	Code    string `json:"code"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Phone   string `json:"phone"`
+}
+
+// Copies of a book at one branch
+type BranchAvailability struct {
+	BranchID  uint   `json:"branch_id"`
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	Total     int    `json:"total"`
+	Available int    `json:"available"`
+}
+
+// Create the branches table
+func createBranchTables() {
+	branchesTableSQL := `
+		CREATE TABLE IF NOT EXISTS branches (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			address TEXT NOT NULL DEFAULT '',
+			phone TEXT NOT NULL DEFAULT ''
+		);`
+	_, err = db.Exec(branchesTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create branches table:", err)
+	}
+}
+
+const branchColumns = "id, code, name, address, phone"
+
+func scanBranch(row interface{ Scan(...interface{}) error }) (Branch, error) {
+	var branch Branch
+	err := row.Scan(&branch.ID, &branch.Code, &branch.Name, &branch.Address, &branch.Phone)
+	return branch, err
+}
+
+func queryBranch(q querier, id interface{}) (Branch, error) {
+	branch, err := scanBranch(q.QueryRow("SELECT "+branchColumns+" FROM branches WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return branch, errBranchNotFound
+	}
+	return branch, err
+}
+
+// Check that a branch named in a request body exists
+func checkBranch(q querier, id uint) error {
+	if _, err := queryBranch(q, id); err != nil {
+		if err == errBranchNotFound {
+			return errUnknownBranch
+		}
+		return err
+	}
+	return nil
+}
+
+// Copies of a book per branch currently holding any, leaving out withdrawn
+// copies. A branchID that is not zero keeps only that branch.
+func getBranchAvailability(q querier, bookID interface{}, branchID uint) ([]BranchAvailability, error) {
+	rows, err := q.Query(`SELECT b.id, b.code, b.name, COUNT(*), SUM(CASE WHEN i.status = ? THEN 1 ELSE 0 END)
+						FROM items AS i INNER JOIN branches AS b ON b.id = i.current_branch_id
+						WHERE i.book_id = ? AND i.status != ? AND (? = 0 OR b.id = ?)
+						GROUP BY b.id ORDER BY b.name`,
+		itemAvailable, bookID, itemWithdrawn, branchID, branchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var branches []BranchAvailability
+	for rows.Next() {
+		var branch BranchAvailability
+		if err := rows.Scan(&branch.BranchID, &branch.Code, &branch.Name, &branch.Total, &branch.Available); err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+	}
+	return branches, rows.Err()
+}
+
+// Responses for the errors branches, their calendars and transfers refuse a
+// request with
+var branchErrors = errorResponses{
+	errBranchNotFound:   {http.StatusNotFound, "Branch not found"},
+	errBranchInUse:      {http.StatusConflict, "Branch still has copies, patrons, transfers, interlibrary loans, orders or subscriptions"},
+	errUnknownBranch:    {http.StatusBadRequest, "Unknown branch"},
+	errTransferNotFound: {http.StatusNotFound, "Transfer not found"},
+	errTransferExists:   {http.StatusConflict, "Item already has an open transfer"},
+	errTransferState:    {http.StatusConflict, "Transfer cannot make that change in its status"},
+	errSameBranch:       {http.StatusConflict, "Item is already at that branch"},
+	errClosureNotFound:  {http.StatusNotFound, "Closure not found"},
+	errInvalidCalendar:  {http.StatusBadRequest, "Invalid iCalendar file"},
+}
+
+// Respond with the matching branch error, falling back to the circulation
+// errors of the items transfers move
+func respondBranchError(c *gin.Context, err error, fallback string) {
+	respondError(c, err, fallback, branchErrors, circulationErrors)
+}
+
+// Respond with the error of a branch change
+func respondBranchChangeError(c *gin.Context, err error, fallback string) {
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Branch code already in use"})
+		return
+	}
+	respondBranchError(c, err, fallback)
+}
+
+// Handlers
+
+func getBranches(c *gin.Context) {
+	rows, err := db.Query("SELECT " + branchColumns + " FROM branches ORDER BY name")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve branches"})
+		return
+	}
+	defer rows.Close()
+
+	branches := []Branch{}
+	for rows.Next() {
+		branch, err := scanBranch(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve branches"})
+			return
+		}
+		branches = append(branches, branch)
+	}
+
+	c.JSON(http.StatusOK, branches)
+}
+
+func getBranch(c *gin.Context) {
+	branch, err := queryBranch(db, c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err, "Failed to retrieve branch")
+		return
+	}
+
+	c.JSON(http.StatusOK, branch)
+}
+
+func createBranch(c *gin.Context) {
+	var branch Branch
+	if err := c.ShouldBindJSON(&branch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if branch.Code == "" || branch.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		r, err := tx.Exec("INSERT INTO branches (code, name, address, phone) VALUES (?, ?, ?, ?)",
+			branch.Code, branch.Name, branch.Address, branch.Phone)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		branch.ID = uint(id)
+		return recordAudit(tx, c, auditCreate, "branch", branch.ID, nil, branch)
+	})
+	if err != nil {
+		respondBranchChangeError(c, err, "Failed to create branch")
+		return
+	}
+
+	c.JSON(http.StatusCreated, branch)
+}
+
+func updateBranch(c *gin.Context) {
+	var branch Branch
+	if err := c.ShouldBindJSON(&branch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if branch.Code == "" || branch.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryBranch(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		branch.ID = before.ID
+
+		_, err = tx.Exec("UPDATE branches SET code = ?, name = ?, address = ?, phone = ? WHERE id = ?",
+			branch.Code, branch.Name, branch.Address, branch.Phone, branch.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "branch", branch.ID, before, branch)
+	})
+	if err != nil {
+		respondBranchChangeError(c, err, "Failed to update branch")
+		return
+	}
+
+	c.JSON(http.StatusOK, branch)
+}
+
+func deleteBranch(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryBranch(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		// Opening hours and closures go with the branch, anything else that
+		// points at it keeps it
+		var users int
+		err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM items WHERE home_branch_id = ? OR current_branch_id = ?) +
+						(SELECT COUNT(*) FROM patrons WHERE home_branch_id = ?) +
+						(SELECT COUNT(*) FROM transfers WHERE from_branch_id = ? OR to_branch_id = ?) +
+						(SELECT COUNT(*) FROM ill_requests WHERE pickup_branch_id = ?) +
+						(SELECT COUNT(*) FROM order_lines WHERE branch_id = ?) +
+						(SELECT COUNT(*) FROM subscriptions WHERE branch_id = ?)`,
+			before.ID, before.ID, before.ID, before.ID, before.ID, before.ID, before.ID, before.ID).Scan(&users)
+		if err != nil {
+			return err
+		}
+		if users > 0 {
+			return errBranchInUse
+		}
+
+		if _, err := tx.Exec("DELETE FROM branches WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "branch", before.ID, before, nil)
+	})
+	if err != nil {
+		respondBranchError(c, err, "Failed to delete branch")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
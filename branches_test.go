@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Add a branch with the given code
+func createTestBranch(t *testing.T, code string) Branch {
+	t.Helper()
+	branch := Branch{Code: code, Name: "Branch " + code}
+	r, err := db.Exec("INSERT INTO branches (code, name) VALUES (?, ?)", branch.Code, branch.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := r.LastInsertId()
+	branch.ID = uint(id)
+	return branch
+}
+
+func TestBranchCRUD(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+
+	recorder := doJSON("POST", "/api/branches", librarian, Branch{Code: "main", Name: "Main Library"})
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/branches", admin, Branch{Code: "main", Name: "Main Library"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	for _, tt := range []struct {
+		body   Branch
+		status int
+	}{
+		{Branch{Code: "main", Name: "Other"}, http.StatusConflict},
+		{Branch{Code: "east"}, http.StatusBadRequest},
+	} {
+		recorder := doJSON("POST", "/api/branches", admin, tt.body)
+		if recorder.Code != tt.status {
+			t.Errorf("Expected status %d, but got %d", tt.status, recorder.Code)
+		}
+	}
+
+	recorder = doJSON("PUT", "/api/branches/1", admin, Branch{Code: "main", Name: "Central Library", Phone: "555-0100"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", "/api/branches", librarian, nil)
+	var branches []Branch
+	json.NewDecoder(recorder.Body).Decode(&branches)
+	if len(branches) != 1 || branches[0].Name != "Central Library" || branches[0].Phone != "555-0100" {
+		t.Errorf("Unexpected branches %+v", branches)
+	}
+
+	// Branches with copies are kept
+	doJSON("POST", "/books", "", Book{Title: "Book 1", PublishedYear: 2022, ISBN: "123456789011x"})
+	doJSON("POST", "/api/books/1/items", librarian, Item{Barcode: "30001", HomeBranchID: 1})
+	recorder = doJSON("DELETE", "/api/branches/1", admin, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	createTestBranch(t, "east")
+	recorder = doJSON("DELETE", "/api/branches/2", admin, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001", "30002")
+	east := createTestBranch(t, "east")
+
+	recorder := doJSON("POST", "/api/transfers", librarian, gin.H{"barcode": "30001", "to_branch_id": 1})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/transfers", librarian, gin.H{"barcode": "30001", "to_branch_id": east.ID})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = doJSON("POST", "/api/transfers", librarian, gin.H{"barcode": "30001", "to_branch_id": east.ID})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/transfers/1/receive", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	// A copy in transit cannot be lent
+	recorder = doJSON("POST", "/api/transfers/1/ship", librarian, nil)
+	var transfer Transfer
+	json.NewDecoder(recorder.Body).Decode(&transfer)
+	if transfer.Status != transferInTransit || transfer.ShippedAt == nil {
+		t.Errorf("Unexpected transfer %+v", transfer)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+
+	// Once the other copy is out, the transferred one goes to the hold
+	checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID})
+	bob := createTestPatron(t, "bob", 0)
+	if _, status := placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID}); status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	recorder = doJSON("POST", "/api/transfers/1/receive", librarian, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	item, _ := lookupItem(db, 0, "30001")
+	if item.CurrentBranchID != east.ID || item.HomeBranchID != 1 || item.Status != itemOnHold {
+		t.Errorf("Unexpected item %+v", item)
+	}
+
+	recorder = doJSON("GET", "/api/transfers?status=received&branch_id=1", librarian, nil)
+	var transfers []Transfer
+	json.NewDecoder(recorder.Body).Decode(&transfers)
+	if len(transfers) != 1 || transfers[0].Barcode != "30001" {
+		t.Errorf("Unexpected transfers %+v", transfers)
+	}
+}
+
+func TestBranchAvailability(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian, "30001", "30002")
+	east := createTestBranch(t, "east")
+	doJSON("PUT", "/api/books/1/items/2", librarian, Item{Barcode: "30002", HomeBranchID: 1, CurrentBranchID: east.ID})
+
+	recorder := doJSON("GET", "/api/books/1", librarian, nil)
+	var book Book
+	json.NewDecoder(recorder.Body).Decode(&book)
+	if len(book.Availability.ByBranch) != 2 || book.Availability.Total != 2 {
+		t.Errorf("Unexpected availability %+v", book.Availability)
+	}
+
+	recorder = doJSON("GET", "/api/books/1?branch_id=2", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&book)
+	if book.Availability.Available != 1 || len(book.Availability.ByBranch) != 1 || book.Availability.ByBranch[0].Code != "east" {
+		t.Errorf("Unexpected availability %+v", book.Availability)
+	}
+
+	recorder = doJSON("GET", "/api/books/1/items?branch_id=2", librarian, nil)
+	var items []Item
+	json.NewDecoder(recorder.Body).Decode(&items)
+	if len(items) != 1 || items[0].Barcode != "30002" {
+		t.Errorf("Unexpected items %+v", items)
+	}
+}
+
+// Branches something still points at are refused with a 409, also with
+// foreign keys enforced as they are in production
+func TestDeleteBranchWithHistory(t *testing.T) {
+	setupIsolated(t)
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatal(err)
+	}
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+	createTestItems(t, librarian, "30001")
+	for _, code := range []string{"east", "west", "north", "south", "spare"} {
+		createTestBranch(t, code)
+	}
+	alice := createTestPatron(t, "alice", 0)
+
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"INSERT INTO transfers (item_id, from_branch_id, to_branch_id, status, requested_at) VALUES (1, 1, 2, ?, ?)",
+			[]interface{}{transferReceived, now()}},
+		{"INSERT INTO ill_requests (patron_id, book_id, pickup_branch_id, status, requested_at) VALUES (?, 1, 3, ?, ?)",
+			[]interface{}{alice.ID, illRequested, now()}},
+		{"INSERT INTO vendors (code, name) VALUES ('BKS', 'Books Inc')", nil},
+		{"INSERT INTO funds (code, name, fiscal_year, allocated) VALUES ('ADULT', 'Adult fiction', 2024, 10000)", nil},
+		{"INSERT INTO purchase_orders (vendor_id, status, created_at) VALUES (1, ?, ?)", []interface{}{orderOpen, now()}},
+		{"INSERT INTO order_lines (order_id, book_id, fund_id, branch_id, quantity, unit_price) VALUES (1, 1, 1, 4, 1, 2500)", nil},
+		{"INSERT INTO serials (title, issn) VALUES ('Library Journal', '0363-0277')", nil},
+		{`INSERT INTO subscriptions (serial_id, branch_id, frequency, first_issue_at, ends_at, first_volume, first_number,
+			issues_per_volume, claim_after_days, status) VALUES (1, 5, ?, ?, ?, 1, 1, 12, 14, ?)`,
+			[]interface{}{frequencyMonthly, now(), now().AddDate(1, 0, 0), subscriptionActive}},
+	} {
+		if _, err := db.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, status := range []int{http.StatusConflict, http.StatusConflict, http.StatusConflict, http.StatusConflict,
+		http.StatusConflict, http.StatusNoContent} {
+		path := "/api/branches/" + strconv.Itoa(id+1)
+		if recorder := doJSON("DELETE", path, admin, nil); recorder.Code != status {
+			t.Errorf("%s: expected status %d, but got %d", path, status, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Calendar dates are days in UTC, written as in dateLayout
+const (
+	dateLayout = "2006-01-02"
+	hourLayout = "15:04"
+)
+
+// How far a due date is rolled forward looking for an open day, so that a
+// branch closed for good still lends
+const maxClosedDays = 366
+
+var (
+	errClosureNotFound = errors.New("closure not found")
+	errInvalidCalendar = errors.New("invalid iCalendar file")
+)
+
+// The hours a branch is open on one day of the week, 0 being Sunday
+type OpeningHours struct {
+	Weekday int    `json:"weekday"`
+	Opens   string `json:"opens"`
+	Closes  string `json:"closes"`
+}
+
+// A day a branch is closed outside its weekly hours, a public holiday say
+type Closure struct {
+	ID       uint   `json:"id"`
+	BranchID uint   `json:"branch_id"`
+	Date     string `json:"date"`
+	Reason   string `json:"reason"`
+}
+
+// Create the opening hours and closures tables
+func createCalendarTables() {
+	calendarTablesSQL := `
+		CREATE TABLE IF NOT EXISTS opening_hours (
+			branch_id INTEGER NOT NULL,
+			weekday INTEGER NOT NULL,
+			opens TEXT NOT NULL,
+			closes TEXT NOT NULL,
+			PRIMARY KEY (branch_id, weekday),
+			FOREIGN KEY (branch_id) REFERENCES branches (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS closures (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			branch_id INTEGER NOT NULL,
+			date TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			UNIQUE (branch_id, date),
+			FOREIGN KEY (branch_id) REFERENCES branches (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(calendarTablesSQL)
+	if err != nil {
+		log.Fatal("Failed to create calendar tables:", err)
+	}
+}
+
+func queryOpeningHours(q querier, branchID uint) ([]OpeningHours, error) {
+	rows, err := q.Query("SELECT weekday, opens, closes FROM opening_hours WHERE branch_id = ? ORDER BY weekday", branchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := []OpeningHours{}
+	for rows.Next() {
+		var h OpeningHours
+		if err := rows.Scan(&h.Weekday, &h.Opens, &h.Closes); err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+const closureColumns = "id, branch_id, date, reason"
+
+func scanClosure(row interface{ Scan(...interface{}) error }) (Closure, error) {
+	var closure Closure
+	err := row.Scan(&closure.ID, &closure.BranchID, &closure.Date, &closure.Reason)
+	return closure, err
+}
+
+func queryClosures(q querier, where string, args ...interface{}) ([]Closure, error) {
+	rows, err := q.Query("SELECT "+closureColumns+" FROM closures "+where+" ORDER BY date", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	closures := []Closure{}
+	for rows.Next() {
+		closure, err := scanClosure(rows)
+		if err != nil {
+			return nil, err
+		}
+		closures = append(closures, closure)
+	}
+	return closures, rows.Err()
+}
+
+// Whether the branch is closed on the day of t. A branch without weekly
+// hours is open every day it has no closure for.
+func isBranchClosed(q querier, branchID uint, t time.Time) (bool, error) {
+	var closed bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM closures WHERE branch_id = ? AND date = ?)
+					OR (EXISTS (SELECT 1 FROM opening_hours WHERE branch_id = ?)
+						AND NOT EXISTS (SELECT 1 FROM opening_hours WHERE branch_id = ? AND weekday = ?))`,
+		branchID, t.UTC().Format(dateLayout), branchID, branchID, int(t.UTC().Weekday())).Scan(&closed)
+	return closed, err
+}
+
+// The due date of a loan or renewal starting at from, rolled forward to
+// the next day the lending branch is open
+func computeDueDate(q querier, from time.Time, policy LoanPolicy, branchID uint) (time.Time, error) {
+	due := from.AddDate(0, 0, policy.LoanDays)
+	for i := 0; i < maxClosedDays; i++ {
+		closed, err := isBranchClosed(q, branchID, due)
+		if err != nil || !closed {
+			return due, err
+		}
+		due = due.AddDate(0, 0, 1)
+	}
+	return from.AddDate(0, 0, policy.LoanDays), nil
+}
+
+// Check the weekly hours from a request body
+func validateOpeningHours(hours []OpeningHours) string {
+	seen := map[int]bool{}
+	for _, h := range hours {
+		if h.Weekday < 0 || h.Weekday > 6 || seen[h.Weekday] {
+			return "Invalid weekday"
+		}
+		seen[h.Weekday] = true
+		opens, err1 := time.Parse(hourLayout, h.Opens)
+		closes, err2 := time.Parse(hourLayout, h.Closes)
+		if err1 != nil || err2 != nil || !opens.Before(closes) {
+			return "Invalid opening hours"
+		}
+	}
+	return ""
+}
+
+// Add a closure, or leave the day alone if the branch is already closed on
+// it. Returns whether it was added.
+func addClosure(tx *sql.Tx, c *gin.Context, closure *Closure) (bool, error) {
+	r, err := tx.Exec("INSERT INTO closures (branch_id, date, reason) VALUES (?, ?, ?) ON CONFLICT (branch_id, date) DO NOTHING",
+		closure.BranchID, closure.Date, closure.Reason)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	id, _ := r.LastInsertId()
+	closure.ID = uint(id)
+	return true, recordAudit(tx, c, auditCreate, "closure", closure.ID, nil, closure)
+}
+
+// iCalendar
+
+// Read the closed days of an iCalendar file, one closure per day an event
+// covers. Recurring events, like the weekly hours of a feed, are left out.
+func parseICalClosures(data string) ([]Closure, error) {
+	var (
+		lines    []string
+		closures []Closure
+	)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Folded lines continue after a single space or tab
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 || lines[0] != "BEGIN:VCALENDAR" {
+		return nil, errInvalidCalendar
+	}
+
+	var (
+		inEvent, recurring bool
+		start, end         string
+		summary            string
+	)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, ";")
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent, recurring, start, end, summary = true, false, "", "", ""
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			if recurring {
+				continue
+			}
+			days, err := icalDays(start, end)
+			if err != nil {
+				return nil, err
+			}
+			for _, day := range days {
+				closures = append(closures, Closure{Date: day, Reason: summary})
+			}
+		case !inEvent:
+		case name == "DTSTART":
+			start = value
+		case name == "DTEND":
+			end = value
+		case name == "RRULE":
+			recurring = true
+		case name == "SUMMARY":
+			summary = icalUnescape(value)
+		}
+	}
+	return closures, nil
+}
+
+// The days from an event's DTSTART up to its DTEND. An end at midnight, as
+// every all-day event's is, leaves that day out.
+func icalDays(start, end string) ([]string, error) {
+	if len(start) < 8 {
+		return nil, errInvalidCalendar
+	}
+	first, err := time.Parse("20060102", start[:8])
+	if err != nil {
+		return nil, errInvalidCalendar
+	}
+	if end == "" {
+		return []string{first.Format(dateLayout)}, nil
+	}
+	if len(end) < 8 {
+		return nil, errInvalidCalendar
+	}
+	last, err := time.Parse("20060102", end[:8])
+	if err != nil {
+		return nil, errInvalidCalendar
+	}
+	if t := strings.TrimSuffix(end[8:], "Z"); t == "" || t == "T000000" {
+		last = last.AddDate(0, 0, -1)
+	}
+
+	var days []string
+	for day := first; !day.After(last) && len(days) < maxClosedDays; day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format(dateLayout))
+	}
+	if len(days) == 0 {
+		days = append(days, first.Format(dateLayout))
+	}
+	return days, nil
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+var icalUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+func icalUnescape(s string) string {
+	return icalUnescaper.Replace(s)
+}
+
+// Write one content line, folded to 75 octets
+func writeICalLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// The weekly hours, as events repeating from the first week of 2024, and
+// the closures of a branch as an iCalendar feed
+func branchICal(branch Branch, hours []OpeningHours, closures []Closure) string {
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:-//Online Library//Branch Calendar//EN")
+	writeICalLine(&b, "X-WR-CALNAME:"+icalEscaper.Replace(branch.Name))
+
+	stamp := now().Format("20060102T150405Z")
+	weekdays := []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+	// 7 January 2024 was a Sunday
+	week := time.Date(2024, time.January, 7, 0, 0, 0, 0, time.UTC)
+	for _, h := range hours {
+		day := week.AddDate(0, 0, h.Weekday).Format("20060102")
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, fmt.Sprintf("UID:hours-%d-%d@online-library", branch.ID, h.Weekday))
+		writeICalLine(&b, "DTSTAMP:"+stamp)
+		writeICalLine(&b, "DTSTART:"+day+"T"+strings.ReplaceAll(h.Opens, ":", "")+"00")
+		writeICalLine(&b, "DTEND:"+day+"T"+strings.ReplaceAll(h.Closes, ":", "")+"00")
+		writeICalLine(&b, "RRULE:FREQ=WEEKLY;BYDAY="+weekdays[h.Weekday])
+		writeICalLine(&b, "SUMMARY:Open")
+		writeICalLine(&b, "END:VEVENT")
+	}
+	for _, closure := range closures {
+		day, _ := time.Parse(dateLayout, closure.Date)
+		summary := "Closed"
+		if closure.Reason != "" {
+			summary += ": " + closure.Reason
+		}
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, fmt.Sprintf("UID:closure-%d@online-library", closure.ID))
+		writeICalLine(&b, "DTSTAMP:"+stamp)
+		writeICalLine(&b, "DTSTART;VALUE=DATE:"+day.Format("20060102"))
+		writeICalLine(&b, "DTEND;VALUE=DATE:"+day.AddDate(0, 0, 1).Format("20060102"))
+		writeICalLine(&b, "SUMMARY:"+icalEscaper.Replace(summary))
+		writeICalLine(&b, "TRANSP:TRANSPARENT")
+		writeICalLine(&b, "END:VEVENT")
+	}
+	writeICalLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// Handlers
+
+func getOpeningHours(c *gin.Context) {
+	branch, err := queryBranch(db, c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err, "Failed to retrieve opening hours")
+		return
+	}
+	hours, err := queryOpeningHours(db, branch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve opening hours"})
+		return
+	}
+
+	c.JSON(http.StatusOK, hours)
+}
+
+// Replace the weekly hours of a branch. Days left out are closed, and an
+// empty list opens the branch every day.
+func setOpeningHours(c *gin.Context) {
+	var hours []OpeningHours
+	if err := c.ShouldBindJSON(&hours); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateOpeningHours(hours); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var after []OpeningHours
+	err := withTx(func(tx *sql.Tx) error {
+		branch, err := queryBranch(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		before, err := queryOpeningHours(tx, branch.ID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM opening_hours WHERE branch_id = ?", branch.ID); err != nil {
+			return err
+		}
+		for _, h := range hours {
+			_, err := tx.Exec("INSERT INTO opening_hours (branch_id, weekday, opens, closes) VALUES (?, ?, ?, ?)",
+				branch.ID, h.Weekday, h.Opens, h.Closes)
+			if err != nil {
+				return err
+			}
+		}
+		if after, err = queryOpeningHours(tx, branch.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "opening_hours", branch.ID, before, after)
+	})
+	if err != nil {
+		respondBranchError(c, err, "Failed to update opening hours")
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+// List the closures of a branch, between the optional from and to dates
+func getClosures(c *gin.Context) {
+	branch, err := queryBranch(db, c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err, "Failed to retrieve closures")
+		return
+	}
+
+	where := "WHERE branch_id = ?"
+	args := []interface{}{branch.ID}
+	if from := c.Query("from"); from != "" {
+		where += " AND date >= ?"
+		args = append(args, from)
+	}
+	if to := c.Query("to"); to != "" {
+		where += " AND date <= ?"
+		args = append(args, to)
+	}
+
+	closures, err := queryClosures(db, where, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve closures"})
+		return
+	}
+
+	c.JSON(http.StatusOK, closures)
+}
+
+func createClosure(c *gin.Context) {
+	var closure Closure
+	if err := c.ShouldBindJSON(&closure); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if closure.Date == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+	if _, err := time.Parse(dateLayout, closure.Date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date"})
+		return
+	}
+
+	var added bool
+	err := withTx(func(tx *sql.Tx) error {
+		branch, err := queryBranch(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		closure.BranchID = branch.ID
+		added, err = addClosure(tx, c, &closure)
+		return err
+	})
+	if err != nil {
+		respondBranchError(c, err, "Failed to create closure")
+		return
+	}
+	if !added {
+		c.JSON(http.StatusConflict, gin.H{"error": "Branch is already closed on that day"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, closure)
+}
+
+func deleteClosure(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := scanClosure(tx.QueryRow("SELECT "+closureColumns+" FROM closures WHERE id = ? AND branch_id = ?",
+			c.Param("closure_id"), c.Param("id")))
+		if err == sql.ErrNoRows {
+			return errClosureNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM closures WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "closure", before.ID, before, nil)
+	})
+	if err != nil {
+		respondBranchError(c, err, "Failed to delete closure")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Add the days of the events in an iCalendar body as closures, skipping
+// days the branch is already closed on
+func importClosures(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	parsed, err := parseICalClosures(string(data))
+	if err != nil {
+		respondBranchError(c, err, "Failed to import closures")
+		return
+	}
+
+	added := []Closure{}
+	err = withTx(func(tx *sql.Tx) error {
+		branch, err := queryBranch(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		for _, closure := range parsed {
+			closure.BranchID = branch.ID
+			ok, err := addClosure(tx, c, &closure)
+			if err != nil {
+				return err
+			}
+			if ok {
+				added = append(added, closure)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondBranchError(c, err, "Failed to import closures")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imported": added, "skipped": len(parsed) - len(added)})
+}
+
+// The branch calendar for calendar apps to subscribe to, so it needs no
+// token
+func getBranchICal(c *gin.Context) {
+	branch, err := queryBranch(db, c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err, "Failed to retrieve calendar")
+		return
+	}
+	hours, err := queryOpeningHours(db, branch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve calendar"})
+		return
+	}
+	closures, err := queryClosures(db, "WHERE branch_id = ?", branch.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve calendar"})
+		return
+	}
+
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(branchICal(branch, hours, closures)))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDueDatesSkipClosedDays(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+	alice := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001")
+
+	// Closed on the day the loan would be due, and every week on the day
+	// after it
+	due := now().AddDate(0, 0, defaultLoanPolicy.LoanDays)
+	recorder := doJSON("POST", "/api/branches/1/closures", admin, Closure{Date: due.Format(dateLayout), Reason: "Holiday"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = doJSON("POST", "/api/branches/1/closures", admin, Closure{Date: due.Format(dateLayout)})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	var hours []OpeningHours
+	for weekday := 0; weekday < 7; weekday++ {
+		if weekday != int(due.AddDate(0, 0, 1).Weekday()) {
+			hours = append(hours, OpeningHours{Weekday: weekday, Opens: "09:00", Closes: "17:00"})
+		}
+	}
+	recorder = doJSON("PUT", "/api/branches/1/hours", admin, hours)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = doJSON("PUT", "/api/branches/1/hours", admin, []OpeningHours{{Weekday: 1, Opens: "17:00", Closes: "09:00"}})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	loan, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	if !loan.DueAt.Equal(due.AddDate(0, 0, 2)) {
+		t.Errorf("Expected the loan due on %v, but got %v", due.AddDate(0, 0, 2), loan.DueAt)
+	}
+}
+
+func TestClosureImportAndFeed(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	createTestBranch(t, "main")
+
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nDTSTART;VALUE=DATE:20261225\r\nDTEND;VALUE=DATE:20261227\r\nSUMMARY:Christmas\\, Boxing\r\n  Day\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nDTSTART:20270101T090000Z\r\nDTEND:20270101T170000Z\r\nSUMMARY:New Year\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nDTSTART;VALUE=DATE:20260105\r\nRRULE:FREQ=WEEKLY\r\nSUMMARY:Staff meeting\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	importClosures := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/branches/1/closures/import", strings.NewReader(ics))
+		req.Header.Set("Content-Type", "text/calendar")
+		req.Header.Set("Authorization", "Bearer "+admin)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := importClosures()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var result struct {
+		Imported []Closure `json:"imported"`
+		Skipped  int       `json:"skipped"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&result)
+	if len(result.Imported) != 3 || result.Imported[0].Date != "2026-12-25" || result.Imported[1].Reason != "Christmas, Boxing Day" {
+		t.Errorf("Unexpected import %+v", result)
+	}
+	json.NewDecoder(importClosures().Body).Decode(&result)
+	if len(result.Imported) != 0 || result.Skipped != 3 {
+		t.Errorf("Unexpected import %+v", result)
+	}
+
+	recorder = doJSON("GET", "/api/branches/1/closures?from=2027-01-01", admin, nil)
+	var closures []Closure
+	json.NewDecoder(recorder.Body).Decode(&closures)
+	if len(closures) != 1 || closures[0].Reason != "New Year" {
+		t.Errorf("Unexpected closures %+v", closures)
+	}
+
+	// The feed needs no token and reads back as the same closures
+	doJSON("PUT", "/api/branches/1/hours", admin, []OpeningHours{{Weekday: 1, Opens: "09:00", Closes: "17:30"}})
+	recorder = doJSON("GET", "/branches/1/calendar.ics", "", nil)
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("Unexpected response %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	feed := recorder.Body.String()
+	if !strings.Contains(feed, "DTSTART:20240108T090000\r\nDTEND:20240108T173000\r\nRRULE:FREQ=WEEKLY;BYDAY=MO\r\n") {
+		t.Errorf("Expected weekly hours in the feed %s", feed)
+	}
+	parsed, err := parseICalClosures(feed)
+	if err != nil || len(parsed) != 3 || parsed[0].Reason != "Closed: Christmas, Boxing Day" {
+		t.Errorf("Unexpected closures %+v in the feed, %v", parsed, err)
+	}
+}
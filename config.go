@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Config is read from the JSON file named by LIBRARY_CONFIG, config.json by default
+type Config struct {
+	JWT  JWTConfig  `json:"jwt"`
+	OIDC OIDCConfig `json:"oidc"`
+	Auth AuthConfig `json:"auth"`
+
+	Fines         FinesConfig         `json:"fines"`
+	Notifications NotificationsConfig `json:"notifications"`
+	Scheduler     SchedulerConfig     `json:"scheduler"`
+	SIP2          SIP2Config          `json:"sip2"`
+}
+
+type JWTConfig struct {
+	AccessTokenTTL  duration `json:"access_token_ttl"`
+	RefreshTokenTTL duration `json:"refresh_token_ttl"`
+
+	// Key used to sign new tokens; the other keys only verify
+	SigningKID string      `json:"signing_kid"`
+	Keys       []KeyConfig `json:"keys"`
+}
+
+type KeyConfig struct {
+	KID string `json:"kid"`
+	Alg string `json:"alg"`
+
+	// Shared secret for the HS algorithms
+	Secret string `json:"secret"`
+
+	// PEM files for the RS and ES algorithms. A key with only a public key
+	// file can still verify tokens it signed before being rotated out.
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+// OpenID Connect login is enabled when Issuer is set
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+
+	// Create an account on first sign-in when no user matches the identity
+	AutoCreateUsers bool   `json:"auto_create_users"`
+	DefaultRole     string `json:"default_role"`
+}
+
+type AuthConfig struct {
+	// Password backends tried in order by /login: "local" and "ldap"
+	Backends []string      `json:"backends"`
+	LDAP     LDAPConfig    `json:"ldap"`
+	Lockout  LockoutConfig `json:"lockout"`
+}
+
+// Failed login limits; zero values keep the defaults
+type LockoutConfig struct {
+	FreeAttempts    int      `json:"free_attempts"`
+	IPFreeAttempts  int      `json:"ip_free_attempts"`
+	BaseDelay       duration `json:"base_delay"`
+	MaxDelay        duration `json:"max_delay"`
+	UserThreshold   int      `json:"user_threshold"`
+	IPThreshold     int      `json:"ip_threshold"`
+	LockoutDuration duration `json:"lockout_duration"`
+}
+
+// Overdue fine settings; fine rates are part of the loan policies
+type FinesConfig struct {
+	// Cents a patron may owe and still borrow; 0 never blocks
+	BlockThreshold *int64 `json:"block_threshold"`
+}
+
+// Notices to patrons. A channel is enabled once its provider is set up:
+// email with an SMTP Addr, sms with an HTTP gateway URL.
+type NotificationsConfig struct {
+	SMTP SMTPConfig `json:"smtp"`
+	SMS  SMSConfig  `json:"sms"`
+
+	// Days before the due date a due-soon notice goes out
+	DueSoonDays int `json:"due_soon_days"`
+
+	// Delivery attempts before a notice fails, waiting RetryDelay after the
+	// first, twice that after the second and so on
+	MaxAttempts int      `json:"max_attempts"`
+	RetryDelay  duration `json:"retry_delay"`
+
+	// Text templates per notice kind, replacing the built-in ones
+	Templates map[string]TemplateConfig `json:"templates"`
+}
+
+type SMTPConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// The gateway gets a JSON POST of from, to and body, with Token as a
+// bearer token
+type SMSConfig struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	From  string `json:"from"`
+}
+
+type TemplateConfig struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type SchedulerConfig struct {
+	// Cron expressions replacing the default schedule of the named jobs,
+	// or "off"
+	Jobs map[string]string `json:"jobs"`
+}
+
+// The SIP2 server for self-check machines listens when Addr is set
+type SIP2Config struct {
+	Addr string `json:"addr"`
+
+	// Sent as the institution ID (AO) and currency (BH) of every response
+	InstitutionID string `json:"institution_id"`
+	Currency      string `json:"currency"`
+}
+
+type LDAPConfig struct {
+	URL      string `json:"url"`
+	StartTLS bool   `json:"start_tls"`
+
+	// Bind directly as fmt.Sprintf(UserDNTemplate, username), or search
+	// BaseDN for UserFilter as BindDN and bind as the entry found
+	UserDNTemplate string `json:"user_dn_template"`
+	BindDN         string `json:"bind_dn"`
+	BindPassword   string `json:"bind_password"`
+	BaseDN         string `json:"base_dn"`
+	UserFilter     string `json:"user_filter"`
+
+	// Groups are searched below GroupBaseDN with GroupFilter applied to the
+	// user's DN, or read from memberOf when GroupFilter is empty
+	GroupBaseDN string            `json:"group_base_dn"`
+	GroupFilter string            `json:"group_filter"`
+	GroupRoles  map[string]string `json:"group_roles"`
+	DefaultRole string            `json:"default_role"`
+}
+
+// duration reads Go duration strings such as "15m" from JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+var config Config
+
+func configPath() string {
+	if path := os.Getenv("LIBRARY_CONFIG"); path != "" {
+		return path
+	}
+	return "config.json"
+}
+
+// Load the configuration file; a missing file leaves every setting at its default
+func loadConfig(path string) (Config, error) {
+	var c Config
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return c, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&c)
+	return c, err
+}
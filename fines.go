@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ledger entry kinds. Charges add to what a patron owes, payments and
+// waivers take from it. Amounts are in cents and always positive.
+const (
+	ledgerCharge  = "charge"
+	ledgerPayment = "payment"
+	ledgerWaiver  = "waiver"
+)
+
+// What a charge is for
+const (
+	feeOverdue = "overdue"
+	feeLost    = "lost"
+)
+
+// Patrons owing more than BlockThreshold cents may not borrow; 0 turns the
+// block off
+type finesPolicy struct {
+	BlockThreshold int64
+}
+
+var fines = finesPolicy{BlockThreshold: 1000}
+
+func configureFines(c FinesConfig) {
+	if c.BlockThreshold != nil {
+		fines.BlockThreshold = *c.BlockThreshold
+	}
+}
+
+var (
+	errFinesOwed      = errors.New("patron owes more than the fine limit")
+	errExceedsBalance = errors.New("amount exceeds the balance")
+)
+
+type LedgerEntry struct {
+	ID        uint      `json:"id"`
+	PatronID  uint      `json:"patron_id"`
+	Kind      string    `json:"kind"`
+	Reason    string    `json:"reason,omitempty"`
+	Amount    int64     `json:"amount"`
+	LoanID    *uint     `json:"loan_id,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Create the ledger table. Like the audit log, entries are never changed;
+// mistakes are corrected with a waiver.
+func createFineTables() {
+	ledgerTableSQL := `
+		CREATE TABLE IF NOT EXISTS ledger_entries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			patron_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			amount INTEGER NOT NULL CHECK (amount > 0),
+			loan_id INTEGER,
+			note TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (patron_id) REFERENCES patrons (id),
+			FOREIGN KEY (loan_id) REFERENCES loans (id)
+		);
+		CREATE INDEX IF NOT EXISTS ledger_patron ON ledger_entries (patron_id);
+		CREATE INDEX IF NOT EXISTS ledger_loan ON ledger_entries (loan_id);
+		CREATE TRIGGER IF NOT EXISTS ledger_no_update BEFORE UPDATE ON ledger_entries
+			BEGIN SELECT RAISE(ABORT, 'ledger entries cannot be changed'); END;
+		CREATE TRIGGER IF NOT EXISTS ledger_no_delete BEFORE DELETE ON ledger_entries
+			BEGIN SELECT RAISE(ABORT, 'ledger entries cannot be deleted'); END;`
+	_, err = db.Exec(ledgerTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create ledger table:", err)
+	}
+}
+
+const ledgerColumns = "id, patron_id, kind, reason, amount, loan_id, note, created_at"
+
+func scanLedgerEntry(row interface{ Scan(...interface{}) error }) (LedgerEntry, error) {
+	var (
+		entry  LedgerEntry
+		loanID sql.NullInt64
+	)
+	err := row.Scan(&entry.ID, &entry.PatronID, &entry.Kind, &entry.Reason, &entry.Amount, &loanID, &entry.Note, &entry.CreatedAt)
+	if loanID.Valid {
+		id := uint(loanID.Int64)
+		entry.LoanID = &id
+	}
+	return entry, err
+}
+
+func addLedgerEntry(q querier, entry LedgerEntry) (LedgerEntry, error) {
+	entry.CreatedAt = now()
+	r, err := q.Exec("INSERT INTO ledger_entries (patron_id, kind, reason, amount, loan_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.PatronID, entry.Kind, entry.Reason, entry.Amount, entry.LoanID, entry.Note, entry.CreatedAt)
+	if err != nil {
+		return entry, err
+	}
+	id, _ := r.LastInsertId()
+	entry.ID = uint(id)
+	return entry, nil
+}
+
+// What the patron owes, in cents
+func patronBalance(q querier, patronID interface{}) (int64, error) {
+	var balance int64
+	err := q.QueryRow("SELECT COALESCE(SUM(CASE kind WHEN ? THEN amount ELSE -amount END), 0) FROM ledger_entries WHERE patron_id = ?",
+		ledgerCharge, patronID).Scan(&balance)
+	return balance, err
+}
+
+// Refuse patrons whose balance is over the block threshold
+func checkFinesOwed(q querier, patronID uint) error {
+	if fines.BlockThreshold <= 0 {
+		return nil
+	}
+	balance, err := patronBalance(q, patronID)
+	if err != nil {
+		return err
+	}
+	if balance > fines.BlockThreshold {
+		return errFinesOwed
+	}
+	return nil
+}
+
+// The fine for a loan due at due and still out at, counting every started day
+func overdueFine(policy LoanPolicy, due, at time.Time) int64 {
+	if !at.After(due) {
+		return 0
+	}
+	days := int64((at.Sub(due) + 24*time.Hour - 1) / (24 * time.Hour))
+	fine := days * policy.FinePerDay
+	if policy.MaxFine > 0 && fine > policy.MaxFine {
+		fine = policy.MaxFine
+	}
+	return fine
+}
+
+// The policy a loan runs under, for charging it
+func loanPolicyFor(q querier, loan Loan) (LoanPolicy, error) {
+	patron, err := queryPatron(q, loan.PatronID)
+	if err != nil {
+		return LoanPolicy{}, err
+	}
+	item, err := lookupItem(q, loan.ItemID, "")
+	if err != nil {
+		return LoanPolicy{}, err
+	}
+	return resolveLoanPolicy(q, patron, item)
+}
+
+// Overdue fines charged for a loan so far
+func chargedOverdueFines(q querier, loanID uint) (int64, error) {
+	var charged int64
+	err := q.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE loan_id = ? AND kind = ? AND reason = ?",
+		loanID, ledgerCharge, feeOverdue).Scan(&charged)
+	return charged, err
+}
+
+// Bring the overdue charges of a loan up to its fine at the given time.
+// Only the part not charged before is added, so this can run repeatedly.
+func chargeOverdueFine(q querier, loan Loan, at time.Time) (int64, error) {
+	policy, err := loanPolicyFor(q, loan)
+	if err != nil {
+		return 0, err
+	}
+
+	// Fines of loan periods before a renewal are settled separately
+	var prior int64
+	if err := q.QueryRow("SELECT prior_fines FROM loans WHERE id = ?", loan.ID).Scan(&prior); err != nil {
+		return 0, err
+	}
+	charged, err := chargedOverdueFines(q, loan.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	due := prior + overdueFine(policy, loan.DueAt, at) - charged
+	if due <= 0 {
+		return 0, nil
+	}
+	_, err = addLedgerEntry(q, LedgerEntry{PatronID: loan.PatronID, Kind: ledgerCharge, Reason: feeOverdue, Amount: due, LoanID: &loan.ID})
+	return due, err
+}
+
+// Charge what a loan owes so far and close its current loan period, so a
+// renewal starts the fine afresh
+func settleOverdueFine(q querier, loan Loan, at time.Time) (int64, error) {
+	fine, err := chargeOverdueFine(q, loan, at)
+	if err != nil {
+		return 0, err
+	}
+	charged, err := chargedOverdueFines(q, loan.ID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = q.Exec("UPDATE loans SET prior_fines = ? WHERE id = ?", charged, loan.ID)
+	return fine, err
+}
+
+// Charge the replacement fee of a lost loan
+func chargeLostFee(q querier, loan Loan) (int64, error) {
+	policy, err := loanPolicyFor(q, loan)
+	if err != nil || policy.LostFee == 0 {
+		return 0, err
+	}
+	_, err = addLedgerEntry(q, LedgerEntry{PatronID: loan.PatronID, Kind: ledgerCharge, Reason: feeLost, Amount: policy.LostFee, LoanID: &loan.ID})
+	return policy.LostFee, err
+}
+
+// Charge the fines accrued so far on every open overdue loan
+func accrueFines() error {
+	return withTx(func(tx *sql.Tx) error {
+		at := now()
+		loans, err := queryLoans(tx, "WHERE l.returned_at IS NULL AND l.due_at < ?", at)
+		if err != nil {
+			return err
+		}
+		for _, loan := range loans {
+			if _, err := chargeOverdueFine(tx, loan, at); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Handlers
+
+func respondLedger(c *gin.Context, patronID interface{}) {
+	balance, err := patronBalance(db, patronID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve ledger"})
+		return
+	}
+
+	rows, err := db.Query("SELECT "+ledgerColumns+" FROM ledger_entries WHERE patron_id = ? ORDER BY id DESC", patronID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve ledger"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve ledger"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"balance": balance, "entries": entries})
+}
+
+func getPatronLedger(c *gin.Context) {
+	respondLedger(c, c.Param("id"))
+}
+
+func getAccountLedger(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondLedger(c, patronID)
+}
+
+// Record a payment or waiver against a patron's balance
+func respondCredit(c *gin.Context, kind, fallback string) {
+	var body struct {
+		Amount int64  `json:"amount"`
+		LoanID *uint  `json:"loan_id"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	var entry LedgerEntry
+	err := withTx(func(tx *sql.Tx) error {
+		patron, err := queryPatron(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		// Patrons are never owed money
+		balance, err := patronBalance(tx, patron.ID)
+		if err != nil {
+			return err
+		}
+		if body.Amount > balance {
+			return errExceedsBalance
+		}
+
+		entry, err = addLedgerEntry(tx, LedgerEntry{PatronID: patron.ID, Kind: kind, Amount: body.Amount, LoanID: body.LoanID, Note: body.Note})
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "ledger_entry", entry.ID, nil, entry)
+	})
+	if err != nil {
+		respondCirculationError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusCreated, entry)
+}
+
+func createPayment(c *gin.Context) {
+	respondCredit(c, ledgerPayment, "Failed to record payment")
+}
+
+func createWaiver(c *gin.Context) {
+	respondCredit(c, ledgerWaiver, "Failed to waive fees")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testLedger struct {
+	Balance int64         `json:"balance"`
+	Entries []LedgerEntry `json:"entries"`
+}
+
+func getTestLedger(t *testing.T, token, path string) testLedger {
+	t.Helper()
+	recorder := doJSON("GET", path, token, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var ledger testLedger
+	json.NewDecoder(recorder.Body).Decode(&ledger)
+	return ledger
+}
+
+func TestOverdueFines(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	ledgerPath := "/api/patrons/" + strconv.Itoa(int(alice.ID)) + "/ledger"
+	createTestItems(t, librarian, "30001")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+
+	// Two and a bit days late
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 1", now().Add(-49*time.Hour))
+	if err := accrueFines(); err != nil {
+		t.Fatal(err)
+	}
+	if ledger := getTestLedger(t, librarian, ledgerPath); ledger.Balance != 3*defaultLoanPolicy.FinePerDay {
+		t.Errorf("Expected balance %d, but got %+v", 3*defaultLoanPolicy.FinePerDay, ledger)
+	}
+
+	// Running the job again charges nothing twice
+	accrueFines()
+	if ledger := getTestLedger(t, librarian, ledgerPath); len(ledger.Entries) != 1 {
+		t.Errorf("Expected one charge, but got %+v", ledger.Entries)
+	}
+
+	// Returning charges the rest, up to the cap
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 1", now().Add(-100*24*time.Hour))
+	recorder := doJSON("POST", "/api/loans/1/return", librarian, nil)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if loan.Fine != defaultLoanPolicy.MaxFine-3*defaultLoanPolicy.FinePerDay {
+		t.Errorf("Unexpected fine on return %+v", loan)
+	}
+	ledger := getTestLedger(t, librarian, ledgerPath)
+	if ledger.Balance != defaultLoanPolicy.MaxFine || len(ledger.Entries) != 2 || *ledger.Entries[0].LoanID != 1 {
+		t.Errorf("Unexpected ledger %+v", ledger)
+	}
+
+	// The ledger cannot be rewritten
+	if _, err := db.Exec("UPDATE ledger_entries SET amount = 1"); err == nil {
+		t.Error("Expected ledger entries to be immutable")
+	}
+}
+
+func TestRenewOverdueLoan(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+
+	// Renewing settles the fine of the first loan period
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 1", now().Add(-time.Hour))
+	recorder := doJSON("POST", "/api/loans/1/renew", librarian, nil)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if loan.Fine != defaultLoanPolicy.FinePerDay {
+		t.Errorf("Unexpected fine on renewal %+v", loan)
+	}
+
+	// and a late return is fined on top of it
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 1", now().Add(-time.Hour))
+	recorder = doJSON("POST", "/api/loans/1/return", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if loan.Fine != defaultLoanPolicy.FinePerDay {
+		t.Errorf("Unexpected fine on return %+v", loan)
+	}
+}
+
+func TestPaymentsAndWaivers(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	user, _ := createUser("alice", "correct horse", roleMember)
+	alice := createTestPatron(t, "alice", user.ID)
+	aliceToken := loginPair(t, "alice", "correct horse").Token
+	patronPath := "/api/patrons/" + strconv.Itoa(int(alice.ID))
+	createTestItems(t, librarian, "30001", "30002")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+
+	recorder := doJSON("POST", "/api/loans/1/lost", librarian, nil)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if !loan.Lost || loan.ReturnedAt == nil || loan.Fine != defaultLoanPolicy.LostFee {
+		t.Errorf("Unexpected lost loan %+v", loan)
+	}
+
+	// Owing more than the threshold blocks borrowing
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID}); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", status)
+	}
+
+	recorder = doJSON("POST", patronPath+"/payments", librarian, gin.H{"amount": defaultLoanPolicy.LostFee + 1})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", patronPath+"/payments", librarian, gin.H{"amount": 1000, "note": "cash"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", patronPath+"/waivers", librarian, gin.H{"amount": 500, "loan_id": 1})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/patrons/99/payments", librarian, gin.H{"amount": 1})
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+
+	ledger := getTestLedger(t, aliceToken, "/api/account/ledger")
+	if ledger.Balance != defaultLoanPolicy.LostFee-1500 || len(ledger.Entries) != 3 || ledger.Entries[0].Kind != ledgerWaiver {
+		t.Errorf("Unexpected ledger %+v", ledger)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID}); status != http.StatusCreated {
+		t.Errorf("Expected status 201, but got %d", status)
+	}
+}
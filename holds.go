@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hold statuses. A waiting hold is in the book's queue, a ready one has a
+// copy set aside on the hold shelf until it expires.
+const (
+	holdWaiting   = "waiting"
+	holdReady     = "ready"
+	holdFulfilled = "fulfilled"
+	holdCancelled = "cancelled"
+	holdExpired   = "expired"
+)
+
+// Days a patron has to collect a copy set aside for them
+const holdPickupDays = 7
+
+var (
+	errHoldNotFound      = errors.New("hold not found")
+	errHoldClosed        = errors.New("hold is no longer active")
+	errHoldExists        = errors.New("patron already has a hold on this book")
+	errCopyAvailable     = errors.New("book has an available copy")
+	errBookNotHoldable   = errors.New("book has no copies to hold")
+	errItemHeldForOther  = errors.New("item is held for another patron")
+	errRenewalHoldsQueue = errors.New("other patrons are waiting for this book")
+)
+
+type Hold struct {
+	ID        uint       `json:"id"`
+	BookID    uint       `json:"book_id"`
+	PatronID  uint       `json:"patron_id"`
+	Status    string     `json:"status"`
+	Position  int        `json:"position,omitempty"`
+	ItemID    *uint      `json:"item_id,omitempty"`
+	PlacedAt  time.Time  `json:"placed_at"`
+	ReadyAt   *time.Time `json:"ready_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+}
+
+// Create the holds table
+func createHoldTables() {
+	holdsTableSQL := `
+		CREATE TABLE IF NOT EXISTS holds (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			book_id INTEGER NOT NULL,
+			patron_id INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			item_id INTEGER,
+			placed_at DATETIME NOT NULL,
+			ready_at DATETIME,
+			expires_at DATETIME,
+			closed_at DATETIME,
+			FOREIGN KEY (book_id) REFERENCES books (id),
+			FOREIGN KEY (patron_id) REFERENCES patrons (id),
+			FOREIGN KEY (item_id) REFERENCES items (id)
+		);
+		CREATE INDEX IF NOT EXISTS holds_queue ON holds (book_id, status, placed_at);
+		CREATE UNIQUE INDEX IF NOT EXISTS holds_active ON holds (book_id, patron_id) WHERE status IN ('waiting', 'ready');`
+	_, err = db.Exec(holdsTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create holds table:", err)
+	}
+}
+
+// Waiting holds carry their place in the book's queue
+const holdColumns = `h.id, h.book_id, h.patron_id, h.status, h.item_id, h.placed_at, h.ready_at, h.expires_at, h.closed_at,
+					CASE WHEN h.status = 'waiting' THEN
+						(SELECT COUNT(*) FROM holds AS w WHERE w.book_id = h.book_id AND w.status = 'waiting' AND w.id <= h.id)
+					ELSE 0 END
+					FROM holds AS h`
+
+func scanHold(row interface{ Scan(...interface{}) error }) (Hold, error) {
+	var (
+		hold                         Hold
+		itemID                       sql.NullInt64
+		readyAt, expiresAt, closedAt sql.NullTime
+	)
+	err := row.Scan(&hold.ID, &hold.BookID, &hold.PatronID, &hold.Status, &itemID, &hold.PlacedAt,
+		&readyAt, &expiresAt, &closedAt, &hold.Position)
+	if itemID.Valid {
+		id := uint(itemID.Int64)
+		hold.ItemID = &id
+	}
+	hold.ReadyAt = nullTimePtr(readyAt)
+	hold.ExpiresAt = nullTimePtr(expiresAt)
+	hold.ClosedAt = nullTimePtr(closedAt)
+	return hold, err
+}
+
+func queryHold(q querier, id interface{}) (Hold, error) {
+	hold, err := scanHold(q.QueryRow("SELECT "+holdColumns+" WHERE h.id = ?", id))
+	if err == sql.ErrNoRows {
+		return hold, errHoldNotFound
+	}
+	return hold, err
+}
+
+func queryHolds(q querier, where string, args ...interface{}) ([]Hold, error) {
+	rows, err := q.Query("SELECT "+holdColumns+" "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []Hold{}
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+// Queue a patron for a book none of whose copies is on the shelf
+func placeHold(tx *sql.Tx, bookID, patronID uint) (Hold, error) {
+	if _, err := lookupPatron(tx, patronID); err != nil {
+		return Hold{}, err
+	}
+	if _, err := queryBook(tx, bookID); err != nil {
+		if err == sql.ErrNoRows {
+			return Hold{}, errBookNotFound
+		}
+		return Hold{}, err
+	}
+
+	availability, err := getBookAvailability(tx, bookID, 0)
+	if err != nil {
+		return Hold{}, err
+	}
+	if availability.Total == 0 {
+		return Hold{}, errBookNotHoldable
+	}
+	if availability.Available > 0 {
+		return Hold{}, errCopyAvailable
+	}
+
+	r, err := tx.Exec("INSERT INTO holds (book_id, patron_id, status, placed_at) VALUES (?, ?, ?, ?)",
+		bookID, patronID, holdWaiting, now())
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Hold{}, errHoldExists
+		}
+		return Hold{}, err
+	}
+	id, _ := r.LastInsertId()
+
+	return queryHold(tx, id)
+}
+
+// Set an available copy aside for the first waiting hold on its book, if
+// any. The copy stays available when nobody is waiting.
+func trapItemForHold(tx *sql.Tx, item Item) (*Hold, error) {
+	var holdID uint
+	err := tx.QueryRow("SELECT id FROM holds WHERE book_id = ? AND status = ? ORDER BY placed_at, id LIMIT 1",
+		item.BookID, holdWaiting).Scan(&holdID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	readyAt := now()
+	_, err = tx.Exec("UPDATE holds SET status = ?, item_id = ?, ready_at = ?, expires_at = ? WHERE id = ?",
+		holdReady, item.ID, readyAt, readyAt.AddDate(0, 0, holdPickupDays), holdID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE items SET status = ? WHERE id = ?", itemOnHold, item.ID); err != nil {
+		return nil, err
+	}
+
+	hold, err := queryHold(tx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	return &hold, queueHoldReadyNotice(tx, hold)
+}
+
+// Take a copy off the hold shelf, passing it to the next waiting patron.
+// A borrowed-in copy is kept aside for its partner library instead.
+func releaseHeldItem(tx *sql.Tx, itemID uint) error {
+	if borrowed, err := holdForPartner(tx, itemID); borrowed || err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE items SET status = ? WHERE id = ?", itemAvailable, itemID); err != nil {
+		return err
+	}
+	item, err := lookupItem(tx, itemID, "")
+	if err != nil {
+		return err
+	}
+	_, err = trapItemForHold(tx, item)
+	return err
+}
+
+// Close an active hold with the given status
+func closeHold(tx *sql.Tx, hold Hold, status string) (Hold, error) {
+	if hold.Status != holdWaiting && hold.Status != holdReady {
+		return hold, errHoldClosed
+	}
+
+	if _, err := tx.Exec("UPDATE holds SET status = ?, closed_at = ? WHERE id = ?", status, now(), hold.ID); err != nil {
+		return hold, err
+	}
+	if hold.Status == holdReady && status != holdFulfilled {
+		if err := releaseHeldItem(tx, *hold.ItemID); err != nil {
+			return hold, err
+		}
+	}
+
+	return queryHold(tx, hold.ID)
+}
+
+// The patron a copy on the hold shelf is set aside for
+func heldItemPatron(q querier, itemID uint) (uint, error) {
+	var patronID uint
+	err := q.QueryRow("SELECT patron_id FROM holds WHERE item_id = ? AND status = ?", itemID, holdReady).Scan(&patronID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return patronID, err
+}
+
+// Check whether a copy on the hold shelf may be lent to the patron,
+// fulfilling their hold if so
+func collectHeldItem(tx *sql.Tx, item Item, patronID uint) error {
+	holds, err := queryHolds(tx, "WHERE h.item_id = ? AND h.status = ?", item.ID, holdReady)
+	if err != nil {
+		return err
+	}
+	if len(holds) == 0 || holds[0].PatronID != patronID {
+		return errItemHeldForOther
+	}
+
+	if _, err := closeHold(tx, holds[0], holdFulfilled); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE items SET status = ? WHERE id = ?", itemAvailable, item.ID)
+	return err
+}
+
+func hasWaitingHolds(q querier, bookID uint) (bool, error) {
+	var waiting int
+	err := q.QueryRow("SELECT COUNT(*) FROM holds WHERE book_id = ? AND status = ?", bookID, holdWaiting).Scan(&waiting)
+	return waiting > 0, err
+}
+
+// Patrons waiting for a copy of the book
+func holdQueueLength(q querier, bookID uint) (int, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM holds WHERE book_id = ? AND status = ?", bookID, holdWaiting).Scan(&n)
+	return n, err
+}
+
+// Expire ready holds that were not collected in time, passing their copies on
+func expireHolds() error {
+	return withTx(func(tx *sql.Tx) error {
+		holds, err := queryHolds(tx, "WHERE h.status = ? AND h.expires_at < ?", holdReady, now())
+		if err != nil {
+			return err
+		}
+		for _, hold := range holds {
+			if _, err := closeHold(tx, hold, holdExpired); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Handlers
+
+func respondPlaceHold(c *gin.Context, bookID, patronID uint) {
+	var hold Hold
+	err := withTx(func(tx *sql.Tx) error {
+		var err error
+		if hold, err = placeHold(tx, bookID, patronID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "hold", hold.ID, nil, hold)
+	})
+	if err != nil {
+		respondCirculationError(c, err, "Failed to place hold")
+		return
+	}
+
+	c.JSON(http.StatusCreated, hold)
+}
+
+func createHold(c *gin.Context) {
+	var body struct {
+		BookID   uint `json:"book_id"`
+		PatronID uint `json:"patron_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.BookID == 0 || body.PatronID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	respondPlaceHold(c, body.BookID, body.PatronID)
+}
+
+func createAccountHold(c *gin.Context) {
+	var body struct {
+		BookID uint `json:"book_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.BookID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondPlaceHold(c, body.BookID, patronID)
+}
+
+// Cancel a hold, limited to patronID's own when ownerOnly is set
+func respondCancelHold(c *gin.Context, patronID uint, ownerOnly bool) {
+	var hold Hold
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryHold(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if ownerOnly && before.PatronID != patronID {
+			return errHoldNotFound
+		}
+		if hold, err = closeHold(tx, before, holdCancelled); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "hold", hold.ID, before, hold)
+	})
+	if err != nil {
+		respondCirculationError(c, err, "Failed to cancel hold")
+		return
+	}
+
+	c.JSON(http.StatusOK, hold)
+}
+
+func cancelHold(c *gin.Context) {
+	respondCancelHold(c, 0, false)
+}
+
+func cancelAccountHold(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondCancelHold(c, patronID, true)
+}
+
+func respondHolds(c *gin.Context, where string, args ...interface{}) {
+	if status := c.Query("status"); status != "" {
+		where += " AND h.status = ?"
+		args = append(args, status)
+	}
+
+	holds, err := queryHolds(db, where+" ORDER BY h.placed_at, h.id", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve holds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, holds)
+}
+
+func getHolds(c *gin.Context) {
+	respondHolds(c, "WHERE 1 = 1")
+}
+
+func getBookHolds(c *gin.Context) {
+	respondHolds(c, "WHERE h.book_id = ?", c.Param("id"))
+}
+
+func getPatronHolds(c *gin.Context) {
+	respondHolds(c, "WHERE h.patron_id = ?", c.Param("id"))
+}
+
+func getAccountHolds(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondHolds(c, "WHERE h.patron_id = ?", patronID)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func placeTestHold(t *testing.T, token, path string, body interface{}) (Hold, int) {
+	t.Helper()
+	recorder := doJSON("POST", path, token, body)
+	var hold Hold
+	json.NewDecoder(recorder.Body).Decode(&hold)
+	return hold, recorder.Code
+}
+
+func TestHoldQueue(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	bob := createTestPatron(t, "bob", 0)
+	carol := createTestPatron(t, "carol", 0)
+	createTestItems(t, librarian, "30001")
+
+	// Nobody queues for a copy on the shelf
+	if _, status := placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+	hold, status := placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	if hold.Status != holdWaiting || hold.Position != 1 {
+		t.Errorf("Unexpected hold %+v", hold)
+	}
+	if _, status := placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+	hold, _ = placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": carol.ID})
+	if hold.Position != 2 {
+		t.Errorf("Expected position 2, but got %+v", hold)
+	}
+
+	// The queue keeps the loan from being renewed
+	recorder := doJSON("POST", "/api/loans/1/renew", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	// The returned copy goes to the first patron in line
+	recorder = doJSON("POST", "/api/loans/1/return", librarian, nil)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if loan.Hold == nil || loan.Hold.PatronID != bob.ID || loan.Hold.Status != holdReady ||
+		!loan.Hold.ExpiresAt.Equal(loan.Hold.ReadyAt.AddDate(0, 0, holdPickupDays)) {
+		t.Fatalf("Expected the copy to be trapped for bob, but got %+v", loan.Hold)
+	}
+
+	// Only bob can take it home
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": carol.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": bob.ID}); status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+
+	recorder = doJSON("GET", "/api/books/1/holds", librarian, nil)
+	var holds []Hold
+	json.NewDecoder(recorder.Body).Decode(&holds)
+	if len(holds) != 2 || holds[0].Status != holdFulfilled || holds[1].Status != holdWaiting || holds[1].Position != 1 {
+		t.Errorf("Unexpected holds %+v", holds)
+	}
+}
+
+func TestHoldExpiry(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	bob := createTestPatron(t, "bob", 0)
+	carol := createTestPatron(t, "carol", 0)
+	createTestItems(t, librarian, "30001")
+
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+	placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID})
+	placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": carol.ID})
+	doJSON("POST", "/api/loans/1/return", librarian, nil)
+
+	// Bob never collects, so the copy moves on to carol
+	db.Exec("UPDATE holds SET expires_at = ? WHERE id = 1", now().Add(-time.Hour))
+	if err := expireHolds(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		patron Patron
+		status string
+	}{
+		{bob, holdExpired},
+		{carol, holdReady},
+	} {
+		recorder := doJSON("GET", "/api/patrons/"+strconv.Itoa(int(tt.patron.ID))+"/holds", librarian, nil)
+		var holds []Hold
+		json.NewDecoder(recorder.Body).Decode(&holds)
+		if len(holds) != 1 || holds[0].Status != tt.status {
+			t.Errorf("Expected %s's hold to be %s, but got %+v", tt.patron.Name, tt.status, holds)
+		}
+	}
+
+	// Once the queue runs dry the copy returns to the shelf
+	db.Exec("UPDATE holds SET expires_at = ? WHERE id = 2", now().Add(-time.Hour))
+	expireHolds()
+	var itemStatus string
+	db.QueryRow("SELECT status FROM items WHERE id = 1").Scan(&itemStatus)
+	if itemStatus != itemAvailable {
+		t.Errorf("Expected the item to be available, but got %s", itemStatus)
+	}
+}
+
+func TestAccountHolds(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	user, _ := createUser("bob", "battery staple", roleMember)
+	createTestPatron(t, "bob", user.ID)
+	bob := loginPair(t, "bob", "battery staple").Token
+	createTestItems(t, librarian, "30001")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+
+	hold, status := placeTestHold(t, bob, "/api/account/holds", gin.H{"book_id": 1})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	if _, status := placeTestHold(t, bob, "/api/account/holds", gin.H{"book_id": 2}); status != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", status)
+	}
+
+	// Patrons only reach their own holds
+	if _, status := placeTestHold(t, bob, "/api/holds", gin.H{"book_id": 1, "patron_id": alice.ID}); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", status)
+	}
+
+	recorder := doJSON("GET", "/api/account/holds", bob, nil)
+	var holds []Hold
+	json.NewDecoder(recorder.Body).Decode(&holds)
+	if len(holds) != 1 || holds[0].ID != hold.ID {
+		t.Errorf("Unexpected holds %+v", holds)
+	}
+
+	// Accounts without a patron record cannot reach anyone's holds
+	createUser("carol", "battery staple", roleMember)
+	carol := loginPair(t, "carol", "battery staple").Token
+	path := "/api/account/holds/" + strconv.Itoa(int(hold.ID))
+	if recorder := doJSON("DELETE", path, carol, nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("GET", "/api/account/holds", carol, nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("DELETE", path, bob, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("DELETE", path, bob, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	// A cancelled hold leaves the returned copy on the shelf
+	recorder = doJSON("POST", "/api/loans/1/return", librarian, nil)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if loan.Hold != nil {
+		t.Errorf("Expected no hold to be filled, but got %+v", loan.Hold)
+	}
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Interlibrary loan request statuses. A requested book is sent for to a
+// partner library, received as a temporary copy set aside for the patron,
+// lent to them and, once back, returned to the partner. Requests not yet
+// received may be cancelled.
+const (
+	illRequested = "requested"
+	illSent      = "sent"
+	illReceived  = "received"
+	illOnLoan    = "on_loan"
+	illReturned  = "returned"
+	illCancelled = "cancelled"
+)
+
+// Item type of borrowed-in copies, as lending rules see them
+const illItemType = "ill"
+
+var (
+	errPartnerNotFound    = errors.New("partner library not found")
+	errPartnerInUse       = errors.New("partner library has requests")
+	errUnknownPartner     = errors.New("unknown partner library")
+	errILLRequestNotFound = errors.New("interlibrary loan request not found")
+	errILLState           = errors.New("interlibrary loan request is not in a state to allow this")
+	errILLItemOnLoan      = errors.New("borrowed copy is still on loan")
+	errILLCatalogue       = errors.New("adding the requested book to the catalogue needs catalog:write")
+)
+
+// A library we borrow books from
+type Partner struct {
+	ID       uint   `json:"id"`
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	AgencyID string `json:"agency_id"`
+	Email    string `json:"email"`
+	Address  string `json:"address"`
+}
+
+// A patron's request for a book borrowed from a partner library. A book we
+// do not have is described by its title, year and ISBN until it is sent for,
+// when it gets a BookID. ItemID is the temporary copy made when it arrives.
+type ILLRequest struct {
+	ID               uint       `json:"id"`
+	PatronID         uint       `json:"patron_id"`
+	BookID           *uint      `json:"book_id,omitempty"`
+	Title            string     `json:"title"`
+	PublishedYear    int        `json:"published_year,omitempty"`
+	ISBN             string     `json:"isbn,omitempty"`
+	PickupBranchID   uint       `json:"pickup_branch_id"`
+	PartnerID        *uint      `json:"partner_id,omitempty"`
+	PartnerReference string     `json:"partner_reference,omitempty"`
+	ItemID           *uint      `json:"item_id,omitempty"`
+	Note             string     `json:"note,omitempty"`
+	Status           string     `json:"status"`
+	RequestedAt      time.Time  `json:"requested_at"`
+	SentAt           *time.Time `json:"sent_at,omitempty"`
+	ReceivedAt       *time.Time `json:"received_at,omitempty"`
+	DueBackAt        *time.Time `json:"due_back_at,omitempty"`
+	ClosedAt         *time.Time `json:"closed_at,omitempty"`
+}
+
+// Create the partner library and interlibrary loan request tables
+func createILLTables() {
+	illTablesSQL := `
+		CREATE TABLE IF NOT EXISTS partner_libraries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			agency_id TEXT NOT NULL DEFAULT '',
+			email TEXT NOT NULL DEFAULT '',
+			address TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS ill_requests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			patron_id INTEGER NOT NULL,
+			book_id INTEGER,
+			title TEXT NOT NULL DEFAULT '',
+			published_year INTEGER NOT NULL DEFAULT 0,
+			isbn TEXT NOT NULL DEFAULT '',
+			pickup_branch_id INTEGER NOT NULL,
+			partner_id INTEGER,
+			partner_reference TEXT NOT NULL DEFAULT '',
+			item_id INTEGER UNIQUE,
+			note TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			requested_at DATETIME NOT NULL,
+			sent_at DATETIME,
+			received_at DATETIME,
+			due_back_at DATETIME,
+			closed_at DATETIME,
+			FOREIGN KEY (patron_id) REFERENCES patrons (id),
+			FOREIGN KEY (book_id) REFERENCES books (id),
+			FOREIGN KEY (pickup_branch_id) REFERENCES branches (id),
+			FOREIGN KEY (partner_id) REFERENCES partner_libraries (id),
+			FOREIGN KEY (item_id) REFERENCES items (id)
+		);
+		CREATE INDEX IF NOT EXISTS ill_requests_patron ON ill_requests (patron_id);`
+	_, err = db.Exec(illTablesSQL)
+	if err != nil {
+		log.Fatal("Failed to create interlibrary loan tables:", err)
+	}
+}
+
+const partnerColumns = "id, code, name, agency_id, email, address"
+
+func scanPartner(row interface{ Scan(...interface{}) error }) (Partner, error) {
+	var partner Partner
+	err := row.Scan(&partner.ID, &partner.Code, &partner.Name, &partner.AgencyID, &partner.Email, &partner.Address)
+	return partner, err
+}
+
+func queryPartner(q querier, id interface{}) (Partner, error) {
+	partner, err := scanPartner(q.QueryRow("SELECT "+partnerColumns+" FROM partner_libraries WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return partner, errPartnerNotFound
+	}
+	return partner, err
+}
+
+const illRequestColumns = `r.id, r.patron_id, r.book_id, COALESCE(b.title, r.title), r.published_year, r.isbn, r.pickup_branch_id,
+						r.partner_id, r.partner_reference, r.item_id, r.note, r.status, r.requested_at, r.sent_at, r.received_at,
+						r.due_back_at, r.closed_at
+						FROM ill_requests AS r LEFT JOIN books AS b ON b.id = r.book_id`
+
+func scanILLRequest(row interface{ Scan(...interface{}) error }) (ILLRequest, error) {
+	var (
+		request                                 ILLRequest
+		bookID, partnerID, itemID               sql.NullInt64
+		sentAt, receivedAt, dueBackAt, closedAt sql.NullTime
+	)
+	err := row.Scan(&request.ID, &request.PatronID, &bookID, &request.Title, &request.PublishedYear, &request.ISBN,
+		&request.PickupBranchID, &partnerID, &request.PartnerReference, &itemID, &request.Note, &request.Status,
+		&request.RequestedAt, &sentAt, &receivedAt, &dueBackAt, &closedAt)
+	if bookID.Valid {
+		id := uint(bookID.Int64)
+		request.BookID = &id
+	}
+	if partnerID.Valid {
+		id := uint(partnerID.Int64)
+		request.PartnerID = &id
+	}
+	if itemID.Valid {
+		id := uint(itemID.Int64)
+		request.ItemID = &id
+	}
+	request.SentAt = nullTimePtr(sentAt)
+	request.ReceivedAt = nullTimePtr(receivedAt)
+	request.DueBackAt = nullTimePtr(dueBackAt)
+	request.ClosedAt = nullTimePtr(closedAt)
+	return request, err
+}
+
+func queryILLRequest(q querier, id interface{}) (ILLRequest, error) {
+	request, err := scanILLRequest(q.QueryRow("SELECT "+illRequestColumns+" WHERE r.id = ?", id))
+	if err == sql.ErrNoRows {
+		return request, errILLRequestNotFound
+	}
+	return request, err
+}
+
+func queryILLRequests(q querier, where string, args ...interface{}) ([]ILLRequest, error) {
+	rows, err := q.Query("SELECT "+illRequestColumns+" "+where+" ORDER BY r.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []ILLRequest{}
+	for rows.Next() {
+		request, err := scanILLRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+// What a patron asks to borrow: a book in the catalogue, or the
+// description of one we do not have
+type illRequestInput struct {
+	BookID         uint   `json:"book_id"`
+	Title          string `json:"title"`
+	PublishedYear  int    `json:"published_year"`
+	ISBN           string `json:"isbn"`
+	PickupBranchID uint   `json:"pickup_branch_id"`
+	Note           string `json:"note"`
+}
+
+func (in illRequestInput) valid() bool {
+	return in.BookID != 0 || (in.Title != "" && in.PublishedYear != 0 && len(in.ISBN) == 13)
+}
+
+// The book a request being sent is for: the one given, the one in the
+// catalogue with the described ISBN, or a new record added from the
+// description when mayCatalogue allows. Borrowed-in copies hang off it
+// like our own.
+func illRequestBook(tx *sql.Tx, c *gin.Context, request ILLRequest, bookID uint, mayCatalogue bool) (Book, error) {
+	if bookID == 0 && request.BookID != nil {
+		bookID = *request.BookID
+	}
+	if bookID != 0 {
+		book, err := queryBook(tx, bookID)
+		if err == sql.ErrNoRows {
+			return book, errBookNotFound
+		}
+		return book, err
+	}
+
+	var id uint
+	err := tx.QueryRow("SELECT id FROM books WHERE isbn = ? ORDER BY id LIMIT 1", request.ISBN).Scan(&id)
+	if err == nil {
+		return queryBook(tx, id)
+	}
+	if err != sql.ErrNoRows {
+		return Book{}, err
+	}
+	if !mayCatalogue {
+		return Book{}, errILLCatalogue
+	}
+
+	book := Book{Title: request.Title, PublishedYear: request.PublishedYear, ISBN: request.ISBN}
+	r, err := tx.Exec("INSERT INTO books (title, published_year, isbn) VALUES (?, ?, ?)", book.Title, book.PublishedYear, book.ISBN)
+	if err != nil {
+		return book, err
+	}
+	newID, _ := r.LastInsertId()
+	book.ID = uint(newID)
+	return book, recordAudit(tx, c, auditCreate, "book", book.ID, nil, book)
+}
+
+// Record a patron's request, to be picked up at their home branch unless
+// another is given. A book we do not have is only described; the
+// catalogue is left alone until staff send for it.
+func requestILL(tx *sql.Tx, patronID uint, in illRequestInput) (ILLRequest, error) {
+	patron, err := lookupPatron(tx, patronID)
+	if err != nil {
+		return ILLRequest{}, err
+	}
+	pickupBranchID := in.PickupBranchID
+	if pickupBranchID == 0 && patron.HomeBranchID != nil {
+		pickupBranchID = *patron.HomeBranchID
+	}
+	if err := checkBranch(tx, pickupBranchID); err != nil {
+		return ILLRequest{}, err
+	}
+
+	var bookID *uint
+	if in.BookID != 0 {
+		if _, err := queryBook(tx, in.BookID); err != nil {
+			if err == sql.ErrNoRows {
+				return ILLRequest{}, errBookNotFound
+			}
+			return ILLRequest{}, err
+		}
+		bookID, in.Title, in.PublishedYear, in.ISBN = &in.BookID, "", 0, ""
+	}
+
+	r, err := tx.Exec(`INSERT INTO ill_requests (patron_id, book_id, title, published_year, isbn, pickup_branch_id, note, status, requested_at)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		patron.ID, bookID, in.Title, in.PublishedYear, in.ISBN, pickupBranchID, in.Note, illRequested, now())
+	if err != nil {
+		return ILLRequest{}, err
+	}
+	id, _ := r.LastInsertId()
+
+	request, err := queryILLRequest(tx, id)
+	if err != nil {
+		return request, err
+	}
+	return request, queueILLNotice(tx, request)
+}
+
+// Ask a partner library for the book, first settling which book in the
+// catalogue it is (see illRequestBook)
+func sendILLRequest(tx *sql.Tx, c *gin.Context, request ILLRequest, partnerID, bookID uint, reference string) error {
+	if request.Status != illRequested {
+		return errILLState
+	}
+	if _, err := queryPartner(tx, partnerID); err != nil {
+		if err == errPartnerNotFound {
+			return errUnknownPartner
+		}
+		return err
+	}
+	book, err := illRequestBook(tx, c, request, bookID, hasPermission(c, permCatalogWrite))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE ill_requests SET status = ?, book_id = ?, partner_id = ?, partner_reference = ?, sent_at = ? WHERE id = ?",
+		illSent, book.ID, partnerID, reference, now(), request.ID)
+	return err
+}
+
+// Take in the partner's copy as a temporary item at the pickup branch and
+// set it aside for the patron, as if for a hold. dueBackAt is when the
+// partner wants it back.
+func receiveILLRequest(tx *sql.Tx, request ILLRequest, barcode string, dueBackAt *time.Time) error {
+	if request.Status != illSent {
+		return errILLState
+	}
+	bookID := *request.BookID
+	if barcode == "" {
+		barcode = fmt.Sprintf("ILL-%d", request.ID)
+	}
+
+	r, err := tx.Exec(`INSERT INTO items (book_id, barcode, home_branch_id, current_branch_id, item_type, status)
+						VALUES (?, ?, ?, ?, ?, ?)`,
+		bookID, barcode, request.PickupBranchID, request.PickupBranchID, illItemType, itemOnHold)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return errBarcodeInUse
+		}
+		return err
+	}
+	itemID, _ := r.LastInsertId()
+
+	// A hold the patron already has on the book is filled by the copy
+	readyAt := now()
+	expiresAt := readyAt.AddDate(0, 0, holdPickupDays)
+	result, err := tx.Exec("UPDATE holds SET status = ?, item_id = ?, ready_at = ?, expires_at = ? WHERE book_id = ? AND patron_id = ? AND status = ?",
+		holdReady, itemID, readyAt, expiresAt, bookID, request.PatronID, holdWaiting)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err := tx.Exec("INSERT INTO holds (book_id, patron_id, status, item_id, placed_at, ready_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			bookID, request.PatronID, holdReady, itemID, readyAt, readyAt, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE ill_requests SET status = ?, item_id = ?, received_at = ?, due_back_at = ? WHERE id = ?",
+		illReceived, itemID, readyAt, dueBackAt, request.ID)
+	return err
+}
+
+// Send the copy back to the partner, taking it out of the collection. A
+// copy the patron did not collect goes back too.
+func returnILLRequest(tx *sql.Tx, request ILLRequest) error {
+	if request.Status != illReceived && request.Status != illOnLoan {
+		return errILLState
+	}
+
+	if _, err := openLoanForItem(tx, *request.ItemID); err != errItemNotOnLoan {
+		if err == nil {
+			return errILLItemOnLoan
+		}
+		return err
+	}
+	holds, err := queryHolds(tx, "WHERE h.item_id = ? AND h.status = ?", *request.ItemID, holdReady)
+	if err != nil {
+		return err
+	}
+	for _, hold := range holds {
+		if _, err := closeHold(tx, hold, holdCancelled); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE items SET status = ? WHERE id = ? AND status != ?", itemWithdrawn, *request.ItemID, itemLost)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE ill_requests SET status = ?, closed_at = ? WHERE id = ?", illReturned, now(), request.ID)
+	return err
+}
+
+// Drop a request whose copy has not arrived
+func cancelILLRequest(tx *sql.Tx, request ILLRequest) error {
+	if request.Status != illRequested && request.Status != illSent {
+		return errILLState
+	}
+
+	_, err := tx.Exec("UPDATE ill_requests SET status = ?, closed_at = ? WHERE id = ?", illCancelled, now(), request.ID)
+	return err
+}
+
+// Mark the request of a borrowed-in copy on loan once the patron checks
+// it out
+func lendILLItem(tx *sql.Tx, itemID uint) error {
+	result, err := tx.Exec("UPDATE ill_requests SET status = ? WHERE item_id = ? AND status = ?", illOnLoan, itemID, illReceived)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	requests, err := queryILLRequests(tx, "WHERE r.item_id = ?", itemID)
+	if err != nil {
+		return err
+	}
+	return queueILLNotice(tx, requests[0])
+}
+
+// Bring the due date of a loan of a borrowed-in copy forward to when its
+// partner wants it back, if that is sooner. Our own copies keep dueAt.
+func capILLDueDate(q querier, item Item, dueAt time.Time) (time.Time, error) {
+	if item.ItemType != illItemType {
+		return dueAt, nil
+	}
+	var dueBackAt sql.NullTime
+	err := q.QueryRow("SELECT due_back_at FROM ill_requests WHERE item_id = ? AND status IN (?, ?)",
+		item.ID, illReceived, illOnLoan).Scan(&dueBackAt)
+	if err == sql.ErrNoRows {
+		return dueAt, nil
+	}
+	if err != nil || !dueBackAt.Valid || !dueBackAt.Time.Before(dueAt) {
+		return dueAt, err
+	}
+	return dueBackAt.Time, nil
+}
+
+// Keep a borrowed-in copy off the shelf once the patron is done with it,
+// until it goes back to its partner. Reports whether it was one.
+func holdForPartner(tx *sql.Tx, itemID uint) (bool, error) {
+	result, err := tx.Exec(`UPDATE items SET status = ? WHERE id = ?
+							AND id IN (SELECT item_id FROM ill_requests WHERE status IN (?, ?))`,
+		itemInTransit, itemID, illReceived, illOnLoan)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Tell the patron where their request has got to
+func queueILLNotice(q querier, request ILLRequest) error {
+	patron, err := queryPatron(q, request.PatronID)
+	if err != nil {
+		return err
+	}
+	branch, err := queryBranch(q, request.PickupBranchID)
+	if err != nil {
+		return err
+	}
+
+	data := noticeData{Title: request.Title, Branch: branch.Name, Status: request.Status}
+	if request.ItemID != nil {
+		item, err := lookupItem(q, *request.ItemID, "")
+		if err != nil {
+			return err
+		}
+		data.Barcode = item.Barcode
+		holds, err := queryHolds(q, "WHERE h.item_id = ? AND h.status = ?", item.ID, holdReady)
+		if err != nil {
+			return err
+		}
+		if len(holds) > 0 && holds[0].ExpiresAt != nil {
+			data.ExpiresAt = *holds[0].ExpiresAt
+		}
+		if loan, err := openLoanForItem(q, item.ID); err == nil {
+			data.DueAt = loan.DueAt
+		} else if err != errItemNotOnLoan {
+			return err
+		}
+	}
+	return queueNotice(q, patron, noticeILLStatus, fmt.Sprintf("ill:%d:%s", request.ID, request.Status), data)
+}
+
+// Handlers
+
+func getPartners(c *gin.Context) {
+	rows, err := db.Query("SELECT " + partnerColumns + " FROM partner_libraries ORDER BY name")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve partner libraries"})
+		return
+	}
+	defer rows.Close()
+
+	partners := []Partner{}
+	for rows.Next() {
+		partner, err := scanPartner(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve partner libraries"})
+			return
+		}
+		partners = append(partners, partner)
+	}
+
+	c.JSON(http.StatusOK, partners)
+}
+
+func getPartner(c *gin.Context) {
+	partner, err := queryPartner(db, c.Param("id"))
+	if err != nil {
+		respondILLError(c, err, "Failed to retrieve partner library")
+		return
+	}
+
+	c.JSON(http.StatusOK, partner)
+}
+
+// Responses for the errors partner libraries and interlibrary loans refuse a
+// request with
+var illErrors = errorResponses{
+	errPartnerNotFound:    {http.StatusNotFound, "Partner library not found"},
+	errPartnerInUse:       {http.StatusConflict, "Partner library has interlibrary loan requests"},
+	errUnknownPartner:     {http.StatusBadRequest, "Unknown partner library"},
+	errILLRequestNotFound: {http.StatusNotFound, "Interlibrary loan request not found"},
+	errILLState:           {http.StatusConflict, "Interlibrary loan request cannot make that change in its status"},
+	errILLItemOnLoan:      {http.StatusConflict, "Borrowed copy is still on loan, check it in first"},
+	errILLCatalogue:       {http.StatusForbidden, "The book is not in the catalogue, and adding it needs catalog:write"},
+}
+
+// Respond with the matching interlibrary loan error, falling back to the
+// circulation and branch errors of the patrons and pickup branches requests
+// name
+func respondILLError(c *gin.Context, err error, fallback string) {
+	respondError(c, err, fallback, illErrors, circulationErrors, branchErrors)
+}
+
+// Respond with the error of a partner library change
+func respondPartnerError(c *gin.Context, err error, fallback string) {
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Partner library code already in use"})
+		return
+	}
+	respondILLError(c, err, fallback)
+}
+
+func createPartner(c *gin.Context) {
+	var partner Partner
+	if err := c.ShouldBindJSON(&partner); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if partner.Code == "" || partner.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		r, err := tx.Exec("INSERT INTO partner_libraries (code, name, agency_id, email, address) VALUES (?, ?, ?, ?, ?)",
+			partner.Code, partner.Name, partner.AgencyID, partner.Email, partner.Address)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		partner.ID = uint(id)
+		return recordAudit(tx, c, auditCreate, "partner", partner.ID, nil, partner)
+	})
+	if err != nil {
+		respondPartnerError(c, err, "Failed to create partner library")
+		return
+	}
+
+	c.JSON(http.StatusCreated, partner)
+}
+
+func updatePartner(c *gin.Context) {
+	var partner Partner
+	if err := c.ShouldBindJSON(&partner); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if partner.Code == "" || partner.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryPartner(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		partner.ID = before.ID
+
+		_, err = tx.Exec("UPDATE partner_libraries SET code = ?, name = ?, agency_id = ?, email = ?, address = ? WHERE id = ?",
+			partner.Code, partner.Name, partner.AgencyID, partner.Email, partner.Address, partner.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "partner", partner.ID, before, partner)
+	})
+	if err != nil {
+		respondPartnerError(c, err, "Failed to update partner library")
+		return
+	}
+
+	c.JSON(http.StatusOK, partner)
+}
+
+func deletePartner(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryPartner(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		var requests int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM ill_requests WHERE partner_id = ?", before.ID).Scan(&requests); err != nil {
+			return err
+		}
+		if requests > 0 {
+			return errPartnerInUse
+		}
+
+		if _, err := tx.Exec("DELETE FROM partner_libraries WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "partner", before.ID, before, nil)
+	})
+	if err != nil {
+		respondILLError(c, err, "Failed to delete partner library")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+func respondRequestILL(c *gin.Context, patronID uint, in illRequestInput) {
+	var request ILLRequest
+	err := withTx(func(tx *sql.Tx) error {
+		var err error
+		if request, err = requestILL(tx, patronID, in); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "ill_request", request.ID, nil, request)
+	})
+	if err != nil {
+		respondILLError(c, err, "Failed to request interlibrary loan")
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+func createILLRequest(c *gin.Context) {
+	var body struct {
+		illRequestInput
+		PatronID uint `json:"patron_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.PatronID == 0 || !body.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	respondRequestILL(c, body.PatronID, body.illRequestInput)
+}
+
+func createAccountILLRequest(c *gin.Context) {
+	var body illRequestInput
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if !body.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondILLError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondRequestILL(c, patronID, body)
+}
+
+// Run a change to an existing request, audit it and tell the patron
+func respondILLChange(c *gin.Context, change func(tx *sql.Tx, request ILLRequest) error, fallback string) {
+	var after ILLRequest
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryILLRequest(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := change(tx, before); err != nil {
+			return err
+		}
+		if after, err = queryILLRequest(tx, before.ID); err != nil {
+			return err
+		}
+		if err := queueILLNotice(tx, after); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "ill_request", after.ID, before, after)
+	})
+	if err != nil {
+		respondILLError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func sendILLRequestHandler(c *gin.Context) {
+	var body struct {
+		PartnerID        uint   `json:"partner_id"`
+		PartnerReference string `json:"partner_reference"`
+		BookID           uint   `json:"book_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.PartnerID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	respondILLChange(c, func(tx *sql.Tx, request ILLRequest) error {
+		return sendILLRequest(tx, c, request, body.PartnerID, body.BookID, body.PartnerReference)
+	}, "Failed to send interlibrary loan request")
+}
+
+// Take in the partner's copy, under the barcode given or ILL-<id>
+func receiveILLRequestHandler(c *gin.Context) {
+	var body struct {
+		Barcode   string     `json:"barcode"`
+		DueBackAt *time.Time `json:"due_back_at"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	respondILLChange(c, func(tx *sql.Tx, request ILLRequest) error {
+		return receiveILLRequest(tx, request, body.Barcode, body.DueBackAt)
+	}, "Failed to receive interlibrary loan")
+}
+
+func returnILLRequestHandler(c *gin.Context) {
+	respondILLChange(c, returnILLRequest, "Failed to return interlibrary loan")
+}
+
+func cancelILLRequestHandler(c *gin.Context) {
+	respondILLChange(c, cancelILLRequest, "Failed to cancel interlibrary loan request")
+}
+
+func getILLRequest(c *gin.Context) {
+	request, err := queryILLRequest(db, c.Param("id"))
+	if err != nil {
+		respondILLError(c, err, "Failed to retrieve interlibrary loan request")
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// List requests, newest first, narrowed by status, patron and partner
+func getILLRequests(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	for _, filter := range []string{"status", "patron_id", "partner_id"} {
+		if value := c.Query(filter); value != "" {
+			where += " AND r." + filter + " = ?"
+			args = append(args, value)
+		}
+	}
+	respondILLRequests(c, where, args...)
+}
+
+func getAccountILLRequests(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondILLError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondILLRequests(c, "WHERE r.patron_id = ?", patronID)
+}
+
+func respondILLRequests(c *gin.Context, where string, args ...interface{}) {
+	requests, err := queryILLRequests(db, where, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve interlibrary loan requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func changeILLRequest(t *testing.T, token string, request ILLRequest, action string, body interface{}) (ILLRequest, int) {
+	t.Helper()
+	recorder := doJSON("POST", "/api/ill-requests/"+strconv.Itoa(int(request.ID))+"/"+action, token, body)
+	var after ILLRequest
+	json.NewDecoder(recorder.Body).Decode(&after)
+	return after, recorder.Code
+}
+
+func TestPartnerCRUD(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+
+	if recorder := doJSON("POST", "/api/partners", librarian, Partner{Code: "CITY", Name: "City Library"}); recorder.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", recorder.Code)
+	}
+	recorder := doJSON("POST", "/api/partners", admin, Partner{Code: "CITY", Name: "City Library", AgencyID: "US-CITY"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", "/api/partners", admin, Partner{Code: "CITY", Name: "Another"}); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", "/api/partners", admin, Partner{Code: "TOWN"}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("PUT", "/api/partners/1", admin, Partner{Code: "CITY", Name: "City Central Library", Email: "ill@city.example.org"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", "/api/partners", librarian, nil)
+	var partners []Partner
+	json.NewDecoder(recorder.Body).Decode(&partners)
+	if len(partners) != 1 || partners[0].Name != "City Central Library" || partners[0].Email != "ill@city.example.org" {
+		t.Fatalf("Unexpected partners %+v", partners)
+	}
+
+	// Partners that lent us books are kept
+	createTestBranch(t, "main")
+	alice := createTestPatron(t, "alice", 0)
+	recorder = doJSON("POST", "/api/ill-requests", librarian, gin.H{"patron_id": alice.ID, "title": "Rare Book", "published_year": 1901, "isbn": "9780000000001", "pickup_branch_id": 1})
+	var request ILLRequest
+	json.NewDecoder(recorder.Body).Decode(&request)
+	changeILLRequest(t, librarian, request, "send", gin.H{"partner_id": 1})
+	if recorder := doJSON("DELETE", "/api/partners/1", admin, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("GET", "/api/partners/2", librarian, nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+}
+
+func TestILLWorkflow(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	useNotifications(t, NotificationsConfig{SMTP: SMTPConfig{Addr: "127.0.0.1:25", From: "library@example.org"}})
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	user, _ := createUser("alice", "battery staple", roleMember)
+	alice := createTestPatron(t, "alice", user.ID)
+	bob := createTestPatron(t, "bob", 0)
+	db.Exec("UPDATE patrons SET email = name || '@example.org'")
+	main := createTestBranch(t, "main")
+	db.Exec("UPDATE patrons SET home_branch_id = ? WHERE id = ?", main.ID, alice.ID)
+	db.Exec("INSERT INTO partner_libraries (code, name) VALUES ('CITY', 'City Library')")
+
+	// Patrons ask for a book we do not have, only describing it
+	token := loginPair(t, "alice", "battery staple").Token
+	recorder := doJSON("POST", "/api/account/ill-requests", token, gin.H{"title": "Rare Book", "published_year": 1901, "isbn": "9780000000001"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	var request ILLRequest
+	json.NewDecoder(recorder.Body).Decode(&request)
+	if request.Status != illRequested || request.PatronID != alice.ID || request.PickupBranchID != main.ID || request.Title != "Rare Book" ||
+		request.ISBN != "9780000000001" || request.BookID != nil {
+		t.Fatalf("Unexpected request %+v", request)
+	}
+	var books int
+	db.QueryRow("SELECT COUNT(*) FROM books").Scan(&books)
+	if books != 0 {
+		t.Fatalf("Expected the catalogue to be left alone, but it has %d books", books)
+	}
+	if recorder := doJSON("POST", "/api/account/ill-requests", token, gin.H{"title": "Rare Book"}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	if _, status := changeILLRequest(t, librarian, request, "receive", nil); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+	if _, status := changeILLRequest(t, librarian, request, "send", gin.H{"partner_id": 9}); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", status)
+	}
+
+	// Sending for it adds the book to the catalogue, which a key scoped to
+	// circulation alone may not do
+	recorder = doJSON("POST", "/api/account/api-keys", librarian, gin.H{"name": "ill", "scopes": []string{permCirculation}})
+	var key APIKey
+	json.NewDecoder(recorder.Body).Decode(&key)
+	send, _ := http.NewRequest("POST", "/api/ill-requests/"+strconv.Itoa(int(request.ID))+"/send", strings.NewReader(`{"partner_id": 1}`))
+	send.Header.Set("X-API-Key", key.Key)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, send)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+	request, status := changeILLRequest(t, librarian, request, "send", gin.H{"partner_id": 1, "partner_reference": "CITY-77"})
+	if status != http.StatusOK || request.Status != illSent || request.PartnerReference != "CITY-77" || request.SentAt == nil || request.BookID == nil {
+		t.Fatalf("Unexpected request %d %+v", status, request)
+	}
+	if book, err := queryBook(db, *request.BookID); err != nil || book.Title != "Rare Book" || book.ISBN != "9780000000001" {
+		t.Fatalf("Expected the book to be catalogued, but got %+v %v", book, err)
+	}
+
+	// The copy that arrives is set aside for the patron alone
+	request, status = changeILLRequest(t, librarian, request, "receive", gin.H{"barcode": "ILL-CITY-1"})
+	if status != http.StatusOK || request.Status != illReceived || request.ItemID == nil {
+		t.Fatalf("Unexpected request %d %+v", status, request)
+	}
+	item, _ := lookupItem(db, *request.ItemID, "")
+	if item.BookID != *request.BookID || item.Barcode != "ILL-CITY-1" || item.Status != itemOnHold || item.ItemType != illItemType {
+		t.Fatalf("Unexpected item %+v", item)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "ILL-CITY-1", "patron_id": bob.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+	loan, status := checkout(t, librarian, gin.H{"barcode": "ILL-CITY-1", "patron_id": alice.ID})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	request, _ = queryILLRequest(db, request.ID)
+	if request.Status != illOnLoan {
+		t.Fatalf("Expected the request to be on loan, but got %s", request.Status)
+	}
+	if _, status := changeILLRequest(t, librarian, request, "return", nil); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+
+	// Once back from the patron it waits for the partner, not the next patron
+	db.Exec("INSERT INTO holds (book_id, patron_id, status, placed_at) VALUES (?, ?, ?, ?)", *request.BookID, bob.ID, holdWaiting, now())
+	if recorder := doJSON("POST", "/api/loans/"+strconv.Itoa(int(loan.ID))+"/return", librarian, nil); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	if item, _ := lookupItem(db, item.ID, ""); item.Status != itemInTransit {
+		t.Fatalf("Expected the copy to be kept for the partner, but got %s", item.Status)
+	}
+	request, status = changeILLRequest(t, librarian, request, "return", nil)
+	if status != http.StatusOK || request.Status != illReturned || request.ClosedAt == nil {
+		t.Fatalf("Unexpected request %d %+v", status, request)
+	}
+	if item, _ := lookupItem(db, item.ID, ""); item.Status != itemWithdrawn {
+		t.Fatalf("Expected the copy to be withdrawn, but got %s", item.Status)
+	}
+	if _, status := changeILLRequest(t, librarian, request, "cancel", nil); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+
+	// Alice was told of each step, once
+	notifications, _ := queryNotifications(db, "WHERE kind = ? AND patron_id = ?", noticeILLStatus, alice.ID)
+	if len(notifications) != 5 {
+		t.Fatalf("Expected 5 notices, but got %d", len(notifications))
+	}
+	for _, n := range notifications {
+		if n.Subject != "Your interlibrary loan request for Rare Book" {
+			t.Fatalf("Unexpected subject %q", n.Subject)
+		}
+		if strings.Contains(n.Body, "arrived") && !strings.Contains(n.Body, "waiting for you at Branch main") {
+			t.Fatalf("Unexpected body %q", n.Body)
+		}
+	}
+
+	recorder = doJSON("GET", "/api/account/ill-requests", token, nil)
+	var requests []ILLRequest
+	json.NewDecoder(recorder.Body).Decode(&requests)
+	if len(requests) != 1 || requests[0].ID != request.ID {
+		t.Fatalf("Unexpected requests %+v", requests)
+	}
+	var entries int
+	db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE entity_type = 'ill_request'").Scan(&entries)
+	if entries != 4 {
+		t.Fatalf("Expected 4 audited changes, but got %d", entries)
+	}
+}
+
+func TestILLUncollected(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian)
+	alice := createTestPatron(t, "alice", 0)
+	db.Exec("INSERT INTO partner_libraries (code, name) VALUES ('CITY', 'City Library')")
+
+	recorder := doJSON("POST", "/api/ill-requests", librarian, gin.H{"patron_id": alice.ID, "book_id": 1})
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a pickup branch to be needed, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/ill-requests", librarian, gin.H{"patron_id": alice.ID, "book_id": 1, "pickup_branch_id": 1})
+	var request ILLRequest
+	json.NewDecoder(recorder.Body).Decode(&request)
+	changeILLRequest(t, librarian, request, "send", gin.H{"partner_id": 1})
+	request, _ = changeILLRequest(t, librarian, request, "receive", nil)
+	if _, status := changeILLRequest(t, librarian, request, "cancel", nil); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+
+	// A copy left on the hold shelf is kept for the partner
+	*clock = clock.AddDate(0, 0, holdPickupDays+1)
+	if err := expireHolds(); err != nil {
+		t.Fatal(err)
+	}
+	item, _ := lookupItem(db, 0, "ILL-1")
+	if item.Status != itemInTransit {
+		t.Fatalf("Expected the copy to be kept for the partner, but got %s", item.Status)
+	}
+	request, status := changeILLRequest(t, librarian, request, "return", nil)
+	if status != http.StatusOK || request.Status != illReturned {
+		t.Fatalf("Unexpected request %d %+v", status, request)
+	}
+}
+
+func TestILLDueBack(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian)
+	alice := createTestPatron(t, "alice", 0)
+	db.Exec("INSERT INTO partner_libraries (code, name) VALUES ('CITY', 'City Library')")
+
+	receive := func(dueBackAt *time.Time) ILLRequest {
+		t.Helper()
+		recorder := doJSON("POST", "/api/ill-requests", librarian, gin.H{"patron_id": alice.ID, "book_id": 1, "pickup_branch_id": 1})
+		var request ILLRequest
+		json.NewDecoder(recorder.Body).Decode(&request)
+		changeILLRequest(t, librarian, request, "send", gin.H{"partner_id": 1})
+		request, status := changeILLRequest(t, librarian, request, "receive", gin.H{"due_back_at": dueBackAt})
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, but got %d", status)
+		}
+		return request
+	}
+
+	// The loan is due when the partner wants the copy back, renewed or not
+	dueBackAt := now().AddDate(0, 0, 3)
+	request := receive(&dueBackAt)
+	loan, status := checkout(t, librarian, gin.H{"item_id": *request.ItemID, "patron_id": alice.ID})
+	if status != http.StatusCreated || !loan.DueAt.Equal(dueBackAt) {
+		t.Fatalf("Expected the loan to be due at %v, but got %d %+v", dueBackAt, status, loan)
+	}
+	*clock = clock.AddDate(0, 0, 1)
+	recorder := doJSON("POST", "/api/loans/"+strconv.Itoa(int(loan.ID))+"/renew", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if recorder.Code != http.StatusOK || !loan.DueAt.Equal(dueBackAt) {
+		t.Fatalf("Expected the renewal to stay due at %v, but got %d %+v", dueBackAt, recorder.Code, loan)
+	}
+	doJSON("POST", "/api/loans/"+strconv.Itoa(int(loan.ID))+"/return", librarian, nil)
+
+	// Without a date from the partner the loan policy decides
+	request = receive(nil)
+	loan, _ = checkout(t, librarian, gin.H{"item_id": *request.ItemID, "patron_id": alice.ID})
+	if due := now().AddDate(0, 0, defaultLoanPolicy.LoanDays); !loan.DueAt.Equal(due) {
+		t.Fatalf("Expected the loan to be due at %v, but got %v", due, loan.DueAt)
+	}
+}
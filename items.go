@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Item statuses
+const (
+	itemAvailable = "available"
+	itemOnLoan    = "on_loan"
+	itemOnHold    = "on_hold"
+	itemInTransit = "in_transit"
+	itemLost      = "lost"
+	itemWithdrawn = "withdrawn"
+)
+
+// Item type of copies added without one, as lending rules see them
+const defaultItemType = "book"
+
+var itemStatuses = []string{itemAvailable, itemOnLoan, itemOnHold, itemInTransit, itemLost, itemWithdrawn}
+
+// Statuses only circulation may move an item into or out of
+func isCirculationStatus(status string) bool {
+	return status == itemOnLoan || status == itemOnHold || status == itemInTransit
+}
+
+// A physical copy of a book. It belongs to its home branch and sits at its
+// current branch, which transfers change.
+type Item struct {
+	ID              uint   `json:"id"`
+	BookID          uint   `json:"book_id"`
+	Barcode         string `json:"barcode"`
+	HomeBranchID    uint   `json:"home_branch_id"`
+	CurrentBranchID uint   `json:"current_branch_id"`
+	Shelf           string `json:"shelf"`
+	Condition       string `json:"condition"`
+	ItemType        string `json:"item_type"`
+	Status          string `json:"status"`
+}
+
+// Copies of a book by status. Total leaves out withdrawn copies.
+type Availability struct {
+	Total     int                  `json:"total"`
+	Available int                  `json:"available"`
+	ByStatus  map[string]int       `json:"by_status,omitempty"`
+	ByBranch  []BranchAvailability `json:"by_branch,omitempty"`
+}
+
+// Create the items table
+func createItemTables() {
+	itemsTableSQL := `
+		CREATE TABLE IF NOT EXISTS items (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			book_id INTEGER NOT NULL,
+			barcode TEXT NOT NULL UNIQUE,
+			home_branch_id INTEGER NOT NULL,
+			current_branch_id INTEGER NOT NULL,
+			shelf TEXT NOT NULL DEFAULT '',
+			condition TEXT NOT NULL DEFAULT '',
+			item_type TEXT NOT NULL DEFAULT 'book',
+			status TEXT NOT NULL,
+			FOREIGN KEY (book_id) REFERENCES books (id),
+			FOREIGN KEY (home_branch_id) REFERENCES branches (id),
+			FOREIGN KEY (current_branch_id) REFERENCES branches (id)
+		);
+		CREATE INDEX IF NOT EXISTS items_book ON items (book_id);`
+	_, err = db.Exec(itemsTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create items table:", err)
+	}
+}
+
+func isValidItemStatus(status string) bool {
+	for _, s := range itemStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+const itemColumns = "id, book_id, barcode, home_branch_id, current_branch_id, shelf, condition, item_type, status"
+
+func scanItem(row interface{ Scan(...interface{}) error }) (Item, error) {
+	var item Item
+	err := row.Scan(&item.ID, &item.BookID, &item.Barcode, &item.HomeBranchID, &item.CurrentBranchID, &item.Shelf, &item.Condition, &item.ItemType, &item.Status)
+	return item, err
+}
+
+func queryItem(q querier, bookID, itemID interface{}) (Item, error) {
+	return scanItem(q.QueryRow("SELECT "+itemColumns+" FROM items WHERE id = ? AND book_id = ?", itemID, bookID))
+}
+
+// Copies of a book by status, at one branch if branchID is not zero
+func getBookAvailability(q querier, bookID interface{}, branchID uint) (Availability, error) {
+	availability := Availability{ByStatus: map[string]int{}}
+	rows, err := q.Query(`SELECT status, COUNT(*) FROM items WHERE book_id = ? AND (? = 0 OR current_branch_id = ?)
+						GROUP BY status`, bookID, branchID, branchID)
+	if err != nil {
+		return availability, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			status string
+			count  int
+		)
+		if err := rows.Scan(&status, &count); err != nil {
+			return availability, err
+		}
+		availability.ByStatus[status] = count
+		if status != itemWithdrawn {
+			availability.Total += count
+		}
+	}
+	availability.Available = availability.ByStatus[itemAvailable]
+	return availability, rows.Err()
+}
+
+// Check an item from a request body, filling in defaults
+func validateItem(item *Item) string {
+	if item.Status == "" {
+		item.Status = itemAvailable
+	}
+	if item.ItemType == "" {
+		item.ItemType = defaultItemType
+	}
+	if item.CurrentBranchID == 0 {
+		item.CurrentBranchID = item.HomeBranchID
+	}
+	if item.Barcode == "" || item.HomeBranchID == 0 {
+		return "Missing required fields"
+	}
+	if !isValidItemStatus(item.Status) {
+		return "Invalid status"
+	}
+	return ""
+}
+
+// Check that the branches of an item exist
+func checkItemBranches(q querier, item Item) error {
+	for _, id := range []uint{item.HomeBranchID, item.CurrentBranchID} {
+		if err := checkBranch(q, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers
+
+func getItems(c *gin.Context) {
+	bookID := c.Param("id")
+
+	if _, err := queryBook(db, bookID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve items"})
+		return
+	}
+
+	where := "WHERE book_id = ?"
+	args := []interface{}{bookID}
+	if branchID := c.Query("branch_id"); branchID != "" {
+		where += " AND current_branch_id = ?"
+		args = append(args, branchID)
+	}
+
+	rows, err := db.Query("SELECT "+itemColumns+" FROM items "+where+" ORDER BY id", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve items"})
+		return
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve items"})
+			return
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+func getItem(c *gin.Context) {
+	item, err := queryItem(db, c.Param("id"), c.Param("item_id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func createItem(c *gin.Context) {
+	var item Item
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateItem(&item); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	if isCirculationStatus(item.Status) {
+		respondCirculationError(c, errItemStatusLocked, "Failed to create item")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+		return
+	}
+	defer tx.Rollback()
+
+	book, err := queryBook(tx, c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+		return
+	}
+	item.BookID = book.ID
+	if err := checkItemBranches(tx, item); err != nil {
+		respondCirculationError(c, err, "Failed to create item")
+		return
+	}
+
+	r, err := tx.Exec(`INSERT INTO items (book_id, barcode, home_branch_id, current_branch_id, shelf, condition, item_type, status)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.BookID, item.Barcode, item.HomeBranchID, item.CurrentBranchID, item.Shelf, item.Condition, item.ItemType, item.Status)
+	if err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Barcode already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+		return
+	}
+	id, _ := r.LastInsertId()
+	item.ID = uint(id)
+
+	// A new copy goes to the first patron waiting for the book
+	if item.Status == itemAvailable {
+		hold, err := trapItemForHold(tx, item)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+			return
+		}
+		if hold != nil {
+			item.Status = itemOnHold
+		}
+	}
+
+	if err := recordAudit(tx, c, auditCreate, "item", item.ID, nil, item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create item"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, item)
+}
+
+func updateItem(c *gin.Context) {
+	var item Item
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateItem(&item); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := queryItem(tx, c.Param("id"), c.Param("item_id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+		return
+	}
+	item.ID = before.ID
+	item.BookID = before.BookID
+
+	// Lending, returning, holds and transfers go through circulation
+	if before.Status != item.Status && (isCirculationStatus(before.Status) || isCirculationStatus(item.Status)) {
+		respondCirculationError(c, errItemStatusLocked, "Failed to update item")
+		return
+	}
+	if before.Status == itemInTransit && item.CurrentBranchID != before.CurrentBranchID {
+		respondCirculationError(c, errItemStatusLocked, "Failed to update item")
+		return
+	}
+	if err := checkItemBranches(tx, item); err != nil {
+		respondCirculationError(c, err, "Failed to update item")
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE items SET barcode = ?, home_branch_id = ?, current_branch_id = ?, shelf = ?, condition = ?, item_type = ?, status = ?
+					WHERE id = ?`,
+		item.Barcode, item.HomeBranchID, item.CurrentBranchID, item.Shelf, item.Condition, item.ItemType, item.Status, item.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Barcode already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+		return
+	}
+
+	// So does a copy coming back on the shelf, say one found after being lost
+	if item.Status == itemAvailable && before.Status != itemAvailable {
+		hold, err := trapItemForHold(tx, item)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+			return
+		}
+		if hold != nil {
+			item.Status = itemOnHold
+		}
+	}
+
+	if err := recordAudit(tx, c, auditUpdate, "item", item.ID, before, item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+func deleteItem(c *gin.Context) {
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := queryItem(tx, c.Param("id"), c.Param("item_id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+
+	// A copy on the hold shelf is cancelled through its hold first
+	if before.Status == itemOnHold {
+		respondCirculationError(c, errItemStatusLocked, "Failed to delete item")
+		return
+	}
+
+	// Keep the loan, hold, interlibrary loan and transfer history intact
+	var history int
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM loans WHERE item_id = ?) + (SELECT COUNT(*) FROM holds WHERE item_id = ?) +
+					(SELECT COUNT(*) FROM ill_requests WHERE item_id = ?) + (SELECT COUNT(*) FROM transfers WHERE item_id = ?)`,
+		before.ID, before.ID, before.ID, before.ID).Scan(&history)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+	if history > 0 {
+		respondCirculationError(c, errItemHasHistory, "Failed to delete item")
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM items WHERE id = ?", before.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+
+	if err := recordAudit(tx, c, auditDelete, "item", before.ID, before, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
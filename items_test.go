@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestItemCRUD(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+	doJSON("POST", "/books", "", Book{Title: "Book 1", PublishedYear: 2022, ISBN: "123456789011x"})
+	createTestBranch(t, "main")
+
+	recorder := doJSON("POST", "/api/books/1/items", librarian, Item{Barcode: "30001", HomeBranchID: 1, Shelf: "A1", Condition: "new"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	expectedResponseBody := `{"id":1,"book_id":1,"barcode":"30001","home_branch_id":1,"current_branch_id":1,"shelf":"A1","condition":"new","item_type":"book","status":"available"}`
+	if recorder.Body.String() != expectedResponseBody {
+		t.Errorf("Expected response body '%s', but got '%s'", expectedResponseBody, recorder.Body.String())
+	}
+
+	// Barcodes are unique across all books
+	recorder = doJSON("POST", "/api/books/1/items", librarian, Item{Barcode: "30001", HomeBranchID: 1})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/books/1/items", librarian, Item{Barcode: "30002"})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/books/1/items", librarian, Item{Barcode: "30002", HomeBranchID: 9})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/books/2/items", librarian, Item{Barcode: "30002", HomeBranchID: 1})
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("PUT", "/api/books/1/items/1", librarian, Item{Barcode: "30001", HomeBranchID: 1, Shelf: "B2", Status: itemLost})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("PUT", "/api/books/1/items/1", librarian, Item{Barcode: "30001", HomeBranchID: 1, Status: "misplaced"})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("GET", "/api/books/1/items", librarian, nil)
+	var items []Item
+	json.NewDecoder(recorder.Body).Decode(&items)
+	if len(items) != 1 || items[0].Shelf != "B2" || items[0].Status != itemLost {
+		t.Errorf("Unexpected items %+v", items)
+	}
+
+	// Items belong to their book
+	recorder = doJSON("GET", "/api/books/2/items/1", librarian, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+
+	// A book with copies cannot be deleted
+	recorder = doJSON("DELETE", "/api/books/1", admin, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("DELETE", "/api/books/1/items/1", librarian, nil)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+	recorder = doJSON("DELETE", "/api/books/1/items/1", admin, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+	recorder = doJSON("DELETE", "/api/books/1", admin, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+}
+
+func TestBookAvailability(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	doJSON("POST", "/books", "", Book{Title: "Book 1", PublishedYear: 2022, ISBN: "123456789011x"})
+	createTestBranch(t, "main")
+
+	for _, item := range []Item{
+		{Barcode: "30001", HomeBranchID: 1},
+		{Barcode: "30002", HomeBranchID: 1},
+		{Barcode: "30003", HomeBranchID: 1, Status: itemLost},
+		{Barcode: "30004", HomeBranchID: 1, Status: itemWithdrawn},
+	} {
+		doJSON("POST", "/api/books/1/items", librarian, item)
+	}
+
+	recorder := doJSON("GET", "/api/books/1", librarian, nil)
+	expectedResponseBody := `{"id":1,"title":"Book 1","published_year":2022,"isbn":"123456789011x",` +
+		`"availability":{"total":3,"available":2,"by_status":{"available":2,"lost":1,"withdrawn":1},` +
+		`"by_branch":[{"branch_id":1,"code":"main","name":"Branch main","total":3,"available":2}]}}`
+	if recorder.Body.String() != expectedResponseBody {
+		t.Errorf("Expected response body '%s', but got '%s'", expectedResponseBody, recorder.Body.String())
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{} // nil for keys kept only to verify
+	verifyKey interface{}
+}
+
+// Keys accepted for verification, looked up by the kid header
+type keySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var signingKeys *keySet
+
+// JSON Web Key as served from /.well-known/jwks.json
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Build the key set from configuration. Without configured keys a single
+// HS256 key is taken from LIBRARY_JWT_SECRET, or generated for this process.
+func loadKeySet(c JWTConfig) (*keySet, error) {
+	keyConfigs := c.Keys
+	signingKID := c.SigningKID
+
+	if len(keyConfigs) == 0 {
+		secret := os.Getenv("LIBRARY_JWT_SECRET")
+		if secret == "" {
+			log.Println("No signing keys configured, tokens will not survive a restart")
+			generated, err := randomToken(32)
+			if err != nil {
+				return nil, err
+			}
+			secret = generated
+		}
+		keyConfigs = []KeyConfig{{KID: "default", Alg: "HS256", Secret: secret}}
+		signingKID = "default"
+	}
+
+	ks := &keySet{keys: make(map[string]*signingKey)}
+	for _, kc := range keyConfigs {
+		key, err := loadSigningKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kc.KID, err)
+		}
+		if _, ok := ks.keys[key.kid]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.kid)
+		}
+		ks.keys[key.kid] = key
+	}
+
+	if signingKID == "" && len(keyConfigs) == 1 {
+		signingKID = keyConfigs[0].KID
+	}
+	ks.active = ks.keys[signingKID]
+	if ks.active == nil {
+		return nil, fmt.Errorf("signing key %q is not configured", signingKID)
+	}
+	if ks.active.signKey == nil {
+		return nil, fmt.Errorf("signing key %q has no private key", signingKID)
+	}
+
+	return ks, nil
+}
+
+func loadSigningKey(kc KeyConfig) (*signingKey, error) {
+	if kc.KID == "" {
+		return nil, errors.New("missing kid")
+	}
+
+	method := jwt.GetSigningMethod(kc.Alg)
+	if method == nil || method == jwt.SigningMethodNone {
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Alg)
+	}
+	key := &signingKey{kid: kc.KID, method: method}
+
+	switch m := method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if kc.Secret == "" {
+			return nil, errors.New("missing secret")
+		}
+		key.signKey = []byte(kc.Secret)
+		key.verifyKey = key.signKey
+
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		private, public, err := readKeyFiles(kc)
+		if err != nil {
+			return nil, err
+		}
+		if private != nil {
+			rsaPrivate, ok := private.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("not an RSA private key")
+			}
+			key.signKey = rsaPrivate
+			public = &rsaPrivate.PublicKey
+		}
+		rsaPublic, ok := public.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		key.verifyKey = rsaPublic
+
+	case *jwt.SigningMethodECDSA:
+		private, public, err := readKeyFiles(kc)
+		if err != nil {
+			return nil, err
+		}
+		if private != nil {
+			ecPrivate, ok := private.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("not an EC private key")
+			}
+			key.signKey = ecPrivate
+			public = &ecPrivate.PublicKey
+		}
+		ecPublic, ok := public.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an EC public key")
+		}
+		if ecPublic.Curve.Params().BitSize != m.CurveBits {
+			return nil, fmt.Errorf("%s needs a %d-bit curve", kc.Alg, m.CurveBits)
+		}
+		key.verifyKey = ecPublic
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Alg)
+	}
+
+	return key, nil
+}
+
+// Read the PEM key files of an asymmetric key, preferring the private key
+func readKeyFiles(kc KeyConfig) (private interface{}, public interface{}, err error) {
+	var block *pem.Block
+
+	switch {
+	case kc.PrivateKeyFile != "":
+		if block, err = readPEM(kc.PrivateKeyFile); err != nil {
+			return nil, nil, err
+		}
+		if private, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			return private, nil, nil
+		}
+		if private, err = x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			return private, nil, nil
+		}
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+		return private, nil, err
+
+	case kc.PublicKeyFile != "":
+		if block, err = readPEM(kc.PublicKeyFile); err != nil {
+			return nil, nil, err
+		}
+		if public, err = x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+			return nil, public, nil
+		}
+		public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		return nil, public, err
+	}
+
+	return nil, nil, errors.New("missing private_key_file or public_key_file")
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+// Sign claims with the active key, naming it in the kid header
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.kid
+	return token.SignedString(ks.active.signKey)
+}
+
+// Resolve the verification key of a token; the algorithm must match the key
+func (ks *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown key id")
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.verifyKey, nil
+}
+
+// Public keys of the set; shared secrets are never published
+func (ks *keySet) jwks() []jwk {
+	keys := []jwk{}
+	for _, key := range ks.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jwk{
+				Kty: "RSA",
+				Kid: key.kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			keys = append(keys, jwk{
+				Kty: "EC",
+				Kid: key.kid,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				Crv: public.Curve.Params().Name,
+				X:   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size))),
+				Y:   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size))),
+			})
+		}
+	}
+	return keys
+}
+
+// Decode the public key of a JSON Web Key published by another issuer
+func parseJWK(key jwk) (interface{}, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+}
+
+// Handlers
+
+func getJWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": signingKeys.jwks()})
+}
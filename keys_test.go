@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Helper function to write PEM encoded private and public keys to a temporary directory
+func writeKeyPair(t *testing.T, name string, private interface{}, public interface{}) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateFile := filepath.Join(dir, name+".key")
+	publicFile := filepath.Join(dir, name+".pub")
+	os.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	os.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600)
+	return privateFile, publicFile
+}
+
+func TestKeyRotation(t *testing.T) {
+	setupIsolated(t)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaPrivate, rsaPublic := writeKeyPair(t, "rsa", rsaKey, &rsaKey.PublicKey)
+	ecPrivate, _ := writeKeyPair(t, "ec", ecKey, &ecKey.PublicKey)
+	user := User{ID: 1, Username: "alice", Role: roleMember}
+
+	// Sign with the RSA key first
+	keys, err := loadKeySet(JWTConfig{
+		SigningKID: "2023",
+		Keys:       []KeyConfig{{KID: "2023", Alg: "RS256", PrivateKeyFile: rsaPrivate}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKeys = keys
+	oldToken, err := issueAccessToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to the EC key, keeping only the public half of the RSA key
+	keys, err = loadKeySet(JWTConfig{
+		SigningKID: "2024",
+		Keys: []KeyConfig{
+			{KID: "2023", Alg: "RS256", PublicKeyFile: rsaPublic},
+			{KID: "2024", Alg: "ES256", PrivateKeyFile: ecPrivate},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKeys = keys
+	newToken, err := issueAccessToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := parseAccessToken(token); err != nil {
+			t.Errorf("Expected token to verify, but got %v", err)
+		}
+	}
+
+	parsed, _ := jwt.Parse(newToken, signingKeys.keyFunc)
+	if parsed.Header["kid"] != "2024" || parsed.Method.Alg() != "ES256" {
+		t.Errorf("Expected an ES256 token from key 2024, but got %v", parsed.Header)
+	}
+
+	// Dropping the old key logs out its tokens
+	keys, _ = loadKeySet(JWTConfig{Keys: []KeyConfig{{KID: "2024", Alg: "ES256", PrivateKeyFile: ecPrivate}}})
+	signingKeys = keys
+	if _, err := parseAccessToken(oldToken); err == nil {
+		t.Error("Expected token from a removed key to be rejected")
+	}
+}
+
+func TestKeySetErrors(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaPrivate, rsaPublic := writeKeyPair(t, "rsa", rsaKey, &rsaKey.PublicKey)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ecPrivate, _ := writeKeyPair(t, "ec", ecKey, &ecKey.PublicKey)
+
+	tests := []struct {
+		name   string
+		config JWTConfig
+	}{
+		{"unknown algorithm", JWTConfig{Keys: []KeyConfig{{KID: "a", Alg: "none", Secret: "x"}}}},
+		{"missing secret", JWTConfig{Keys: []KeyConfig{{KID: "a", Alg: "HS256"}}}},
+		{"wrong curve", JWTConfig{Keys: []KeyConfig{{KID: "a", Alg: "ES256", PrivateKeyFile: ecPrivate}}}},
+		{"verify-only signing key", JWTConfig{Keys: []KeyConfig{{KID: "a", Alg: "RS256", PublicKeyFile: rsaPublic}}}},
+		{"unknown signing key", JWTConfig{SigningKID: "b", Keys: []KeyConfig{{KID: "a", Alg: "RS256", PrivateKeyFile: rsaPrivate}}}},
+		{"duplicate key id", JWTConfig{SigningKID: "a", Keys: []KeyConfig{
+			{KID: "a", Alg: "HS256", Secret: "x"},
+			{KID: "a", Alg: "RS256", PrivateKeyFile: rsaPrivate},
+		}}},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadKeySet(tt.config); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	setupIsolated(t)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, rsaPublic := writeKeyPair(t, "rsa", rsaKey, &rsaKey.PublicKey)
+	rsaPublicPEM, _ := os.ReadFile(rsaPublic)
+
+	keys, _ := loadKeySet(JWTConfig{
+		SigningKID: "hs",
+		Keys: []KeyConfig{
+			{KID: "hs", Alg: "HS256", Secret: "secret"},
+			{KID: "rs", Alg: "RS256", PublicKeyFile: rsaPublic},
+		},
+	})
+	signingKeys = keys
+
+	// An HS256 token keyed with the RSA public key must not pass as the RSA key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{StandardClaims: jwt.StandardClaims{Id: "x", ExpiresAt: now().Unix() + 60}})
+	forged.Header["kid"] = "rs"
+	tokenString, _ := forged.SignedString(rsaPublicPEM)
+	if _, err := parseAccessToken(tokenString); err == nil {
+		t.Error("Expected forged token to be rejected")
+	}
+}
+
+func TestGetJWKS(t *testing.T) {
+	setupIsolated(t)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaPrivate, _ := writeKeyPair(t, "rsa", rsaKey, &rsaKey.PublicKey)
+	_, ecPublic := writeKeyPair(t, "ec", ecKey, &ecKey.PublicKey)
+
+	keys, _ := loadKeySet(JWTConfig{
+		SigningKID: "rs",
+		Keys: []KeyConfig{
+			{KID: "rs", Alg: "RS256", PrivateKeyFile: rsaPrivate},
+			{KID: "es", Alg: "ES256", PublicKeyFile: ecPublic},
+			{KID: "hs", Alg: "HS256", Secret: "secret"},
+		},
+	})
+	signingKeys = keys
+
+	recorder := doJSON("GET", "/.well-known/jwks.json", "", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	var body struct {
+		Keys []jwk `json:"keys"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&body)
+
+	found := map[string]jwk{}
+	for _, key := range body.Keys {
+		found[key.Kid] = key
+	}
+	if len(found) != 2 {
+		t.Fatalf("Expected the RSA and EC public keys only, but got %+v", body.Keys)
+	}
+	if found["rs"].Kty != "RSA" || found["rs"].E != "AQAB" || found["rs"].N == "" {
+		t.Errorf("Unexpected RSA key %+v", found["rs"])
+	}
+	if found["es"].Kty != "EC" || found["es"].Crv != "P-256" || len(found["es"].X) != 43 || len(found["es"].Y) != 43 {
+		t.Errorf("Unexpected EC key %+v", found["es"])
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// The subset of *ldap.Conn used to authenticate
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// Authenticates by binding to the directory as the user, then keeps a local
+// account in sync so the user can be issued library tokens
+type ldapAuthenticator struct {
+	config LDAPConfig
+	dial   func() (ldapConn, error)
+}
+
+// Most privileged first, used when a user is in several mapped groups
+var rolePrecedence = []string{roleAdmin, roleLibrarian, roleMember, roleReadOnly}
+
+func newLDAPAuthenticator(c LDAPConfig) (*ldapAuthenticator, error) {
+	if c.URL == "" {
+		return nil, errors.New("ldap: missing url")
+	}
+	if c.UserDNTemplate == "" && (c.BaseDN == "" || c.UserFilter == "") {
+		return nil, errors.New("ldap: either user_dn_template or base_dn and user_filter are required")
+	}
+	for group, role := range c.GroupRoles {
+		if !isValidRole(role) {
+			return nil, fmt.Errorf("ldap: group %q maps to unknown role %q", group, role)
+		}
+	}
+	if c.DefaultRole != "" && !isValidRole(c.DefaultRole) {
+		return nil, fmt.Errorf("ldap: unknown default role %q", c.DefaultRole)
+	}
+
+	a := &ldapAuthenticator{config: c}
+	a.dial = a.dialDirectory
+	return a, nil
+}
+
+func (a *ldapAuthenticator) dialDirectory() (ldapConn, error) {
+	conn, err := ldap.DialURL(a.config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.StartTLS {
+		u, _ := url.Parse(a.config.URL)
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (User, error) {
+	// An empty password would be an unauthenticated bind, which always succeeds
+	if username == "" || password == "" {
+		return User{}, errInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	userDN, err := a.findUserDN(conn, username)
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return User{}, errInvalidCredentials
+		}
+		return User{}, err
+	}
+
+	role, err := a.mapRole(conn, userDN)
+	if err != nil {
+		return User{}, err
+	}
+
+	return a.syncDirectoryUser(userDN, username, role)
+}
+
+// Build the user's DN from the template, or search for it with the service account
+func (a *ldapAuthenticator) findUserDN(conn ldapConn, username string) (string, error) {
+	if a.config.UserDNTemplate != "" {
+		return fmt.Sprintf(a.config.UserDNTemplate, ldap.EscapeDN(username)), nil
+	}
+
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return "", err
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", errInvalidCredentials
+		}
+		return "", err
+	}
+	if len(result.Entries) != 1 {
+		return "", errInvalidCredentials
+	}
+	return result.Entries[0].DN, nil
+}
+
+// Pick the most privileged role among the user's groups, falling back to
+// the default role. Users without any role are refused.
+func (a *ldapAuthenticator) mapRole(conn ldapConn, userDN string) (string, error) {
+	if len(a.config.GroupRoles) == 0 {
+		if a.config.DefaultRole == "" {
+			return roleMember, nil
+		}
+		return a.config.DefaultRole, nil
+	}
+
+	groups, err := a.userGroups(conn, userDN)
+	if err != nil {
+		return "", err
+	}
+
+	matched := map[string]bool{}
+	for group, role := range a.config.GroupRoles {
+		for _, g := range groups {
+			if strings.EqualFold(g, group) {
+				matched[role] = true
+			}
+		}
+	}
+	for _, role := range rolePrecedence {
+		if matched[role] {
+			return role, nil
+		}
+	}
+
+	if a.config.DefaultRole == "" {
+		return "", errInvalidCredentials
+	}
+	return a.config.DefaultRole, nil
+}
+
+// DNs of the groups the user is a member of, found with the group filter
+// or read from the user's memberOf attribute
+func (a *ldapAuthenticator) userGroups(conn ldapConn, userDN string) ([]string, error) {
+	if a.config.GroupFilter != "" {
+		result, err := conn.Search(ldap.NewSearchRequest(
+			a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(a.config.GroupFilter, ldap.EscapeFilter(userDN)),
+			[]string{"dn"}, nil,
+		))
+		if err != nil {
+			return nil, err
+		}
+
+		var groups []string
+		for _, entry := range result.Entries {
+			groups = append(groups, entry.DN)
+		}
+		return groups, nil
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", []string{"memberOf"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	return result.Entries[0].GetAttributeValues("memberOf"), nil
+}
+
+// Create or update the local account of a directory user, linked to its
+// DN so later logins find it whatever its username. Directory users get no
+// local password, and their role follows the directory. A local account
+// that already has the username is never adopted, since anyone could have
+// registered it; the directory login is refused instead.
+func (a *ldapAuthenticator) syncDirectoryUser(userDN, username, role string) (User, error) {
+	issuer := "ldap:" + a.config.URL
+	subject := strings.ToLower(userDN)
+
+	var user User
+	err := withTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT u.id, u.username, COALESCE(u.email, ''), u.role, u.disabled FROM users AS u
+							INNER JOIN user_identities AS ui ON u.id = ui.user_id
+							WHERE ui.issuer = ? AND ui.subject = ?`, issuer, subject).
+			Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Disabled)
+		if err == sql.ErrNoRows {
+			// Accounts made by directory logins before they were linked have
+			// no password and no identity, and are taken over
+			var hash string
+			err = tx.QueryRow(`SELECT id, username, COALESCE(email, ''), password_hash, role, disabled FROM users
+								WHERE username = ? AND NOT EXISTS (SELECT 1 FROM user_identities WHERE user_id = users.id)`, username).
+				Scan(&user.ID, &user.Username, &user.Email, &hash, &user.Role, &user.Disabled)
+			if err == sql.ErrNoRows {
+				user, err = insertUser(tx, User{Username: username, Role: role}, "")
+				if err == errUsernameTaken {
+					return errInvalidCredentials
+				}
+			} else if err == nil && hash != "" {
+				return errInvalidCredentials
+			}
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)",
+				issuer, subject, user.ID, now())
+		}
+		if err != nil {
+			return err
+		}
+
+		if user.Role != role {
+			if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, user.ID); err != nil {
+				return err
+			}
+			user.Role = role
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
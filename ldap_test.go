@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// In-process stand-in for a directory server
+type fakeDirectory map[string]fakeEntry
+
+type fakeEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+type fakeLDAPConn struct {
+	dir   fakeDirectory
+	bound bool
+}
+
+func (c *fakeLDAPConn) Bind(dn, password string) error {
+	// Like a real server, an empty password is an anonymous bind
+	if password == "" {
+		c.bound = false
+		return nil
+	}
+
+	entry, ok := c.dir[strings.ToLower(dn)]
+	if !ok || entry.password != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.bound = true
+	return nil
+}
+
+// Supports single equality filters such as (uid=alice) and (objectClass=*)
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if !c.bound {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("bind required"))
+	}
+
+	attr, value, _ := strings.Cut(strings.Trim(req.Filter, "()"), "=")
+	value = strings.NewReplacer(`\28`, "(", `\29`, ")", `\2a`, "*", `\5c`, `\`).Replace(value)
+	base := strings.ToLower(req.BaseDN)
+
+	result := &ldap.SearchResult{}
+	for dn, entry := range c.dir {
+		if req.Scope == ldap.ScopeBaseObject && dn != base || !strings.HasSuffix(dn, base) {
+			continue
+		}
+		matches := value == "*"
+		for _, v := range entry.attrs[attr] {
+			matches = matches || strings.EqualFold(v, value)
+		}
+		if !matches {
+			continue
+		}
+
+		e := &ldap.Entry{DN: dn}
+		for _, name := range req.Attributes {
+			e.Attributes = append(e.Attributes, &ldap.EntryAttribute{Name: name, Values: entry.attrs[name]})
+		}
+		result.Entries = append(result.Entries, e)
+	}
+	return result, nil
+}
+
+func (c *fakeLDAPConn) Close() error {
+	return nil
+}
+
+func testDirectory() fakeDirectory {
+	return fakeDirectory{
+		"cn=reader,dc=example,dc=org": {password: "service password"},
+		"uid=alice,ou=people,dc=example,dc=org": {password: "alice password", attrs: map[string][]string{
+			"uid":      {"alice"},
+			"memberOf": {"cn=Staff,ou=groups,dc=example,dc=org"},
+		}},
+		"uid=bob,ou=people,dc=example,dc=org": {password: "bob password", attrs: map[string][]string{
+			"uid": {"bob"},
+		}},
+		"cn=staff,ou=groups,dc=example,dc=org": {attrs: map[string][]string{
+			"member": {"uid=alice,ou=people,dc=example,dc=org"},
+		}},
+	}
+}
+
+// Helper function to route /login through an LDAP authenticator backed by dir
+func useLDAP(t *testing.T, c LDAPConfig, dir fakeDirectory) {
+	t.Helper()
+	ldapAuth, err := newLDAPAuthenticator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldapAuth.dial = func() (ldapConn, error) { return &fakeLDAPConn{dir: dir}, nil }
+
+	authenticator = chainAuthenticator{ldapAuth, localAuthenticator{}}
+	t.Cleanup(func() { authenticator = localAuthenticator{} })
+}
+
+func TestLDAPDirectBind(t *testing.T) {
+	setupIsolated(t)
+	useLDAP(t, LDAPConfig{
+		URL:            "ldap://directory.example.org",
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+		GroupRoles:     map[string]string{"cn=staff,ou=groups,dc=example,dc=org": roleLibrarian},
+		DefaultRole:    roleReadOnly,
+	}, testDirectory())
+
+	token := loginPair(t, "alice", "alice password")
+	claims, _ := parseAccessToken(token.Token)
+	if claims == nil || claims.Username != "alice" || claims.Role != roleLibrarian {
+		t.Errorf("Expected a librarian token for alice, but got %+v", claims)
+	}
+
+	// Users outside the mapped groups get the default role
+	token = loginPair(t, "bob", "bob password")
+	claims, _ = parseAccessToken(token.Token)
+	if claims == nil || claims.Role != roleReadOnly {
+		t.Errorf("Expected a readonly token for bob, but got %+v", claims)
+	}
+
+	// The local account has no password of its own
+	user, hash, err := getUserByUsername("alice")
+	if err != nil || hash != "" || user.Role != roleLibrarian {
+		t.Errorf("Unexpected local account %+v", user)
+	}
+
+	for _, password := range []string{"wrong password", ""} {
+		recorder := doJSON("POST", "/login", "", User{Username: "alice", Password: password})
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for password %q, but got %d", password, recorder.Code)
+		}
+	}
+}
+
+func TestLDAPSearchBind(t *testing.T) {
+	setupIsolated(t)
+	useLDAP(t, LDAPConfig{
+		URL:          "ldap://directory.example.org",
+		BindDN:       "cn=reader,dc=example,dc=org",
+		BindPassword: "service password",
+		BaseDN:       "ou=people,dc=example,dc=org",
+		UserFilter:   "(uid=%s)",
+		GroupBaseDN:  "ou=groups,dc=example,dc=org",
+		GroupFilter:  "(member=%s)",
+		GroupRoles:   map[string]string{"cn=staff,ou=groups,dc=example,dc=org": roleAdmin},
+	}, testDirectory())
+
+	token := loginPair(t, "alice", "alice password")
+	claims, _ := parseAccessToken(token.Token)
+	if claims == nil || claims.Role != roleAdmin {
+		t.Errorf("Expected an admin token for alice, but got %+v", claims)
+	}
+
+	// Without a default role, users outside the mapped groups are refused
+	recorder := doJSON("POST", "/login", "", User{Username: "bob", Password: "bob password"})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	// Local accounts still work behind the directory
+	createUser("carol", "carol password", roleMember)
+	loginPair(t, "carol", "carol password")
+
+	// A directory login never takes over a local account of the same name
+	doJSON("POST", "/register", "", User{Username: "dave", Password: "chosen password"})
+	dir := testDirectory()
+	dir["uid=dave,ou=people,dc=example,dc=org"] = fakeEntry{password: "dave password", attrs: map[string][]string{
+		"uid":      {"dave"},
+		"memberOf": {"cn=staff,ou=groups,dc=example,dc=org"},
+	}}
+	useLDAP(t, LDAPConfig{
+		URL:            "ldap://directory.example.org",
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org",
+		GroupRoles:     map[string]string{"cn=staff,ou=groups,dc=example,dc=org": roleAdmin},
+	}, dir)
+	recorder = doJSON("POST", "/login", "", User{Username: "dave", Password: "dave password"})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+	token = loginPair(t, "dave", "chosen password")
+	claims, _ = parseAccessToken(token.Token)
+	if claims == nil || claims.Role != roleMember {
+		t.Errorf("Expected the local account to stay a member, but got %+v", claims)
+	}
+}
+
+func TestConfigureAuthenticator(t *testing.T) {
+	t.Cleanup(func() { authenticator = localAuthenticator{} })
+
+	if err := configureAuthenticator(AuthConfig{Backends: []string{"kerberos"}}); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+	if err := configureAuthenticator(AuthConfig{Backends: []string{"ldap"}}); err == nil {
+		t.Error("Expected an error for an LDAP backend without a URL")
+	}
+	if err := configureAuthenticator(AuthConfig{Backends: []string{"ldap"}, LDAP: LDAPConfig{
+		URL:            "ldap://directory.example.org",
+		UserDNTemplate: "uid=%s,dc=example,dc=org",
+		GroupRoles:     map[string]string{"cn=staff": "superuser"},
+	}}); err == nil {
+		t.Error("Expected an error for an unknown role")
+	}
+
+	if err := configureAuthenticator(AuthConfig{Backends: []string{"ldap", "local"}, LDAP: LDAPConfig{
+		URL:            "ldap://directory.example.org",
+		UserDNTemplate: "uid=%s,dc=example,dc=org",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if chain, ok := authenticator.(chainAuthenticator); !ok || len(chain) != 2 {
+		t.Errorf("Expected a chain of two authenticators, but got %T", authenticator)
+	}
+}
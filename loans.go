@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errItemNotFound     = errors.New("item not found")
+	errItemUnavailable  = errors.New("item is not available")
+	errPatronNotFound   = errors.New("patron not found")
+	errPatronBlocked    = errors.New("patron is blocked")
+	errLoanNotFound     = errors.New("loan not found")
+	errLoanClosed       = errors.New("loan already returned")
+	errItemNotOnLoan    = errors.New("item is not on loan")
+	errRenewalLimit     = errors.New("renewal limit reached")
+	errItemHasHistory   = errors.New("item has circulation history")
+	errItemStatusLocked = errors.New("item status is managed by circulation")
+	errBookNotFound     = errors.New("book not found")
+	errBarcodeInUse     = errors.New("barcode already in use")
+)
+
+type Loan struct {
+	ID           uint       `json:"id"`
+	ItemID       uint       `json:"item_id"`
+	BookID       uint       `json:"book_id"`
+	Barcode      string     `json:"barcode"`
+	PatronID     uint       `json:"patron_id"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	DueAt        time.Time  `json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty"`
+	Renewals     int        `json:"renewals"`
+	Overdue      bool       `json:"overdue"`
+	Lost         bool       `json:"lost,omitempty"`
+
+	// Set in the response to the change that caused them
+	Hold *Hold `json:"hold,omitempty"`
+	Fine int64 `json:"fine,omitempty"`
+}
+
+// Create the loans table
+func createLoanTables() {
+	loansTableSQL := `
+		CREATE TABLE IF NOT EXISTS loans (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			item_id INTEGER NOT NULL,
+			patron_id INTEGER NOT NULL,
+			checked_out_at DATETIME NOT NULL,
+			due_at DATETIME NOT NULL,
+			returned_at DATETIME,
+			renewals INTEGER NOT NULL DEFAULT 0,
+			lost INTEGER NOT NULL DEFAULT 0,
+			prior_fines INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (item_id) REFERENCES items (id),
+			FOREIGN KEY (patron_id) REFERENCES patrons (id)
+		);
+		CREATE INDEX IF NOT EXISTS loans_item ON loans (item_id);
+		CREATE INDEX IF NOT EXISTS loans_patron ON loans (patron_id);
+		CREATE UNIQUE INDEX IF NOT EXISTS loans_open_item ON loans (item_id) WHERE returned_at IS NULL;`
+	_, err = db.Exec(loansTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create loans table:", err)
+	}
+}
+
+const loanColumns = `l.id, l.item_id, i.book_id, i.barcode, l.patron_id, l.checked_out_at, l.due_at, l.returned_at, l.renewals, l.lost
+					FROM loans AS l INNER JOIN items AS i ON i.id = l.item_id`
+
+func scanLoan(row interface{ Scan(...interface{}) error }) (Loan, error) {
+	var (
+		loan       Loan
+		returnedAt sql.NullTime
+	)
+	err := row.Scan(&loan.ID, &loan.ItemID, &loan.BookID, &loan.Barcode, &loan.PatronID,
+		&loan.CheckedOutAt, &loan.DueAt, &returnedAt, &loan.Renewals, &loan.Lost)
+	loan.ReturnedAt = nullTimePtr(returnedAt)
+	loan.Overdue = loan.ReturnedAt == nil && loan.DueAt.Before(now())
+	return loan, err
+}
+
+func queryLoan(q querier, id interface{}) (Loan, error) {
+	loan, err := scanLoan(q.QueryRow("SELECT "+loanColumns+" WHERE l.id = ?", id))
+	if err == sql.ErrNoRows {
+		return loan, errLoanNotFound
+	}
+	return loan, err
+}
+
+func queryLoans(q querier, where string, args ...interface{}) ([]Loan, error) {
+	rows, err := q.Query("SELECT "+loanColumns+" "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loans := []Loan{}
+	for rows.Next() {
+		loan, err := scanLoan(rows)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, loan)
+	}
+	return loans, rows.Err()
+}
+
+// Find an item by ID, or by barcode when itemID is zero
+func lookupItem(q querier, itemID uint, barcode string) (Item, error) {
+	var row *sql.Row
+	if itemID != 0 {
+		row = q.QueryRow("SELECT "+itemColumns+" FROM items WHERE id = ?", itemID)
+	} else {
+		row = q.QueryRow("SELECT "+itemColumns+" FROM items WHERE barcode = ?", barcode)
+	}
+	item, err := scanItem(row)
+	if err == sql.ErrNoRows {
+		return item, errItemNotFound
+	}
+	return item, err
+}
+
+// The open loan of an item
+func openLoanForItem(q querier, itemID uint) (Loan, error) {
+	loan, err := scanLoan(q.QueryRow("SELECT "+loanColumns+" WHERE l.item_id = ? AND l.returned_at IS NULL", itemID))
+	if err == sql.ErrNoRows {
+		return loan, errItemNotOnLoan
+	}
+	return loan, err
+}
+
+// Lend an available item to a patron, within the loan policy
+func checkoutItem(tx *sql.Tx, item Item, patronID uint) (Loan, error) {
+	policy, err := evaluateCheckout(tx, item, patronID)
+	if err != nil {
+		return Loan{}, err
+	}
+
+	// A copy on the hold shelf fulfils the hold it was set aside for
+	if item.Status == itemOnHold {
+		if err := collectHeldItem(tx, item, patronID); err != nil {
+			return Loan{}, err
+		}
+	}
+
+	// Only one open loan per item, whatever the status says
+	result, err := tx.Exec("UPDATE items SET status = ? WHERE id = ? AND status = ?", itemOnLoan, item.ID, itemAvailable)
+	if err != nil {
+		return Loan{}, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return Loan{}, errItemUnavailable
+	}
+
+	checkedOutAt := now()
+	dueAt, err := computeDueDate(tx, checkedOutAt, policy, item.CurrentBranchID)
+	if err != nil {
+		return Loan{}, err
+	}
+	if dueAt, err = capILLDueDate(tx, item, dueAt); err != nil {
+		return Loan{}, err
+	}
+	r, err := tx.Exec("INSERT INTO loans (item_id, patron_id, checked_out_at, due_at) VALUES (?, ?, ?, ?)",
+		item.ID, patronID, checkedOutAt, dueAt)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Loan{}, errItemUnavailable
+		}
+		return Loan{}, err
+	}
+	id, _ := r.LastInsertId()
+	if err := lendILLItem(tx, item.ID); err != nil {
+		return Loan{}, err
+	}
+
+	return queryLoan(tx, id)
+}
+
+// Close an open loan, charging any overdue fine, and put the item back on
+// the shelf, or on the hold shelf when a patron is waiting for the book.
+// Borrowed-in copies are kept aside for their partner library instead.
+func returnLoan(tx *sql.Tx, loanID interface{}) (Loan, error) {
+	loan, err := queryLoan(tx, loanID)
+	if err != nil {
+		return loan, err
+	}
+	if loan.ReturnedAt != nil {
+		return loan, errLoanClosed
+	}
+
+	returnedAt := now()
+	fine, err := chargeOverdueFine(tx, loan, returnedAt)
+	if err != nil {
+		return loan, err
+	}
+	if _, err := tx.Exec("UPDATE loans SET returned_at = ? WHERE id = ?", returnedAt, loan.ID); err != nil {
+		return loan, err
+	}
+	borrowed, err := holdForPartner(tx, loan.ItemID)
+	if err != nil {
+		return loan, err
+	}
+	var hold *Hold
+	if !borrowed {
+		if _, err := tx.Exec("UPDATE items SET status = ? WHERE id = ?", itemAvailable, loan.ItemID); err != nil {
+			return loan, err
+		}
+		if hold, err = trapItemForHold(tx, Item{ID: loan.ItemID, BookID: loan.BookID}); err != nil {
+			return loan, err
+		}
+	}
+
+	loan, err = queryLoan(tx, loan.ID)
+	loan.Hold = hold
+	loan.Fine = fine
+	return loan, err
+}
+
+// Close an open loan whose copy will not come back, charging the overdue
+// fine so far and the replacement fee
+func declareLoanLost(tx *sql.Tx, loanID interface{}) (Loan, error) {
+	loan, err := queryLoan(tx, loanID)
+	if err != nil {
+		return loan, err
+	}
+	if loan.ReturnedAt != nil {
+		return loan, errLoanClosed
+	}
+
+	closedAt := now()
+	fine, err := chargeOverdueFine(tx, loan, closedAt)
+	if err != nil {
+		return loan, err
+	}
+	fee, err := chargeLostFee(tx, loan)
+	if err != nil {
+		return loan, err
+	}
+	if _, err := tx.Exec("UPDATE loans SET returned_at = ?, lost = 1 WHERE id = ?", closedAt, loan.ID); err != nil {
+		return loan, err
+	}
+	if _, err := tx.Exec("UPDATE items SET status = ? WHERE id = ?", itemLost, loan.ItemID); err != nil {
+		return loan, err
+	}
+
+	loan, err = queryLoan(tx, loan.ID)
+	loan.Fine = fine + fee
+	return loan, err
+}
+
+// Extend an open loan by another loan period from today, within the loan
+// policy in force now and, for a borrowed-in copy, its partner's due date
+func renewLoan(tx *sql.Tx, loanID interface{}) (Loan, error) {
+	loan, err := queryLoan(tx, loanID)
+	if err != nil {
+		return loan, err
+	}
+	if loan.ReturnedAt != nil {
+		return loan, errLoanClosed
+	}
+	patron, err := lookupPatron(tx, loan.PatronID)
+	if err != nil {
+		return loan, err
+	}
+	item, err := lookupItem(tx, loan.ItemID, "")
+	if err != nil {
+		return loan, err
+	}
+	policy, err := resolveLoanPolicy(tx, patron, item)
+	if err != nil {
+		return loan, err
+	}
+	if loan.Renewals >= policy.MaxRenewals {
+		return loan, errRenewalLimit
+	}
+	waiting, err := hasWaitingHolds(tx, loan.BookID)
+	if err != nil {
+		return loan, err
+	}
+	if waiting {
+		return loan, errRenewalHoldsQueue
+	}
+	fine, err := settleOverdueFine(tx, loan, now())
+	if err != nil {
+		return loan, err
+	}
+
+	dueAt, err := computeDueDate(tx, now(), policy, item.CurrentBranchID)
+	if err != nil {
+		return loan, err
+	}
+	if dueAt, err = capILLDueDate(tx, item, dueAt); err != nil {
+		return loan, err
+	}
+
+	_, err = tx.Exec("UPDATE loans SET due_at = ?, renewals = renewals + 1 WHERE id = ?", dueAt, loan.ID)
+	if err != nil {
+		return loan, err
+	}
+
+	loan, err = queryLoan(tx, loan.ID)
+	loan.Fine = fine
+	return loan, err
+}
+
+// Responses for the errors circulation refuses a request with
+var circulationErrors = errorResponses{
+	errItemNotFound:     {http.StatusNotFound, "Item not found"},
+	errPatronNotFound:   {http.StatusNotFound, "Patron not found"},
+	errLoanNotFound:     {http.StatusNotFound, "Loan not found"},
+	errItemUnavailable:  {http.StatusConflict, "Item is not available"},
+	errLoanClosed:       {http.StatusConflict, "Loan already returned"},
+	errItemNotOnLoan:    {http.StatusConflict, "Item is not on loan"},
+	errRenewalLimit:     {http.StatusConflict, "Renewal limit reached"},
+	errItemHasHistory:   {http.StatusConflict, "Item has circulation history, withdraw it instead"},
+	errPatronBlocked:    {http.StatusForbidden, "Patron is blocked"},
+	errCardExpired:      {http.StatusForbidden, "Library card has expired"},
+	errPatronHasHistory: {http.StatusConflict, "Patron has circulation history"},
+	errUnknownUser:      {http.StatusBadRequest, "Unknown user account"},
+	errItemStatusLocked: {http.StatusBadRequest, "Item status is managed by circulation"},
+	errBookNotFound:     {http.StatusNotFound, "Book not found"},
+
+	errHoldNotFound:      {http.StatusNotFound, "Hold not found"},
+	errHoldClosed:        {http.StatusConflict, "Hold is no longer active"},
+	errHoldExists:        {http.StatusConflict, "Patron already has a hold on this book"},
+	errCopyAvailable:     {http.StatusConflict, "A copy is available, check it out instead"},
+	errBookNotHoldable:   {http.StatusConflict, "Book has no copies to hold"},
+	errItemHeldForOther:  {http.StatusConflict, "Item is held for another patron"},
+	errRenewalHoldsQueue: {http.StatusConflict, "Other patrons are waiting for this book"},
+
+	errLoanPolicyNotFound: {http.StatusNotFound, "Loan policy not found"},
+	errLoanLimit:          {http.StatusConflict, "Patron has reached the loan limit"},
+
+	errFinesOwed:      {http.StatusForbidden, "Patron owes more than the fine limit"},
+	errExceedsBalance: {http.StatusBadRequest, "Amount exceeds the balance"},
+	errBarcodeInUse:   {http.StatusConflict, "Barcode already in use"},
+}
+
+// Respond with the matching circulation error, falling back to the branch
+// errors of the branches copies and patrons belong to
+func respondCirculationError(c *gin.Context, err error, fallback string) {
+	respondError(c, err, fallback, circulationErrors, branchErrors)
+}
+
+// Handlers
+
+func createLoan(c *gin.Context) {
+	var body struct {
+		ItemID   uint   `json:"item_id"`
+		Barcode  string `json:"barcode"`
+		PatronID uint   `json:"patron_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if (body.ItemID == 0 && body.Barcode == "") || body.PatronID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	var loan Loan
+	err := withTx(func(tx *sql.Tx) error {
+		item, err := lookupItem(tx, body.ItemID, body.Barcode)
+		if err != nil {
+			return err
+		}
+		if loan, err = checkoutItem(tx, item, body.PatronID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "loan", loan.ID, nil, loan)
+	})
+	if err != nil {
+		respondCirculationError(c, err, "Failed to check out item")
+		return
+	}
+
+	c.JSON(http.StatusCreated, loan)
+}
+
+// Run a change to an existing loan and respond with the result
+func respondLoanChange(c *gin.Context, change func(tx *sql.Tx, loanID interface{}) (Loan, error), fallback string) {
+	var loan Loan
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryLoan(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if loan, err = change(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "loan", loan.ID, before, loan)
+	})
+	if err != nil {
+		respondCirculationError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, loan)
+}
+
+func returnLoanHandler(c *gin.Context) {
+	respondLoanChange(c, returnLoan, "Failed to return loan")
+}
+
+func renewLoanHandler(c *gin.Context) {
+	respondLoanChange(c, renewLoan, "Failed to renew loan")
+}
+
+func lostLoanHandler(c *gin.Context) {
+	respondLoanChange(c, declareLoanLost, "Failed to declare loan lost")
+}
+
+func getLoan(c *gin.Context) {
+	loan, err := queryLoan(db, c.Param("id"))
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve loan")
+		return
+	}
+
+	c.JSON(http.StatusOK, loan)
+}
+
+// List loans matching where, narrowed by the open and overdue query parameters
+func respondLoans(c *gin.Context, where string, args ...interface{}) {
+	if open, _ := strconv.ParseBool(c.Query("open")); open {
+		where += " AND l.returned_at IS NULL"
+	}
+	if overdue, _ := strconv.ParseBool(c.Query("overdue")); overdue {
+		where += " AND l.returned_at IS NULL AND l.due_at < ?"
+		args = append(args, now())
+	}
+
+	loans, err := queryLoans(db, where+" ORDER BY l.id DESC", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve loans"})
+		return
+	}
+
+	c.JSON(http.StatusOK, loans)
+}
+
+func getLoans(c *gin.Context) {
+	respondLoans(c, "WHERE 1 = 1")
+}
+
+func getPatronLoans(c *gin.Context) {
+	respondLoans(c, "WHERE l.patron_id = ?", c.Param("id"))
+}
+
+func getBookLoans(c *gin.Context) {
+	respondLoans(c, "WHERE i.book_id = ?", c.Param("id"))
+}
+
+func getAccountLoans(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondLoans(c, "WHERE l.patron_id = ?", patronID)
+}
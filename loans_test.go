@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Create a book with one available item per barcode, all at branch "main"
+func createTestItems(t *testing.T, token string, barcodes ...string) {
+	t.Helper()
+	recorder := doJSON("POST", "/api/books", token, Book{Title: "Book 1", PublishedYear: 2022, ISBN: "123456789011x"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	var book Book
+	json.NewDecoder(recorder.Body).Decode(&book)
+	createTestBranch(t, "main")
+
+	for _, barcode := range barcodes {
+		recorder := doJSON("POST", "/api/books/"+strconv.Itoa(int(book.ID))+"/items", token, Item{Barcode: barcode, HomeBranchID: 1})
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, but got %d", recorder.Code)
+		}
+	}
+}
+
+func checkout(t *testing.T, token string, body interface{}) (Loan, int) {
+	t.Helper()
+	recorder := doJSON("POST", "/api/loans", token, body)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	return loan, recorder.Code
+}
+
+func TestCheckoutAndReturn(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	patron := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001", "30002")
+
+	loan, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": patron.ID})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	if loan.ItemID != 1 || loan.BookID != 1 || loan.PatronID != patron.ID || loan.ReturnedAt != nil ||
+		!loan.DueAt.Equal(loan.CheckedOutAt.AddDate(0, 0, defaultLoanPolicy.LoanDays)) {
+		t.Errorf("Unexpected loan %+v", loan)
+	}
+
+	// The same copy cannot go out twice
+	if _, status := checkout(t, librarian, gin.H{"item_id": 1, "patron_id": patron.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "39999", "patron_id": patron.ID}); status != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", status)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": 99}); status != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", status)
+	}
+
+	recorder := doJSON("GET", "/api/books/1", librarian, nil)
+	var book Book
+	json.NewDecoder(recorder.Body).Decode(&book)
+	if book.Availability.Available != 1 || book.Availability.ByStatus[itemOnLoan] != 1 {
+		t.Errorf("Unexpected availability %+v", book.Availability)
+	}
+
+	// Circulation owns the on-loan status
+	recorder = doJSON("PUT", "/api/books/1/items/1", librarian, Item{Barcode: "30001", HomeBranchID: 1})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/api/loans/1/return", librarian, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if loan.ReturnedAt == nil {
+		t.Errorf("Expected the loan to be returned, but got %+v", loan)
+	}
+	recorder = doJSON("POST", "/api/loans/1/return", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	// The copy can go out again
+	if _, status := checkout(t, librarian, gin.H{"item_id": 1, "patron_id": patron.ID}); status != http.StatusCreated {
+		t.Errorf("Expected status 201, but got %d", status)
+	}
+
+	// Copies with a loan history are withdrawn rather than deleted
+	admin := tokenFor(t, "admin", roleAdmin)
+	recorder = doJSON("DELETE", "/api/books/1/items/1", admin, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+}
+
+// Copies something still points at are refused with a 409, also with
+// foreign keys enforced as they are in production
+func TestDeleteItemWithHistory(t *testing.T) {
+	setupIsolated(t)
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatal(err)
+	}
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+	createTestItems(t, librarian, "30001", "30002")
+	createTestBranch(t, "east")
+	_, err := db.Exec("INSERT INTO transfers (item_id, from_branch_id, to_branch_id, status, requested_at) VALUES (1, 1, 2, ?, ?)",
+		transferReceived, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recorder := doJSON("DELETE", "/api/books/1/items/1", admin, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("DELETE", "/api/books/1/items/2", admin, nil); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+}
+
+func TestCheckoutRefusals(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	member := tokenFor(t, "member", roleMember)
+	patron := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001")
+
+	if _, status := checkout(t, member, gin.H{"barcode": "30001", "patron_id": patron.ID}); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", status)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001"}); status != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", status)
+	}
+
+	db.Exec("UPDATE patrons SET status = ? WHERE id = ?", patronBlocked, patron.ID)
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": patron.ID}); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", status)
+	}
+
+	// A refused checkout leaves the copy available
+	var itemStatus string
+	db.QueryRow("SELECT status FROM items WHERE id = 1").Scan(&itemStatus)
+	if itemStatus != itemAvailable {
+		t.Errorf("Expected the item to stay available, but got %s", itemStatus)
+	}
+}
+
+func TestRenewLoan(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	patron := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": patron.ID})
+
+	*clock = clock.Add(time.Minute)
+	for i := 1; i <= defaultLoanPolicy.MaxRenewals; i++ {
+		recorder := doJSON("POST", "/api/loans/1/renew", librarian, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, but got %d", recorder.Code)
+		}
+		var loan Loan
+		json.NewDecoder(recorder.Body).Decode(&loan)
+		if loan.Renewals != i || !loan.DueAt.Equal(clock.AddDate(0, 0, defaultLoanPolicy.LoanDays)) {
+			t.Errorf("Unexpected renewed loan %+v", loan)
+		}
+	}
+
+	recorder := doJSON("POST", "/api/loans/1/renew", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/loans/2/renew", librarian, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+}
+
+func TestLoanHistory(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	user, _ := createUser("alice", "correct horse", roleMember)
+	patron := createTestPatron(t, "alice", user.ID)
+	alice := loginPair(t, "alice", "correct horse").Token
+	createTestItems(t, librarian, "30001", "30002")
+
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": patron.ID})
+	doJSON("POST", "/api/loans/1/return", librarian, nil)
+	checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": patron.ID})
+
+	patronPath := "/api/patrons/" + strconv.Itoa(int(patron.ID)) + "/loans"
+	for _, tt := range []struct {
+		path  string
+		token string
+		count int
+	}{
+		{patronPath, librarian, 2},
+		{patronPath + "?open=true", librarian, 1},
+		{"/api/books/1/loans", librarian, 2},
+		{"/api/loans?open=true", librarian, 1},
+		{"/api/account/loans", alice, 2},
+	} {
+		recorder := doJSON("GET", tt.path, tt.token, nil)
+		var loans []Loan
+		json.NewDecoder(recorder.Body).Decode(&loans)
+		if len(loans) != tt.count {
+			t.Errorf("%s: expected %d loans, but got %d", tt.path, tt.count, len(loans))
+		}
+	}
+
+	// Patrons only see their own history through /account
+	recorder := doJSON("GET", patronPath, alice, nil)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 2", now().Add(-time.Hour))
+	recorder = doJSON("GET", "/api/loans/2", librarian, nil)
+	var loan Loan
+	json.NewDecoder(recorder.Body).Decode(&loan)
+	if !loan.Overdue {
+		t.Errorf("Expected the loan to be overdue, but got %+v", loan)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Failed login handling: past its free attempts each further failure for a
+// username or address doubles the wait before the next try, and reaching its
+// threshold locks it for LockoutDuration
+type lockoutPolicy struct {
+	FreeAttempts       int
+	IPFreeAttempts     int
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+	UserThreshold      int
+	IPThreshold        int
+	LockoutDuration    time.Duration
+	FailureMemoryLimit time.Duration
+}
+
+var lockout = lockoutPolicy{
+	FreeAttempts:       3,
+	IPFreeAttempts:     10,
+	BaseDelay:          time.Second,
+	MaxDelay:           5 * time.Minute,
+	UserThreshold:      10,
+	IPThreshold:        50,
+	LockoutDuration:    30 * time.Minute,
+	FailureMemoryLimit: 24 * time.Hour,
+}
+
+// A security event recorded for administrators
+type AuthEvent struct {
+	ID        uint      `json:"id"`
+	Event     string    `json:"event"`
+	Username  string    `json:"username,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// A username or address currently refused by /login
+type Lockout struct {
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"last_failure"`
+	BlockedUntil time.Time `json:"blocked_until"`
+}
+
+// Create the login failure counter and security event tables
+func createLockoutTables() {
+	loginFailuresTableSQL := `
+		CREATE TABLE IF NOT EXISTS login_failures (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL,
+			last_failure DATETIME NOT NULL,
+			locked_until DATETIME
+		);`
+	_, err = db.Exec(loginFailuresTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create login_failures table:", err)
+	}
+
+	authEventsTableSQL := `
+		CREATE TABLE IF NOT EXISTS auth_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event TEXT NOT NULL,
+			username TEXT,
+			ip TEXT,
+			detail TEXT,
+			created_at DATETIME NOT NULL
+		);`
+	_, err = db.Exec(authEventsTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create auth_events table:", err)
+	}
+}
+
+// Apply the lockout settings from configuration over the defaults
+func configureLockout(c LockoutConfig) {
+	if c.FreeAttempts > 0 {
+		lockout.FreeAttempts = c.FreeAttempts
+	}
+	if c.IPFreeAttempts > 0 {
+		lockout.IPFreeAttempts = c.IPFreeAttempts
+	}
+	if c.BaseDelay > 0 {
+		lockout.BaseDelay = time.Duration(c.BaseDelay)
+	}
+	if c.MaxDelay > 0 {
+		lockout.MaxDelay = time.Duration(c.MaxDelay)
+	}
+	if c.UserThreshold > 0 {
+		lockout.UserThreshold = c.UserThreshold
+	}
+	if c.IPThreshold > 0 {
+		lockout.IPThreshold = c.IPThreshold
+	}
+	if c.LockoutDuration > 0 {
+		lockout.LockoutDuration = time.Duration(c.LockoutDuration)
+	}
+}
+
+func userLockoutKey(username string) string {
+	return "user:" + username
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// When the back-off after a number of failures ends
+func (p lockoutPolicy) backoffUntil(key string, failures int, lastFailure time.Time) time.Time {
+	free := p.FreeAttempts
+	if strings.HasPrefix(key, "ip:") {
+		free = p.IPFreeAttempts
+	}
+	if failures < free {
+		return time.Time{}
+	}
+
+	delay := p.MaxDelay
+	if shift := failures - free; shift < 32 {
+		delay = time.Duration(math.Min(float64(p.BaseDelay)*math.Pow(2, float64(shift)), float64(p.MaxDelay)))
+	}
+	return lastFailure.Add(delay)
+}
+
+func getLockout(q querier, key string) (Lockout, error) {
+	var (
+		l           Lockout
+		lockedUntil sql.NullTime
+	)
+	err := q.QueryRow("SELECT key, failures, last_failure, locked_until FROM login_failures WHERE key = ?", key).
+		Scan(&l.Key, &l.Failures, &l.LastFailure, &lockedUntil)
+	if err != nil {
+		return l, err
+	}
+
+	l.BlockedUntil = lockout.backoffUntil(l.Key, l.Failures, l.LastFailure)
+	if lockedUntil.Valid && lockedUntil.Time.After(l.BlockedUntil) {
+		l.BlockedUntil = lockedUntil.Time
+	}
+	return l, nil
+}
+
+// The time until which login attempts for username from ip are refused,
+// zero when an attempt is allowed now
+func loginBlockedUntil(username, ip string) (time.Time, error) {
+	var until time.Time
+	for _, key := range []string{userLockoutKey(username), ipLockoutKey(ip)} {
+		l, err := getLockout(db, key)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if l.BlockedUntil.After(until) {
+			until = l.BlockedUntil
+		}
+	}
+
+	if !until.After(now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// Count a failed attempt against the username and the address, locking
+// either once it reaches its threshold
+func recordLoginFailure(username, ip string) error {
+	keys := []struct {
+		key       string
+		threshold int
+		event     string
+	}{
+		{userLockoutKey(username), lockout.UserThreshold, "account_locked"},
+		{ipLockoutKey(ip), lockout.IPThreshold, "address_locked"},
+	}
+
+	for _, k := range keys {
+		_, err := db.Exec(`INSERT INTO login_failures (key, failures, last_failure) VALUES (?, 1, ?)
+							ON CONFLICT (key) DO UPDATE SET failures = failures + 1, last_failure = excluded.last_failure`,
+			k.key, now())
+		if err != nil {
+			return err
+		}
+
+		var failures int
+		if err := db.QueryRow("SELECT failures FROM login_failures WHERE key = ?", k.key).Scan(&failures); err != nil {
+			return err
+		}
+		if failures < k.threshold {
+			continue
+		}
+
+		// The counter starts over once the lockout ends
+		lockedUntil := now().Add(lockout.LockoutDuration)
+		if _, err := db.Exec("UPDATE login_failures SET failures = 0, locked_until = ? WHERE key = ?", lockedUntil, k.key); err != nil {
+			return err
+		}
+		detail := strconv.Itoa(failures) + " failed attempts, locked until " + lockedUntil.Format(time.RFC3339)
+		if err := recordAuthEvent(db, k.event, username, ip, detail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clearLoginFailures(username string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE key = ?", userLockoutKey(username))
+	return err
+}
+
+// Forget failures old enough not to matter any more
+func purgeLoginFailures() error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE last_failure < ? AND (locked_until IS NULL OR locked_until < ?)",
+		now().Add(-lockout.FailureMemoryLimit), now())
+	return err
+}
+
+func recordAuthEvent(q querier, event, username, ip, detail string) error {
+	_, err := q.Exec("INSERT INTO auth_events (event, username, ip, detail, created_at) VALUES (?, ?, ?, ?, ?)",
+		event, username, ip, detail, now())
+	return err
+}
+
+// Refuse the request with 429 while username or the client address is
+// backing off or locked. Returns true when the request was refused.
+func refuseThrottledLogin(c *gin.Context, username string) bool {
+	until, err := loginBlockedUntil(username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return true
+	}
+	if until.IsZero() {
+		return false
+	}
+
+	retryAfter := int(until.Sub(now()) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed attempts", "retry_after": retryAfter})
+	return true
+}
+
+// Handlers
+
+func getLockouts(c *gin.Context) {
+	rows, err := db.Query("SELECT key FROM login_failures ORDER BY key")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve lockouts"})
+		return
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve lockouts"})
+			return
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	lockouts := []Lockout{}
+	for _, key := range keys {
+		l, err := getLockout(db, key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve lockouts"})
+			return
+		}
+		if l.BlockedUntil.After(now()) {
+			lockouts = append(lockouts, l)
+		}
+	}
+
+	c.JSON(http.StatusOK, lockouts)
+}
+
+func unlockUser(c *gin.Context) {
+	user, err := getUserByID(c.Param("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	respondUnlock(c, userLockoutKey(user.Username), "account_unlocked", user.Username, c.ClientIP(), "Failed to unlock user")
+}
+
+// Clear the failures of an address, for staff sharing one behind a
+// locked-out office network
+func unlockAddress(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address"})
+		return
+	}
+
+	respondUnlock(c, ipLockoutKey(ip.String()), "address_unlocked", "", ip.String(), "Failed to unlock address")
+}
+
+// Clear the failures and lockout under key, auditing it and recording the
+// event for the username and ip given. Keys without failures are left be.
+func respondUnlock(c *gin.Context, key, event, username, ip, fallback string) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := getLockout(tx, key)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM login_failures WHERE key = ?", key); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, c, auditDelete, "lockout", before.Key, before, nil); err != nil {
+			return err
+		}
+		return recordAuthEvent(tx, event, username, ip, "unlocked by "+c.GetString("username"))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+func getAuthEvents(c *gin.Context) {
+	query := "SELECT id, event, COALESCE(username, ''), COALESCE(ip, ''), COALESCE(detail, ''), created_at FROM auth_events"
+	var args []interface{}
+	if username := c.Query("username"); username != "" {
+		query += " WHERE username = ?"
+		args = append(args, username)
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve events"})
+		return
+	}
+	defer rows.Close()
+
+	events := []AuthEvent{}
+	for rows.Next() {
+		var event AuthEvent
+		if err := rows.Scan(&event.ID, &event.Event, &event.Username, &event.IP, &event.Detail, &event.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve events"})
+			return
+		}
+		events = append(events, event)
+	}
+
+	c.JSON(http.StatusOK, events)
+}
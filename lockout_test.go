@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Freeze the clock at a point the test can move forward. It starts a little
+// in the past since token validation compares against the real time.
+func useClock(t *testing.T) *time.Time {
+	t.Helper()
+	current := time.Now().UTC().Truncate(time.Second).Add(-10 * time.Minute)
+	prevNow := now
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = prevNow })
+	return &current
+}
+
+// Shorten the lockout delays so a test's clock stays behind real time
+func useShortLockout(t *testing.T) {
+	t.Helper()
+	prevLockout := lockout
+	lockout.MaxDelay = time.Second
+	lockout.LockoutDuration = time.Minute
+	t.Cleanup(func() { lockout = prevLockout })
+}
+
+func TestLoginBackoff(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	createUser("alice", "correct horse", roleMember)
+
+	for i := 0; i < lockout.FreeAttempts; i++ {
+		recorder := doJSON("POST", "/login", "", User{Username: "alice", Password: "wrong"})
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, but got %d", recorder.Code)
+		}
+	}
+
+	// Even the right password waits out the back-off
+	recorder := doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, but got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After 1, but got %q", recorder.Header().Get("Retry-After"))
+	}
+
+	// The next failure doubles the wait
+	*clock = clock.Add(time.Second)
+	doJSON("POST", "/login", "", User{Username: "alice", Password: "wrong"})
+	recorder = doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expected a 2 second back-off, but got %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	// A successful login resets the count
+	*clock = clock.Add(2 * time.Second)
+	loginPair(t, "alice", "correct horse")
+	recorder = doJSON("POST", "/login", "", User{Username: "alice", Password: "wrong"})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
+
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	setupIsolated(t)
+	useShortLockout(t)
+	clock := useClock(t)
+	user, _ := createUser("alice", "correct horse", roleMember)
+
+	// Wait out each back-off so the failures reach the lockout threshold
+	for i := 0; i < lockout.UserThreshold; i++ {
+		doJSON("POST", "/login", "", User{Username: "alice", Password: "wrong"})
+		*clock = clock.Add(lockout.MaxDelay)
+	}
+
+	recorder := doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, but got %d", recorder.Code)
+	}
+	retryAfter, _ := strconv.Atoi(recorder.Header().Get("Retry-After"))
+	if time.Duration(retryAfter)*time.Second != lockout.LockoutDuration-lockout.MaxDelay {
+		t.Errorf("Expected the rest of the lockout, but got Retry-After %d", retryAfter)
+	}
+
+	admin := tokenFor(t, "admin", roleAdmin)
+	recorder = doJSON("GET", "/api/admin/lockouts", admin, nil)
+	var lockouts []Lockout
+	json.NewDecoder(recorder.Body).Decode(&lockouts)
+	if len(lockouts) != 1 || lockouts[0].Key != "user:alice" {
+		t.Errorf("Expected alice to be locked, but got %+v", lockouts)
+	}
+
+	// Members cannot unlock themselves
+	member := tokenFor(t, "bob", roleMember)
+	recorder = doJSON("POST", "/api/admin/users/"+strconv.Itoa(int(user.ID))+"/unlock", member, nil)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/api/admin/users/"+strconv.Itoa(int(user.ID))+"/unlock", admin, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", recorder.Code)
+	}
+	loginPair(t, "alice", "correct horse")
+
+	recorder = doJSON("GET", "/api/admin/auth-events?username=alice", admin, nil)
+	var events []AuthEvent
+	json.NewDecoder(recorder.Body).Decode(&events)
+	if len(events) != 2 || events[0].Event != "account_unlocked" || events[1].Event != "account_locked" {
+		t.Errorf("Expected lock and unlock events, but got %+v", events)
+	}
+
+	recorder = doJSON("POST", "/api/admin/users/99/unlock", admin, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+}
+
+func TestLoginAddressLockout(t *testing.T) {
+	setupIsolated(t)
+	useShortLockout(t)
+	clock := useClock(t)
+	createUser("alice", "correct horse", roleMember)
+	admin := tokenFor(t, "admin", roleAdmin)
+
+	// Guessing across many usernames trips the address counter
+	for i := 0; i < lockout.IPThreshold; i++ {
+		doJSON("POST", "/login", "", User{Username: "user" + strconv.Itoa(i), Password: "wrong"})
+		*clock = clock.Add(lockout.MaxDelay)
+	}
+
+	recorder := doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, but got %d", recorder.Code)
+	}
+
+	*clock = clock.Add(lockout.LockoutDuration)
+	loginPair(t, "alice", "correct horse")
+
+	// Administrators can let a locked address back in early
+	office := func(username, password string) int {
+		body, _ := json.Marshal(User{Username: username, Password: password})
+		request, _ := http.NewRequest("POST", "/login", bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.RemoteAddr = "192.0.2.10:41000"
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	for i := 0; i < lockout.IPThreshold; i++ {
+		office("user"+strconv.Itoa(i), "wrong")
+		*clock = clock.Add(lockout.MaxDelay)
+	}
+	if status := office("alice", "correct horse"); status != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, but got %d", status)
+	}
+	if recorder := doJSON("POST", "/api/admin/addresses/not-an-address/unlock", admin, nil); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", "/api/admin/addresses/192.0.2.10/unlock", admin, nil); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", recorder.Code)
+	}
+	if status := office("alice", "correct horse"); status != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", status)
+	}
+
+	recorder = doJSON("GET", "/api/admin/auth-events", admin, nil)
+	var events []AuthEvent
+	json.NewDecoder(recorder.Body).Decode(&events)
+	if len(events) == 0 || events[0].Event != "address_unlocked" || events[0].IP != "192.0.2.10" || events[0].Detail != "unlocked by admin" {
+		t.Errorf("Expected an unlock event, but got %+v", events)
+	}
+}
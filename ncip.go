@@ -0,0 +1,533 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Partner libraries' interlibrary loan systems talk to /ncip in NCIP 2
+// (NISO Circulation Interchange Protocol) XML. Patrons are identified by
+// card number and items by barcode, as on self-check machines.
+
+const (
+	ncipNamespace = "http://www.niso.org/2008/ncip"
+	ncipVersion   = "http://www.niso.org/schemas/ncip/v2_02/ncip_v2_02.xsd"
+
+	// Messages are a few kilobytes; anything much larger is not NCIP
+	ncipMaxBodyBytes = 1 << 20
+)
+
+var (
+	errNCIPMissingUser = errors.New("NCIP request has no user")
+	errNCIPMissingItem = errors.New("NCIP request has no item")
+)
+
+// Problem types for the errors circulation refuses a request with, and the
+// request element at fault
+var ncipProblems = map[error]struct {
+	problemType string
+	element     string
+}{
+	errNCIPMissingUser:    {"Needed Data Missing", "UserId"},
+	errNCIPMissingItem:    {"Needed Data Missing", "ItemId"},
+	errPatronNotFound:     {"Unknown User", "UserIdentifierValue"},
+	errPatronBlocked:      {"User Blocked", "UserIdentifierValue"},
+	errCardExpired:        {"User Blocked", "UserIdentifierValue"},
+	errFinesOwed:          {"User Blocked", "UserIdentifierValue"},
+	errLoanLimit:          {"Maximum Check Outs Exceeded", "UserIdentifierValue"},
+	errItemNotFound:       {"Unknown Item", "ItemIdentifierValue"},
+	errBookNotFound:       {"Unknown Item", "BibliographicId"},
+	errItemUnavailable:    {"Item Not Available By Need Before Date", "ItemIdentifierValue"},
+	errItemHeldForOther:   {"Item Not Available By Need Before Date", "ItemIdentifierValue"},
+	errItemNotOnLoan:      {"Item Not Checked Out", "ItemIdentifierValue"},
+	errHoldExists:         {"Duplicate Request", "UserIdentifierValue"},
+	errCopyAvailable:      {"User Ineligible To Request This Item", "BibliographicId"},
+	errBookNotHoldable:    {"User Ineligible To Request This Item", "BibliographicId"},
+	errLoanPolicyNotFound: {"Item Does Not Circulate", "ItemIdentifierValue"},
+}
+
+// Circulation statuses of item lookups
+var ncipItemStatuses = map[string]string{
+	itemAvailable: "Available On Shelf",
+	itemOnLoan:    "On Loan",
+	itemOnHold:    "Available For Pickup",
+	itemInTransit: "In Transit Between Library Locations",
+	itemLost:      "Lost",
+	itemWithdrawn: "Not Available",
+}
+
+type ncipHeader struct {
+	FromAgencyID string `xml:"FromAgencyId>AgencyId"`
+	ToAgencyID   string `xml:"ToAgencyId>AgencyId"`
+}
+
+// The header of the response to a request with this header, if it had one
+func (h ncipHeader) reply() *ncipHeader {
+	if h.FromAgencyID == "" || h.ToAgencyID == "" {
+		return nil
+	}
+	return &ncipHeader{FromAgencyID: h.ToAgencyID, ToAgencyID: h.FromAgencyID}
+}
+
+type ncipUserID struct {
+	AgencyID string `xml:"AgencyId,omitempty"`
+	Value    string `xml:"UserIdentifierValue"`
+}
+
+type ncipItemID struct {
+	AgencyID string `xml:"AgencyId,omitempty"`
+	Value    string `xml:"ItemIdentifierValue"`
+}
+
+// The parts of the supported requests read here. Each service reads the
+// ones it needs.
+type ncipService struct {
+	Header      ncipHeader  `xml:"InitiationHeader"`
+	UserID      *ncipUserID `xml:"UserId"`
+	ItemID      *ncipItemID `xml:"ItemId"`
+	RecordID    string      `xml:"BibliographicId>BibliographicRecordId>BibliographicRecordIdentifier"`
+	ISBN        string      `xml:"BibliographicId>BibliographicItemId>BibliographicItemIdentifier"`
+	RequestType string      `xml:"RequestType"`
+}
+
+func (s ncipService) userValue() string {
+	if s.UserID == nil {
+		return ""
+	}
+	return s.UserID.Value
+}
+
+func (s ncipService) itemValue() string {
+	if s.ItemID == nil {
+		return ""
+	}
+	return s.ItemID.Value
+}
+
+type ncipRequest struct {
+	XMLName      xml.Name     `xml:"NCIPMessage"`
+	LookupUser   *ncipService `xml:"LookupUser"`
+	LookupItem   *ncipService `xml:"LookupItem"`
+	RequestItem  *ncipService `xml:"RequestItem"`
+	CheckOutItem *ncipService `xml:"CheckOutItem"`
+	CheckInItem  *ncipService `xml:"CheckInItem"`
+}
+
+type ncipRequestID struct {
+	Value string `xml:"RequestIdentifierValue"`
+}
+
+type ncipProblem struct {
+	Type    string `xml:"ProblemType"`
+	Detail  string `xml:"ProblemDetail,omitempty"`
+	Element string `xml:"ProblemElement,omitempty"`
+	Value   string `xml:"ProblemValue,omitempty"`
+}
+
+// A postal address or an electronic one, such as mailto or tel
+type ncipUserAddress struct {
+	Role       string                 `xml:"UserAddressRoleType"`
+	Postal     *ncipPostalAddress     `xml:"PhysicalAddress"`
+	Electronic *ncipElectronicAddress `xml:"ElectronicAddress"`
+}
+
+type ncipPostalAddress struct {
+	Data string `xml:"UnstructuredAddress>UnstructuredAddressData"`
+}
+
+type ncipElectronicAddress struct {
+	Type string `xml:"ElectronicAddressType"`
+	Data string `xml:"ElectronicAddressData"`
+}
+
+type ncipUserPrivilege struct {
+	Type    string    `xml:"AgencyUserPrivilegeType"`
+	ValidTo time.Time `xml:"ValidToDate"`
+	Status  string    `xml:"UserPrivilegeStatus>UserPrivilegeStatusType"`
+}
+
+type ncipUserFields struct {
+	Name      string            `xml:"NameInformation>PersonalNameInformation>UnstructuredPersonalUserName"`
+	Addresses []ncipUserAddress `xml:"UserAddressInformation"`
+	Privilege ncipUserPrivilege `xml:"UserPrivilege"`
+	Blocks    []ncipBlock       `xml:"BlockOrTrap"`
+}
+
+type ncipBlock struct {
+	AgencyID string `xml:"AgencyId"`
+	Type     string `xml:"BlockOrTrapType"`
+}
+
+type ncipLocation struct {
+	Type  string `xml:"LocationType"`
+	Level int    `xml:"LocationName>LocationNameInstance>LocationNameLevel"`
+	Name  string `xml:"LocationName>LocationNameInstance>LocationNameValue"`
+}
+
+type ncipItemFields struct {
+	Author          string         `xml:"BibliographicDescription>Author,omitempty"`
+	ISBN            string         `xml:"BibliographicDescription>BibliographicItemId>BibliographicItemIdentifier,omitempty"`
+	ISBNCode        string         `xml:"BibliographicDescription>BibliographicItemId>BibliographicItemIdentifierCode,omitempty"`
+	RecordID        string         `xml:"BibliographicDescription>BibliographicRecordId>BibliographicRecordIdentifier"`
+	PublicationDate string         `xml:"BibliographicDescription>PublicationDate,omitempty"`
+	Title           string         `xml:"BibliographicDescription>Title"`
+	Status          string         `xml:"CirculationStatus"`
+	HoldQueueLength int            `xml:"HoldQueueLength"`
+	Locations       []ncipLocation `xml:"Location"`
+	DateDue         *time.Time     `xml:"DateDue,omitempty"`
+}
+
+// A response to one service, named after it. Fields a service does not
+// fill in are left out.
+type ncipServiceResponse struct {
+	XMLName          xml.Name
+	Header           *ncipHeader     `xml:"ResponseHeader"`
+	Problem          *ncipProblem    `xml:"Problem"`
+	RequestID        *ncipRequestID  `xml:"RequestId"`
+	ItemID           *ncipItemID     `xml:"ItemId"`
+	UserID           *ncipUserID     `xml:"UserId"`
+	RequestType      string          `xml:"RequestType,omitempty"`
+	RequestScopeType string          `xml:"RequestScopeType,omitempty"`
+	DateDue          *time.Time      `xml:"DateDue,omitempty"`
+	HoldPickupDate   *time.Time      `xml:"HoldPickupDate,omitempty"`
+	User             *ncipUserFields `xml:"UserOptionalFields"`
+	Item             *ncipItemFields `xml:"ItemOptionalFields"`
+}
+
+type ncipResponse struct {
+	XMLName  xml.Name     `xml:"NCIPMessage"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Version  string       `xml:"version,attr"`
+	Problem  *ncipProblem `xml:"Problem"`
+	Response *ncipServiceResponse
+}
+
+func respondNCIP(c *gin.Context, status int, response ncipResponse) {
+	response.Xmlns = ncipNamespace
+	response.Version = ncipVersion
+	body, err := xml.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode NCIP response"})
+		return
+	}
+	c.Data(status, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+}
+
+// Handlers
+
+// Answer one NCIP message. Refusals come back as a Problem in the service's
+// response with status 200, as NCIP expects.
+func handleNCIP(c *gin.Context) {
+	var request ncipRequest
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, ncipMaxBodyBytes)
+	if err := xml.NewDecoder(body).Decode(&request); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondNCIP(c, http.StatusRequestEntityTooLarge, ncipResponse{Problem: &ncipProblem{Type: "Invalid Message", Detail: err.Error()}})
+			return
+		}
+		respondNCIP(c, http.StatusBadRequest, ncipResponse{Problem: &ncipProblem{Type: "Invalid Message", Detail: err.Error()}})
+		return
+	}
+
+	services := []struct {
+		name    string
+		request *ncipService
+		run     func(c *gin.Context, request ncipService, response *ncipServiceResponse) error
+	}{
+		{"LookupUser", request.LookupUser, ncipLookupUser},
+		{"LookupItem", request.LookupItem, ncipLookupItem},
+		{"RequestItem", request.RequestItem, ncipRequestItem},
+		{"CheckOutItem", request.CheckOutItem, ncipCheckOutItem},
+		{"CheckInItem", request.CheckInItem, ncipCheckInItem},
+	}
+	for _, service := range services {
+		if service.request == nil {
+			continue
+		}
+
+		response := &ncipServiceResponse{XMLName: xml.Name{Local: service.name + "Response"}, Header: service.request.Header.reply()}
+		err := service.run(c, *service.request, response)
+		if err == nil {
+			respondNCIP(c, http.StatusOK, ncipResponse{Response: response})
+			return
+		}
+
+		failed := &ncipServiceResponse{XMLName: response.XMLName, Header: response.Header}
+		p, known := ncipProblems[err]
+		if !known {
+			failed.Problem = &ncipProblem{Type: "Temporary Processing Failure"}
+			respondNCIP(c, http.StatusInternalServerError, ncipResponse{Response: failed})
+			return
+		}
+		failed.Problem = &ncipProblem{Type: p.problemType, Detail: circulationErrors[err].message, Element: p.element}
+		switch p.element {
+		case "UserIdentifierValue":
+			failed.Problem.Value = service.request.userValue()
+		case "ItemIdentifierValue":
+			failed.Problem.Value = service.request.itemValue()
+		}
+		respondNCIP(c, http.StatusOK, ncipResponse{Response: failed})
+		return
+	}
+
+	respondNCIP(c, http.StatusBadRequest, ncipResponse{Problem: &ncipProblem{Type: "Unsupported Service"}})
+}
+
+// The patron named by the request's user ID
+func ncipPatron(q querier, request ncipService) (Patron, error) {
+	if request.userValue() == "" {
+		return Patron{}, errNCIPMissingUser
+	}
+	return queryPatronByCard(q, request.userValue())
+}
+
+// The item named by the request's item ID
+func ncipItem(q querier, request ncipService) (Item, error) {
+	if request.itemValue() == "" {
+		return Item{}, errNCIPMissingItem
+	}
+	return lookupItem(q, 0, request.itemValue())
+}
+
+// A patron's name, addresses, card and, if they may not borrow, blocks
+func ncipLookupUser(c *gin.Context, request ncipService, response *ncipServiceResponse) error {
+	patron, err := ncipPatron(db, request)
+	if err != nil {
+		return err
+	}
+
+	fields := &ncipUserFields{Name: patron.Name}
+	if patron.Address != "" {
+		fields.Addresses = append(fields.Addresses, ncipUserAddress{Role: "Home", Postal: &ncipPostalAddress{Data: patron.Address}})
+	}
+	if patron.Email != "" {
+		fields.Addresses = append(fields.Addresses, ncipUserAddress{Role: "Home", Electronic: &ncipElectronicAddress{Type: "mailto", Data: patron.Email}})
+	}
+	if patron.Phone != "" {
+		fields.Addresses = append(fields.Addresses, ncipUserAddress{Role: "Home", Electronic: &ncipElectronicAddress{Type: "tel", Data: patron.Phone}})
+	}
+
+	fields.Privilege = ncipUserPrivilege{Type: patron.Category, ValidTo: patron.CardExpiresAt, Status: "Active"}
+	err = checkPatronMayBorrow(db, patron.ID)
+	switch err {
+	case nil:
+	case errPatronBlocked, errFinesOwed:
+		fields.Privilege.Status = "Blocked"
+	case errCardExpired:
+		fields.Privilege.Status = "Expired"
+	default:
+		return err
+	}
+	if err != nil {
+		for _, block := range []string{"Block Check Out", "Block Renewal", "Block Request Item"} {
+			fields.Blocks = append(fields.Blocks, ncipBlock{AgencyID: request.Header.ToAgencyID, Type: block})
+		}
+	}
+
+	response.UserID = &ncipUserID{Value: patron.CardNumber}
+	response.User = fields
+	return nil
+}
+
+// An item's title, status, hold queue, locations and due date if on loan
+func ncipLookupItem(c *gin.Context, request ncipService, response *ncipServiceResponse) error {
+	item, err := ncipItem(db, request)
+	if err != nil {
+		return err
+	}
+	book, err := queryBook(db, item.BookID)
+	if err != nil {
+		return err
+	}
+	authors, err := ncipAuthors(db, book.ID)
+	if err != nil {
+		return err
+	}
+	queue, err := holdQueueLength(db, item.BookID)
+	if err != nil {
+		return err
+	}
+
+	fields := &ncipItemFields{
+		Author:          authors,
+		RecordID:        strconv.FormatUint(uint64(book.ID), 10),
+		PublicationDate: strconv.Itoa(book.PublishedYear),
+		Title:           book.Title,
+		Status:          ncipItemStatuses[item.Status],
+		HoldQueueLength: queue,
+	}
+	if book.ISBN != "" {
+		fields.ISBN, fields.ISBNCode = book.ISBN, "ISBN"
+	}
+	for _, location := range []struct {
+		kind     string
+		branchID uint
+	}{{"Permanent Location", item.HomeBranchID}, {"Current Location", item.CurrentBranchID}} {
+		branch, err := queryBranch(db, location.branchID)
+		if err != nil {
+			return err
+		}
+		fields.Locations = append(fields.Locations, ncipLocation{Type: location.kind, Level: 1, Name: branch.Code})
+	}
+
+	switch item.Status {
+	case itemOnLoan:
+		loan, err := openLoanForItem(db, item.ID)
+		if err != nil {
+			return err
+		}
+		fields.DateDue = &loan.DueAt
+	case itemOnHold:
+		holds, err := queryHolds(db, "WHERE h.item_id = ? AND h.status = ?", item.ID, holdReady)
+		if err != nil {
+			return err
+		}
+		if len(holds) > 0 {
+			response.HoldPickupDate = holds[0].ExpiresAt
+		}
+	}
+
+	response.ItemID = &ncipItemID{Value: item.Barcode}
+	response.Item = fields
+	return nil
+}
+
+// The names of a book's authors, separated by semicolons
+func ncipAuthors(q querier, bookID uint) (string, error) {
+	rows, err := q.Query(`SELECT a.name FROM authors AS a INNER JOIN books_authors AS ba ON a.id = ba.author_id
+						WHERE ba.book_id = ? ORDER BY a.name`, bookID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "; "), rows.Err()
+}
+
+// Place a hold for the patron on a book, named by its record ID, its ISBN
+// or the barcode of one of its copies
+func ncipRequestItem(c *gin.Context, request ncipService, response *ncipServiceResponse) error {
+	var hold Hold
+	err := withTx(func(tx *sql.Tx) error {
+		patron, err := ncipPatron(tx, request)
+		if err != nil {
+			return err
+		}
+
+		var bookID uint
+		switch {
+		case request.RecordID != "":
+			id, err := strconv.ParseUint(request.RecordID, 10, 32)
+			if err != nil {
+				return errBookNotFound
+			}
+			bookID = uint(id)
+		case request.ISBN != "":
+			err := tx.QueryRow("SELECT id FROM books WHERE isbn = ?", request.ISBN).Scan(&bookID)
+			if err == sql.ErrNoRows {
+				return errBookNotFound
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			item, err := ncipItem(tx, request)
+			if err != nil {
+				return err
+			}
+			bookID = item.BookID
+		}
+
+		if hold, err = placeHold(tx, bookID, patron.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "hold", hold.ID, nil, hold)
+	})
+	if err != nil {
+		return err
+	}
+
+	response.RequestID = &ncipRequestID{Value: strconv.FormatUint(uint64(hold.ID), 10)}
+	response.ItemID = request.ItemID
+	response.UserID = request.UserID
+	response.RequestType = request.RequestType
+	if response.RequestType == "" {
+		response.RequestType = "Hold"
+	}
+	response.RequestScopeType = "Bibliographic Item"
+	return nil
+}
+
+func ncipCheckOutItem(c *gin.Context, request ncipService, response *ncipServiceResponse) error {
+	var loan Loan
+	err := withTx(func(tx *sql.Tx) error {
+		patron, err := ncipPatron(tx, request)
+		if err != nil {
+			return err
+		}
+		item, err := ncipItem(tx, request)
+		if err != nil {
+			return err
+		}
+		if loan, err = checkoutItem(tx, item, patron.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "loan", loan.ID, nil, loan)
+	})
+	if err != nil {
+		return err
+	}
+
+	response.ItemID = request.ItemID
+	response.UserID = request.UserID
+	response.DateDue = &loan.DueAt
+	return nil
+}
+
+// Return an item, telling the caller whose loan it closed
+func ncipCheckInItem(c *gin.Context, request ncipService, response *ncipServiceResponse) error {
+	var cardNumber string
+	err := withTx(func(tx *sql.Tx) error {
+		item, err := ncipItem(tx, request)
+		if err != nil {
+			return err
+		}
+		before, err := openLoanForItem(tx, item.ID)
+		if err != nil {
+			return err
+		}
+		patron, err := queryPatron(tx, before.PatronID)
+		if err != nil {
+			return err
+		}
+		cardNumber = patron.CardNumber
+		loan, err := returnLoan(tx, before.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "loan", loan.ID, before, loan)
+	})
+	if err != nil {
+		return err
+	}
+
+	response.ItemID = request.ItemID
+	response.UserID = &ncipUserID{Value: cardNumber}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Send an NCIP message wrapping the service element, from PARTNER to LIB
+func postNCIP(t *testing.T, token, service, body string) (int, string) {
+	t.Helper()
+	message := `<?xml version="1.0" encoding="UTF-8"?>
+<NCIPMessage xmlns="http://www.niso.org/2008/ncip" version="http://www.niso.org/schemas/ncip/v2_02/ncip_v2_02.xsd">
+	<` + service + `>
+		<InitiationHeader>
+			<FromAgencyId><AgencyId>PARTNER</AgencyId></FromAgencyId>
+			<ToAgencyId><AgencyId>LIB</AgencyId></ToAgencyId>
+		</InitiationHeader>
+		` + body + `
+	</` + service + `>
+</NCIPMessage>`
+	request, _ := http.NewRequest("POST", "/api/ncip", strings.NewReader(message))
+	request.Header.Set("Content-Type", "application/xml")
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder.Code, recorder.Body.String()
+}
+
+func ncipUser(card string) string {
+	return "<UserId><UserIdentifierValue>" + card + "</UserIdentifierValue></UserId>"
+}
+
+func ncipItemBarcode(barcode string) string {
+	return "<ItemId><ItemIdentifierValue>" + barcode + "</ItemIdentifierValue></ItemId>"
+}
+
+func expectNCIP(t *testing.T, status int, body string, contains ...string) {
+	t.Helper()
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", status, body)
+	}
+	for _, s := range contains {
+		if !strings.Contains(body, s) {
+			t.Fatalf("Expected %q in the response, but got %s", s, body)
+		}
+	}
+}
+
+func TestNCIPCirculation(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian, "50001", "50002")
+	alice := createTestPatron(t, "alice", 0)
+	createTestPatron(t, "bob", 0)
+	db.Exec("UPDATE patrons SET email = 'alice@example.org' WHERE id = ?", alice.ID)
+
+	status, body := postNCIP(t, librarian, "LookupUser", ncipUser("C-alice"))
+	expectNCIP(t, status, body, "<LookupUserResponse>",
+		"<ResponseHeader><FromAgencyId><AgencyId>LIB</AgencyId></FromAgencyId><ToAgencyId><AgencyId>PARTNER</AgencyId></ToAgencyId></ResponseHeader>",
+		"<UnstructuredPersonalUserName>alice</UnstructuredPersonalUserName>",
+		"<ElectronicAddressData>alice@example.org</ElectronicAddressData>",
+		"<UserPrivilegeStatusType>Active</UserPrivilegeStatusType>")
+	if strings.Contains(body, "BlockOrTrap") {
+		t.Fatalf("Expected no blocks, but got %s", body)
+	}
+	status, body = postNCIP(t, librarian, "LookupUser", ncipUser("C-nobody"))
+	expectNCIP(t, status, body, "<ProblemType>Unknown User</ProblemType>", "<ProblemValue>C-nobody</ProblemValue>")
+
+	status, body = postNCIP(t, librarian, "CheckOutItem", ncipUser("C-alice")+ncipItemBarcode("50001"))
+	expectNCIP(t, status, body, "<CheckOutItemResponse>", "<DateDue>")
+	status, body = postNCIP(t, librarian, "CheckOutItem", ncipUser("C-bob")+ncipItemBarcode("50001"))
+	expectNCIP(t, status, body, "<ProblemType>Item Not Available By Need Before Date</ProblemType>", "<ProblemValue>50001</ProblemValue>")
+	status, body = postNCIP(t, librarian, "CheckOutItem", ncipItemBarcode("50002"))
+	expectNCIP(t, status, body, "<ProblemType>Needed Data Missing</ProblemType>", "<ProblemElement>UserId</ProblemElement>")
+
+	status, body = postNCIP(t, librarian, "LookupItem", ncipItemBarcode("50001"))
+	expectNCIP(t, status, body, "<LookupItemResponse>", "<Title>Book 1</Title>", "<BibliographicRecordIdentifier>1</BibliographicRecordIdentifier>",
+		"<CirculationStatus>On Loan</CirculationStatus>", "<LocationNameValue>main</LocationNameValue>", "<DateDue>")
+
+	// Holds are only taken once no copy is on the shelf
+	request := ncipUser("C-bob") + "<BibliographicId><BibliographicRecordId><BibliographicRecordIdentifier>1</BibliographicRecordIdentifier></BibliographicRecordId></BibliographicId><RequestType>Hold</RequestType>"
+	status, body = postNCIP(t, librarian, "RequestItem", request)
+	expectNCIP(t, status, body, "<ProblemType>User Ineligible To Request This Item</ProblemType>")
+	postNCIP(t, librarian, "CheckOutItem", ncipUser("C-alice")+ncipItemBarcode("50002"))
+	status, body = postNCIP(t, librarian, "RequestItem", request)
+	expectNCIP(t, status, body, "<RequestItemResponse>", "<RequestIdentifierValue>1</RequestIdentifierValue>", "<RequestType>Hold</RequestType>")
+	status, body = postNCIP(t, librarian, "RequestItem", request)
+	expectNCIP(t, status, body, "<ProblemType>Duplicate Request</ProblemType>")
+
+	status, body = postNCIP(t, librarian, "CheckInItem", ncipItemBarcode("50001"))
+	expectNCIP(t, status, body, "<CheckInItemResponse>", "<UserIdentifierValue>C-alice</UserIdentifierValue>")
+	status, body = postNCIP(t, librarian, "CheckInItem", ncipItemBarcode("50001"))
+	expectNCIP(t, status, body, "<ProblemType>Item Not Checked Out</ProblemType>")
+	status, body = postNCIP(t, librarian, "LookupItem", ncipItemBarcode("50001"))
+	expectNCIP(t, status, body, "<HoldPickupDate>", "<CirculationStatus>Available For Pickup</CirculationStatus>", "<HoldQueueLength>0</HoldQueueLength>")
+
+	var entries int
+	db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE entity_type IN ('loan', 'hold') AND username = 'librarian'").Scan(&entries)
+	if entries != 4 {
+		t.Fatalf("Expected 4 audited changes, but got %d", entries)
+	}
+
+	// Owing fines blocks as much as a blocked card does
+	addLedgerEntry(db, LedgerEntry{PatronID: alice.ID, Kind: ledgerCharge, Reason: feeLost, Amount: fines.BlockThreshold + 500})
+	status, body = postNCIP(t, librarian, "LookupUser", ncipUser("C-alice"))
+	expectNCIP(t, status, body, "<UserPrivilegeStatusType>Blocked</UserPrivilegeStatusType>",
+		"<BlockOrTrap><AgencyId>LIB</AgencyId><BlockOrTrapType>Block Check Out</BlockOrTrapType></BlockOrTrap>")
+
+	db.Exec("UPDATE patrons SET status = ? WHERE id = ?", patronBlocked, alice.ID)
+	status, body = postNCIP(t, librarian, "LookupUser", ncipUser("C-alice"))
+	expectNCIP(t, status, body, "<UserPrivilegeStatusType>Blocked</UserPrivilegeStatusType>",
+		"<BlockOrTrap><AgencyId>LIB</AgencyId><BlockOrTrapType>Block Check Out</BlockOrTrapType></BlockOrTrap>")
+}
+
+func TestNCIPInvalidMessages(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	member := tokenFor(t, "member", roleMember)
+
+	status, body := postNCIP(t, librarian, "RenewItem", "")
+	if status != http.StatusBadRequest || !strings.Contains(body, "<ProblemType>Unsupported Service</ProblemType>") {
+		t.Fatalf("Expected an unsupported service, but got %d: %s", status, body)
+	}
+
+	request, _ := http.NewRequest("POST", "/api/ncip", strings.NewReader("<NCIPMessage><LookupUser>"))
+	request.Header.Set("Authorization", "Bearer "+librarian)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "<ProblemType>Invalid Message</ProblemType>") {
+		t.Fatalf("Expected an invalid message, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	request, _ = http.NewRequest("POST", "/api/ncip", strings.NewReader("<NCIPMessage>"+strings.Repeat(" ", ncipMaxBodyBytes)+"</NCIPMessage>"))
+	request.Header.Set("Authorization", "Bearer "+librarian)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status 413, but got %d", recorder.Code)
+	}
+
+	if status, _ := postNCIP(t, member, "LookupUser", ncipUser("C-alice")); status != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", status)
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notice kinds
+const (
+	noticeDueSoon   = "due_soon"
+	noticeOverdue   = "overdue"
+	noticeHoldReady = "hold_ready"
+	noticeILLStatus = "ill_status"
+)
+
+var noticeKinds = []string{noticeDueSoon, noticeOverdue, noticeHoldReady, noticeILLStatus}
+
+// Channels, and the one patrons get notices on until they choose
+const (
+	channelEmail = "email"
+	channelSMS   = "sms"
+
+	defaultChannel = channelEmail
+)
+
+// Notification statuses. A queued notice is retried until it is sent or
+// runs out of attempts and fails.
+const (
+	notificationQueued = "queued"
+	notificationSent   = "sent"
+	notificationFailed = "failed"
+)
+
+// Delivers a message on one channel
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+// Sends mail through an SMTP relay
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPNotifier(c SMTPConfig) smtpNotifier {
+	n := smtpNotifier{addr: c.Addr, from: c.From}
+	if c.Username != "" {
+		host, _, _ := strings.Cut(c.Addr, ":")
+		n.auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return n
+}
+
+func (n smtpNotifier) Send(to, subject, body string) error {
+	// Addresses go into the headers, so anything that is not exactly one
+	// address (such as one with a line break and more headers) is refused
+	from, err := mail.ParseAddress(n.from)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", rcpt.Address)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return smtp.SendMail(n.addr, n.auth, from.Address, []string{rcpt.Address}, []byte(msg.String()))
+}
+
+// Sends text messages through an HTTP gateway. Messages have no subject.
+type httpSMSNotifier struct {
+	url    string
+	token  string
+	from   string
+	client *http.Client
+}
+
+func newHTTPSMSNotifier(c SMSConfig) httpSMSNotifier {
+	return httpSMSNotifier{url: c.URL, token: c.Token, from: c.From, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n httpSMSNotifier) Send(to, subject, body string) error {
+	payload, _ := json.Marshal(map[string]string{"from": n.from, "to": to, "body": body})
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("SMS gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// What a notice template may refer to
+type noticeData struct {
+	Patron    Patron
+	Title     string
+	Barcode   string
+	Branch    string
+	DueAt     time.Time
+	ExpiresAt time.Time
+	Status    string
+}
+
+type noticeTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+var noticeFuncs = template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("Monday 2 January 2006") },
+}
+
+var defaultNoticeTemplates = map[string]TemplateConfig{
+	noticeDueSoon: {
+		Subject: "{{.Title}} is due {{date .DueAt}}",
+		Body:    "Dear {{.Patron.Name}},\n\n{{.Title}} ({{.Barcode}}) is due back on {{date .DueAt}}. You can renew it unless someone is waiting for it.\n",
+	},
+	noticeOverdue: {
+		Subject: "{{.Title}} is overdue",
+		Body:    "Dear {{.Patron.Name}},\n\n{{.Title}} ({{.Barcode}}) was due back on {{date .DueAt}}. Please return it; every day it is late adds to the fine.\n",
+	},
+	noticeHoldReady: {
+		Subject: "{{.Title}} is ready for pickup",
+		Body:    "Dear {{.Patron.Name}},\n\n{{.Title}} is waiting for you at {{.Branch}} until {{date .ExpiresAt}}.\n",
+	},
+	noticeILLStatus: {
+		Subject: "Your interlibrary loan request for {{.Title}}",
+		Body: "Dear {{.Patron.Name}},\n\n" +
+			"{{if eq .Status \"requested\"}}We have your request for {{.Title}} and will ask another library for it." +
+			"{{else if eq .Status \"sent\"}}We have asked another library to lend us {{.Title}}." +
+			"{{else if eq .Status \"received\"}}{{.Title}} has arrived from another library and is waiting for you at {{.Branch}} until {{date .ExpiresAt}}." +
+			"{{else if eq .Status \"on_loan\"}}You have borrowed {{.Title}} ({{.Barcode}}) from another library. It is due back on {{date .DueAt}}." +
+			"{{else if eq .Status \"returned\"}}{{.Title}} has gone back to the library that lent it." +
+			"{{else}}Your request for {{.Title}} has been cancelled.{{end}}\n",
+	},
+}
+
+type noticeSettings struct {
+	DueSoonDays int
+	MaxAttempts int
+	RetryDelay  time.Duration
+	Templates   map[string]noticeTemplate
+}
+
+var (
+	notices = noticeSettings{
+		DueSoonDays: 2,
+		MaxAttempts: 5,
+		RetryDelay:  15 * time.Minute,
+		Templates:   mustParseNoticeTemplates(nil),
+	}
+	notifiers = map[string]Notifier{}
+)
+
+// The longest wait between delivery attempts, however many there were
+const maxNoticeRetryDelay = 24 * time.Hour
+
+// The wait after the given number of failed attempts, doubling from
+// RetryDelay up to maxNoticeRetryDelay
+func (s noticeSettings) retryDelay(attempts int) time.Duration {
+	delay := s.RetryDelay
+	for i := 1; i < attempts && delay < maxNoticeRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxNoticeRetryDelay {
+		delay = maxNoticeRetryDelay
+	}
+	return delay
+}
+
+// Parse the template of every notice kind, the built-in one unless
+// overridden
+func parseNoticeTemplates(overrides map[string]TemplateConfig) (map[string]noticeTemplate, error) {
+	for kind := range overrides {
+		if !isValidNoticeKind(kind) {
+			return nil, fmt.Errorf("unknown notice kind %q", kind)
+		}
+	}
+
+	templates := map[string]noticeTemplate{}
+	for _, kind := range noticeKinds {
+		text := defaultNoticeTemplates[kind]
+		if t, ok := overrides[kind]; ok {
+			text = t
+		}
+		subject, err := template.New(kind + " subject").Funcs(noticeFuncs).Parse(text.Subject)
+		if err != nil {
+			return nil, err
+		}
+		body, err := template.New(kind + " body").Funcs(noticeFuncs).Parse(text.Body)
+		if err != nil {
+			return nil, err
+		}
+		templates[kind] = noticeTemplate{subject: subject, body: body}
+	}
+	return templates, nil
+}
+
+func mustParseNoticeTemplates(overrides map[string]TemplateConfig) map[string]noticeTemplate {
+	templates, err := parseNoticeTemplates(overrides)
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+// Set up the providers and templates from the configuration
+func configureNotifications(c NotificationsConfig) error {
+	if c.DueSoonDays > 0 {
+		notices.DueSoonDays = c.DueSoonDays
+	}
+	if c.MaxAttempts > 0 {
+		notices.MaxAttempts = c.MaxAttempts
+	}
+	if c.RetryDelay > 0 {
+		notices.RetryDelay = time.Duration(c.RetryDelay)
+	}
+
+	templates, err := parseNoticeTemplates(c.Templates)
+	if err != nil {
+		return err
+	}
+	notices.Templates = templates
+
+	notifiers = map[string]Notifier{}
+	if c.SMTP.Addr != "" {
+		notifiers[channelEmail] = newSMTPNotifier(c.SMTP)
+	}
+	if c.SMS.URL != "" {
+		notifiers[channelSMS] = newHTTPSMSNotifier(c.SMS)
+	}
+	return nil
+}
+
+func isValidNoticeKind(kind string) bool {
+	for _, k := range noticeKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidChannel(channel string) bool {
+	return channel == channelEmail || channel == channelSMS
+}
+
+type Notification struct {
+	ID            uint       `json:"id"`
+	PatronID      uint       `json:"patron_id"`
+	Kind          string     `json:"kind"`
+	Channel       string     `json:"channel"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	Body          string     `json:"body"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+// Create the notifications and notification preferences tables. A notice
+// is queued once per channel for its key, the event it is about.
+func createNotificationTables() {
+	notificationTablesSQL := `
+		CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			patron_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			channel TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			notice_key TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at DATETIME,
+			created_at DATETIME NOT NULL,
+			sent_at DATETIME,
+			UNIQUE (notice_key, channel),
+			FOREIGN KEY (patron_id) REFERENCES patrons (id)
+		);
+		CREATE INDEX IF NOT EXISTS notifications_queue ON notifications (status, next_attempt_at);
+		CREATE TABLE IF NOT EXISTS notification_preferences (
+			patron_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			channels TEXT NOT NULL,
+			PRIMARY KEY (patron_id, kind),
+			FOREIGN KEY (patron_id) REFERENCES patrons (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(notificationTablesSQL)
+	if err != nil {
+		log.Fatal("Failed to create notification tables:", err)
+	}
+}
+
+const notificationColumns = `id, patron_id, kind, channel, recipient, subject, body, status, attempts, last_error,
+							next_attempt_at, created_at, sent_at`
+
+func scanNotification(row interface{ Scan(...interface{}) error }) (Notification, error) {
+	var (
+		n                     Notification
+		nextAttemptAt, sentAt sql.NullTime
+	)
+	err := row.Scan(&n.ID, &n.PatronID, &n.Kind, &n.Channel, &n.Recipient, &n.Subject, &n.Body, &n.Status,
+		&n.Attempts, &n.LastError, &nextAttemptAt, &n.CreatedAt, &sentAt)
+	n.NextAttemptAt = nullTimePtr(nextAttemptAt)
+	n.SentAt = nullTimePtr(sentAt)
+	return n, err
+}
+
+func queryNotifications(q querier, where string, args ...interface{}) ([]Notification, error) {
+	rows, err := q.Query("SELECT "+notificationColumns+" FROM notifications "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// The channels a patron wants each kind of notice on
+func queryNoticePreferences(q querier, patronID uint) (map[string][]string, error) {
+	prefs := map[string][]string{}
+	for _, kind := range noticeKinds {
+		prefs[kind] = []string{defaultChannel}
+	}
+
+	rows, err := q.Query("SELECT kind, channels FROM notification_preferences WHERE patron_id = ?", patronID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, channels string
+		if err := rows.Scan(&kind, &channels); err != nil {
+			return nil, err
+		}
+		prefs[kind] = []string{}
+		if channels != "" {
+			prefs[kind] = strings.Split(channels, ",")
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// Queue a notice for the patron on each channel they want it on that is
+// set up and that they have an address for. A key already queued is left
+// alone, so an event is only told once.
+func queueNotice(q querier, patron Patron, kind, key string, data noticeData) error {
+	prefs, err := queryNoticePreferences(q, patron.ID)
+	if err != nil {
+		return err
+	}
+
+	data.Patron = patron
+	tmpl := notices.Templates[kind]
+	var subject, body strings.Builder
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := tmpl.body.Execute(&body, data); err != nil {
+		return err
+	}
+
+	for _, channel := range prefs[kind] {
+		recipient := patron.Email
+		if channel == channelSMS {
+			recipient = patron.Phone
+		}
+		if _, ok := notifiers[channel]; !ok || recipient == "" {
+			continue
+		}
+
+		_, err := q.Exec(`INSERT INTO notifications (patron_id, kind, channel, recipient, subject, body, notice_key, status,
+							next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+							ON CONFLICT (notice_key, channel) DO NOTHING`,
+			patron.ID, kind, channel, recipient, subject.String(), body.String(), key, notificationQueued, now(), now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tell the patron a ready hold has a copy waiting at its branch
+func queueHoldReadyNotice(q querier, hold Hold) error {
+	patron, err := queryPatron(q, hold.PatronID)
+	if err != nil {
+		return err
+	}
+	item, err := lookupItem(q, *hold.ItemID, "")
+	if err != nil {
+		return err
+	}
+	book, err := queryBook(q, hold.BookID)
+	if err != nil {
+		return err
+	}
+	branch, err := queryBranch(q, item.CurrentBranchID)
+	if err != nil {
+		return err
+	}
+
+	data := noticeData{Title: book.Title, Barcode: item.Barcode, Branch: branch.Name}
+	if hold.ExpiresAt != nil {
+		data.ExpiresAt = *hold.ExpiresAt
+	}
+	return queueNotice(q, patron, noticeHoldReady, fmt.Sprintf("hold_ready:%d", hold.ID), data)
+}
+
+// Queue due-soon notices for loans due within the next days and overdue
+// notices for loans past due. Each is sent once per due date, so renewed
+// loans are told again.
+func queueLoanNotices() error {
+	rows, err := db.Query(`SELECT l.id, l.patron_id, l.due_at, i.barcode, b.title
+							FROM loans AS l INNER JOIN items AS i ON i.id = l.item_id INNER JOIN books AS b ON b.id = i.book_id
+							WHERE l.returned_at IS NULL AND l.due_at <= ?`, now().AddDate(0, 0, notices.DueSoonDays))
+	if err != nil {
+		return err
+	}
+	type dueLoan struct {
+		id, patronID uint
+		data         noticeData
+	}
+	var loans []dueLoan
+	for rows.Next() {
+		var loan dueLoan
+		if err := rows.Scan(&loan.id, &loan.patronID, &loan.data.DueAt, &loan.data.Barcode, &loan.data.Title); err != nil {
+			rows.Close()
+			return err
+		}
+		loans = append(loans, loan)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, loan := range loans {
+		patron, err := queryPatron(db, loan.patronID)
+		if err != nil {
+			return err
+		}
+		kind := noticeDueSoon
+		if loan.data.DueAt.Before(now()) {
+			kind = noticeOverdue
+		}
+		key := fmt.Sprintf("%s:%d:%d", kind, loan.id, loan.data.DueAt.Unix())
+		if err := queueNotice(db, patron, kind, key, loan.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send the notices whose next attempt is due. Failures are kept on the
+// notice and retried later, so only database errors are returned.
+func deliverNotifications() error {
+	pending, err := queryNotifications(db, "WHERE status = ? AND next_attempt_at <= ? ORDER BY id",
+		notificationQueued, now())
+	if err != nil {
+		return err
+	}
+
+	for _, n := range pending {
+		err := fmt.Errorf("channel %s is not set up", n.Channel)
+		if notifier, ok := notifiers[n.Channel]; ok {
+			err = notifier.Send(n.Recipient, n.Subject, n.Body)
+		}
+
+		attempts := n.Attempts + 1
+		if err == nil {
+			_, err = db.Exec("UPDATE notifications SET status = ?, attempts = ?, last_error = '', next_attempt_at = NULL, sent_at = ? WHERE id = ?",
+				notificationSent, attempts, now(), n.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		status, next := notificationQueued, sql.NullTime{Time: now().Add(notices.retryDelay(attempts)), Valid: true}
+		if attempts >= notices.MaxAttempts {
+			status, next = notificationFailed, sql.NullTime{}
+		}
+		_, err = db.Exec("UPDATE notifications SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+			status, attempts, err.Error(), next, n.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers
+
+// List notices, newest first, narrowed by patron, status and kind
+func getNotifications(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	for _, filter := range []string{"patron_id", "status", "kind"} {
+		if value := c.Query(filter); value != "" {
+			where += " AND " + filter + " = ?"
+			args = append(args, value)
+		}
+	}
+	respondNotifications(c, where, args...)
+}
+
+func getPatronNotifications(c *gin.Context) {
+	respondNotifications(c, "WHERE patron_id = ?", c.Param("id"))
+}
+
+func getAccountNotifications(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondNotifications(c, "WHERE patron_id = ?", patronID)
+}
+
+func respondNotifications(c *gin.Context, where string, args ...interface{}) {
+	list, err := queryNotifications(db, where+" ORDER BY id DESC", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// Queue a failed notice for another round of attempts
+func retryNotification(c *gin.Context) {
+	list, err := queryNotifications(db, "WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry notification"})
+		return
+	}
+	if len(list) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+	if list[0].Status != notificationFailed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only failed notifications can be retried"})
+		return
+	}
+
+	_, err = db.Exec("UPDATE notifications SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ?",
+		notificationQueued, now(), list[0].ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry notification"})
+		return
+	}
+	list, err = queryNotifications(db, "WHERE id = ?", list[0].ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list[0])
+}
+
+func respondNoticePreferences(c *gin.Context, patronID interface{}) {
+	patron, err := queryPatron(db, patronID)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve notification preferences")
+		return
+	}
+	prefs, err := queryNoticePreferences(db, patron.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notification preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, prefs)
+}
+
+func getPatronNoticePreferences(c *gin.Context) {
+	respondNoticePreferences(c, c.Param("id"))
+}
+
+func getAccountNoticePreferences(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	respondNoticePreferences(c, patronID)
+}
+
+// Set the channels per notice kind. Kinds left out go back to the default.
+func updateNoticePreferences(c *gin.Context, patronID interface{}) {
+	var prefs map[string][]string
+	if err := c.ShouldBindJSON(&prefs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	for kind, channels := range prefs {
+		if !isValidNoticeKind(kind) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notice kind"})
+			return
+		}
+		for _, channel := range channels {
+			if !isValidChannel(channel) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel"})
+				return
+			}
+		}
+	}
+
+	var after map[string][]string
+	err := withTx(func(tx *sql.Tx) error {
+		patron, err := queryPatron(tx, patronID)
+		if err != nil {
+			return err
+		}
+		before, err := queryNoticePreferences(tx, patron.ID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM notification_preferences WHERE patron_id = ?", patron.ID); err != nil {
+			return err
+		}
+		for kind, channels := range prefs {
+			_, err := tx.Exec("INSERT INTO notification_preferences (patron_id, kind, channels) VALUES (?, ?, ?)",
+				patron.ID, kind, strings.Join(channels, ","))
+			if err != nil {
+				return err
+			}
+		}
+		if after, err = queryNoticePreferences(tx, patron.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "notification_preferences", patron.ID, before, after)
+	})
+	if err != nil {
+		respondCirculationError(c, err, "Failed to update notification preferences")
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func updatePatronNoticePreferences(c *gin.Context) {
+	updateNoticePreferences(c, c.Param("id"))
+}
+
+func updateAccountNoticePreferences(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	updateNoticePreferences(c, patronID)
+}
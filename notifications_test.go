@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A local SMTP server keeping the messages it is sent
+type smtpSink struct {
+	addr     string
+	mu       sync.Mutex
+	messages []string
+}
+
+func startSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sink := &smtpSink{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(textproto.NewConn(conn))
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) serve(conn *textproto.Conn) {
+	defer conn.Close()
+	conn.PrintfLine("220 sink ready")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "DATA":
+			conn.PrintfLine("354 go ahead")
+			data, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			conn.PrintfLine("250 queued")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *smtpSink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// A local SMS gateway keeping the messages it is sent, refusing them while
+// fail is set
+type smsGateway struct {
+	mu       sync.Mutex
+	fail     bool
+	messages []map[string]string
+}
+
+func startSMSGateway(t *testing.T) (*smsGateway, string) {
+	t.Helper()
+	gateway := &smsGateway{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gateway.mu.Lock()
+		defer gateway.mu.Unlock()
+		if gateway.fail || r.Header.Get("Authorization") != "Bearer sms-token" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var message map[string]string
+		json.NewDecoder(r.Body).Decode(&message)
+		gateway.messages = append(gateway.messages, message)
+	}))
+	t.Cleanup(server.Close)
+	return gateway, server.URL
+}
+
+func useNotifications(t *testing.T, c NotificationsConfig) {
+	t.Helper()
+	prevNotices, prevNotifiers := notices, notifiers
+	t.Cleanup(func() { notices, notifiers = prevNotices, prevNotifiers })
+	if err := configureNotifications(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotificationDelivery(t *testing.T) {
+	setupIsolated(t)
+	sink := startSMTPSink(t)
+	gateway, gatewayURL := startSMSGateway(t)
+	useNotifications(t, NotificationsConfig{
+		SMTP: SMTPConfig{Addr: sink.addr, From: "library@example.org"},
+		SMS:  SMSConfig{URL: gatewayURL, Token: "sms-token", From: "LIBRARY"},
+		Templates: map[string]TemplateConfig{
+			noticeDueSoon: {Subject: "Due soon: {{.Title}}", Body: "Hi {{.Patron.Name}}, {{.Barcode}} is due {{date .DueAt}}."},
+		},
+	})
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	bob := createTestPatron(t, "bob", 0)
+	db.Exec("UPDATE patrons SET email = name || '@example.org', phone = '555-0100'")
+	createTestItems(t, librarian, "30001", "30002")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+	checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID})
+	placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID})
+
+	recorder := doJSON("PUT", "/api/patrons/2/notification-preferences", librarian, gin.H{"hold_ready": []string{"email", "pigeon"}})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("PUT", "/api/patrons/2/notification-preferences", librarian, gin.H{"hold_ready": []string{"email", "sms"}})
+	var prefs map[string][]string
+	json.NewDecoder(recorder.Body).Decode(&prefs)
+	if len(prefs[noticeHoldReady]) != 2 || len(prefs[noticeOverdue]) != 1 || prefs[noticeOverdue][0] != channelEmail {
+		t.Errorf("Unexpected preferences %+v", prefs)
+	}
+	doJSON("PUT", "/api/patrons/1/notification-preferences", librarian, gin.H{"overdue": []string{}})
+
+	// The returned copy is held for bob, who hears about it both ways
+	doJSON("POST", "/api/loans/1/return", librarian, nil)
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 2", now().Add(24*time.Hour))
+	if err := queueLoanNotices(); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverNotifications(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := sink.received()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 emails, but got %q", messages)
+	}
+	if !strings.Contains(messages[0], "To: bob@example.org") || !strings.Contains(messages[0], "Subject: Book 1 is ready for pickup") ||
+		!strings.Contains(messages[0], "waiting for you at Branch main") {
+		t.Errorf("Unexpected hold notice %q", messages[0])
+	}
+	if !strings.Contains(messages[1], "Subject: Due soon: Book 1") || !strings.Contains(messages[1], "Hi alice, 30002 is due") {
+		t.Errorf("Unexpected due-soon notice %q", messages[1])
+	}
+	if len(gateway.messages) != 1 || gateway.messages[0]["to"] != "555-0100" || gateway.messages[0]["from"] != "LIBRARY" {
+		t.Errorf("Unexpected text messages %+v", gateway.messages)
+	}
+
+	// Nothing is told twice, and alice wants no overdue notices
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 2", now().Add(-time.Hour))
+	queueLoanNotices()
+	deliverNotifications()
+	if messages := sink.received(); len(messages) != 2 {
+		t.Errorf("Expected no more emails, but got %q", messages[2:])
+	}
+
+	recorder = doJSON("GET", "/api/notifications?status=sent", librarian, nil)
+	var sent []Notification
+	json.NewDecoder(recorder.Body).Decode(&sent)
+	if len(sent) != 3 || sent[0].Kind != noticeDueSoon || sent[0].SentAt == nil {
+		t.Errorf("Unexpected notification log %+v", sent)
+	}
+}
+
+func TestNotificationRetries(t *testing.T) {
+	setupIsolated(t)
+	gateway, gatewayURL := startSMSGateway(t)
+	gateway.fail = true
+	useNotifications(t, NotificationsConfig{SMS: SMSConfig{URL: gatewayURL, Token: "sms-token"}, MaxAttempts: 2})
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	db.Exec("UPDATE patrons SET email = 'alice@example.org', phone = '555-0100'")
+	doJSON("PUT", "/api/patrons/1/notification-preferences", librarian, gin.H{"due_soon": []string{"email", "sms"}})
+	createTestItems(t, librarian, "30001")
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+	db.Exec("UPDATE loans SET due_at = ? WHERE id = 1", now().Add(time.Hour))
+
+	// Email is not set up, so only a text message is queued
+	queueLoanNotices()
+	deliverNotifications()
+	list, _ := queryNotifications(db, "")
+	if len(list) != 1 || list[0].Status != notificationQueued || list[0].Attempts != 1 ||
+		!list[0].NextAttemptAt.Equal(now().Add(15*time.Minute)) || list[0].LastError == "" {
+		t.Fatalf("Unexpected notifications %+v", list)
+	}
+
+	// Retries wait for their time, then give up
+	deliverNotifications()
+	db.Exec("UPDATE notifications SET next_attempt_at = ?", now())
+	deliverNotifications()
+	list, _ = queryNotifications(db, "")
+	if list[0].Status != notificationFailed || list[0].Attempts != 2 {
+		t.Fatalf("Unexpected notification %+v", list[0])
+	}
+
+	gateway.fail = false
+	recorder := doJSON("POST", "/api/notifications/1/retry", librarian, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	deliverNotifications()
+	recorder = doJSON("GET", "/api/patrons/1/notifications", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&list)
+	if len(list) != 1 || list[0].Status != notificationSent || len(gateway.messages) != 1 {
+		t.Errorf("Unexpected notifications %+v", list)
+	}
+	recorder = doJSON("POST", "/api/notifications/1/retry", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+}
+
+func TestSMTPAddresses(t *testing.T) {
+	// Nothing listens here, so only a refused address returns before dialling
+	n := newSMTPNotifier(SMTPConfig{Addr: "127.0.0.1:1", From: "library@example.org"})
+	for _, to := range []string{"alice@example.org\r\nBcc: mallory@example.org", "not an address", ""} {
+		if err := n.Send(to, "Subject", "Body"); err == nil || !strings.Contains(err.Error(), "invalid recipient") {
+			t.Errorf("Expected %q to be refused, but got %v", to, err)
+		}
+	}
+	n = newSMTPNotifier(SMTPConfig{Addr: "127.0.0.1:1", From: "library@example.org\r\nBcc: mallory@example.org"})
+	if err := n.Send("alice@example.org", "Subject", "Body"); err == nil || !strings.Contains(err.Error(), "invalid sender") {
+		t.Errorf("Expected the sender to be refused, but got %v", err)
+	}
+}
+
+func TestNoticeRetryDelay(t *testing.T) {
+	s := noticeSettings{RetryDelay: 15 * time.Minute}
+	for _, tt := range []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 15 * time.Minute},
+		{3, time.Hour},
+		{7, 16 * time.Hour},
+		{8, maxNoticeRetryDelay},
+		{100, maxNoticeRetryDelay},
+	} {
+		if delay := s.retryDelay(tt.attempts); delay != tt.delay {
+			t.Errorf("After %d attempts: expected %s, but got %s", tt.attempts, tt.delay, delay)
+		}
+	}
+}
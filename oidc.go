@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// How long a started sign-in may take before the callback is refused
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	oidc *oidcClient
+
+	errOIDCNoAccount = errors.New("no account for this identity")
+)
+
+// Relying party for the configured OpenID Connect provider. The discovery
+// document and signing keys are fetched on first use.
+type oidcClient struct {
+	config     OIDCConfig
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]interface{}
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims read from the provider's ID token
+type oidcIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// Create the sign-in state and linked identity tables
+func createOIDCTables() {
+	oidcStatesTableSQL := `
+		CREATE TABLE IF NOT EXISTS oidc_states (
+			state TEXT PRIMARY KEY,
+			nonce TEXT NOT NULL,
+			code_verifier TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+		);`
+	_, err = db.Exec(oidcStatesTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create oidc_states table:", err)
+	}
+
+	userIdentitiesTableSQL := `
+		CREATE TABLE IF NOT EXISTS user_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (issuer, subject),
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(userIdentitiesTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create user_identities table:", err)
+	}
+}
+
+// Enable OpenID Connect login when an issuer is configured
+func configureOIDC(c OIDCConfig) {
+	oidc = nil
+	if c.Issuer == "" {
+		return
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	if c.DefaultRole == "" {
+		c.DefaultRole = roleMember
+	}
+	oidc = &oidcClient{config: c, httpClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (o *oidcClient) getJSON(rawURL string, v interface{}) error {
+	resp, err := o.httpClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (o *oidcClient) getDiscovery() (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := o.getJSON(strings.TrimSuffix(o.config.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, o.config.Issuer)
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+// Look up a provider signing key, refetching the key set once for unknown
+// key IDs since the provider may have rotated its keys
+func (o *oidcClient) getKey(kid string) (interface{}, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := o.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if public, err := parseJWK(k); err == nil {
+			keys[k.Kid] = public
+		}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (o *oidcClient) authorizationURL(state, nonce, codeVerifier string) (string, error) {
+	d, err := o.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {strings.Join(o.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange an authorization code and verify the returned ID token
+func (o *oidcClient) exchange(code, codeVerifier, nonce string) (oidcIdentity, error) {
+	d, err := o.getDiscovery()
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return oidcIdentity{}, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return oidcIdentity{}, err
+	}
+
+	return o.verifyIDToken(body.IDToken, nonce)
+}
+
+func (o *oidcClient) verifyIDToken(idToken, nonce string) (oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, errors.New("unexpected signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return o.getKey(kid)
+	})
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	if !claims.VerifyIssuer(o.config.Issuer, true) {
+		return oidcIdentity{}, errors.New("unexpected issuer")
+	}
+	if !audienceContains(claims["aud"], o.config.ClientID) {
+		return oidcIdentity{}, errors.New("unexpected audience")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return oidcIdentity{}, errors.New("missing expiry")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return oidcIdentity{}, errors.New("nonce mismatch")
+	}
+
+	identity := oidcIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	if identity.Subject == "" {
+		return oidcIdentity{}, errors.New("missing subject")
+	}
+	return identity, nil
+}
+
+// The aud claim is either a single string or an array of strings
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find the local account for an identity: a linked identity first, then an
+// account with the same verified email, then a new account if allowed.
+// Whatever is found is linked so later sign-ins match by subject.
+func (o *oidcClient) resolveUser(identity oidcIdentity) (User, error) {
+	var user User
+	err := db.QueryRow(`SELECT u.id, u.username, COALESCE(u.email, ''), u.role, u.disabled FROM users AS u
+						INNER JOIN user_identities AS ui ON u.id = ui.user_id
+						WHERE ui.issuer = ? AND ui.subject = ?`, o.config.Issuer, identity.Subject).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Disabled)
+	if err == nil {
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		return User{}, err
+	}
+
+	if identity.Email != "" && identity.EmailVerified {
+		err = db.QueryRow("SELECT id, username, COALESCE(email, ''), role, disabled FROM users WHERE email = ?", identity.Email).
+			Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Disabled)
+		if err != nil && err != sql.ErrNoRows {
+			return User{}, err
+		}
+	}
+
+	if user.ID == 0 {
+		if !o.config.AutoCreateUsers {
+			return User{}, errOIDCNoAccount
+		}
+
+		username := identity.PreferredUsername
+		if username == "" {
+			username = identity.Email
+		}
+		if username == "" {
+			username = identity.Subject
+		}
+		user = User{Username: username, Role: o.config.DefaultRole}
+		if identity.EmailVerified {
+			user.Email = identity.Email
+		}
+		if user, err = storeUser(user, ""); err != nil {
+			return User{}, err
+		}
+	}
+
+	_, err = db.Exec("INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)",
+		o.config.Issuer, identity.Subject, user.ID, now())
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Handlers
+
+func oidcStart(c *gin.Context) {
+	if oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OpenID Connect login is not configured"})
+		return
+	}
+
+	state, err1 := randomToken(16)
+	nonce, err2 := randomToken(16)
+	codeVerifier, err3 := randomToken(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO oidc_states (state, nonce, code_verifier, expires_at) VALUES (?, ?, ?, ?)",
+		state, nonce, codeVerifier, now().Add(oidcStateTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	redirect, err := oidc.authorizationURL(state, nonce, codeVerifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirect)
+}
+
+func oidcCallback(c *gin.Context) {
+	if oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OpenID Connect login is not configured"})
+		return
+	}
+
+	if providerError := c.Query("error"); providerError != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": providerError})
+		return
+	}
+
+	// Each state can complete one sign-in
+	var (
+		nonce, codeVerifier string
+		expiresAt           time.Time
+	)
+	state := c.Query("state")
+	err := db.QueryRow("SELECT nonce, code_verifier, expires_at FROM oidc_states WHERE state = ?", state).
+		Scan(&nonce, &codeVerifier, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+		return
+	}
+	if _, err := db.Exec("DELETE FROM oidc_states WHERE state = ? OR expires_at < ?", state, now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+		return
+	}
+	if !expiresAt.After(now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+		return
+	}
+
+	identity, err := oidc.exchange(c.Query("code"), codeVerifier, nonce)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization code"})
+		return
+	}
+
+	user, err := oidc.resolveUser(identity)
+	if err != nil {
+		if err == errOIDCNoAccount {
+			c.JSON(http.StatusForbidden, gin.H{"error": "No account for this identity"})
+			return
+		}
+		if err == errUsernameTaken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already taken"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+		return
+	}
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	// The provider's sign-in does not stand in for the account's own second
+	// factor, so accounts with an authenticator continue at /login/totp
+	if respondMFARequired(c, user.ID, "Failed to complete login") {
+		return
+	}
+
+	token, err := issueTokens(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, token)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Local OpenID Connect issuer that hands out one ID token per authorization code
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+	code   string
+	nonce  string
+	pkce   string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key, code: "auth-code"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.server.URL,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kty: "RSA",
+			Kid: "mock",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != m.code || clientID != "library" || clientSecret != "secret" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != m.pkce {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":   m.server.URL,
+			"aud":   []string{"library"},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": m.nonce,
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "mock"
+		idToken, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// Start a sign-in, let the mock issuer approve it and return the callback response
+func (m *mockIssuer) signIn(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := doJSON("GET", "/auth/oidc/start", "", nil)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Expected status 302, but got %d", recorder.Code)
+	}
+
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	query := location.Query()
+	if location.Path != "/authorize" || query.Get("client_id") != "library" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Unexpected authorization URL %s", location)
+	}
+	m.nonce = query.Get("nonce")
+	m.pkce = query.Get("code_challenge")
+
+	return doJSON("GET", "/auth/oidc/callback?code="+m.code+"&state="+query.Get("state"), "", nil)
+}
+
+func configureMockOIDC(m *mockIssuer, autoCreate bool) {
+	configureOIDC(OIDCConfig{
+		Issuer:          m.server.URL,
+		ClientID:        "library",
+		ClientSecret:    "secret",
+		RedirectURL:     "http://localhost:8080/auth/oidc/callback",
+		AutoCreateUsers: autoCreate,
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	setupIsolated(t)
+	t.Cleanup(func() { configureOIDC(OIDCConfig{}) })
+	m := newMockIssuer(t)
+	configureMockOIDC(m, false)
+
+	// Existing account matched by verified email
+	storeUser(User{Username: "alice", Email: "alice@example.org", Role: roleLibrarian}, "")
+	m.claims = jwt.MapClaims{"sub": "provider-1", "email": "alice@example.org", "email_verified": true}
+
+	recorder := m.signIn(t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var token Token
+	json.NewDecoder(recorder.Body).Decode(&token)
+	claims, err := parseAccessToken(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "alice" || claims.Role != roleLibrarian {
+		t.Errorf("Expected a library token for alice, but got %+v", claims)
+	}
+
+	// Later sign-ins match the linked subject even when the email changes
+	m.claims = jwt.MapClaims{"sub": "provider-1", "email": "alice@elsewhere.org", "email_verified": true}
+	recorder = m.signIn(t)
+	json.NewDecoder(recorder.Body).Decode(&token)
+	if claims, _ := parseAccessToken(token.Token); claims == nil || claims.Username != "alice" {
+		t.Errorf("Expected the linked account, but got status %d", recorder.Code)
+	}
+
+	// Accounts with an authenticator still need its code
+	db.Exec("INSERT INTO user_totp (user_id, secret, enabled, created_at) VALUES (1, 'JBSWY3DPEHPK3PXP', 1, ?)", now())
+	recorder = m.signIn(t)
+	var step1 struct {
+		MFARequired bool   `json:"mfa_required"`
+		Challenge   string `json:"challenge"`
+		Token       string `json:"token"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&step1)
+	if recorder.Code != http.StatusOK || !step1.MFARequired || step1.Challenge == "" || step1.Token != "" {
+		t.Errorf("Expected a second factor challenge, but got %d %+v", recorder.Code, step1)
+	}
+	db.Exec("DELETE FROM user_totp")
+
+	// Unverified emails and unknown identities are refused
+	m.claims = jwt.MapClaims{"sub": "provider-2", "email": "alice@example.org", "email_verified": false}
+	recorder = m.signIn(t)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+}
+
+func TestOIDCAutoCreate(t *testing.T) {
+	setupIsolated(t)
+	t.Cleanup(func() { configureOIDC(OIDCConfig{}) })
+	m := newMockIssuer(t)
+	configureMockOIDC(m, true)
+
+	m.claims = jwt.MapClaims{"sub": "provider-3", "preferred_username": "bob", "email": "bob@example.org", "email_verified": true}
+	recorder := m.signIn(t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	user, hash, err := getUserByUsername("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != roleMember || user.Email != "bob@example.org" || hash != "" {
+		t.Errorf("Unexpected account %+v", user)
+	}
+
+	// The created account has no password to log in with
+	recorder = doJSON("POST", "/login", "", User{Username: "bob", Password: ""})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
+
+func TestOIDCCallbackErrors(t *testing.T) {
+	setupIsolated(t)
+	t.Cleanup(func() { configureOIDC(OIDCConfig{}) })
+
+	recorder := doJSON("GET", "/auth/oidc/start", "", nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 while unconfigured, but got %d", recorder.Code)
+	}
+
+	m := newMockIssuer(t)
+	configureMockOIDC(m, true)
+	m.claims = jwt.MapClaims{"sub": "provider-4"}
+
+	recorder = doJSON("GET", "/auth/oidc/callback?code=auth-code&state=forged", "", nil)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown state, but got %d", recorder.Code)
+	}
+
+	// A wrong code is rejected by the issuer
+	m.code = "other-code"
+	recorder = doJSON("GET", "/auth/oidc/start", "", nil)
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	recorder = doJSON("GET", "/auth/oidc/callback?code=auth-code&state="+location.Query().Get("state"), "", nil)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	// A replayed ID token fails the nonce check
+	m.code = "auth-code"
+	recorder = m.signIn(t)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", "/auth/oidc/start", "", nil)
+	location, _ = url.Parse(recorder.Header().Get("Location"))
+	recorder = doJSON("GET", "/auth/oidc/callback?code=auth-code&state="+location.Query().Get("state"), "", nil)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,6 +17,9 @@ type Book struct {
 	Title         string `json:"title"`
 	PublishedYear int    `json:"published_year"`
 	ISBN          string `json:"isbn"`
+
+	// Only filled in for a single book
+	Availability *Availability `json:"availability,omitempty"`
 }
 
 type Author struct {
@@ -27,19 +31,65 @@ type Author struct {
 type User struct {
 	ID       uint   `json:"id"`
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
 }
 
 type Token struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
 }
 
 var (
 	db  *sql.DB
 	err error
+
+	// Current time as stored in the database, replaceable in tests
+	now = func() time.Time { return time.Now().UTC().Truncate(time.Second) }
 )
 
-// Create the books and authors tables
+// Satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Run fn in a transaction, committing if it returns nil
+func withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Statuses and messages that a module's sentinel errors are answered with
+type errorResponses map[error]struct {
+	status  int
+	message string
+}
+
+// Respond with the first of the tables to match err, or 500 with fallback
+func respondError(c *gin.Context, err error, fallback string, tables ...errorResponses) {
+	for _, table := range tables {
+		if e, ok := table[err]; ok {
+			c.JSON(e.status, gin.H{"error": e.message})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
+
+// Create the books, authors and supporting tables
 func createTables() {
 	booksTableSQL := `
 		CREATE TABLE IF NOT EXISTS books (
@@ -75,39 +125,88 @@ func createTables() {
 	if err != nil {
 		log.Fatal("Failed to create books_authors table:", err)
 	}
+
+	createUserTables()
+	createTokenTables()
+	createOIDCTables()
+	createAPIKeyTables()
+	createTOTPTables()
+	createLockoutTables()
+	createAuditTables()
+	createBranchTables()
+	createCalendarTables()
+	createPatronTables()
+	createItemTables()
+	createTransferTables()
+	createLoanTables()
+	createHoldTables()
+	createPolicyTables()
+	createFineTables()
+	createNotificationTables()
+	createSchedulerTables()
+	createILLTables()
+	createAcquisitionTables()
+	createSerialTables()
 }
 
 // Auth middleware
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenString := c.GetHeader("Authorization")
-		tokenString = strings.Split(tokenString, "Bearer ")[1]
+		// Machine clients authenticate with an API key instead of a token
+		if key := apiKeyFromRequest(c); key != "" {
+			authenticateAPIKey(c, key)
+			return
+		}
+
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
 		if tokenString == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte("JtQmEYnaYDj476+w+NmsXwWS8sBcftCgVwuhupDK+YW9ohM7W/mi+BM7n3uxaKL9Z1p5OQ4Ory634Yz7"), nil
-		})
-
+		claims, err := parseAccessToken(tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
 
-		if _, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			c.Next()
+		revoked, err := isTokenRevoked(claims.Id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check token"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
 			return
 		}
 
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		c.Abort()
+		// Expose the caller to the permission middleware and handlers
+		c.Set("user_id", claims.Subject)
+		c.Set("username", claims.Username)
+		c.Set("role", claims.Role)
+		c.Set("jti", claims.Id)
+		c.Next()
 	}
 }
 
+func queryBook(q querier, id interface{}) (Book, error) {
+	var book Book
+	err := q.QueryRow("SELECT id, title, published_year, isbn FROM books WHERE id = ?", id).
+		Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN)
+	return book, err
+}
+
+func queryAuthor(q querier, id interface{}) (Author, error) {
+	var author Author
+	err := q.QueryRow("SELECT id, name, country FROM authors WHERE id = ?", id).
+		Scan(&author.ID, &author.Name, &author.Country)
+	return author, err
+}
+
 // Handlers
 
 func createBook(c *gin.Context) {
@@ -123,8 +222,15 @@ func createBook(c *gin.Context) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book"})
+		return
+	}
+	defer tx.Rollback()
+
 	// Create the book
-	stmt, err := db.Prepare("INSERT INTO books (title, published_year, isbn) VALUES (?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO books (title, published_year, isbn) VALUES (?, ?, ?)")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book"})
 		return
@@ -133,13 +239,22 @@ func createBook(c *gin.Context) {
 
 	var r sql.Result
 	r, err = stmt.Exec(book.Title, book.PublishedYear, book.ISBN)
-	id, _ := r.LastInsertId()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book"})
 		return
 	}
-
+	id, _ := r.LastInsertId()
 	book.ID = uint(id)
+
+	if err := recordAudit(tx, c, auditCreate, "book", book.ID, nil, book); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book"})
+		return
+	}
+
 	c.JSON(http.StatusCreated, book)
 }
 
@@ -167,9 +282,7 @@ func getBooks(c *gin.Context) {
 func getBook(c *gin.Context) {
 	id := c.Param("id")
 
-	var book Book
-	err := db.QueryRow("SELECT id, title, published_year, isbn FROM books WHERE id = ?", id).
-		Scan(&book.ID, &book.Title, &book.PublishedYear, &book.ISBN)
+	book, err := queryBook(db, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
@@ -179,6 +292,28 @@ func getBook(c *gin.Context) {
 		return
 	}
 
+	// Counts at one branch only, if asked for
+	var branchID uint
+	if s := c.Query("branch_id"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid branch_id"})
+			return
+		}
+		branchID = uint(id)
+	}
+
+	availability, err := getBookAvailability(db, book.ID, branchID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	if availability.ByBranch, err = getBranchAvailability(db, book.ID, branchID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve book"})
+		return
+	}
+	book.Availability = &availability
+
 	c.JSON(http.StatusOK, book)
 }
 
@@ -197,8 +332,25 @@ func updateBook(c *gin.Context) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := queryBook(tx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+		return
+	}
+
 	// Update the book
-	stmt, err := db.Prepare("UPDATE books SET title = ?, published_year = ?, isbn = ? WHERE id = ?")
+	stmt, err := tx.Prepare("UPDATE books SET title = ?, published_year = ?, isbn = ? WHERE id = ?")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
 		return
@@ -210,6 +362,16 @@ func updateBook(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
 		return
 	}
+	book.ID = before.ID
+
+	if err := recordAudit(tx, c, auditUpdate, "book", book.ID, before, book); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+		return
+	}
 
 	c.JSON(http.StatusOK, book)
 }
@@ -217,22 +379,59 @@ func updateBook(c *gin.Context) {
 func deleteBook(c *gin.Context) {
 	id := c.Param("id")
 
-	stmt, err := db.Prepare("DELETE FROM books WHERE id = ?")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := queryBook(tx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
+		return
+	}
+
+	// Copies have to be withdrawn and deleted first, and a book that was
+	// held, borrowed in or ordered keeps its history
+	var users int
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM items WHERE book_id = ?) +
+					(SELECT COUNT(*) FROM holds WHERE book_id = ?) +
+					(SELECT COUNT(*) FROM ill_requests WHERE book_id = ?) +
+					(SELECT COUNT(*) FROM order_lines WHERE book_id = ?)`,
+		before.ID, before.ID, before.ID, before.ID).Scan(&users)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
+		return
+	}
+	if users > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Book still has items, holds, interlibrary loans or orders"})
+		return
+	}
+
+	stmt, err := tx.Prepare("DELETE FROM books WHERE id = ?")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
 		return
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(id)
+	_, err = stmt.Exec(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+	if err := recordAudit(tx, c, auditDelete, "book", before.ID, before, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete book"})
 		return
 	}
 
@@ -252,8 +451,15 @@ func createAuthor(c *gin.Context) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create author"})
+		return
+	}
+	defer tx.Rollback()
+
 	// Create the author
-	stmt, err := db.Prepare("INSERT INTO authors (name, country) VALUES (?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO authors (name, country) VALUES (?, ?)")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create author"})
 		return
@@ -267,6 +473,16 @@ func createAuthor(c *gin.Context) {
 	}
 	id, _ := r.LastInsertId()
 	author.ID = uint(id)
+
+	if err := recordAudit(tx, c, auditCreate, "author", author.ID, nil, author); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create author"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create author"})
+		return
+	}
+
 	c.JSON(http.StatusCreated, author)
 }
 
@@ -294,9 +510,7 @@ func getAuthors(c *gin.Context) {
 func getAuthor(c *gin.Context) {
 	id := c.Param("id")
 
-	var author Author
-	err := db.QueryRow("SELECT id, name, country FROM authors WHERE id = ?", id).
-		Scan(&author.ID, &author.Name, &author.Country)
+	author, err := queryAuthor(db, id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Author not found"})
@@ -324,8 +538,25 @@ func updateAuthor(c *gin.Context) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update author"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := queryAuthor(tx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Author not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update author"})
+		return
+	}
+
 	// Update the author
-	stmt, err := db.Prepare("UPDATE authors SET name = ?, country = ? WHERE id = ?")
+	stmt, err := tx.Prepare("UPDATE authors SET name = ?, country = ? WHERE id = ?")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update author"})
 		return
@@ -337,6 +568,16 @@ func updateAuthor(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update author"})
 		return
 	}
+	author.ID = before.ID
+
+	if err := recordAudit(tx, c, auditUpdate, "author", author.ID, before, author); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update author"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update author"})
+		return
+	}
 
 	c.JSON(http.StatusOK, author)
 }
@@ -344,22 +585,42 @@ func updateAuthor(c *gin.Context) {
 func deleteAuthor(c *gin.Context) {
 	id := c.Param("id")
 
-	stmt, err := db.Prepare("DELETE FROM authors WHERE id = ?")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete author"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := queryAuthor(tx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Author not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete author"})
+		return
+	}
+
+	stmt, err := tx.Prepare("DELETE FROM authors WHERE id = ?")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete author"})
 		return
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(id)
+	_, err = stmt.Exec(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete author"})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Author not found"})
+	if err := recordAudit(tx, c, auditDelete, "author", before.ID, before, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete author"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete author"})
 		return
 	}
 
@@ -419,10 +680,17 @@ func getAuthorsByBook(c *gin.Context) {
 }
 
 func linkBookToAuthor(c *gin.Context) {
-	BookID := c.Param("book_id")
+	BookID := c.Param("id")
 	AuthorID := c.Param("author_id")
 
-	stmt, err := db.Prepare("INSERT INTO books_authors (book_id, author_id) VALUES (?, ?)")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link book to author"})
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO books_authors (book_id, author_id) VALUES (?, ?)")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link book to author"})
 		return
@@ -434,6 +702,16 @@ func linkBookToAuthor(c *gin.Context) {
 		return
 	}
 
+	link := gin.H{"book_id": BookID, "author_id": AuthorID}
+	if err := recordAudit(tx, c, auditLink, "book", BookID, nil, link); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link book to author"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link book to author"})
+		return
+	}
+
 	c.JSON(http.StatusNoContent, nil)
 }
 
@@ -444,26 +722,265 @@ func login(c *gin.Context) {
 		return
 	}
 
-	// Authenticate user ()
-	if user.Username != "zegen" || user.Password != "zegen" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if refuseThrottledLogin(c, user.Username) {
 		return
 	}
 
-	// Generate JWT token
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["username"] = user.Username
-	tokenString, err := token.SignedString([]byte("JtQmEYnaYDj476+w+NmsXwWS8sBcftCgVwuhupDK+YW9ohM7W/mi+BM7n3uxaKL9Z1p5OQ4Ory634Yz7"))
+	// Authenticate user
+	stored, err := authenticator.Authenticate(user.Username, user.Password)
+	if err != nil {
+		if err == errInvalidCredentials {
+			if err := recordLoginFailure(user.Username, c.ClientIP()); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if stored.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	// Accounts with an authenticator continue at /login/totp
+	if respondMFARequired(c, stored.ID, "Failed to authenticate") {
+		return
+	}
+
+	// A successful login resets the failure count
+	if err := clearLoginFailures(stored.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+
+	// Generate JWT and refresh tokens
+	token, err := issueTokens(stored)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+	c.JSON(http.StatusOK, token)
+}
+
+// Register the public and protected routes on r
+func registerRoutes(r *gin.Engine) {
+	// Public routes
+	r.POST("/login", login)
+	r.POST("/login/totp", loginTOTP)
+	r.POST("/register", register)
+	r.POST("/refresh", refresh)
+	r.POST("/logout", logout)
+	r.GET("/.well-known/jwks.json", getJWKS)
+	r.GET("/branches/:id/calendar.ics", getBranchICal)
+	r.GET("/auth/oidc/start", oidcStart)
+	r.GET("/auth/oidc/callback", oidcCallback)
+
+	// Protected routes
+	api := r.Group("/api")
+	api.Use(authMiddleware())
+
+	{
+		api.GET("/books", requirePermission(permCatalogRead), getBooks)
+		api.POST("/books", requirePermission(permCatalogWrite), createBook)
+		api.GET("/books/:id", requirePermission(permCatalogRead), getBook)
+		api.PUT("/books/:id", requirePermission(permCatalogWrite), updateBook)
+		api.DELETE("/books/:id", requirePermission(permCatalogDelete), deleteBook)
+
+		api.GET("/authors", requirePermission(permCatalogRead), getAuthors)
+		api.POST("/authors", requirePermission(permCatalogWrite), createAuthor)
+		api.GET("/authors/:id", requirePermission(permCatalogRead), getAuthor)
+		api.PUT("/authors/:id", requirePermission(permCatalogWrite), updateAuthor)
+		api.DELETE("/authors/:id", requirePermission(permCatalogDelete), deleteAuthor)
+
+		api.POST("/books/:id/authors/:author_id", requirePermission(permCatalogWrite), linkBookToAuthor)
+		api.GET("/authors/:id/books", requirePermission(permCatalogRead), getBooksByAuthor)
+		api.GET("/books/:id/authors", requirePermission(permCatalogRead), getAuthorsByBook)
+
+		api.GET("/books/:id/items", requirePermission(permCatalogRead), getItems)
+		api.POST("/books/:id/items", requirePermission(permCatalogWrite), createItem)
+		api.GET("/books/:id/items/:item_id", requirePermission(permCatalogRead), getItem)
+		api.PUT("/books/:id/items/:item_id", requirePermission(permCatalogWrite), updateItem)
+		api.DELETE("/books/:id/items/:item_id", requirePermission(permCatalogDelete), deleteItem)
+
+		api.GET("/books/:id/loans", requirePermission(permCirculation), getBookLoans)
+		api.GET("/books/:id/holds", requirePermission(permCirculation), getBookHolds)
+
+		api.GET("/loans", requirePermission(permCirculation), getLoans)
+		api.POST("/loans", requirePermission(permCirculation), createLoan)
+		api.GET("/loans/:id", requirePermission(permCirculation), getLoan)
+		api.POST("/loans/:id/return", requirePermission(permCirculation), returnLoanHandler)
+		api.POST("/loans/:id/renew", requirePermission(permCirculation), renewLoanHandler)
+		api.POST("/loans/:id/lost", requirePermission(permCirculation), lostLoanHandler)
+		api.GET("/patrons", requirePermission(permCirculation), getPatrons)
+		api.POST("/patrons", requirePermission(permCirculation), createPatron)
+		api.GET("/patrons/:id", requirePermission(permCirculation), getPatron)
+		api.PUT("/patrons/:id", requirePermission(permCirculation), updatePatron)
+		api.DELETE("/patrons/:id", requirePermission(permCirculation), deletePatron)
+		api.POST("/patrons/:id/renew-card", requirePermission(permCirculation), renewPatronCard)
+		api.POST("/patrons/:id/block", requirePermission(permCirculation), blockPatron)
+		api.POST("/patrons/:id/unblock", requirePermission(permCirculation), unblockPatron)
+		api.GET("/patrons/:id/loans", requirePermission(permCirculation), getPatronLoans)
+		api.GET("/loan-policies", requirePermission(permCirculation), getLoanPolicies)
+		api.POST("/loan-policies", requirePermission(permPolicyManage), createLoanPolicy)
+		api.POST("/loan-policies/simulate", requirePermission(permCirculation), simulateCheckout)
+		api.GET("/loan-policies/:id", requirePermission(permCirculation), getLoanPolicy)
+		api.PUT("/loan-policies/:id", requirePermission(permPolicyManage), updateLoanPolicy)
+		api.DELETE("/loan-policies/:id", requirePermission(permPolicyManage), deleteLoanPolicy)
+		api.GET("/holds", requirePermission(permCirculation), getHolds)
+		api.POST("/holds", requirePermission(permCirculation), createHold)
+		api.DELETE("/holds/:id", requirePermission(permCirculation), cancelHold)
+		api.GET("/patrons/:id/holds", requirePermission(permCirculation), getPatronHolds)
+		api.GET("/patrons/:id/ledger", requirePermission(permCirculation), getPatronLedger)
+		api.POST("/patrons/:id/payments", requirePermission(permCirculation), createPayment)
+		api.POST("/patrons/:id/waivers", requirePermission(permCirculation), createWaiver)
+		api.GET("/patrons/:id/notifications", requirePermission(permCirculation), getPatronNotifications)
+		api.GET("/patrons/:id/notification-preferences", requirePermission(permCirculation), getPatronNoticePreferences)
+		api.PUT("/patrons/:id/notification-preferences", requirePermission(permCirculation), updatePatronNoticePreferences)
+		api.GET("/notifications", requirePermission(permCirculation), getNotifications)
+		api.POST("/notifications/:id/retry", requirePermission(permCirculation), retryNotification)
+
+		api.GET("/branches", requirePermission(permCatalogRead), getBranches)
+		api.POST("/branches", requirePermission(permBranchesManage), createBranch)
+		api.GET("/branches/:id", requirePermission(permCatalogRead), getBranch)
+		api.PUT("/branches/:id", requirePermission(permBranchesManage), updateBranch)
+		api.DELETE("/branches/:id", requirePermission(permBranchesManage), deleteBranch)
+		api.GET("/branches/:id/hours", requirePermission(permCatalogRead), getOpeningHours)
+		api.PUT("/branches/:id/hours", requirePermission(permBranchesManage), setOpeningHours)
+		api.GET("/branches/:id/closures", requirePermission(permCatalogRead), getClosures)
+		api.POST("/branches/:id/closures", requirePermission(permBranchesManage), createClosure)
+		api.POST("/branches/:id/closures/import", requirePermission(permBranchesManage), importClosures)
+		api.DELETE("/branches/:id/closures/:closure_id", requirePermission(permBranchesManage), deleteClosure)
+		api.GET("/transfers", requirePermission(permCirculation), getTransfers)
+		api.POST("/transfers", requirePermission(permCirculation), createTransfer)
+		api.GET("/transfers/:id", requirePermission(permCirculation), getTransfer)
+		api.POST("/transfers/:id/ship", requirePermission(permCirculation), shipTransferHandler)
+		api.POST("/transfers/:id/receive", requirePermission(permCirculation), receiveTransferHandler)
+		api.POST("/transfers/:id/cancel", requirePermission(permCirculation), cancelTransferHandler)
+		api.GET("/partners", requirePermission(permCirculation), getPartners)
+		api.POST("/partners", requirePermission(permBranchesManage), createPartner)
+		api.GET("/partners/:id", requirePermission(permCirculation), getPartner)
+		api.PUT("/partners/:id", requirePermission(permBranchesManage), updatePartner)
+		api.DELETE("/partners/:id", requirePermission(permBranchesManage), deletePartner)
+		api.GET("/ill-requests", requirePermission(permCirculation), getILLRequests)
+		api.POST("/ill-requests", requirePermission(permCirculation), createILLRequest)
+		api.GET("/ill-requests/:id", requirePermission(permCirculation), getILLRequest)
+		api.POST("/ill-requests/:id/send", requirePermission(permCirculation), sendILLRequestHandler)
+		api.POST("/ill-requests/:id/receive", requirePermission(permCirculation), receiveILLRequestHandler)
+		api.POST("/ill-requests/:id/return", requirePermission(permCirculation), returnILLRequestHandler)
+		api.POST("/ill-requests/:id/cancel", requirePermission(permCirculation), cancelILLRequestHandler)
+		api.GET("/vendors", requirePermission(permAcquisitions), getVendors)
+		api.POST("/vendors", requirePermission(permAcquisitions), createVendor)
+		api.GET("/vendors/:id", requirePermission(permAcquisitions), getVendor)
+		api.PUT("/vendors/:id", requirePermission(permAcquisitions), updateVendor)
+		api.DELETE("/vendors/:id", requirePermission(permAcquisitions), deleteVendor)
+		api.GET("/funds", requirePermission(permAcquisitions), getFunds)
+		api.POST("/funds", requirePermission(permAcquisitions), createFund)
+		api.GET("/funds/encumbrances", requirePermission(permAcquisitions), getEncumbranceReport)
+		api.GET("/funds/:id", requirePermission(permAcquisitions), getFund)
+		api.PUT("/funds/:id", requirePermission(permAcquisitions), updateFund)
+		api.DELETE("/funds/:id", requirePermission(permAcquisitions), deleteFund)
+		api.GET("/purchase-orders", requirePermission(permAcquisitions), getPurchaseOrders)
+		api.POST("/purchase-orders", requirePermission(permAcquisitions), createPurchaseOrder)
+		api.GET("/purchase-orders/:id", requirePermission(permAcquisitions), getPurchaseOrder)
+		api.POST("/purchase-orders/:id/lines", requirePermission(permAcquisitions), addOrderLineHandler)
+		api.DELETE("/purchase-orders/:id/lines/:line_id", requirePermission(permAcquisitions), deleteOrderLine)
+		api.POST("/purchase-orders/:id/place", requirePermission(permAcquisitions), placeOrderHandler)
+		api.POST("/purchase-orders/:id/lines/:line_id/receive", requirePermission(permAcquisitions), receiveOrderLineHandler)
+		api.POST("/purchase-orders/:id/cancel", requirePermission(permAcquisitions), cancelOrderHandler)
+		api.GET("/serials", requirePermission(permCatalogRead), getSerials)
+		api.POST("/serials", requirePermission(permCatalogWrite), createSerial)
+		api.GET("/serials/:id", requirePermission(permCatalogRead), getSerial)
+		api.PUT("/serials/:id", requirePermission(permCatalogWrite), updateSerial)
+		api.DELETE("/serials/:id", requirePermission(permCatalogDelete), deleteSerial)
+		api.GET("/subscriptions", requirePermission(permAcquisitions), getSubscriptions)
+		api.POST("/subscriptions", requirePermission(permAcquisitions), createSubscription)
+		api.GET("/subscriptions/:id", requirePermission(permAcquisitions), getSubscription)
+		api.GET("/subscriptions/:id/issues", requirePermission(permAcquisitions), getSubscriptionIssues)
+		api.POST("/subscriptions/:id/renew", requirePermission(permAcquisitions), renewSubscriptionHandler)
+		api.POST("/subscriptions/:id/cancel", requirePermission(permAcquisitions), cancelSubscriptionHandler)
+		api.GET("/serial-issues/late", requirePermission(permAcquisitions), getLateIssues)
+		api.POST("/serial-issues/:id/receive", requirePermission(permAcquisitions), receiveIssueHandler)
+		api.POST("/serial-issues/:id/claim", requirePermission(permAcquisitions), claimIssueHandler)
+		api.POST("/ncip", requirePermission(permCirculation), handleNCIP)
+
+		api.GET("/audit", requirePermission(permAuditRead), getAuditLog)
+	}
+
+	// Account routes, available to every role
+	account := api.Group("/account")
+
+	{
+		account.GET("/api-keys", getAPIKeys)
+		account.POST("/api-keys", createAPIKey)
+		account.DELETE("/api-keys/:id", revokeAPIKey)
+
+		account.POST("/totp", enrollTOTP)
+		account.POST("/totp/verify", verifyTOTPEnrollment)
+		account.DELETE("/totp", disableTOTP)
+
+		account.GET("/patron", getAccountPatron)
+		account.GET("/loans", getAccountLoans)
+		account.GET("/holds", getAccountHolds)
+		account.GET("/ledger", getAccountLedger)
+		account.GET("/notifications", getAccountNotifications)
+		account.GET("/notification-preferences", getAccountNoticePreferences)
+		account.PUT("/notification-preferences", updateAccountNoticePreferences)
+		account.POST("/holds", createAccountHold)
+		account.DELETE("/holds/:id", cancelAccountHold)
+		account.GET("/ill-requests", getAccountILLRequests)
+		account.POST("/ill-requests", createAccountILLRequest)
+	}
+
+	// Admin routes
+	admin := api.Group("/admin")
+	admin.Use(requirePermission(permUsersManage))
+
+	{
+		admin.GET("/users", getUsers)
+		admin.POST("/users", createUserAccount)
+		admin.PUT("/users/:id/disable", disableUser)
+		admin.PUT("/users/:id/enable", enableUser)
+		admin.PUT("/users/:id/role", updateUserRole)
+		admin.POST("/users/:id/unlock", unlockUser)
+		admin.POST("/addresses/:ip/unlock", unlockAddress)
+		admin.GET("/lockouts", getLockouts)
+		admin.GET("/auth-events", getAuthEvents)
+		admin.POST("/tokens/revoke", revokeToken)
+		admin.GET("/api-keys", getAllAPIKeys)
+		admin.DELETE("/api-keys/:id", revokeAnyAPIKey)
+		admin.GET("/jobs", getJobs)
+		admin.GET("/jobs/:name/runs", getJobRuns)
+		admin.POST("/jobs/:name/run", triggerJob)
+	}
 }
 
 func main() {
+	// Load configuration
+	config, err = loadConfig(configPath())
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	if err = configureTokens(config.JWT); err != nil {
+		log.Fatal("Failed to load signing keys:", err)
+	}
+	configureOIDC(config.OIDC)
+	if err = configureAuthenticator(config.Auth); err != nil {
+		log.Fatal("Failed to configure authentication:", err)
+	}
+	configureLockout(config.Auth.Lockout)
+	configureFines(config.Fines)
+	if err = configureNotifications(config.Notifications); err != nil {
+		log.Fatal("Failed to configure notifications:", err)
+	}
+	if err = configureScheduler(config.Scheduler); err != nil {
+		log.Fatal("Failed to configure the scheduler:", err)
+	}
+	configureSIP2(config.SIP2)
+
 	// Initialize database
 	db, _ = sql.Open("sqlite3", "./library.db?_foreign_keys=on")
 	if err != nil {
@@ -497,32 +1014,22 @@ func main() {
 						PRIMARY KEY (book_id, author_id)
 					)`)
 
+	// Create the remaining tables and the bootstrap account
+	createTables()
+	seedAdminUser()
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
+	registerRoutes(r)
 
-	// Public routes
-	r.POST("/login", login)
-
-	// Protected routes
-	api := r.Group("/api")
-	api.Use(authMiddleware())
+	// Expire holds, accrue fines, send notices and clean up in the background
+	go runScheduler()
 
-	{
-		api.GET("/books", getBooks)
-		api.POST("/books", createBook)
-		api.GET("/books/:id", getBook)
-		api.PUT("/books/:id", updateBook)
-		api.DELETE("/books/:id", deleteBook)
-
-		api.GET("/authors", getAuthors)
-		api.POST("/authors", createAuthor)
-		api.GET("/authors/:id", getAuthor)
-		api.PUT("/authors/:id", updateAuthor)
-		api.DELETE("/authors/:id", deleteAuthor)
-
-		api.POST("/books/:book_id/authors/:author_id", linkBookToAuthor)
-		api.GET("/authors/:id/books", getBooksByAuthor)
-		api.GET("/books/:id/authors", getAuthorsByBook)
+	// Self-check machines connect over SIP2 when it is configured
+	if config.SIP2.Addr != "" {
+		if err = startSIP2Server(config.SIP2.Addr); err != nil {
+			log.Fatal("Failed to start the SIP2 server:", err)
+		}
 	}
 
 	r.Run(":8080")
@@ -32,7 +32,8 @@ func setupRoutes() {
 	router.GET("/authors/:id", getAuthor)
 	router.PUT("/authors/:id", updateAuthor)
 	router.DELETE("/authors/:id", deleteAuthor)
-	router.POST("/books/:book_id/authors/:author_id", linkBookToAuthor)
+	router.POST("/books/:id/authors/:author_id", linkBookToAuthor)
+	registerRoutes(router)
 }
 
 func TestCreateBook(t *testing.T) {
@@ -103,7 +104,7 @@ func TestGetBook(t *testing.T) {
 	}
 
 	// Check the response body
-	expectedResponseBody := `{"id":1,"title":"Book 1","published_year":2022,"isbn":"123456789011x"}`
+	expectedResponseBody := `{"id":1,"title":"Book 1","published_year":2022,"isbn":"123456789011x","availability":{"total":0,"available":0}}`
 	if recorder.Body.String() != expectedResponseBody {
 		t.Errorf("Expected response body '%s', but got '%s'", expectedResponseBody, recorder.Body.String())
 	}
@@ -142,6 +143,42 @@ func TestDeleteBook(t *testing.T) {
 	}
 }
 
+// Books that were held or borrowed in are refused with a 409, also with
+// foreign keys enforced as they are in production
+func TestDeleteBookWithHistory(t *testing.T) {
+	setupIsolated(t)
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatal(err)
+	}
+	admin := tokenFor(t, "admin", roleAdmin)
+	patron := createTestPatron(t, "alice", 0)
+	branch := createTestBranch(t, "main")
+	for _, isbn := range []string{"9780000000001", "9780000000002", "9780000000003"} {
+		if _, err := db.Exec("INSERT INTO books (title, published_year, isbn) VALUES ('Book', 2022, ?)", isbn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec("INSERT INTO holds (book_id, patron_id, status, placed_at, closed_at) VALUES (1, ?, ?, ?, ?)",
+		patron.ID, holdCancelled, now(), now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO ill_requests (patron_id, book_id, pickup_branch_id, status, requested_at) VALUES (?, 2, ?, ?, ?)",
+		patron.ID, branch.ID, illRequested, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/books/1", "/api/books/2"} {
+		if recorder := doJSON("DELETE", path, admin, nil); recorder.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for %s, but got %d", path, recorder.Code)
+		}
+	}
+	if recorder := doJSON("DELETE", "/api/books/3", admin, nil); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+}
+
 // Helper function to insert a book into the database
 func insertBook(title string, publishedYear int, isbn string) {
 	stmt, _ := db.Prepare("DELETE FROM books;INSERT INTO books (title, published_year, isbn) VALUES (?, ?, ?)")
@@ -285,7 +322,7 @@ func TestIntegration(t *testing.T) {
 	router.ServeHTTP(recorderBook, requestBook)
 
 	// Verify the response
-	expectedResponseBody := `{"id":1,"title":"Book 1","published_year":2022,"isbn":"123456789011x"}`
+	expectedResponseBody := `{"id":1,"title":"Book 1","published_year":2022,"isbn":"123456789011x","availability":{"total":0,"available":0}}`
 	if recorderBook.Body.String() != expectedResponseBody {
 		t.Errorf("Expected response body '%s', but got '%s'", expectedResponseBody, recorderBook.Body.String())
 	}
@@ -368,9 +405,15 @@ func setup() {
 	// Connect to the in-memory SQLite database for testing
 	db, _ = sql.Open("sqlite3", ":memory:")
 
+	// An in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+
 	// Create the tables for testing
 	createTables()
 
+	// Sign tokens with a key generated for this run
+	signingKeys, _ = loadKeySet(JWTConfig{})
+
 	// Set the router to use the test database
 	router.Use(func(c *gin.Context) {
 		c.Set("db", db)
@@ -381,6 +424,16 @@ func setup() {
 	setupRoutes()
 }
 
+// Give a test its own database and router, restoring the shared ones afterwards
+func setupIsolated(t *testing.T) {
+	prevDB, prevRouter := db, router
+	setup()
+	t.Cleanup(func() {
+		teardown()
+		db, router = prevDB, prevRouter
+	})
+}
+
 func TestMain(m *testing.M) {
 	// Set up test environment
 	setup()
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Patron statuses. Blocked patrons keep their record but may not borrow.
+const (
+	patronActive  = "active"
+	patronBlocked = "blocked"
+)
+
+// Category of patrons added without one, as lending rules see them
+const defaultPatronCategory = "adult"
+
+// How long a new or renewed library card is valid
+const cardValidity = 365 * 24 * time.Hour
+
+var (
+	errCardExpired      = errors.New("library card has expired")
+	errPatronHasHistory = errors.New("patron has circulation history")
+	errUnknownUser      = errors.New("unknown user account")
+)
+
+// A borrower. Patrons may have a login account, linked through UserID,
+// to reach their own loans, holds and fines under /account.
+type Patron struct {
+	ID            uint      `json:"id"`
+	UserID        *uint     `json:"user_id,omitempty"`
+	Name          string    `json:"name"`
+	Email         string    `json:"email"`
+	Phone         string    `json:"phone"`
+	Address       string    `json:"address"`
+	Category      string    `json:"category"`
+	CardNumber    string    `json:"card_number"`
+	CardExpiresAt time.Time `json:"card_expires_at"`
+	HomeBranchID  *uint     `json:"home_branch_id,omitempty"`
+	Status        string    `json:"status"`
+	BlockedReason string    `json:"blocked_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Create the patrons table
+func createPatronTables() {
+	patronsTableSQL := `
+		CREATE TABLE IF NOT EXISTS patrons (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER UNIQUE,
+			name TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			phone TEXT NOT NULL DEFAULT '',
+			address TEXT NOT NULL DEFAULT '',
+			category TEXT NOT NULL,
+			card_number TEXT NOT NULL UNIQUE,
+			card_expires_at DATETIME NOT NULL,
+			home_branch_id INTEGER,
+			status TEXT NOT NULL,
+			blocked_reason TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL,
+			FOREIGN KEY (home_branch_id) REFERENCES branches (id)
+		);`
+	_, err = db.Exec(patronsTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create patrons table:", err)
+	}
+}
+
+const patronColumns = `id, user_id, name, email, phone, address, category, card_number, card_expires_at,
+					home_branch_id, status, blocked_reason, created_at`
+
+func scanPatron(row interface{ Scan(...interface{}) error }) (Patron, error) {
+	var (
+		patron       Patron
+		userID       sql.NullInt64
+		homeBranchID sql.NullInt64
+	)
+	err := row.Scan(&patron.ID, &userID, &patron.Name, &patron.Email, &patron.Phone, &patron.Address,
+		&patron.Category, &patron.CardNumber, &patron.CardExpiresAt, &homeBranchID,
+		&patron.Status, &patron.BlockedReason, &patron.CreatedAt)
+	if userID.Valid {
+		id := uint(userID.Int64)
+		patron.UserID = &id
+	}
+	if homeBranchID.Valid {
+		id := uint(homeBranchID.Int64)
+		patron.HomeBranchID = &id
+	}
+	return patron, err
+}
+
+func queryPatron(q querier, id interface{}) (Patron, error) {
+	patron, err := scanPatron(q.QueryRow("SELECT "+patronColumns+" FROM patrons WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return patron, errPatronNotFound
+	}
+	return patron, err
+}
+
+func queryPatronByCard(q querier, cardNumber string) (Patron, error) {
+	patron, err := scanPatron(q.QueryRow("SELECT "+patronColumns+" FROM patrons WHERE card_number = ?", cardNumber))
+	if err == sql.ErrNoRows {
+		return patron, errPatronNotFound
+	}
+	return patron, err
+}
+
+// Check that the patron exists and may borrow
+func lookupPatron(q querier, patronID interface{}) (Patron, error) {
+	patron, err := queryPatron(q, patronID)
+	if err != nil {
+		return patron, err
+	}
+	if patron.Status == patronBlocked {
+		return patron, errPatronBlocked
+	}
+	if patron.CardExpiresAt.Before(now()) {
+		return patron, errCardExpired
+	}
+	return patron, nil
+}
+
+// Check that the patron may borrow, with their card in order and owing no
+// more than the fine limit
+func checkPatronMayBorrow(q querier, patronID uint) error {
+	if _, err := lookupPatron(q, patronID); err != nil {
+		return err
+	}
+	return checkFinesOwed(q, patronID)
+}
+
+// The patron the calling account borrows as. Accounts and API keys without
+// a patron record get errPatronNotFound.
+func accountPatronID(c *gin.Context) (uint, error) {
+	var id uint
+	err := db.QueryRow("SELECT id FROM patrons WHERE user_id = ?", c.GetString("user_id")).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errPatronNotFound
+	}
+	return id, err
+}
+
+// Check a patron from a request body, filling in defaults
+func validatePatron(patron *Patron) string {
+	if patron.Category == "" {
+		patron.Category = defaultPatronCategory
+	}
+	if patron.CardExpiresAt.IsZero() {
+		patron.CardExpiresAt = now().Add(cardValidity)
+	}
+	if patron.Name == "" || patron.CardNumber == "" {
+		return "Missing required fields"
+	}
+	return ""
+}
+
+// Respond with the error of a patron change
+func respondPatronError(c *gin.Context, err error, fallback string) {
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Card number or account already in use"})
+		return
+	}
+	respondCirculationError(c, err, fallback)
+}
+
+// Check the home branch of a patron from a request body, if it has one
+func checkPatronBranch(q querier, patron Patron) error {
+	if patron.HomeBranchID == nil {
+		return nil
+	}
+	return checkBranch(q, *patron.HomeBranchID)
+}
+
+// Check the login account of a patron from a request body, if it has one
+func checkPatronUser(q querier, patron Patron) error {
+	if patron.UserID == nil {
+		return nil
+	}
+	if _, err := queryUser(q, *patron.UserID); err != nil {
+		if err == sql.ErrNoRows {
+			return errUnknownUser
+		}
+		return err
+	}
+	return nil
+}
+
+// Handlers
+
+// Search by name, card number or email, narrowed by status and category
+func getPatrons(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	if q := c.Query("q"); q != "" {
+		where += " AND (name LIKE ? OR card_number = ? OR email LIKE ?)"
+		args = append(args, "%"+q+"%", q, "%"+q+"%")
+	}
+	if status := c.Query("status"); status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	if category := c.Query("category"); category != "" {
+		where += " AND category = ?"
+		args = append(args, category)
+	}
+
+	rows, err := db.Query("SELECT "+patronColumns+" FROM patrons "+where+" ORDER BY name, id", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve patrons"})
+		return
+	}
+	defer rows.Close()
+
+	patrons := []Patron{}
+	for rows.Next() {
+		patron, err := scanPatron(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve patrons"})
+			return
+		}
+		patrons = append(patrons, patron)
+	}
+
+	c.JSON(http.StatusOK, patrons)
+}
+
+func getPatron(c *gin.Context) {
+	patron, err := queryPatron(db, c.Param("id"))
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+
+	c.JSON(http.StatusOK, patron)
+}
+
+func getAccountPatron(c *gin.Context) {
+	patronID, err := accountPatronID(c)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+	patron, err := queryPatron(db, patronID)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve patron")
+		return
+	}
+
+	c.JSON(http.StatusOK, patron)
+}
+
+func createPatron(c *gin.Context) {
+	var patron Patron
+	if err := c.ShouldBindJSON(&patron); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validatePatron(&patron); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	patron.Status = patronActive
+	patron.BlockedReason = ""
+	patron.CreatedAt = now()
+
+	err := withTx(func(tx *sql.Tx) error {
+		if err := checkPatronBranch(tx, patron); err != nil {
+			return err
+		}
+		if err := checkPatronUser(tx, patron); err != nil {
+			return err
+		}
+		r, err := tx.Exec(`INSERT INTO patrons (user_id, name, email, phone, address, category, card_number, card_expires_at,
+							home_branch_id, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			patron.UserID, patron.Name, patron.Email, patron.Phone, patron.Address, patron.Category, patron.CardNumber,
+			patron.CardExpiresAt, patron.HomeBranchID, patron.Status, patron.CreatedAt)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		patron.ID = uint(id)
+		return recordAudit(tx, c, auditCreate, "patron", patron.ID, nil, patron)
+	})
+	if err != nil {
+		respondPatronError(c, err, "Failed to create patron")
+		return
+	}
+
+	c.JSON(http.StatusCreated, patron)
+}
+
+// Update the patron's details. Status and card expiry have their own
+// endpoints.
+func updatePatron(c *gin.Context) {
+	var patron Patron
+	if err := c.ShouldBindJSON(&patron); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validatePatron(&patron); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var after Patron
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryPatron(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := checkPatronBranch(tx, patron); err != nil {
+			return err
+		}
+		if err := checkPatronUser(tx, patron); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE patrons SET user_id = ?, name = ?, email = ?, phone = ?, address = ?, category = ?,
+							card_number = ?, home_branch_id = ? WHERE id = ?`,
+			patron.UserID, patron.Name, patron.Email, patron.Phone, patron.Address, patron.Category,
+			patron.CardNumber, patron.HomeBranchID, before.ID)
+		if err != nil {
+			return err
+		}
+		if after, err = queryPatron(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "patron", after.ID, before, after)
+	})
+	if err != nil {
+		respondPatronError(c, err, "Failed to update patron")
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func deletePatron(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryPatron(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		// Everything that points at the patron is kept: loans, holds, fines,
+		// interlibrary loans and the notices sent to them
+		var history int
+		err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM loans WHERE patron_id = ?) + (SELECT COUNT(*) FROM holds WHERE patron_id = ?) +
+						(SELECT COUNT(*) FROM ledger_entries WHERE patron_id = ?) + (SELECT COUNT(*) FROM ill_requests WHERE patron_id = ?) +
+						(SELECT COUNT(*) FROM notifications WHERE patron_id = ?)`,
+			before.ID, before.ID, before.ID, before.ID, before.ID).Scan(&history)
+		if err != nil {
+			return err
+		}
+		if history > 0 {
+			return errPatronHasHistory
+		}
+
+		if _, err := tx.Exec("DELETE FROM patrons WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "patron", before.ID, before, nil)
+	})
+	if err != nil {
+		respondCirculationError(c, err, "Failed to delete patron")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Run a change to an existing patron and respond with the result
+func respondPatronChange(c *gin.Context, change func(tx *sql.Tx, patron Patron) error, fallback string) {
+	var after Patron
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryPatron(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := change(tx, before); err != nil {
+			return err
+		}
+		if after, err = queryPatron(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "patron", after.ID, before, after)
+	})
+	if err != nil {
+		respondCirculationError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+// Extend the card by a year from its expiry, or from today once expired,
+// unless the body names the new expiry
+func renewPatronCard(c *gin.Context) {
+	var body struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	respondPatronChange(c, func(tx *sql.Tx, patron Patron) error {
+		expiresAt := patron.CardExpiresAt
+		if expiresAt.Before(now()) {
+			expiresAt = now()
+		}
+		expiresAt = expiresAt.Add(cardValidity)
+		if body.ExpiresAt != nil {
+			expiresAt = body.ExpiresAt.UTC()
+		}
+		_, err := tx.Exec("UPDATE patrons SET card_expires_at = ? WHERE id = ?", expiresAt, patron.ID)
+		return err
+	}, "Failed to renew card")
+}
+
+func blockPatron(c *gin.Context) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	respondPatronChange(c, func(tx *sql.Tx, patron Patron) error {
+		_, err := tx.Exec("UPDATE patrons SET status = ?, blocked_reason = ? WHERE id = ?", patronBlocked, body.Reason, patron.ID)
+		return err
+	}, "Failed to block patron")
+}
+
+func unblockPatron(c *gin.Context) {
+	respondPatronChange(c, func(tx *sql.Tx, patron Patron) error {
+		_, err := tx.Exec("UPDATE patrons SET status = ?, blocked_reason = '' WHERE id = ?", patronActive, patron.ID)
+		return err
+	}, "Failed to unblock patron")
+}
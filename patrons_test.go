@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Add an active patron with a valid card, linked to the account if userID
+// is not zero
+func createTestPatron(t *testing.T, name string, userID uint) Patron {
+	t.Helper()
+	patron := Patron{Name: name, CardNumber: "C-" + name}
+	validatePatron(&patron)
+	if userID != 0 {
+		patron.UserID = &userID
+	}
+	r, err := db.Exec(`INSERT INTO patrons (user_id, name, category, card_number, card_expires_at, status, created_at)
+					VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		patron.UserID, patron.Name, patron.Category, patron.CardNumber, patron.CardExpiresAt, patronActive, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := r.LastInsertId()
+	patron.ID = uint(id)
+	return patron
+}
+
+func TestPatronCRUD(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	member := tokenFor(t, "member", roleMember)
+
+	recorder := doJSON("POST", "/api/patrons", librarian, Patron{Name: "Alice Liddell", Email: "alice@example.org", CardNumber: "20001"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var patron Patron
+	json.NewDecoder(recorder.Body).Decode(&patron)
+	if patron.Category != defaultPatronCategory || patron.Status != patronActive || !patron.CardExpiresAt.After(now()) {
+		t.Errorf("Unexpected patron %+v", patron)
+	}
+
+	doJSON("POST", "/api/patrons", librarian, Patron{Name: "Bob Bobson", CardNumber: "20002", Category: "child"})
+	for _, tt := range []struct {
+		body   Patron
+		status int
+	}{
+		{Patron{Name: "Carol", CardNumber: "20001"}, http.StatusConflict},
+		{Patron{Name: "Carol"}, http.StatusBadRequest},
+	} {
+		recorder := doJSON("POST", "/api/patrons", librarian, tt.body)
+		if recorder.Code != tt.status {
+			t.Errorf("Expected status %d, but got %d", tt.status, recorder.Code)
+		}
+	}
+	if recorder := doJSON("GET", "/api/patrons", member, nil); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+
+	for _, tt := range []struct {
+		query string
+		count int
+	}{
+		{"", 2},
+		{"?q=alice", 1},
+		{"?q=20002", 1},
+		{"?category=child", 1},
+		{"?status=blocked", 0},
+	} {
+		recorder := doJSON("GET", "/api/patrons"+tt.query, librarian, nil)
+		var patrons []Patron
+		json.NewDecoder(recorder.Body).Decode(&patrons)
+		if len(patrons) != tt.count {
+			t.Errorf("%s: expected %d patrons, but got %d", tt.query, tt.count, len(patrons))
+		}
+	}
+
+	recorder = doJSON("PUT", "/api/patrons/1", librarian, Patron{Name: "Alice Liddell", Phone: "555-0100", CardNumber: "20001", Category: "staff"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var updated Patron
+	json.NewDecoder(recorder.Body).Decode(&updated)
+	if updated.Phone != "555-0100" || updated.Category != "staff" || !updated.CardExpiresAt.Equal(patron.CardExpiresAt) {
+		t.Errorf("Unexpected patron %+v", updated)
+	}
+
+	recorder = doJSON("DELETE", "/api/patrons/2", librarian, nil)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", "/api/patrons/2", librarian, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+
+	// Patrons link to accounts that exist, one patron each
+	user, _, _ := getUserByUsername("member")
+	missing := uint(99)
+	for _, tt := range []struct {
+		method, path string
+		body         Patron
+		status       int
+	}{
+		{"PUT", "/api/patrons/1", Patron{Name: "Alice Liddell", CardNumber: "20001", UserID: &missing}, http.StatusBadRequest},
+		{"POST", "/api/patrons", Patron{Name: "Carol", CardNumber: "20003", UserID: &missing}, http.StatusBadRequest},
+		{"PUT", "/api/patrons/1", Patron{Name: "Alice Liddell", CardNumber: "20001", UserID: &user.ID}, http.StatusOK},
+		{"POST", "/api/patrons", Patron{Name: "Carol", CardNumber: "20003", UserID: &user.ID}, http.StatusConflict},
+	} {
+		if recorder := doJSON(tt.method, tt.path, librarian, tt.body); recorder.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, but got %d", tt.method, tt.path, tt.status, recorder.Code)
+		}
+	}
+}
+
+func TestPatronBlocksAndCards(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	alice := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001", "30002")
+
+	recorder := doJSON("POST", "/api/patrons/1/block", librarian, gin.H{})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/patrons/1/block", librarian, gin.H{"reason": "Address unknown"})
+	var patron Patron
+	json.NewDecoder(recorder.Body).Decode(&patron)
+	if patron.Status != patronBlocked || patron.BlockedReason != "Address unknown" {
+		t.Errorf("Unexpected patron %+v", patron)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID}); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", status)
+	}
+
+	doJSON("POST", "/api/patrons/1/unblock", librarian, nil)
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID}); status != http.StatusCreated {
+		t.Errorf("Expected status 201, but got %d", status)
+	}
+
+	// An expired card is renewed from today
+	db.Exec("UPDATE patrons SET card_expires_at = ? WHERE id = 1", now().Add(-time.Hour))
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID}); status != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", status)
+	}
+	recorder = doJSON("POST", "/api/patrons/1/renew-card", librarian, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	json.NewDecoder(recorder.Body).Decode(&patron)
+	if !patron.CardExpiresAt.Equal(now().Add(cardValidity)) {
+		t.Errorf("Unexpected card expiry %v", patron.CardExpiresAt)
+	}
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID}); status != http.StatusCreated {
+		t.Errorf("Expected status 201, but got %d", status)
+	}
+
+	// Patrons with loans are kept
+	recorder = doJSON("DELETE", "/api/patrons/1", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+}
+
+// Patrons something still points at are refused with a 409, also with
+// foreign keys enforced as they are in production
+func TestDeleteWithHistory(t *testing.T) {
+	setupIsolated(t)
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatal(err)
+	}
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian, "30001")
+	alice := createTestPatron(t, "alice", 0)
+	bob := createTestPatron(t, "bob", 0)
+	carol := createTestPatron(t, "carol", 0)
+
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO notifications (patron_id, kind, channel, recipient, subject, body, notice_key, status, created_at)
+			VALUES (?, ?, 'email', 'alice@example.org', '', '', 'alice', ?, ?)`, []interface{}{alice.ID, noticeHoldReady, notificationSent, now()}},
+		{"INSERT INTO ill_requests (patron_id, book_id, pickup_branch_id, status, requested_at) VALUES (?, 1, 1, ?, ?)",
+			[]interface{}{bob.ID, illRequested, now()}},
+		{"INSERT INTO notification_preferences (patron_id, kind, channels) VALUES (?, ?, 'email')", []interface{}{carol.ID, noticeHoldReady}},
+	} {
+		if _, err := db.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		patron Patron
+		status int
+	}{
+		{alice, http.StatusConflict},
+		{bob, http.StatusConflict},
+		{carol, http.StatusNoContent},
+	} {
+		path := "/api/patrons/" + strconv.Itoa(int(tt.patron.ID))
+		if recorder := doJSON("DELETE", path, librarian, nil); recorder.Code != tt.status {
+			t.Errorf("%s: expected status %d, but got %d", path, tt.status, recorder.Code)
+		}
+	}
+}
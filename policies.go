@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lending rules for an item type lent to a patron category at a branch,
+// named by its code. Empty criteria match anything.
+type LoanPolicy struct {
+	ID             uint   `json:"id,omitempty"`
+	PatronCategory string `json:"patron_category"`
+	ItemType       string `json:"item_type"`
+	Branch         string `json:"branch"`
+	LoanDays       int    `json:"loan_days"`
+	MaxRenewals    int    `json:"max_renewals"`
+	MaxLoans       int    `json:"max_loans"`
+
+	// Fees in cents. MaxFine of 0 leaves overdue fines uncapped.
+	FinePerDay int64 `json:"fine_per_day"`
+	MaxFine    int64 `json:"max_fine"`
+	LostFee    int64 `json:"lost_fee"`
+}
+
+// Applied when no rule matches. MaxLoans of 0 means no limit.
+var defaultLoanPolicy = LoanPolicy{LoanDays: 21, MaxRenewals: 2, FinePerDay: 25, MaxFine: 1000, LostFee: 2500}
+
+var (
+	errLoanPolicyNotFound = errors.New("loan policy not found")
+	errLoanLimit          = errors.New("patron has reached the loan limit")
+)
+
+// Create the loan policies table
+func createPolicyTables() {
+	policiesTableSQL := `
+		CREATE TABLE IF NOT EXISTS loan_policies (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			patron_category TEXT NOT NULL DEFAULT '',
+			item_type TEXT NOT NULL DEFAULT '',
+			branch TEXT NOT NULL DEFAULT '',
+			loan_days INTEGER NOT NULL,
+			max_renewals INTEGER NOT NULL,
+			max_loans INTEGER NOT NULL,
+			fine_per_day INTEGER NOT NULL DEFAULT 0,
+			max_fine INTEGER NOT NULL DEFAULT 0,
+			lost_fee INTEGER NOT NULL DEFAULT 0,
+			UNIQUE (patron_category, item_type, branch)
+		);`
+	_, err = db.Exec(policiesTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create loan policies table:", err)
+	}
+}
+
+const policyColumns = "id, patron_category, item_type, branch, loan_days, max_renewals, max_loans, fine_per_day, max_fine, lost_fee"
+
+func scanLoanPolicy(row interface{ Scan(...interface{}) error }) (LoanPolicy, error) {
+	var policy LoanPolicy
+	err := row.Scan(&policy.ID, &policy.PatronCategory, &policy.ItemType, &policy.Branch,
+		&policy.LoanDays, &policy.MaxRenewals, &policy.MaxLoans, &policy.FinePerDay, &policy.MaxFine, &policy.LostFee)
+	return policy, err
+}
+
+func queryLoanPolicy(q querier, id interface{}) (LoanPolicy, error) {
+	policy, err := scanLoanPolicy(q.QueryRow("SELECT "+policyColumns+" FROM loan_policies WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return policy, errLoanPolicyNotFound
+	}
+	return policy, err
+}
+
+// Pick the rule matching the most criteria, earliest first on a tie. The
+// branch is the one the copy is lent from, its current branch.
+func resolveLoanPolicy(q querier, patron Patron, item Item) (LoanPolicy, error) {
+	policy, err := scanLoanPolicy(q.QueryRow("SELECT "+policyColumns+` FROM loan_policies
+		WHERE patron_category IN ('', ?) AND item_type IN ('', ?)
+			AND branch IN ('', (SELECT code FROM branches WHERE id = ?))
+		ORDER BY (patron_category != '') + (item_type != '') + (branch != '') DESC, id LIMIT 1`,
+		patron.Category, item.ItemType, item.CurrentBranchID))
+	if err == sql.ErrNoRows {
+		return defaultLoanPolicy, nil
+	}
+	return policy, err
+}
+
+// Check whether the patron may borrow the item, without changing anything
+func evaluateCheckout(q querier, item Item, patronID uint) (LoanPolicy, error) {
+	patron, err := lookupPatron(q, patronID)
+	if err != nil {
+		return LoanPolicy{}, err
+	}
+	if err := checkFinesOwed(q, patronID); err != nil {
+		return LoanPolicy{}, err
+	}
+
+	switch item.Status {
+	case itemAvailable:
+	case itemOnHold:
+		heldFor, err := heldItemPatron(q, item.ID)
+		if err != nil {
+			return LoanPolicy{}, err
+		}
+		if heldFor != patronID {
+			return LoanPolicy{}, errItemHeldForOther
+		}
+	default:
+		return LoanPolicy{}, errItemUnavailable
+	}
+
+	policy, err := resolveLoanPolicy(q, patron, item)
+	if err != nil {
+		return policy, err
+	}
+	if policy.MaxLoans > 0 {
+		var open int
+		err := q.QueryRow("SELECT COUNT(*) FROM loans WHERE patron_id = ? AND returned_at IS NULL", patronID).Scan(&open)
+		if err != nil {
+			return policy, err
+		}
+		if open >= policy.MaxLoans {
+			return policy, errLoanLimit
+		}
+	}
+	return policy, nil
+}
+
+// Check a policy from a request body
+func validateLoanPolicy(policy LoanPolicy) string {
+	if policy.LoanDays <= 0 || policy.MaxRenewals < 0 || policy.MaxLoans < 0 ||
+		policy.FinePerDay < 0 || policy.MaxFine < 0 || policy.LostFee < 0 {
+		return "Missing required fields"
+	}
+	return ""
+}
+
+// Handlers
+
+func getLoanPolicies(c *gin.Context) {
+	rows, err := db.Query("SELECT " + policyColumns + " FROM loan_policies ORDER BY id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve loan policies"})
+		return
+	}
+	defer rows.Close()
+
+	policies := []LoanPolicy{}
+	for rows.Next() {
+		policy, err := scanLoanPolicy(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve loan policies"})
+			return
+		}
+		policies = append(policies, policy)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"default": defaultLoanPolicy, "rules": policies})
+}
+
+func getLoanPolicy(c *gin.Context) {
+	policy, err := queryLoanPolicy(db, c.Param("id"))
+	if err != nil {
+		respondCirculationError(c, err, "Failed to retrieve loan policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+func createLoanPolicy(c *gin.Context) {
+	var policy LoanPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateLoanPolicy(policy); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		r, err := tx.Exec(`INSERT INTO loan_policies (patron_category, item_type, branch, loan_days, max_renewals, max_loans, fine_per_day, max_fine, lost_fee)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			policy.PatronCategory, policy.ItemType, policy.Branch, policy.LoanDays, policy.MaxRenewals, policy.MaxLoans,
+			policy.FinePerDay, policy.MaxFine, policy.LostFee)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		policy.ID = uint(id)
+		return recordAudit(tx, c, auditCreate, "loan_policy", policy.ID, nil, policy)
+	})
+	if err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A rule for these criteria already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create loan policy"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, policy)
+}
+
+func updateLoanPolicy(c *gin.Context) {
+	var policy LoanPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateLoanPolicy(policy); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryLoanPolicy(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		policy.ID = before.ID
+
+		_, err = tx.Exec(`UPDATE loan_policies SET patron_category = ?, item_type = ?, branch = ?, loan_days = ?, max_renewals = ?, max_loans = ?,
+						fine_per_day = ?, max_fine = ?, lost_fee = ? WHERE id = ?`,
+			policy.PatronCategory, policy.ItemType, policy.Branch, policy.LoanDays, policy.MaxRenewals, policy.MaxLoans,
+			policy.FinePerDay, policy.MaxFine, policy.LostFee, policy.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "loan_policy", policy.ID, before, policy)
+	})
+	if err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A rule for these criteria already exists"})
+			return
+		}
+		respondCirculationError(c, err, "Failed to update loan policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+func deleteLoanPolicy(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryLoanPolicy(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM loan_policies WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "loan_policy", before.ID, before, nil)
+	})
+	if err != nil {
+		respondCirculationError(c, err, "Failed to delete loan policy")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Report what a checkout of the item to the patron would do
+func simulateCheckout(c *gin.Context) {
+	var body struct {
+		ItemID   uint   `json:"item_id"`
+		Barcode  string `json:"barcode"`
+		PatronID uint   `json:"patron_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if (body.ItemID == 0 && body.Barcode == "") || body.PatronID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	item, err := lookupItem(db, body.ItemID, body.Barcode)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to simulate checkout")
+		return
+	}
+	patron, err := queryPatron(db, body.PatronID)
+	if err != nil {
+		respondCirculationError(c, err, "Failed to simulate checkout")
+		return
+	}
+
+	// The policy is reported even when the checkout would be refused
+	policy, err := resolveLoanPolicy(db, patron, item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to simulate checkout"})
+		return
+	}
+	result := gin.H{
+		"patron_id":       patron.ID,
+		"patron_category": patron.Category,
+		"item_id":         item.ID,
+		"item_type":       item.ItemType,
+		"branch_id":       item.CurrentBranchID,
+		"policy":          policy,
+	}
+
+	if _, err := evaluateCheckout(db, item, patron.ID); err != nil {
+		e, ok := circulationErrors[err]
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to simulate checkout"})
+			return
+		}
+		result["allowed"] = false
+		result["reason"] = e.message
+	} else {
+		dueAt, err := computeDueDate(db, now(), policy, item.CurrentBranchID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to simulate checkout"})
+			return
+		}
+		result["allowed"] = true
+		result["due_at"] = dueAt
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoanPolicyMatching(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+	alice := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001", "30002")
+	annex := createTestBranch(t, "annex")
+	doJSON("PUT", "/api/books/1/items/2", librarian, Item{Barcode: "30002", HomeBranchID: annex.ID, ItemType: "dvd"})
+
+	for _, policy := range []LoanPolicy{
+		{PatronCategory: defaultPatronCategory, LoanDays: 14, MaxRenewals: 1, MaxLoans: 1},
+		{PatronCategory: defaultPatronCategory, ItemType: "dvd", LoanDays: 7, MaxRenewals: 0, MaxLoans: 5},
+		{ItemType: "dvd", Branch: "annex", LoanDays: 3, MaxRenewals: 0, MaxLoans: 5},
+	} {
+		recorder := doJSON("POST", "/api/loan-policies", admin, policy)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, but got %d", recorder.Code)
+		}
+	}
+
+	// Managing rules is for admins only
+	recorder := doJSON("POST", "/api/loan-policies", librarian, LoanPolicy{LoanDays: 1})
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/loan-policies", admin, LoanPolicy{PatronCategory: defaultPatronCategory, LoanDays: 1})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/loan-policies", admin, LoanPolicy{PatronCategory: defaultPatronCategory})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	loan, status := checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	if !loan.DueAt.Equal(loan.CheckedOutAt.AddDate(0, 0, 14)) {
+		t.Errorf("Expected a 14 day loan, but got %+v", loan)
+	}
+
+	// Ties between equally specific rules go to the oldest
+	recorder = doJSON("POST", "/api/loan-policies/simulate", librarian, gin.H{"barcode": "30002", "patron_id": alice.ID})
+	var result struct {
+		Allowed bool       `json:"allowed"`
+		Reason  string     `json:"reason"`
+		Policy  LoanPolicy `json:"policy"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&result)
+	if !result.Allowed || result.Policy.ID != 2 || result.Policy.LoanDays != 7 {
+		t.Errorf("Unexpected simulation %+v", result)
+	}
+
+	// Renewals follow the rule too
+	recorder = doJSON("POST", "/api/loans/1/renew", librarian, nil)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/loans/1/renew", librarian, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+}
+
+func TestLoanLimit(t *testing.T) {
+	setupIsolated(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	admin := tokenFor(t, "admin", roleAdmin)
+	alice := createTestPatron(t, "alice", 0)
+	createTestItems(t, librarian, "30001", "30002")
+	doJSON("POST", "/api/loan-policies", admin, LoanPolicy{LoanDays: 14, MaxRenewals: 1, MaxLoans: 1})
+
+	checkout(t, librarian, gin.H{"barcode": "30001", "patron_id": alice.ID})
+
+	// Simulating reports the refusal without lending anything
+	recorder := doJSON("POST", "/api/loan-policies/simulate", librarian, gin.H{"barcode": "30002", "patron_id": alice.ID})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var result struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&result)
+	if result.Allowed || result.Reason != "Patron has reached the loan limit" {
+		t.Errorf("Unexpected simulation %+v", result)
+	}
+
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID}); status != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", status)
+	}
+	doJSON("POST", "/api/loans/1/return", librarian, nil)
+	if _, status := checkout(t, librarian, gin.H{"barcode": "30002", "patron_id": alice.ID}); status != http.StatusCreated {
+		t.Errorf("Expected status 201, but got %d", status)
+	}
+}
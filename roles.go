@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles carried in the "role" claim of issued tokens
+const (
+	roleAdmin     = "admin"
+	roleLibrarian = "librarian"
+	roleMember    = "member"
+	roleReadOnly  = "readonly"
+)
+
+// Permissions checked per route by requirePermission
+const (
+	permCatalogRead    = "catalog:read"
+	permCatalogWrite   = "catalog:write"
+	permCatalogDelete  = "catalog:delete"
+	permUsersManage    = "users:manage"
+	permAuditRead      = "audit:read"
+	permCirculation    = "circulation"
+	permPolicyManage   = "policy:manage"
+	permBranchesManage = "branches:manage"
+	permAcquisitions   = "acquisitions"
+)
+
+var rolePermissions = map[string][]string{
+	roleAdmin: {
+		permCatalogRead, permCatalogWrite, permCatalogDelete,
+		permUsersManage, permAuditRead, permCirculation, permPolicyManage,
+		permBranchesManage, permAcquisitions,
+	},
+	roleLibrarian: {
+		permCatalogRead, permCatalogWrite, permCirculation, permAcquisitions,
+	},
+	roleMember: {
+		permCatalogRead,
+	},
+	roleReadOnly: {
+		permCatalogRead,
+	},
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleHasPermission(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the caller's role, and the scopes of the API key it used if any
+func hasPermission(c *gin.Context, permission string) bool {
+	if !roleHasPermission(c.GetString("role"), permission) {
+		return false
+	}
+
+	scopes, ok := c.Get("scopes")
+	if !ok {
+		return true
+	}
+	for _, scope := range scopes.([]string) {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Permission middleware, must run after authMiddleware
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
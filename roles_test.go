@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Helper function to create an account with the given role and log it in
+func tokenFor(t *testing.T, username, role string) string {
+	t.Helper()
+	if _, err := createUser(username, username+" password", role); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := doJSON("POST", "/login", "", User{Username: username, Password: username + " password"})
+	var token Token
+	if err := json.NewDecoder(recorder.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	return token.Token
+}
+
+func TestRolePermissions(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	member := tokenFor(t, "member", roleMember)
+	readonly := tokenFor(t, "readonly", roleReadOnly)
+	book := Book{Title: "Book 1", PublishedYear: 2022, ISBN: "123456789011x"}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{"no token", "GET", "/api/books", "", nil, http.StatusUnauthorized},
+		{"bad token", "GET", "/api/books", "not-a-jwt", nil, http.StatusUnauthorized},
+		{"member reads", "GET", "/api/books", member, nil, http.StatusOK},
+		{"readonly reads", "GET", "/api/authors", readonly, nil, http.StatusOK},
+		{"member creates", "POST", "/api/books", member, book, http.StatusForbidden},
+		{"readonly creates", "POST", "/api/books", readonly, book, http.StatusForbidden},
+		{"librarian creates", "POST", "/api/books", librarian, book, http.StatusCreated},
+		{"librarian deletes", "DELETE", "/api/books/1", librarian, nil, http.StatusForbidden},
+		{"admin deletes", "DELETE", "/api/books/1", admin, nil, http.StatusNoContent},
+		{"librarian manages users", "GET", "/api/admin/users", librarian, nil, http.StatusForbidden},
+		{"admin manages users", "GET", "/api/admin/users", admin, nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		recorder := doJSON(tt.method, tt.path, tt.token, tt.body)
+		if recorder.Code != tt.status {
+			t.Errorf("%s: expected status %d, but got %d", tt.name, tt.status, recorder.Code)
+		}
+	}
+}
+
+func TestUpdateUserRole(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	createUser("alice", "correct horse", roleMember)
+
+	recorder := doJSON("PUT", "/api/admin/users/2/role", admin, map[string]string{"role": "superuser"})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("PUT", "/api/admin/users/2/role", admin, map[string]string{"role": roleLibrarian})
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	expectedResponseBody := `{"id":2,"username":"alice","role":"librarian","disabled":false}`
+	if recorder.Body.String() != expectedResponseBody {
+		t.Errorf("Expected response body '%s', but got '%s'", expectedResponseBody, recorder.Body.String())
+	}
+
+	// Self-registration cannot pick a role
+	recorder = doJSON("POST", "/register", "", User{Username: "mallory", Password: "mallory password", Role: roleAdmin})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+	var user User
+	json.NewDecoder(recorder.Body).Decode(&user)
+	if user.Role != roleMember {
+		t.Errorf("Expected role '%s', but got '%s'", roleMember, user.Role)
+	}
+}
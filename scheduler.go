@@ -0,0 +1,503 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job run statuses
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// What started a run
+const (
+	triggerSchedule = "schedule"
+	triggerManual   = "manual"
+)
+
+// How long a lock outlives an instance that died while running the job.
+// A running job renews its lock well before then.
+const (
+	jobLockTTL     = 10 * time.Minute
+	jobLockRenewal = jobLockTTL / 3
+)
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobLocked   = errors.New("job is running on another instance")
+)
+
+// A piece of periodic work. Schedules are cron expressions in UTC.
+type scheduledJob struct {
+	name     string
+	schedule cronSchedule
+	spec     string
+	run      func() error
+}
+
+func newJob(name, spec string, run func() error) *scheduledJob {
+	schedule, err := parseCron(spec)
+	if err != nil {
+		panic(err)
+	}
+	return &scheduledJob{name: name, schedule: schedule, spec: spec, run: run}
+}
+
+var jobs = []*scheduledJob{
+	newJob("expire_holds", "0 * * * *", expireHolds),
+	newJob("accrue_fines", "0 2 * * *", accrueFines),
+	newJob("queue_loan_notices", "0 * * * *", queueLoanNotices),
+	newJob("deliver_notifications", "* * * * *", deliverNotifications),
+	newJob("purge_expired_tokens", "30 3 * * *", purgeExpiredTokens),
+	newJob("purge_login_failures", "15 * * * *", purgeLoginFailures),
+}
+
+// Names this process in job locks and runs
+var schedulerInstance = func() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}()
+
+func findJob(name string) (*scheduledJob, error) {
+	for _, job := range jobs {
+		if job.name == name {
+			return job, nil
+		}
+	}
+	return nil, errJobNotFound
+}
+
+// Replace the schedules of the jobs named in the configuration. "off"
+// stops a job running on its own; it can still be run by hand.
+func configureScheduler(c SchedulerConfig) error {
+	for name, spec := range c.Jobs {
+		job, err := findJob(name)
+		if err != nil {
+			return fmt.Errorf("unknown job %q", name)
+		}
+		if spec == "off" {
+			job.schedule, job.spec = cronSchedule{}, spec
+			continue
+		}
+		schedule, err := parseCron(spec)
+		if err != nil {
+			return fmt.Errorf("job %s: %w", name, err)
+		}
+		job.schedule, job.spec = schedule, spec
+	}
+	return nil
+}
+
+type JobRun struct {
+	ID           uint       `json:"id"`
+	JobName      string     `json:"job_name"`
+	Trigger      string     `json:"trigger"`
+	ScheduledFor *time.Time `json:"scheduled_for,omitempty"`
+	Instance     string     `json:"instance"`
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+type Job struct {
+	Name      string     `json:"name"`
+	Schedule  string     `json:"schedule"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastRun   *JobRun    `json:"last_run,omitempty"`
+}
+
+// Create the job runs and job locks tables. Scheduled runs are unique per
+// job and time, so a slot is only run once whichever instance gets there.
+func createSchedulerTables() {
+	schedulerTablesSQL := `
+		CREATE TABLE IF NOT EXISTS job_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			job_name TEXT NOT NULL,
+			triggered_by TEXT NOT NULL,
+			scheduled_for DATETIME,
+			instance TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME,
+			UNIQUE (job_name, scheduled_for)
+		);
+		CREATE TABLE IF NOT EXISTS job_locks (
+			job_name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			locked_until DATETIME NOT NULL
+		);`
+	_, err = db.Exec(schedulerTablesSQL)
+	if err != nil {
+		log.Fatal("Failed to create scheduler tables:", err)
+	}
+}
+
+const jobRunColumns = "id, job_name, triggered_by, scheduled_for, instance, status, error, started_at, finished_at"
+
+func scanJobRun(row interface{ Scan(...interface{}) error }) (JobRun, error) {
+	var (
+		run                      JobRun
+		scheduledFor, finishedAt sql.NullTime
+	)
+	err := row.Scan(&run.ID, &run.JobName, &run.Trigger, &scheduledFor, &run.Instance, &run.Status, &run.Error,
+		&run.StartedAt, &finishedAt)
+	run.ScheduledFor = nullTimePtr(scheduledFor)
+	run.FinishedAt = nullTimePtr(finishedAt)
+	return run, err
+}
+
+func queryJobRun(q querier, id interface{}) (JobRun, error) {
+	return scanJobRun(q.QueryRow("SELECT "+jobRunColumns+" FROM job_runs WHERE id = ?", id))
+}
+
+// Take the job's lock for this instance, unless another instance holds it
+func acquireJobLock(name string) (bool, error) {
+	r, err := db.Exec(`INSERT INTO job_locks (job_name, holder, locked_until) VALUES (?, ?, ?)
+					ON CONFLICT (job_name) DO UPDATE SET holder = excluded.holder, locked_until = excluded.locked_until
+					WHERE job_locks.locked_until < ?`,
+		name, schedulerInstance, now().Add(jobLockTTL), now())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+// Extend the job's lock while this instance still holds it
+func renewJobLock(name string) error {
+	_, err := db.Exec("UPDATE job_locks SET locked_until = ? WHERE job_name = ? AND holder = ?",
+		now().Add(jobLockTTL), name, schedulerInstance)
+	return err
+}
+
+// Keep renewing the job's lock until done is closed, so a long run is not
+// taken for a dead one
+func heartbeatJobLock(name string, done <-chan struct{}) {
+	ticker := time.NewTicker(jobLockRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := renewJobLock(name); err != nil {
+				log.Printf("Failed to renew the lock of job %s: %v", name, err)
+			}
+		}
+	}
+}
+
+func releaseJobLock(name string) error {
+	_, err := db.Exec("DELETE FROM job_locks WHERE job_name = ? AND holder = ?", name, schedulerInstance)
+	return err
+}
+
+// Run a job under its lock, recording the run. scheduledFor is the slot of
+// a scheduled run, which is skipped if any instance has already run it;
+// it is nil for manual runs. Returns nil without a run if skipped.
+func runJob(job *scheduledJob, trigger string, scheduledFor *time.Time) (*JobRun, error) {
+	locked, err := acquireJobLock(job.name)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, errJobLocked
+	}
+	defer releaseJobLock(job.name)
+	done := make(chan struct{})
+	defer close(done)
+	go heartbeatJobLock(job.name, done)
+
+	r, err := db.Exec(`INSERT INTO job_runs (job_name, triggered_by, scheduled_for, instance, status, started_at)
+					VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (job_name, scheduled_for) DO NOTHING`,
+		job.name, trigger, scheduledFor, schedulerInstance, jobRunning, now())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	id, _ := r.LastInsertId()
+
+	status, message := jobSucceeded, ""
+	if err := runRecovered(job); err != nil {
+		status, message = jobFailed, err.Error()
+		log.Printf("Job %s failed: %v", job.name, err)
+	}
+
+	_, err = db.Exec("UPDATE job_runs SET status = ?, error = ?, finished_at = ? WHERE id = ?", status, message, now(), id)
+	if err != nil {
+		return nil, err
+	}
+	run, err := queryJobRun(db, id)
+	return &run, err
+}
+
+// Run the job's work, turning a panic into an error so it fails the run
+// rather than the process
+func runRecovered(job *scheduledJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %s panicked: %v\n%s", job.name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.run()
+}
+
+// Start the jobs due each minute until the process ends. Another instance
+// holding a job's lock, or having run the slot already, is not an error.
+func runScheduler() {
+	for {
+		next := now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+		for _, job := range jobs {
+			if !job.schedule.matches(next) {
+				continue
+			}
+			go func(job *scheduledJob, slot time.Time) {
+				if _, err := runJob(job, triggerSchedule, &slot); err != nil && err != errJobLocked {
+					log.Printf("Failed to run job %s: %v", job.name, err)
+				}
+			}(job, next)
+		}
+	}
+}
+
+// Cron expressions
+
+// The minutes, hours, days of the month, months and weekdays a cron
+// expression matches, one bit each. The zero value never matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Either day field left as "*" lets the other alone decide
+	domAny, dowAny bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// Parse a five field cron expression: minute, hour, day of the month,
+// month and day of the week (0 or 7 being Sunday). Fields take "*",
+// numbers, ranges such as "1-5", steps such as "*/15" and lists of those.
+func parseCron(spec string) (cronSchedule, error) {
+	if shortcut, ok := cronShortcuts[spec]; ok {
+		spec = shortcut
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("invalid cron expression %q: expected 5 fields", spec)
+	}
+
+	var s cronSchedule
+	bounds := []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		bits, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid cron expression %q: %w", spec, err)
+		}
+		*b.field = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s cronSchedule) matches(t time.Time) bool {
+	t = t.UTC()
+	return s.minute&(1<<uint(t.Minute())) != 0 && s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.month&(1<<uint(t.Month())) != 0 && s.matchesDay(t)
+}
+
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// The first minute after t the schedule matches, or the zero time if none
+// in the next five years
+func (s cronSchedule) next(t time.Time) time.Time {
+	if s.minute == 0 {
+		return time.Time{}
+	}
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Handlers
+
+// List the jobs with their schedule, next run and last run
+func getJobs(c *gin.Context) {
+	list := []Job{}
+	for _, job := range jobs {
+		entry := Job{Name: job.name, Schedule: job.spec}
+		if next := job.schedule.next(now()); !next.IsZero() {
+			entry.NextRunAt = &next
+		}
+		run, err := scanJobRun(db.QueryRow("SELECT "+jobRunColumns+" FROM job_runs WHERE job_name = ? ORDER BY id DESC LIMIT 1", job.name))
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve jobs"})
+			return
+		}
+		if err == nil {
+			entry.LastRun = &run
+		}
+		list = append(list, entry)
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// The runs of a job, newest first, 50 at a time before ?before=<run id>
+func getJobRuns(c *gin.Context) {
+	job, err := findJob(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	where := "WHERE job_name = ?"
+	args := []interface{}{job.name}
+	if before := c.Query("before"); before != "" {
+		where += " AND id < ?"
+		args = append(args, before)
+	}
+
+	rows, err := db.Query("SELECT "+jobRunColumns+" FROM job_runs "+where+" ORDER BY id DESC LIMIT 50", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job runs"})
+		return
+	}
+	defer rows.Close()
+
+	runs := []JobRun{}
+	for rows.Next() {
+		run, err := scanJobRun(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job runs"})
+			return
+		}
+		runs = append(runs, run)
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
+
+// Run a job now and respond with the finished run
+func triggerJob(c *gin.Context) {
+	job, err := findJob(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	run, err := runJob(job, triggerManual, nil)
+	if err == errJobLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is already running"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
+}
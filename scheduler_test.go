@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Add a job to the registry for the length of the test
+func useTestJob(t *testing.T, name string, run func() error) *scheduledJob {
+	t.Helper()
+	prevJobs := jobs
+	job := newJob(name, "*/5 * * * *", run)
+	jobs = append(append([]*scheduledJob{}, jobs...), job)
+	t.Cleanup(func() { jobs = prevJobs })
+	return job
+}
+
+func TestCronSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		spec, from, next string
+	}{
+		{"* * * * *", "2024-03-10 10:15", "2024-03-10 10:16"},
+		{"*/15 * * * *", "2024-03-10 10:15", "2024-03-10 10:30"},
+		{"0 2 * * *", "2024-03-10 10:15", "2024-03-11 02:00"},
+		{"30 9 * * 1-5", "2024-03-08 10:00", "2024-03-11 09:30"},
+		{"0 0 1,15 * *", "2024-03-10 10:15", "2024-03-15 00:00"},
+		{"0 0 * * 7", "2024-03-10 10:15", "2024-03-17 00:00"},
+		{"@monthly", "2024-12-31 23:59", "2025-01-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 12 13 * 5", "2024-03-10 10:15", "2024-03-13 12:00"},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", test.spec, err)
+		}
+		next := schedule.next(at(test.from))
+		if !next.Equal(at(test.next)) {
+			t.Errorf("%s after %s: expected %s, but got %s", test.spec, test.from, test.next, next)
+		}
+		if !schedule.matches(next) {
+			t.Errorf("%s: matches disagrees with next at %s", test.spec, next)
+		}
+	}
+
+	if next := (cronSchedule{}).next(at("2024-03-10 10:15")); !next.IsZero() {
+		t.Errorf("Expected an empty schedule never to run, but got %s", next)
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@sometimes"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestScheduledRunsOnce(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	calls := 0
+	job := useTestJob(t, "count", func() error { calls++; return nil })
+
+	slot := now().Truncate(time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := runJob(job, triggerSchedule, &slot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected the slot to run once, but it ran %d times", calls)
+	}
+
+	// Manual runs are not tied to a slot
+	for i := 0; i < 2; i++ {
+		run, err := runJob(job, triggerManual, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run.Status != jobSucceeded || run.Trigger != triggerManual || run.FinishedAt == nil {
+			t.Fatalf("Unexpected run %+v", run)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("Expected 3 runs, but got %d", calls)
+	}
+}
+
+func TestJobLocks(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	calls := 0
+	useTestJob(t, "count", func() error { calls++; return nil })
+
+	if _, err := db.Exec("INSERT INTO job_locks (job_name, holder, locked_until) VALUES (?, ?, ?)",
+		"count", "another-instance", now().Add(jobLockTTL)); err != nil {
+		t.Fatal(err)
+	}
+	recorder := doJSON("POST", "/api/admin/jobs/count/run", admin, nil)
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409, but got %d", recorder.Code)
+	}
+	if calls != 0 {
+		t.Fatal("Expected the job not to run while locked")
+	}
+
+	// A lock left behind by a dead instance runs out
+	*clock = clock.Add(jobLockTTL + time.Minute)
+	recorder = doJSON("POST", "/api/admin/jobs/count/run", admin, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var holders int
+	db.QueryRow("SELECT COUNT(*) FROM job_locks WHERE job_name = 'count'").Scan(&holders)
+	if calls != 1 || holders != 0 {
+		t.Fatalf("Expected one run and the lock released, but got %d runs and %d locks", calls, holders)
+	}
+
+	// A running job keeps its lock from running out, but not another's
+	acquireJobLock("count")
+	*clock = clock.Add(jobLockTTL - time.Minute)
+	db.Exec("INSERT INTO job_locks (job_name, holder, locked_until) VALUES ('other', 'another-instance', ?)", now())
+	for _, name := range []string{"count", "other"} {
+		if err := renewJobLock(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var countUntil, otherUntil time.Time
+	db.QueryRow("SELECT locked_until FROM job_locks WHERE job_name = 'count'").Scan(&countUntil)
+	db.QueryRow("SELECT locked_until FROM job_locks WHERE job_name = 'other'").Scan(&otherUntil)
+	if !countUntil.Equal(now().Add(jobLockTTL)) || !otherUntil.Equal(now()) {
+		t.Fatalf("Unexpected locks until %s and %s", countUntil, otherUntil)
+	}
+	releaseJobLock("count")
+
+	// A job that panics fails its run instead of the process, and lets go
+	job := useTestJob(t, "panics", func() error { panic("out of paper") })
+	run, err := runJob(job, triggerManual, nil)
+	if err != nil || run.Status != jobFailed || run.Error != "panic: out of paper" {
+		t.Fatalf("Unexpected run %+v: %v", run, err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM job_locks WHERE job_name = 'panics'").Scan(&holders)
+	if holders != 0 {
+		t.Fatal("Expected the lock to be released")
+	}
+}
+
+func TestJobEndpoints(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	useTestJob(t, "broken", func() error { return errors.New("out of paper") })
+
+	recorder := doJSON("POST", "/api/admin/jobs/broken/run", admin, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var run JobRun
+	json.NewDecoder(recorder.Body).Decode(&run)
+	if run.Status != jobFailed || run.Error != "out of paper" || run.Instance != schedulerInstance {
+		t.Fatalf("Unexpected run %+v", run)
+	}
+
+	recorder = doJSON("GET", "/api/admin/jobs", admin, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var list []Job
+	json.NewDecoder(recorder.Body).Decode(&list)
+	if len(list) != len(jobs) {
+		t.Fatalf("Expected %d jobs, but got %d", len(jobs), len(list))
+	}
+	broken := list[len(list)-1]
+	if broken.Name != "broken" || broken.NextRunAt == nil || broken.LastRun == nil || broken.LastRun.ID != run.ID {
+		t.Fatalf("Unexpected job %+v", broken)
+	}
+
+	recorder = doJSON("GET", "/api/admin/jobs/broken/runs", admin, nil)
+	var runs []JobRun
+	json.NewDecoder(recorder.Body).Decode(&runs)
+	if len(runs) != 1 || runs[0].Error != "out of paper" {
+		t.Fatalf("Unexpected runs %+v", runs)
+	}
+
+	if recorder := doJSON("POST", "/api/admin/jobs/missing/run", admin, nil); recorder.Code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("GET", "/api/admin/jobs", librarian, nil); recorder.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, but got %d", recorder.Code)
+	}
+}
+
+func TestConfigureScheduler(t *testing.T) {
+	job := useTestJob(t, "count", func() error { return nil })
+	prev := *job
+	t.Cleanup(func() { *job = prev })
+
+	if err := configureScheduler(SchedulerConfig{Jobs: map[string]string{"count": "off"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !job.schedule.next(time.Now()).IsZero() {
+		t.Fatal("Expected a job switched off not to be scheduled")
+	}
+	if err := configureScheduler(SchedulerConfig{Jobs: map[string]string{"missing": "@daily"}}); err == nil {
+		t.Fatal("Expected an unknown job to be rejected")
+	}
+	if err := configureScheduler(SchedulerConfig{Jobs: map[string]string{"count": "every day"}}); err == nil {
+		t.Fatal("Expected an invalid schedule to be rejected")
+	}
+}
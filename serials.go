@@ -0,0 +1,829 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often a subscription's issues come out
+const (
+	frequencyWeekly    = "weekly"
+	frequencyMonthly   = "monthly"
+	frequencyQuarterly = "quarterly"
+)
+
+// Issues per volume of subscriptions that do not say
+var defaultIssuesPerVolume = map[string]int{
+	frequencyWeekly:    52,
+	frequencyMonthly:   12,
+	frequencyQuarterly: 4,
+}
+
+// Subscription statuses
+const (
+	subscriptionActive    = "active"
+	subscriptionCancelled = "cancelled"
+)
+
+// Issue statuses. A predicted issue is expected until it is checked in,
+// and claimed from the vendor when it is late.
+const (
+	issueExpected = "expected"
+	issueReceived = "received"
+	issueClaimed  = "claimed"
+)
+
+// Days past its expected date before an issue is late, for subscriptions
+// that do not say
+const defaultClaimAfterDays = 14
+
+// Years ahead of the first issue it adds that a subscription or renewal may
+// run, which bounds the issues predicted at once
+const maxSubscriptionYears = 5
+
+var (
+	errSerialNotFound       = errors.New("serial not found")
+	errSerialInUse          = errors.New("serial has subscriptions")
+	errUnknownSerial        = errors.New("unknown serial")
+	errSubscriptionNotFound = errors.New("subscription not found")
+	errSubscriptionState    = errors.New("subscription is not in a state to allow this")
+	errIssueNotFound        = errors.New("issue not found")
+	errIssueReceived        = errors.New("issue already received")
+	errRenewalEnd           = errors.New("renewal does not extend the subscription")
+	errSubscriptionRun      = errors.New("subscription runs too long")
+	errIssueNotLate         = errors.New("issue is not late")
+)
+
+// Responses for the errors serials refuse a request with
+var serialErrors = errorResponses{
+	errSerialNotFound:       {http.StatusNotFound, "Serial not found"},
+	errSerialInUse:          {http.StatusConflict, "Serial has subscriptions"},
+	errUnknownSerial:        {http.StatusBadRequest, "Unknown serial"},
+	errSubscriptionNotFound: {http.StatusNotFound, "Subscription not found"},
+	errSubscriptionState:    {http.StatusConflict, "Subscription is no longer active"},
+	errIssueNotFound:        {http.StatusNotFound, "Issue not found"},
+	errIssueReceived:        {http.StatusConflict, "Issue already received"},
+	errRenewalEnd:           {http.StatusBadRequest, "Renewal must end after the subscription does"},
+	errSubscriptionRun:      {http.StatusBadRequest, fmt.Sprintf("Subscription may run at most %d years ahead", maxSubscriptionYears)},
+	errIssueNotLate:         {http.StatusConflict, "Issue is not late yet"},
+}
+
+// Respond with the matching serials error, falling back to those of the
+// vendors and branches subscriptions point at
+func respondSerialError(c *gin.Context, err error, fallback string) {
+	respondError(c, err, fallback, serialErrors, acquisitionErrors, circulationErrors, branchErrors)
+}
+
+// A magazine, journal or other title published in issues
+type Serial struct {
+	ID        uint   `json:"id"`
+	Title     string `json:"title"`
+	ISSN      string `json:"issn"`
+	Publisher string `json:"publisher"`
+}
+
+// A run of a serial bought from a vendor for a branch. Its prediction
+// pattern places the first issue at FirstIssueAt with the given volume and
+// number, and each next one a week, month or quarter later, numbered on
+// until a volume is full.
+type Subscription struct {
+	ID              uint      `json:"id"`
+	SerialID        uint      `json:"serial_id"`
+	VendorID        *uint     `json:"vendor_id,omitempty"`
+	BranchID        uint      `json:"branch_id"`
+	Frequency       string    `json:"frequency"`
+	FirstIssueAt    time.Time `json:"first_issue_at"`
+	EndsAt          time.Time `json:"ends_at"`
+	FirstVolume     int       `json:"first_volume"`
+	FirstNumber     int       `json:"first_number"`
+	IssuesPerVolume int       `json:"issues_per_volume"`
+	ClaimAfterDays  int       `json:"claim_after_days"`
+	Status          string    `json:"status"`
+	Note            string    `json:"note"`
+}
+
+// One issue of a subscription. Enumeration is its volume and number, and
+// chronology the period it covers.
+type SerialIssue struct {
+	ID             uint       `json:"id"`
+	SubscriptionID uint       `json:"subscription_id"`
+	Sequence       int        `json:"sequence"`
+	Volume         int        `json:"volume"`
+	Number         int        `json:"number"`
+	Enumeration    string     `json:"enumeration"`
+	Chronology     string     `json:"chronology"`
+	ExpectedAt     time.Time  `json:"expected_at"`
+	Status         string     `json:"status"`
+	ReceivedAt     *time.Time `json:"received_at,omitempty"`
+	ClaimedAt      *time.Time `json:"claimed_at,omitempty"`
+	Claims         int        `json:"claims"`
+
+	// Set in lists of late issues
+	Title    string `json:"title,omitempty"`
+	VendorID *uint  `json:"vendor_id,omitempty"`
+}
+
+// Create the serial, subscription and issue tables
+func createSerialTables() {
+	serialTablesSQL := `
+		CREATE TABLE IF NOT EXISTS serials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT NOT NULL,
+			issn TEXT NOT NULL,
+			publisher TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS subscriptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			serial_id INTEGER NOT NULL,
+			vendor_id INTEGER,
+			branch_id INTEGER NOT NULL,
+			frequency TEXT NOT NULL,
+			first_issue_at DATETIME NOT NULL,
+			ends_at DATETIME NOT NULL,
+			first_volume INTEGER NOT NULL,
+			first_number INTEGER NOT NULL,
+			issues_per_volume INTEGER NOT NULL,
+			claim_after_days INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (serial_id) REFERENCES serials (id),
+			FOREIGN KEY (vendor_id) REFERENCES vendors (id),
+			FOREIGN KEY (branch_id) REFERENCES branches (id)
+		);
+		CREATE TABLE IF NOT EXISTS serial_issues (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			subscription_id INTEGER NOT NULL,
+			sequence INTEGER NOT NULL,
+			volume INTEGER NOT NULL,
+			number INTEGER NOT NULL,
+			enumeration TEXT NOT NULL,
+			chronology TEXT NOT NULL,
+			expected_at DATETIME NOT NULL,
+			status TEXT NOT NULL,
+			received_at DATETIME,
+			claimed_at DATETIME,
+			claims INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (subscription_id) REFERENCES subscriptions (id),
+			UNIQUE (subscription_id, sequence)
+		);`
+	_, err = db.Exec(serialTablesSQL)
+	if err != nil {
+		log.Fatal("Failed to create serial tables:", err)
+	}
+}
+
+const serialColumns = "id, title, issn, publisher"
+
+func scanSerial(row interface{ Scan(...interface{}) error }) (Serial, error) {
+	var serial Serial
+	err := row.Scan(&serial.ID, &serial.Title, &serial.ISSN, &serial.Publisher)
+	return serial, err
+}
+
+func querySerial(q querier, id interface{}) (Serial, error) {
+	serial, err := scanSerial(q.QueryRow("SELECT "+serialColumns+" FROM serials WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return serial, errSerialNotFound
+	}
+	return serial, err
+}
+
+// Check an ISSN: four digits, a hyphen, three digits and a check digit
+// (or X) over the seven digits before it
+func isValidISSN(issn string) bool {
+	if len(issn) != 9 || issn[4] != '-' {
+		return false
+	}
+	digits := issn[:4] + issn[5:8]
+	sum := 0
+	for i, d := range digits {
+		if d < '0' || d > '9' {
+			return false
+		}
+		sum += int(d-'0') * (8 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return issn[8] == 'X'
+	}
+	return int(issn[8]-'0') == check
+}
+
+const subscriptionColumns = `id, serial_id, vendor_id, branch_id, frequency, first_issue_at, ends_at, first_volume, first_number,
+							issues_per_volume, claim_after_days, status, note`
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (Subscription, error) {
+	var (
+		sub      Subscription
+		vendorID sql.NullInt64
+	)
+	err := row.Scan(&sub.ID, &sub.SerialID, &vendorID, &sub.BranchID, &sub.Frequency, &sub.FirstIssueAt, &sub.EndsAt,
+		&sub.FirstVolume, &sub.FirstNumber, &sub.IssuesPerVolume, &sub.ClaimAfterDays, &sub.Status, &sub.Note)
+	if vendorID.Valid {
+		id := uint(vendorID.Int64)
+		sub.VendorID = &id
+	}
+	return sub, err
+}
+
+func querySubscription(q querier, id interface{}) (Subscription, error) {
+	sub, err := scanSubscription(q.QueryRow("SELECT "+subscriptionColumns+" FROM subscriptions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return sub, errSubscriptionNotFound
+	}
+	return sub, err
+}
+
+const serialIssueColumns = `i.id, i.subscription_id, i.sequence, i.volume, i.number, i.enumeration, i.chronology, i.expected_at,
+							i.status, i.received_at, i.claimed_at, i.claims
+							FROM serial_issues AS i`
+
+func scanSerialIssue(row interface{ Scan(...interface{}) error }) (SerialIssue, error) {
+	var (
+		issue                 SerialIssue
+		receivedAt, claimedAt sql.NullTime
+	)
+	err := row.Scan(&issue.ID, &issue.SubscriptionID, &issue.Sequence, &issue.Volume, &issue.Number, &issue.Enumeration,
+		&issue.Chronology, &issue.ExpectedAt, &issue.Status, &receivedAt, &claimedAt, &issue.Claims)
+	issue.ReceivedAt = nullTimePtr(receivedAt)
+	issue.ClaimedAt = nullTimePtr(claimedAt)
+	return issue, err
+}
+
+func querySerialIssue(q querier, id interface{}) (SerialIssue, error) {
+	issue, err := scanSerialIssue(q.QueryRow("SELECT "+serialIssueColumns+" WHERE i.id = ?", id))
+	if err == sql.ErrNoRows {
+		return issue, errIssueNotFound
+	}
+	return issue, err
+}
+
+func querySerialIssues(q querier, where string, args ...interface{}) ([]SerialIssue, error) {
+	rows, err := q.Query("SELECT "+serialIssueColumns+" "+where+" ORDER BY i.expected_at, i.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	issues := []SerialIssue{}
+	for rows.Next() {
+		issue, err := scanSerialIssue(rows)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, issue)
+	}
+	return issues, rows.Err()
+}
+
+// Check a subscription from a request body, filling in defaults. The run
+// lasts a year unless it says when it ends.
+func validateSubscription(sub *Subscription) string {
+	if sub.SerialID == 0 || sub.BranchID == 0 || sub.Frequency == "" || sub.FirstIssueAt.IsZero() {
+		return "Missing required fields"
+	}
+	perVolume, ok := defaultIssuesPerVolume[sub.Frequency]
+	if !ok {
+		return "Invalid frequency"
+	}
+	if sub.IssuesPerVolume == 0 {
+		sub.IssuesPerVolume = perVolume
+	}
+	if sub.FirstVolume == 0 {
+		sub.FirstVolume = 1
+	}
+	if sub.FirstNumber == 0 {
+		sub.FirstNumber = 1
+	}
+	if sub.ClaimAfterDays == 0 {
+		sub.ClaimAfterDays = defaultClaimAfterDays
+	}
+	if sub.EndsAt.IsZero() {
+		sub.EndsAt = sub.FirstIssueAt.AddDate(1, 0, -1)
+	}
+	if sub.IssuesPerVolume < 0 || sub.FirstVolume < 0 || sub.FirstNumber < 0 || sub.FirstNumber > sub.IssuesPerVolume ||
+		sub.ClaimAfterDays < 0 || sub.EndsAt.Before(sub.FirstIssueAt) {
+		return "Invalid prediction pattern"
+	}
+	if sub.EndsAt.After(sub.FirstIssueAt.AddDate(maxSubscriptionYears, 0, 0)) {
+		return fmt.Sprintf("Subscription may run at most %d years ahead", maxSubscriptionYears)
+	}
+	return ""
+}
+
+// The date n months after t, on the same day or the month's last
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// The issue a subscription's pattern predicts at the given place in its
+// run, counting from zero
+func predictIssue(sub Subscription, sequence int) SerialIssue {
+	issue := SerialIssue{SubscriptionID: sub.ID, Sequence: sequence, Status: issueExpected}
+
+	switch sub.Frequency {
+	case frequencyWeekly:
+		issue.ExpectedAt = sub.FirstIssueAt.AddDate(0, 0, 7*sequence)
+		issue.Chronology = issue.ExpectedAt.Format("2 January 2006")
+	case frequencyMonthly:
+		issue.ExpectedAt = addMonths(sub.FirstIssueAt, sequence)
+		issue.Chronology = issue.ExpectedAt.Format("January 2006")
+	case frequencyQuarterly:
+		issue.ExpectedAt = addMonths(sub.FirstIssueAt, 3*sequence)
+		issue.Chronology = fmt.Sprintf("Q%d %d", (int(issue.ExpectedAt.Month())+2)/3, issue.ExpectedAt.Year())
+	}
+
+	n := sub.FirstNumber - 1 + sequence
+	issue.Volume = sub.FirstVolume + n/sub.IssuesPerVolume
+	issue.Number = n%sub.IssuesPerVolume + 1
+	issue.Enumeration = fmt.Sprintf("v.%d no.%d", issue.Volume, issue.Number)
+	return issue
+}
+
+// Add the issues the pattern predicts from the given place in the run up
+// to the end of the subscription
+func predictIssues(tx *sql.Tx, sub Subscription, from int) error {
+	if sub.EndsAt.After(predictIssue(sub, from).ExpectedAt.AddDate(maxSubscriptionYears, 0, 0)) {
+		return errSubscriptionRun
+	}
+
+	for sequence := from; ; sequence++ {
+		issue := predictIssue(sub, sequence)
+		if issue.ExpectedAt.After(sub.EndsAt) {
+			return nil
+		}
+		_, err := tx.Exec(`INSERT INTO serial_issues (subscription_id, sequence, volume, number, enumeration, chronology,
+							expected_at, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			sub.ID, issue.Sequence, issue.Volume, issue.Number, issue.Enumeration, issue.Chronology, issue.ExpectedAt, issue.Status)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Extend an active subscription to a later end, predicting its issues
+func renewSubscription(tx *sql.Tx, sub Subscription, endsAt time.Time) error {
+	if sub.Status != subscriptionActive {
+		return errSubscriptionState
+	}
+	if !endsAt.After(sub.EndsAt) {
+		return errRenewalEnd
+	}
+
+	var next int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(sequence) + 1, 0) FROM serial_issues WHERE subscription_id = ?", sub.ID).Scan(&next); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE subscriptions SET ends_at = ? WHERE id = ?", endsAt, sub.ID); err != nil {
+		return err
+	}
+	sub.EndsAt = endsAt
+	return predictIssues(tx, sub, next)
+}
+
+// Stop a subscription, dropping the issues it no longer brings
+func cancelSubscription(tx *sql.Tx, sub Subscription) error {
+	if sub.Status != subscriptionActive {
+		return errSubscriptionState
+	}
+
+	_, err := tx.Exec("DELETE FROM serial_issues WHERE subscription_id = ? AND status = ? AND expected_at > ?", sub.ID, issueExpected, now())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE subscriptions SET status = ?, ends_at = ? WHERE id = ?", subscriptionCancelled, now(), sub.ID)
+	return err
+}
+
+// Check in an issue that has come, claimed or not
+func receiveIssue(tx *sql.Tx, issue SerialIssue) error {
+	if issue.Status == issueReceived {
+		return errIssueReceived
+	}
+
+	_, err := tx.Exec("UPDATE serial_issues SET status = ?, received_at = ? WHERE id = ?", issueReceived, now(), issue.ID)
+	return err
+}
+
+// Record a claim for an issue of an active subscription with the vendor
+// once it is late. Issues may be claimed again while they do not come, a
+// claim period after the last claim, as queryLateIssues lists them.
+func claimIssue(tx *sql.Tx, issue SerialIssue) error {
+	if issue.Status == issueReceived {
+		return errIssueReceived
+	}
+
+	sub, err := querySubscription(tx, issue.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	if sub.Status != subscriptionActive {
+		return errSubscriptionState
+	}
+	since := issue.ExpectedAt
+	if issue.ClaimedAt != nil {
+		since = *issue.ClaimedAt
+	}
+	if !now().After(since.AddDate(0, 0, sub.ClaimAfterDays)) {
+		return errIssueNotLate
+	}
+
+	_, err = tx.Exec("UPDATE serial_issues SET status = ?, claimed_at = ?, claims = claims + 1 WHERE id = ?", issueClaimed, now(), issue.ID)
+	return err
+}
+
+// Issues of active subscriptions not received by their claim period past
+// the expected date, whose last claim, if any, is as old. Cancelled
+// subscriptions are no longer worth chasing.
+func queryLateIssues(q querier) ([]SerialIssue, error) {
+	issues, err := querySerialIssues(q, `INNER JOIN subscriptions AS s ON s.id = i.subscription_id
+							WHERE s.status = ? AND i.status != ? AND julianday(?) - julianday(COALESCE(i.claimed_at, i.expected_at)) > s.claim_after_days`,
+		subscriptionActive, issueReceived, now())
+	if err != nil {
+		return nil, err
+	}
+
+	// Named once the list is read, as the connection is shared
+	for i := range issues {
+		sub, err := querySubscription(q, issues[i].SubscriptionID)
+		if err != nil {
+			return nil, err
+		}
+		serial, err := querySerial(q, sub.SerialID)
+		if err != nil {
+			return nil, err
+		}
+		issues[i].Title = serial.Title
+		issues[i].VendorID = sub.VendorID
+	}
+	return issues, nil
+}
+
+// Handlers
+
+func getSerials(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	if issn := c.Query("issn"); issn != "" {
+		where += " AND issn = ?"
+		args = append(args, issn)
+	}
+
+	rows, err := db.Query("SELECT "+serialColumns+" FROM serials "+where+" ORDER BY title", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve serials"})
+		return
+	}
+	defer rows.Close()
+
+	serials := []Serial{}
+	for rows.Next() {
+		serial, err := scanSerial(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve serials"})
+			return
+		}
+		serials = append(serials, serial)
+	}
+
+	c.JSON(http.StatusOK, serials)
+}
+
+func getSerial(c *gin.Context) {
+	serial, err := querySerial(db, c.Param("id"))
+	if err != nil {
+		respondSerialError(c, err, "Failed to retrieve serial")
+		return
+	}
+
+	c.JSON(http.StatusOK, serial)
+}
+
+// Check a serial from a request body
+func validateSerial(serial Serial) string {
+	if serial.Title == "" || serial.ISSN == "" {
+		return "Missing required fields"
+	}
+	if !isValidISSN(serial.ISSN) {
+		return "Invalid ISSN"
+	}
+	return ""
+}
+
+func createSerial(c *gin.Context) {
+	var serial Serial
+	if err := c.ShouldBindJSON(&serial); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateSerial(serial); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		r, err := tx.Exec("INSERT INTO serials (title, issn, publisher) VALUES (?, ?, ?)", serial.Title, serial.ISSN, serial.Publisher)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		serial.ID = uint(id)
+		return recordAudit(tx, c, auditCreate, "serial", serial.ID, nil, serial)
+	})
+	if err != nil {
+		respondSerialError(c, err, "Failed to create serial")
+		return
+	}
+
+	c.JSON(http.StatusCreated, serial)
+}
+
+func updateSerial(c *gin.Context) {
+	var serial Serial
+	if err := c.ShouldBindJSON(&serial); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateSerial(serial); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := querySerial(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		serial.ID = before.ID
+
+		_, err = tx.Exec("UPDATE serials SET title = ?, issn = ?, publisher = ? WHERE id = ?",
+			serial.Title, serial.ISSN, serial.Publisher, serial.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "serial", serial.ID, before, serial)
+	})
+	if err != nil {
+		respondSerialError(c, err, "Failed to update serial")
+		return
+	}
+
+	c.JSON(http.StatusOK, serial)
+}
+
+func deleteSerial(c *gin.Context) {
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := querySerial(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		var subscriptions int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE serial_id = ?", before.ID).Scan(&subscriptions); err != nil {
+			return err
+		}
+		if subscriptions > 0 {
+			return errSerialInUse
+		}
+
+		if _, err := tx.Exec("DELETE FROM serials WHERE id = ?", before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "serial", before.ID, before, nil)
+	})
+	if err != nil {
+		respondSerialError(c, err, "Failed to delete serial")
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Subscribe to a serial, predicting its issues to the end of the run
+func createSubscription(c *gin.Context) {
+	var sub Subscription
+	if err := c.ShouldBindJSON(&sub); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if msg := validateSubscription(&sub); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	err := withTx(func(tx *sql.Tx) error {
+		if _, err := querySerial(tx, sub.SerialID); err != nil {
+			if err == errSerialNotFound {
+				return errUnknownSerial
+			}
+			return err
+		}
+		if sub.VendorID != nil {
+			if _, err := queryVendor(tx, *sub.VendorID); err != nil {
+				if err == errVendorNotFound {
+					return errUnknownVendor
+				}
+				return err
+			}
+		}
+		if err := checkBranch(tx, sub.BranchID); err != nil {
+			return err
+		}
+
+		r, err := tx.Exec(`INSERT INTO subscriptions (serial_id, vendor_id, branch_id, frequency, first_issue_at, ends_at, first_volume,
+							first_number, issues_per_volume, claim_after_days, status, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			sub.SerialID, sub.VendorID, sub.BranchID, sub.Frequency, sub.FirstIssueAt, sub.EndsAt, sub.FirstVolume,
+			sub.FirstNumber, sub.IssuesPerVolume, sub.ClaimAfterDays, subscriptionActive, sub.Note)
+		if err != nil {
+			return err
+		}
+		id, _ := r.LastInsertId()
+		if sub, err = querySubscription(tx, id); err != nil {
+			return err
+		}
+		if err := predictIssues(tx, sub, 0); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "subscription", sub.ID, nil, sub)
+	})
+	if err != nil {
+		respondSerialError(c, err, "Failed to create subscription")
+		return
+	}
+
+	c.JSON(http.StatusCreated, sub)
+}
+
+func getSubscription(c *gin.Context) {
+	sub, err := querySubscription(db, c.Param("id"))
+	if err != nil {
+		respondSerialError(c, err, "Failed to retrieve subscription")
+		return
+	}
+
+	c.JSON(http.StatusOK, sub)
+}
+
+// List subscriptions, narrowed by serial, vendor, branch and status
+func getSubscriptions(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	for _, filter := range []string{"serial_id", "vendor_id", "branch_id", "status"} {
+		if value := c.Query(filter); value != "" {
+			where += " AND " + filter + " = ?"
+			args = append(args, value)
+		}
+	}
+
+	rows, err := db.Query("SELECT "+subscriptionColumns+" FROM subscriptions "+where+" ORDER BY id", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve subscriptions"})
+		return
+	}
+	defer rows.Close()
+
+	subs := []Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve subscriptions"})
+			return
+		}
+		subs = append(subs, sub)
+	}
+
+	c.JSON(http.StatusOK, subs)
+}
+
+// Run a change to an existing subscription and respond with the result
+func respondSubscriptionChange(c *gin.Context, change func(tx *sql.Tx, sub Subscription) error, fallback string) {
+	var after Subscription
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := querySubscription(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := change(tx, before); err != nil {
+			return err
+		}
+		if after, err = querySubscription(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "subscription", after.ID, before, after)
+	})
+	if err != nil {
+		respondSerialError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func renewSubscriptionHandler(c *gin.Context) {
+	var body struct {
+		EndsAt time.Time `json:"ends_at"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if body.EndsAt.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	respondSubscriptionChange(c, func(tx *sql.Tx, sub Subscription) error {
+		return renewSubscription(tx, sub, body.EndsAt)
+	}, "Failed to renew subscription")
+}
+
+func cancelSubscriptionHandler(c *gin.Context) {
+	respondSubscriptionChange(c, cancelSubscription, "Failed to cancel subscription")
+}
+
+// List a subscription's issues in the order they are expected, narrowed by
+// status
+func getSubscriptionIssues(c *gin.Context) {
+	sub, err := querySubscription(db, c.Param("id"))
+	if err != nil {
+		respondSerialError(c, err, "Failed to retrieve issues")
+		return
+	}
+
+	where := "WHERE i.subscription_id = ?"
+	args := []interface{}{sub.ID}
+	if status := c.Query("status"); status != "" {
+		where += " AND i.status = ?"
+		args = append(args, status)
+	}
+
+	issues, err := querySerialIssues(db, where, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve issues"})
+		return
+	}
+
+	c.JSON(http.StatusOK, issues)
+}
+
+func getLateIssues(c *gin.Context) {
+	issues, err := queryLateIssues(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve late issues"})
+		return
+	}
+
+	c.JSON(http.StatusOK, issues)
+}
+
+// Run a change to an existing issue and respond with the result
+func respondIssueChange(c *gin.Context, change func(tx *sql.Tx, issue SerialIssue) error, fallback string) {
+	var after SerialIssue
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := querySerialIssue(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := change(tx, before); err != nil {
+			return err
+		}
+		if after, err = querySerialIssue(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "serial_issue", after.ID, before, after)
+	})
+	if err != nil {
+		respondSerialError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func receiveIssueHandler(c *gin.Context) {
+	respondIssueChange(c, receiveIssue, "Failed to check in issue")
+}
+
+func claimIssueHandler(c *gin.Context) {
+	respondIssueChange(c, claimIssue, "Failed to claim issue")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIssuePrediction(t *testing.T) {
+	date := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		sub         Subscription
+		sequence    int
+		expected    string
+		enumeration string
+		chronology  string
+	}{
+		{Subscription{Frequency: frequencyWeekly, FirstIssueAt: date("2024-01-01"), FirstVolume: 10, FirstNumber: 1, IssuesPerVolume: 52},
+			3, "2024-01-22", "v.10 no.4", "22 January 2024"},
+		{Subscription{Frequency: frequencyWeekly, FirstIssueAt: date("2024-01-01"), FirstVolume: 10, FirstNumber: 50, IssuesPerVolume: 52},
+			3, "2024-01-22", "v.11 no.1", "22 January 2024"},
+		{Subscription{Frequency: frequencyMonthly, FirstIssueAt: date("2024-01-31"), FirstVolume: 3, FirstNumber: 1, IssuesPerVolume: 12},
+			1, "2024-02-29", "v.3 no.2", "February 2024"},
+		{Subscription{Frequency: frequencyMonthly, FirstIssueAt: date("2024-01-31"), FirstVolume: 3, FirstNumber: 1, IssuesPerVolume: 12},
+			12, "2025-01-31", "v.4 no.1", "January 2025"},
+		{Subscription{Frequency: frequencyQuarterly, FirstIssueAt: date("2024-03-15"), FirstVolume: 1, FirstNumber: 2, IssuesPerVolume: 4},
+			3, "2024-12-15", "v.2 no.1", "Q4 2024"},
+	}
+	for _, test := range tests {
+		issue := predictIssue(test.sub, test.sequence)
+		if !issue.ExpectedAt.Equal(date(test.expected)) || issue.Enumeration != test.enumeration || issue.Chronology != test.chronology {
+			t.Errorf("%s #%d: expected %s %s %s, but got %s %s %s", test.sub.Frequency, test.sequence, test.expected,
+				test.enumeration, test.chronology, issue.ExpectedAt.Format("2006-01-02"), issue.Enumeration, issue.Chronology)
+		}
+	}
+
+	for _, issn := range []string{"0317-8471", "2434-561X"} {
+		if !isValidISSN(issn) {
+			t.Errorf("Expected %s to be valid", issn)
+		}
+	}
+	for _, issn := range []string{"0317-8472", "03178471", "0317-847X", "abcd-efgh"} {
+		if isValidISSN(issn) {
+			t.Errorf("Expected %s to be invalid", issn)
+		}
+	}
+}
+
+func TestSerialSubscriptions(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestBranch(t, "main")
+	doJSON("POST", "/api/vendors", librarian, Vendor{Code: "SUBS", Name: "Subscription Agency"})
+
+	if recorder := doJSON("POST", "/api/serials", librarian, Serial{Title: "Library Journal", ISSN: "0363-0278"}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder := doJSON("POST", "/api/serials", librarian, Serial{Title: "Library Journal", ISSN: "0363-0277", Publisher: "LJ"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+
+	first := clock.AddDate(0, 0, -40).Truncate(24 * time.Hour)
+	body := gin.H{"serial_id": 1, "vendor_id": 1, "branch_id": 1, "frequency": "monthly", "first_issue_at": first, "first_volume": 7, "first_number": 11}
+	if recorder := doJSON("POST", "/api/subscriptions", librarian, gin.H{"serial_id": 1, "branch_id": 1, "frequency": "daily", "first_issue_at": first}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	tooLong := gin.H{"serial_id": 1, "branch_id": 1, "frequency": "weekly", "first_issue_at": first, "ends_at": first.AddDate(maxSubscriptionYears+1, 0, 0)}
+	if recorder := doJSON("POST", "/api/subscriptions", librarian, tooLong); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/subscriptions", librarian, body)
+	var sub Subscription
+	json.NewDecoder(recorder.Body).Decode(&sub)
+	if recorder.Code != http.StatusCreated || sub.IssuesPerVolume != 12 || sub.ClaimAfterDays != defaultClaimAfterDays || sub.Status != subscriptionActive {
+		t.Fatalf("Unexpected subscription %d %+v", recorder.Code, sub)
+	}
+
+	path := "/api/subscriptions/" + strconv.Itoa(int(sub.ID))
+	recorder = doJSON("GET", path+"/issues", librarian, nil)
+	var issues []SerialIssue
+	json.NewDecoder(recorder.Body).Decode(&issues)
+	if len(issues) != 12 || issues[0].Enumeration != "v.7 no.11" || issues[2].Enumeration != "v.8 no.1" {
+		t.Fatalf("Unexpected issues %+v", issues)
+	}
+
+	// The first issue is over the claim period late, the second not yet
+	recorder = doJSON("GET", "/api/serial-issues/late", librarian, nil)
+	var late []SerialIssue
+	json.NewDecoder(recorder.Body).Decode(&late)
+	if len(late) != 1 || late[0].ID != issues[0].ID || late[0].Title != "Library Journal" || late[0].VendorID == nil {
+		t.Fatalf("Unexpected late issues %+v", late)
+	}
+	recorder = doJSON("POST", "/api/serial-issues/"+strconv.Itoa(int(issues[0].ID))+"/claim", librarian, nil)
+	var issue SerialIssue
+	json.NewDecoder(recorder.Body).Decode(&issue)
+	if recorder.Code != http.StatusOK || issue.Status != issueClaimed || issue.Claims != 1 || issue.ClaimedAt == nil {
+		t.Fatalf("Unexpected issue %d %+v", recorder.Code, issue)
+	}
+	recorder = doJSON("GET", "/api/serial-issues/late", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&late)
+	if len(late) != 0 {
+		t.Fatalf("Expected a claimed issue not to be late until the claim is, but got %+v", late)
+	}
+	claim := "/api/serial-issues/" + strconv.Itoa(int(issues[0].ID)) + "/claim"
+	if recorder := doJSON("POST", claim, librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a claim made too soon after the last to be refused, but got %d", recorder.Code)
+	}
+	db.Exec("UPDATE serial_issues SET claimed_at = ? WHERE id = ?", clock.AddDate(0, 0, -sub.ClaimAfterDays-1), issues[0].ID)
+	recorder = doJSON("POST", claim, librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&issue)
+	if recorder.Code != http.StatusOK || issue.Claims != 2 {
+		t.Fatalf("Unexpected issue %d %+v", recorder.Code, issue)
+	}
+
+	if recorder := doJSON("POST", "/api/serial-issues/"+strconv.Itoa(int(issues[1].ID))+"/claim", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected an issue not yet late to be refused, but got %d", recorder.Code)
+	}
+
+	for _, issue := range issues[:2] {
+		recorder := doJSON("POST", "/api/serial-issues/"+strconv.Itoa(int(issue.ID))+"/receive", librarian, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, but got %d", recorder.Code)
+		}
+	}
+	if recorder := doJSON("POST", "/api/serial-issues/"+strconv.Itoa(int(issues[0].ID))+"/claim", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", path+"/issues?status=received", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&issues)
+	if len(issues) != 2 || issues[0].ReceivedAt == nil {
+		t.Fatalf("Unexpected issues %+v", issues)
+	}
+
+	// Renewing predicts the next year on from where the run left off
+	if recorder := doJSON("POST", path+"/renew", librarian, gin.H{"ends_at": sub.EndsAt.AddDate(0, -1, 0)}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", path+"/renew", librarian, gin.H{"ends_at": sub.EndsAt.AddDate(maxSubscriptionYears+1, 0, 0)}); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", path+"/renew", librarian, gin.H{"ends_at": sub.EndsAt.AddDate(1, 0, 0)}); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	recorder = doJSON("GET", path+"/issues", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&issues)
+	if len(issues) != 24 || issues[12].Sequence != 12 || issues[12].Enumeration != "v.8 no.11" {
+		t.Fatalf("Unexpected issues %+v", issues)
+	}
+
+	// Cancelling drops the issues still to come
+	recorder = doJSON("POST", path+"/cancel", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&sub)
+	if recorder.Code != http.StatusOK || sub.Status != subscriptionCancelled {
+		t.Fatalf("Unexpected subscription %d %+v", recorder.Code, sub)
+	}
+	recorder = doJSON("GET", path+"/issues", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&issues)
+	if len(issues) != 2 {
+		t.Fatalf("Expected the past issues to be kept, but got %+v", issues)
+	}
+	db.Exec("UPDATE serial_issues SET status = ?, received_at = NULL, claimed_at = NULL", issueExpected)
+	recorder = doJSON("GET", "/api/serial-issues/late", librarian, nil)
+	json.NewDecoder(recorder.Body).Decode(&late)
+	if len(late) != 0 {
+		t.Fatalf("Expected no late issues for a cancelled subscription, but got %+v", late)
+	}
+	if recorder := doJSON("POST", "/api/serial-issues/"+strconv.Itoa(int(issues[0].ID))+"/claim", librarian, nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a claim for a cancelled subscription to be refused, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("POST", path+"/renew", librarian, gin.H{"ends_at": clock.AddDate(2, 0, 0)}); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+	if recorder := doJSON("DELETE", "/api/serials/1", tokenFor(t, "admin", roleAdmin), nil); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Self-check machines speak 3M SIP2 over TCP. Each message is a line ending
+// in a carriage return: a two digit command code, a fixed part, then fields
+// of a two letter code and a value ending in "|". Machines with error
+// detection on end their messages with a sequence number (AY) and checksum
+// (AZ), which the response repeats.
+
+// How long a connection may stay quiet before it is closed
+const sipIdleTimeout = 30 * time.Minute
+
+// The longest message read. Machines send a few hundred bytes at most, so a
+// longer line closes the connection rather than being buffered.
+const sipMaxMessageBytes = 4096
+
+// Messages answered, in the order of the SC status supported messages field:
+// patron status, checkout, checkin, block patron, SC status, resend, login,
+// patron information, end session, fee paid, item information, item status
+// update, patron enable, hold, renew and renew all
+const sipSupportedMessages = "YYYNYYYYYNYNNNYN"
+
+// Sent when a message cannot be read, asking for it again
+const sipResendRequest = "96"
+
+var (
+	errSIPMalformed   = errors.New("malformed SIP2 message")
+	errSIPChecksum    = errors.New("SIP2 checksum mismatch")
+	errSIPNotLoggedIn = errors.New("SIP2 message before login")
+	errSIPTooLong     = errors.New("SIP2 message too long")
+)
+
+type sipSettings struct {
+	InstitutionID string
+	Currency      string
+}
+
+var sip2 = sipSettings{InstitutionID: "library", Currency: "USD"}
+
+func configureSIP2(c SIP2Config) {
+	if c.InstitutionID != "" {
+		sip2.InstitutionID = c.InstitutionID
+	}
+	if c.Currency != "" {
+		sip2.Currency = c.Currency
+	}
+}
+
+// Length of the fixed part of each request, after the command code
+var sipFixedLengths = map[string]int{
+	"93": 2,  // login
+	"99": 8,  // SC status
+	"23": 21, // patron status
+	"63": 31, // patron information
+	"11": 38, // checkout
+	"09": 37, // checkin
+	"29": 38, // renew
+	"17": 18, // item information
+	"35": 18, // end patron session
+	"97": 0,  // request ACS resend
+}
+
+// Circulation status codes of item information responses
+var sipItemStatuses = map[string]string{
+	itemAvailable: "03",
+	itemOnLoan:    "04",
+	itemOnHold:    "08",
+	itemInTransit: "10",
+	itemLost:      "12",
+	itemWithdrawn: "01",
+}
+
+type sipMessage struct {
+	code   string
+	fixed  string
+	fields map[string]string
+
+	// Sequence number, and whether the message came with a checksum
+	seq     string
+	checked bool
+}
+
+// Split a request into its parts, checking the checksum if it has one
+func parseSIPMessage(line string) (sipMessage, error) {
+	var msg sipMessage
+	if i := strings.LastIndex(line, "AZ"); i >= 0 && len(line)-i == 6 {
+		if !strings.EqualFold(sipChecksum(line[:i+2]), line[i+2:]) {
+			return msg, errSIPChecksum
+		}
+		msg.checked = true
+		line = line[:i]
+		if j := strings.LastIndex(line, "AY"); j >= 0 && len(line)-j == 3 {
+			msg.seq = line[j+2:]
+			line = line[:j]
+		}
+	}
+
+	if len(line) < 2 {
+		return msg, errSIPMalformed
+	}
+	msg.code = line[:2]
+	n, ok := sipFixedLengths[msg.code]
+	if !ok || len(line) < 2+n {
+		return msg, errSIPMalformed
+	}
+	msg.fixed = line[2 : 2+n]
+
+	msg.fields = map[string]string{}
+	for _, field := range strings.Split(line[2+n:], "|") {
+		if len(field) < 2 {
+			continue
+		}
+		if _, seen := msg.fields[field[:2]]; !seen {
+			msg.fields[field[:2]] = field[2:]
+		}
+	}
+	return msg, nil
+}
+
+// The four hex digit checksum of a message up to and including "AZ": the
+// two's complement of the sum of its bytes
+func sipChecksum(s string) string {
+	var sum uint16
+	for i := 0; i < len(s); i++ {
+		sum += uint16(s[i])
+	}
+	return fmt.Sprintf("%04X", -sum)
+}
+
+// A response being built, from its command code and fixed part
+type sipResponse struct {
+	b strings.Builder
+}
+
+func newSIPResponse(code string, fixed ...string) *sipResponse {
+	r := &sipResponse{}
+	r.b.WriteString(code)
+	for _, part := range fixed {
+		r.b.WriteString(part)
+	}
+	return r
+}
+
+func (r *sipResponse) field(code, value string) *sipResponse {
+	r.b.WriteString(code)
+	r.b.WriteString(strings.ReplaceAll(value, "|", " "))
+	r.b.WriteString("|")
+	return r
+}
+
+// Add the field only if it has a value
+func (r *sipResponse) optional(code, value string) *sipResponse {
+	if value != "" {
+		r.field(code, value)
+	}
+	return r
+}
+
+// Dates are sent as YYYYMMDDZZZZHHMMSS, with Z as the time zone for UTC
+func sipDate(t time.Time) string {
+	t = t.UTC()
+	return t.Format("20060102") + "   Z" + t.Format("150405")
+}
+
+func sipAmount(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+func sipYN(b bool) string {
+	if b {
+		return "Y"
+	}
+	return "N"
+}
+
+func sipOK(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// The screen message for a circulation refusal, or false if err is not one
+func sipRefusal(err error) (string, bool) {
+	e, ok := circulationErrors[err]
+	return e.message, ok
+}
+
+// Start listening for self-check machines
+func startSIP2Server(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("SIP2 server listening on", ln.Addr())
+	go serveSIP2(ln)
+	return nil
+}
+
+func serveSIP2(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go (&sipSession{conn: conn}).serve()
+	}
+}
+
+// One machine's connection. It logs in as a staff account, which the
+// changes it makes are audited under.
+type sipSession struct {
+	conn net.Conn
+	user *User
+
+	// Last response sent, for resend requests
+	last string
+}
+
+func (s *sipSession) serve() {
+	defer s.conn.Close()
+	reader := bufio.NewReaderSize(s.conn, sipMaxMessageBytes)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(sipIdleTimeout))
+		data, err := reader.ReadSlice('\r')
+		if err == bufio.ErrBufferFull {
+			log.Printf("Closing SIP2 connection from %s: %v", s.conn.RemoteAddr(), errSIPTooLong)
+			return
+		}
+		if err != nil {
+			return
+		}
+		line := strings.Trim(string(data), "\r\n")
+		if line == "" {
+			continue
+		}
+
+		response, err := s.handle(line)
+		if err != nil {
+			log.Printf("Closing SIP2 connection from %s: %v", s.conn.RemoteAddr(), err)
+			return
+		}
+		if _, err := io.WriteString(s.conn, response+"\r"); err != nil {
+			return
+		}
+	}
+}
+
+// Answer one request. An error closes the connection.
+func (s *sipSession) handle(line string) (string, error) {
+	msg, err := parseSIPMessage(line)
+	if err != nil {
+		return sipResendRequest, nil
+	}
+	if msg.code == "97" {
+		if s.last == "" {
+			return sipResendRequest, nil
+		}
+		return s.last, nil
+	}
+
+	var response *sipResponse
+	switch {
+	case msg.code == "93":
+		response, err = s.login(msg)
+	case msg.code == "99":
+		response = s.status()
+	case s.user == nil:
+		return "", errSIPNotLoggedIn
+	case msg.code == "23":
+		response, err = s.patronStatus(msg)
+	case msg.code == "63":
+		response, err = s.patronInformation(msg)
+	case msg.code == "11":
+		response, err = s.checkout(msg)
+	case msg.code == "09":
+		response, err = s.checkin(msg)
+	case msg.code == "29":
+		response, err = s.renew(msg)
+	case msg.code == "17":
+		response, err = s.itemInformation(msg)
+	case msg.code == "35":
+		response = newSIPResponse("36", "Y", sipDate(now())).
+			field("AO", sip2.InstitutionID).field("AA", msg.fields["AA"])
+	}
+	if err != nil {
+		return "", err
+	}
+
+	out := response.b.String()
+	if msg.checked {
+		seq := msg.seq
+		if seq == "" {
+			seq = "0"
+		}
+		out += "AY" + seq + "AZ"
+		out += sipChecksum(out)
+	}
+	s.last = out
+	return out, nil
+}
+
+// Log the machine in as a staff account allowed to circulate items. The
+// machine cannot answer a second factor, so accounts with one are refused.
+func (s *sipSession) login(msg sipMessage) (*sipResponse, error) {
+	s.user = nil
+	username, password := msg.fields["CN"], msg.fields["CO"]
+	ip := s.remoteIP()
+
+	until, err := loginBlockedUntil(username, ip)
+	if err != nil {
+		return nil, err
+	}
+	if !until.IsZero() {
+		return newSIPResponse("94", "0"), nil
+	}
+
+	user, err := authenticator.Authenticate(username, password)
+	if err == errInvalidCredentials {
+		return newSIPResponse("94", "0"), recordLoginFailure(username, ip)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mfa, err := isTOTPEnabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled || mfa || !roleHasPermission(user.Role, permCirculation) {
+		return newSIPResponse("94", "0"), nil
+	}
+	if err := clearLoginFailures(user.Username); err != nil {
+		return nil, err
+	}
+
+	s.user = &user
+	return newSIPResponse("94", "1"), nil
+}
+
+// The machine's address, which failed logins and PIN checks count against
+func (s *sipSession) remoteIP() string {
+	ip, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return ip
+}
+
+func (s *sipSession) status() *sipResponse {
+	return newSIPResponse("98", "Y", "Y", "Y", "Y", "N", "N", "030", "003", sipDate(now()), "2.00").
+		field("AO", sip2.InstitutionID).
+		field("BX", sipSupportedMessages)
+}
+
+// A patron as a machine sees them, looked up by card number
+type sipPatron struct {
+	Patron
+
+	// Why the patron may not borrow, or nil
+	refusal error
+	balance int64
+}
+
+func loadSIPPatron(q querier, cardNumber string) (sipPatron, error) {
+	patron, err := queryPatronByCard(q, cardNumber)
+	if err == errPatronNotFound {
+		return sipPatron{refusal: err}, nil
+	}
+	if err != nil {
+		return sipPatron{}, err
+	}
+	p := sipPatron{Patron: patron}
+
+	if err := checkPatronMayBorrow(q, patron.ID); err != nil {
+		if _, refused := sipRefusal(err); !refused {
+			return p, err
+		}
+		p.refusal = err
+	}
+	p.balance, err = patronBalance(q, patron.ID)
+	return p, err
+}
+
+func (p sipPatron) found() bool {
+	return p.ID != 0
+}
+
+// The fourteen patron status flags. Refused patrons are denied charge,
+// renewal and hold privileges, and owing too much is flagged as such.
+func (p sipPatron) flags() string {
+	flags := []byte(strings.Repeat(" ", 14))
+	if p.refusal != nil {
+		flags[0], flags[1], flags[3] = 'Y', 'Y', 'Y'
+	}
+	if p.refusal == errFinesOwed {
+		flags[10] = 'Y'
+	}
+	return string(flags)
+}
+
+func (p sipPatron) screenMessage() string {
+	message, _ := sipRefusal(p.refusal)
+	return message
+}
+
+// Check a patron's PIN against the password of their login account from
+// the machine at ip. Wrong PINs count towards the login lockouts like
+// failed logins, and while the account or machine is refused every PIN is
+// answered as wrong. Accounts with a second factor never match, as their
+// password alone does not sign them in.
+func checkPatronPassword(patron Patron, password, ip string) (bool, error) {
+	if patron.UserID == nil {
+		return false, nil
+	}
+	user, err := getUserByID(*patron.UserID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	until, err := loginBlockedUntil(user.Username, ip)
+	if err != nil || !until.IsZero() {
+		return false, err
+	}
+	mfa, err := isTOTPEnabled(user.ID)
+	if err != nil || mfa || user.Disabled {
+		return false, err
+	}
+
+	_, err = authenticator.Authenticate(user.Username, password)
+	if err == errInvalidCredentials {
+		return false, recordLoginFailure(user.Username, ip)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, clearLoginFailures(user.Username)
+}
+
+// Add the identity, validity, PIN check and fee fields shared by patron
+// status and patron information responses
+func (s *sipSession) patronFields(response *sipResponse, msg sipMessage, p sipPatron) error {
+	response.field("AO", sip2.InstitutionID).
+		field("AA", msg.fields["AA"]).
+		field("AE", p.Name).
+		field("BL", sipYN(p.found()))
+	if password := msg.fields["AD"]; password != "" && p.found() {
+		valid, err := checkPatronPassword(p.Patron, password, s.remoteIP())
+		if err != nil {
+			return err
+		}
+		response.field("CQ", sipYN(valid))
+	}
+	response.field("BH", sip2.Currency).field("BV", sipAmount(p.balance))
+	return nil
+}
+
+func (s *sipSession) patronStatus(msg sipMessage) (*sipResponse, error) {
+	p, err := loadSIPPatron(db, msg.fields["AA"])
+	if err != nil {
+		return nil, err
+	}
+
+	response := newSIPResponse("24", p.flags(), "000", sipDate(now()))
+	if err := s.patronFields(response, msg, p); err != nil {
+		return nil, err
+	}
+	return response.optional("AF", p.screenMessage()), nil
+}
+
+// Patron status with counts of the patron's holds and loans. The summary
+// in the fixed part asks for the items behind one of the counts, narrowed
+// to positions BP to BQ.
+func (s *sipSession) patronInformation(msg sipMessage) (*sipResponse, error) {
+	p, err := loadSIPPatron(db, msg.fields["AA"])
+	if err != nil {
+		return nil, err
+	}
+
+	var ready, waiting []Hold
+	var loans, overdue []Loan
+	if p.found() {
+		if ready, err = queryHolds(db, "WHERE h.patron_id = ? AND h.status = ? ORDER BY h.id", p.ID, holdReady); err != nil {
+			return nil, err
+		}
+		if waiting, err = queryHolds(db, "WHERE h.patron_id = ? AND h.status = ? ORDER BY h.id", p.ID, holdWaiting); err != nil {
+			return nil, err
+		}
+		if loans, err = queryLoans(db, "WHERE l.patron_id = ? AND l.returned_at IS NULL ORDER BY l.due_at", p.ID); err != nil {
+			return nil, err
+		}
+		for _, loan := range loans {
+			if loan.Overdue {
+				overdue = append(overdue, loan)
+			}
+		}
+	}
+
+	count := func(n int) string { return fmt.Sprintf("%04d", n) }
+	response := newSIPResponse("64", p.flags(), "000", sipDate(now()),
+		count(len(ready)), count(len(overdue)), count(len(loans)), count(0), count(0), count(len(waiting)))
+	if err := s.patronFields(response, msg, p); err != nil {
+		return nil, err
+	}
+
+	// The first requested summary position picks the list
+	var code string
+	var list []string
+	switch strings.IndexByte(msg.fixed[21:], 'Y') {
+	case 0:
+		code = "AS"
+		for _, hold := range ready {
+			item, err := lookupItem(db, *hold.ItemID, "")
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item.Barcode)
+		}
+	case 1:
+		code = "AT"
+		for _, loan := range overdue {
+			list = append(list, loan.Barcode)
+		}
+	case 2:
+		code = "AU"
+		for _, loan := range loans {
+			list = append(list, loan.Barcode)
+		}
+	case 5:
+		// Holds on a title have no item yet, so the title stands in
+		code = "CD"
+		for _, hold := range waiting {
+			book, err := queryBook(db, hold.BookID)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, book.Title)
+		}
+	}
+	start, end := 1, len(list)
+	if v, err := strconv.Atoi(msg.fields["BP"]); err == nil && v > start {
+		start = v
+	}
+	if v, err := strconv.Atoi(msg.fields["BQ"]); err == nil && v < end {
+		end = v
+	}
+	for i := start; i <= end; i++ {
+		response.field(code, list[i-1])
+	}
+
+	return response.
+		optional("BE", p.Email).
+		optional("BF", p.Phone).
+		optional("BD", p.Address).
+		optional("AF", p.screenMessage()), nil
+}
+
+// Check an item out to a patron. Checking out a copy the patron already
+// has renews it, if the machine's renewal policy allows.
+func (s *sipSession) checkout(msg sipMessage) (*sipResponse, error) {
+	allowRenewal := msg.fixed[0] == 'Y'
+	var (
+		loan    Loan
+		title   string
+		renewed bool
+	)
+	err := withTx(func(tx *sql.Tx) error {
+		patron, err := queryPatronByCard(tx, msg.fields["AA"])
+		if err != nil {
+			return err
+		}
+		item, err := lookupItem(tx, 0, msg.fields["AB"])
+		if err != nil {
+			return err
+		}
+		book, err := queryBook(tx, item.BookID)
+		if err != nil {
+			return err
+		}
+		title = book.Title
+
+		if item.Status == itemOnLoan && allowRenewal {
+			before, err := openLoanForItem(tx, item.ID)
+			if err != nil {
+				return err
+			}
+			if before.PatronID == patron.ID {
+				if loan, err = renewLoan(tx, before.ID); err != nil {
+					return err
+				}
+				renewed = true
+				return recordUserAudit(tx, *s.user, auditUpdate, "loan", loan.ID, before, loan)
+			}
+		}
+
+		if loan, err = checkoutItem(tx, item, patron.ID); err != nil {
+			return err
+		}
+		return recordUserAudit(tx, *s.user, auditCreate, "loan", loan.ID, nil, loan)
+	})
+	message, refused := sipRefusal(err)
+	if err != nil && !refused {
+		return nil, err
+	}
+
+	ok := err == nil
+	response := newSIPResponse("12", sipOK(ok), sipYN(renewed), "N", sipYN(ok), sipDate(now())).
+		field("AO", sip2.InstitutionID).
+		field("AA", msg.fields["AA"]).
+		field("AB", msg.fields["AB"]).
+		field("AJ", title)
+	if ok {
+		response.field("AH", sipDate(loan.DueAt))
+	}
+	if loan.Fine > 0 {
+		response.field("BH", sip2.Currency).field("BV", sipAmount(loan.Fine))
+	}
+	return response.optional("AF", message), nil
+}
+
+// Return an item. A copy set aside for a hold raises the alert, so the
+// machine sorts it away from the shelving returns.
+func (s *sipSession) checkin(msg sipMessage) (*sipResponse, error) {
+	var (
+		loan             Loan
+		title, location  string
+		patronCardNumber string
+	)
+	err := withTx(func(tx *sql.Tx) error {
+		item, err := lookupItem(tx, 0, msg.fields["AB"])
+		if err != nil {
+			return err
+		}
+		book, err := queryBook(tx, item.BookID)
+		if err != nil {
+			return err
+		}
+		title = book.Title
+		branch, err := queryBranch(tx, item.HomeBranchID)
+		if err != nil {
+			return err
+		}
+		location = branch.Code
+
+		before, err := openLoanForItem(tx, item.ID)
+		if err != nil {
+			return err
+		}
+		patron, err := queryPatron(tx, before.PatronID)
+		if err != nil {
+			return err
+		}
+		patronCardNumber = patron.CardNumber
+		if loan, err = returnLoan(tx, before.ID); err != nil {
+			return err
+		}
+		return recordUserAudit(tx, *s.user, auditUpdate, "loan", loan.ID, before, loan)
+	})
+	message, refused := sipRefusal(err)
+	if err != nil && !refused {
+		return nil, err
+	}
+
+	ok := err == nil
+	held := loan.Hold != nil
+	response := newSIPResponse("10", sipOK(ok), sipYN(ok && !held), "N", sipYN(held), sipDate(now())).
+		field("AO", sip2.InstitutionID).
+		field("AB", msg.fields["AB"]).
+		field("AQ", location).
+		field("AJ", title).
+		optional("AA", patronCardNumber)
+	if held {
+		response.field("CV", "01")
+		message = "Set aside for a hold"
+	}
+	return response.optional("AF", message), nil
+}
+
+// Renew an item on loan to the patron
+func (s *sipSession) renew(msg sipMessage) (*sipResponse, error) {
+	var (
+		loan  Loan
+		title string
+	)
+	err := withTx(func(tx *sql.Tx) error {
+		patron, err := queryPatronByCard(tx, msg.fields["AA"])
+		if err != nil {
+			return err
+		}
+		item, err := lookupItem(tx, 0, msg.fields["AB"])
+		if err != nil {
+			return err
+		}
+		book, err := queryBook(tx, item.BookID)
+		if err != nil {
+			return err
+		}
+		title = book.Title
+
+		before, err := openLoanForItem(tx, item.ID)
+		if err != nil {
+			return err
+		}
+		if before.PatronID != patron.ID {
+			return errItemNotOnLoan
+		}
+		if loan, err = renewLoan(tx, before.ID); err != nil {
+			return err
+		}
+		return recordUserAudit(tx, *s.user, auditUpdate, "loan", loan.ID, before, loan)
+	})
+	message, refused := sipRefusal(err)
+	if err != nil && !refused {
+		return nil, err
+	}
+
+	ok := err == nil
+	response := newSIPResponse("30", sipOK(ok), sipYN(ok), "N", "U", sipDate(now())).
+		field("AO", sip2.InstitutionID).
+		field("AA", msg.fields["AA"]).
+		field("AB", msg.fields["AB"]).
+		field("AJ", title)
+	if ok {
+		response.field("AH", sipDate(loan.DueAt))
+	}
+	if loan.Fine > 0 {
+		response.field("BH", sip2.Currency).field("BV", sipAmount(loan.Fine))
+	}
+	return response.optional("AF", message), nil
+}
+
+// Describe an item: its status, title, hold queue, due date if on loan,
+// pickup deadline if on the hold shelf, and where it belongs and is
+func (s *sipSession) itemInformation(msg sipMessage) (*sipResponse, error) {
+	item, err := lookupItem(db, 0, msg.fields["AB"])
+	if err == errItemNotFound {
+		return newSIPResponse("18", "01", "00", "01", sipDate(now())).
+			field("AB", msg.fields["AB"]).
+			field("AJ", "").
+			field("AF", "Item not found"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	book, err := queryBook(db, item.BookID)
+	if err != nil {
+		return nil, err
+	}
+	home, err := queryBranch(db, item.HomeBranchID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := queryBranch(db, item.CurrentBranchID)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := holdQueueLength(db, item.BookID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := newSIPResponse("18", sipItemStatuses[item.Status], "00", "01", sipDate(now())).
+		field("CF", strconv.Itoa(queue))
+	switch item.Status {
+	case itemOnLoan:
+		loan, err := openLoanForItem(db, item.ID)
+		if err != nil {
+			return nil, err
+		}
+		response.field("AH", sipDate(loan.DueAt))
+	case itemOnHold:
+		holds, err := queryHolds(db, "WHERE h.item_id = ? AND h.status = ?", item.ID, holdReady)
+		if err != nil {
+			return nil, err
+		}
+		if len(holds) > 0 && holds[0].ExpiresAt != nil {
+			response.field("CM", sipDate(*holds[0].ExpiresAt))
+		}
+	}
+	return response.
+		field("AB", item.Barcode).
+		field("AJ", book.Title).
+		field("AQ", home.Code).
+		field("AP", current.Code), nil
+}
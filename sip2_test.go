@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A self-check machine scripted by a test
+type sipTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    int
+}
+
+// Start a SIP2 server on a free port and connect a client to it
+func dialTestSIP2(t *testing.T) *sipTestClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveSIP2(ln)
+	t.Cleanup(func() { ln.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &sipTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Send a message as is and read the response, or "" if the server hung up
+func (c *sipTestClient) sendRaw(msg string) string {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c.conn, msg+"\r"); err != nil {
+		c.t.Fatal(err)
+	}
+	response, err := c.reader.ReadString('\r')
+	if err == io.EOF {
+		return ""
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(response, "\r")
+}
+
+// Send a message with a sequence number and checksum, checking that the
+// response repeats the one and carries a valid other, which are cut off
+func (c *sipTestClient) send(msg string) string {
+	c.t.Helper()
+	c.seq = (c.seq + 1) % 10
+	msg += "AY" + strconv.Itoa(c.seq) + "AZ"
+	response := c.sendRaw(msg + sipChecksum(msg))
+
+	trailer := "AY" + strconv.Itoa(c.seq) + "AZ"
+	i := len(response) - len(trailer) - 4
+	if i < 0 || response[i:i+len(trailer)] != trailer || sipChecksum(response[:i+len(trailer)]) != response[i+len(trailer):] {
+		c.t.Fatalf("Expected a response with sequence number %d and a valid checksum, but got %q", c.seq, response)
+	}
+	return response[:i]
+}
+
+func expectSIP(t *testing.T, response, prefix string, contains ...string) {
+	t.Helper()
+	if !strings.HasPrefix(response, prefix) {
+		t.Fatalf("Expected a response starting %q, but got %q", prefix, response)
+	}
+	for _, s := range contains {
+		if !strings.Contains(response, s) {
+			t.Fatalf("Expected %q in the response, but got %q", s, response)
+		}
+	}
+}
+
+func TestSIP2Messages(t *testing.T) {
+	if got := sipChecksum("96AZ"); got != "FEF6" {
+		t.Errorf("Expected checksum FEF6, but got %s", got)
+	}
+
+	line := "9300CNkiosk|COsecret|CPmain|AY4AZ"
+	msg, err := parseSIPMessage(line + sipChecksum(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.code != "93" || msg.fixed != "00" || msg.fields["CN"] != "kiosk" || msg.fields["CO"] != "secret" || msg.seq != "4" || !msg.checked {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	if _, err := parseSIPMessage(strings.Replace(line, "kiosk", "kiosq", 1) + sipChecksum(line)); err != errSIPChecksum {
+		t.Errorf("Expected a checksum mismatch, but got %v", err)
+	}
+	for _, line := range []string{"9", "2300", "15NN"} {
+		if _, err := parseSIPMessage(line); err != errSIPMalformed {
+			t.Errorf("Expected %q to be malformed, but got %v", line, err)
+		}
+	}
+}
+
+func TestSIP2Login(t *testing.T) {
+	setupIsolated(t)
+	tokenFor(t, "kiosk", roleLibrarian)
+	tokenFor(t, "member", roleMember)
+	client := dialTestSIP2(t)
+
+	expectSIP(t, client.send("9900302.00"), "98YYYYNN", "AOlibrary|", "BX"+sipSupportedMessages+"|")
+	expectSIP(t, client.send("9300CNkiosk|COwrong|"), "940")
+	expectSIP(t, client.send("9300CNmember|COmember password|"), "940")
+	expectSIP(t, client.send("9300CNkiosk|COkiosk password|"), "941")
+
+	// A garbled message is asked for again, and the last response resent
+	expectSIP(t, client.sendRaw("9300CNkiosk|COkiosk password|AY1AZ0000"), sipResendRequest)
+	expectSIP(t, client.sendRaw("97"), "941AY4AZ")
+
+	// Nothing but status is answered before logging in
+	other := dialTestSIP2(t)
+	if response := other.sendRaw("2300120240301   Z120000AOlibrary|AAC-alice|AC|"); response != "" {
+		t.Fatalf("Expected the connection to be closed, but got %q", response)
+	}
+
+	// Nor is a message longer than any machine sends
+	other = dialTestSIP2(t)
+	other.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(other.conn, "9900302.00"+strings.Repeat("X", sipMaxMessageBytes)+"\r")
+	response, err := other.reader.ReadString('\r')
+	if timeout, ok := err.(net.Error); err == nil || ok && timeout.Timeout() {
+		t.Fatalf("Expected the connection to be closed, but got %q, %v", response, err)
+	}
+}
+
+func TestSIP2PatronPassword(t *testing.T) {
+	setupIsolated(t)
+	clock := useClock(t)
+	tokenFor(t, "kiosk", roleLibrarian)
+	user, _ := createUser("alice", "correct horse", roleMember)
+	createTestPatron(t, "alice", user.ID)
+	client := dialTestSIP2(t)
+	expectSIP(t, client.send("9300CNkiosk|COkiosk password|"), "941")
+
+	status := func(pin string) string {
+		return client.send("23001" + sipDate(now()) + "AOlibrary|AAC-alice|AC|AD" + pin + "|")
+	}
+	expectSIP(t, status("correct horse"), "24", "CQY|")
+
+	// Wrong PINs count as failed logins, so guessing is soon refused
+	for i := 0; i < lockout.FreeAttempts; i++ {
+		expectSIP(t, status("wrong"), "24", "CQN|")
+	}
+	expectSIP(t, status("correct horse"), "24", "CQN|")
+	var failures int
+	db.QueryRow("SELECT failures FROM login_failures WHERE key = ?", userLockoutKey("alice")).Scan(&failures)
+	if failures != lockout.FreeAttempts {
+		t.Errorf("Expected %d failures, but got %d", lockout.FreeAttempts, failures)
+	}
+	*clock = clock.Add(lockout.MaxDelay)
+	expectSIP(t, status("correct horse"), "24", "CQY|")
+
+	// A password alone does not stand for an account with a second factor
+	db.Exec("INSERT INTO user_totp (user_id, secret, enabled, created_at) VALUES (?, 'JBSWY3DPEHPK3PXP', 1, ?)", user.ID, now())
+	expectSIP(t, status("correct horse"), "24", "CQN|")
+}
+
+func TestSIP2Circulation(t *testing.T) {
+	setupIsolated(t)
+	useClock(t)
+	tokenFor(t, "kiosk", roleLibrarian)
+	librarian := tokenFor(t, "librarian", roleLibrarian)
+	createTestItems(t, librarian, "40001", "40002")
+	alice := createTestPatron(t, "alice", 0)
+	bob := createTestPatron(t, "bob", 0)
+	client := dialTestSIP2(t)
+	expectSIP(t, client.send("9300CNkiosk|COkiosk password|"), "941")
+
+	date := sipDate(now())
+	clear := strings.Repeat(" ", 14)
+	expectSIP(t, client.send("23001"+date+"AOlibrary|AAC-alice|AC|"), "24"+clear+"000", "AEalice|", "BLY|", "BV0.00|")
+	expectSIP(t, client.send("23001"+date+"AOlibrary|AAC-nobody|AC|"), "24YY Y", "BLN|")
+
+	expectSIP(t, client.send("11NN"+date+date+"AOlibrary|AAC-alice|AB40001|AC|"), "121NNY", "AJBook 1|", "AH")
+	expectSIP(t, client.send("11NN"+date+date+"AOlibrary|AAC-bob|AB40001|AC|"), "120NNN", "AFItem is not available|")
+	expectSIP(t, client.send("11NN"+date+date+"AOlibrary|AAC-alice|AB49999|AC|"), "120NNN", "AFItem not found|")
+
+	expectSIP(t, client.send("63001"+date+"  Y       AOlibrary|AAC-alice|AC|"), "64"+clear+"000"+date+"000000000001000000000000", "AU40001|")
+	expectSIP(t, client.send("17"+date+"AOlibrary|AB40001|"), "1804", "AJBook 1|", "AH", "AQmain|", "CF0|")
+	expectSIP(t, client.send("17"+date+"AOlibrary|AB40002|"), "1803", "APmain|")
+
+	expectSIP(t, client.send("29NN"+date+date+"AOlibrary|AAC-bob|AB40001|AC|"), "300NNU", "AFItem is not on loan|")
+	expectSIP(t, client.send("29NN"+date+date+"AOlibrary|AAC-alice|AB40001|AC|"), "301YNU", "AH")
+
+	// A copy coming back to a waiting patron raises the alert
+	checkout(t, librarian, gin.H{"barcode": "40002", "patron_id": alice.ID})
+	if _, status := placeTestHold(t, librarian, "/api/holds", gin.H{"book_id": 1, "patron_id": bob.ID}); status != 201 {
+		t.Fatalf("Expected status 201, but got %d", status)
+	}
+	expectSIP(t, client.send("09N"+date+date+"APmain|AOlibrary|AB40001|AC|"), "101NNY", "AAC-alice|", "CV01|")
+	expectSIP(t, client.send("09N"+date+date+"APmain|AOlibrary|AB40001|AC|"), "100", "AFItem is not on loan|")
+	expectSIP(t, client.send("11NN"+date+date+"AOlibrary|AAC-bob|AB40001|AC|"), "121NNY")
+
+	var entries int
+	db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE entity_type = 'loan' AND username = 'kiosk'").Scan(&entries)
+	if entries != 4 {
+		t.Fatalf("Expected 4 loan changes audited under the kiosk account, but got %d", entries)
+	}
+
+	// Blocked patrons are told why
+	db.Exec("UPDATE patrons SET status = ? WHERE id = ?", patronBlocked, alice.ID)
+	expectSIP(t, client.send("11NN"+date+date+"AOlibrary|AAC-alice|AB40002|AC|"), "120NNN", "AFPatron is blocked|")
+	expectSIP(t, client.send("23001"+date+"AOlibrary|AAC-alice|AC|"), "24YY Y", "BLY|", "AFPatron is blocked|")
+	expectSIP(t, client.send("35"+date+"AOlibrary|AAC-alice|"), "36Y")
+}
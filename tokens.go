@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// Lifetimes of issued tokens
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+)
+
+// Claims carried by access tokens; Subject holds the user ID and Id the jti
+type Claims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	jwt.StandardClaims
+}
+
+// Apply the token lifetimes and signing keys from configuration
+func configureTokens(c JWTConfig) error {
+	if c.AccessTokenTTL > 0 {
+		accessTokenTTL = time.Duration(c.AccessTokenTTL)
+	}
+	if c.RefreshTokenTTL > 0 {
+		refreshTokenTTL = time.Duration(c.RefreshTokenTTL)
+	}
+
+	keys, err := loadKeySet(c)
+	if err != nil {
+		return err
+	}
+	signingKeys = keys
+	return nil
+}
+
+// Create the refresh token and access token denylist tables
+func createTokenTables() {
+	refreshTokensTableSQL := `
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(refreshTokensTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create refresh_tokens table:", err)
+	}
+
+	revokedTokensTableSQL := `
+		CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti TEXT PRIMARY KEY,
+			expires_at DATETIME NOT NULL
+		);`
+	_, err = db.Exec(revokedTokensTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create revoked_tokens table:", err)
+	}
+}
+
+// Generate n random bytes encoded as hex
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign a short-lived access token for user
+func issueAccessToken(user User) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	issuedAt := now()
+	claims := Claims{
+		Username: user.Username,
+		Role:     user.Role,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Id:        jti,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(accessTokenTTL).Unix(),
+		},
+	}
+
+	return signingKeys.sign(claims)
+}
+
+// Verify the signature and lifetime of an access token
+func parseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, signingKeys.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Id == "" || claims.ExpiresAt == 0 {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// Issue an access token together with a new stored refresh token
+func issueTokens(user User) (Token, error) {
+	accessToken, err := issueAccessToken(user)
+	if err != nil {
+		return Token{}, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return Token{}, err
+	}
+
+	_, err = db.Exec("INSERT INTO refresh_tokens (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		user.ID, hashToken(refreshToken), now().Add(refreshTokenTTL), now())
+	if err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+	}, nil
+}
+
+// Revoke a refresh token and return the account it belongs to. Presenting
+// an already revoked token revokes every refresh token of that account,
+// since it means the token was copied.
+func consumeRefreshToken(refreshToken string) (User, error) {
+	var (
+		id        int64
+		user      User
+		expiresAt time.Time
+		revokedAt sql.NullTime
+	)
+	err := db.QueryRow(`SELECT rt.id, rt.expires_at, rt.revoked_at, u.id, u.username, u.role, u.disabled
+						FROM refresh_tokens AS rt
+						INNER JOIN users AS u ON u.id = rt.user_id
+						WHERE rt.token_hash = ?`, hashToken(refreshToken)).
+		Scan(&id, &expiresAt, &revokedAt, &user.ID, &user.Username, &user.Role, &user.Disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, errInvalidRefreshToken
+		}
+		return User{}, err
+	}
+
+	if revokedAt.Valid {
+		if err := revokeRefreshTokensForUser(db, user.ID); err != nil {
+			return User{}, err
+		}
+		return User{}, errInvalidRefreshToken
+	}
+
+	result, err := db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", now(), id)
+	if err != nil {
+		return User{}, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 || !expiresAt.After(now()) || user.Disabled {
+		return User{}, errInvalidRefreshToken
+	}
+
+	return user, nil
+}
+
+func revokeRefreshTokensForUser(q querier, userID interface{}) error {
+	_, err := q.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now(), userID)
+	return err
+}
+
+// Add an access token ID to the denylist until it would have expired anyway
+func denyAccessToken(jti string, expiresAt time.Time) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)", jti, expiresAt.UTC())
+	return err
+}
+
+func isTokenRevoked(jti string) (bool, error) {
+	var found int
+	err := db.QueryRow("SELECT 1 FROM revoked_tokens WHERE jti = ?", jti).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete refresh tokens and denylist entries that can no longer be used
+func purgeExpiredTokens() error {
+	if _, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now()); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now())
+	return err
+}
+
+// Handlers
+
+func refresh(c *gin.Context) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := consumeRefreshToken(body.RefreshToken)
+	if err != nil {
+		if err == errInvalidRefreshToken {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	token, err := issueTokens(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, token)
+}
+
+func logout(c *gin.Context) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE token_hash = ? AND revoked_at IS NULL",
+		now(), hashToken(body.RefreshToken))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	// Kill the access token as well when one is presented
+	tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if claims, err := parseAccessToken(tokenString); err == nil {
+		if err := denyAccessToken(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+func revokeToken(c *gin.Context) {
+	var body struct {
+		JTI string `json:"jti"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if body.JTI == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	// The token cannot outlive the longest access token lifetime
+	if err := denyAccessToken(body.JTI, now().Add(accessTokenTTL)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	if err := recordAudit(db, c, auditCreate, "token_revocation", body.JTI, nil, gin.H{"jti": body.JTI}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Helper function to log in and decode the issued token pair
+func loginPair(t *testing.T, username, password string) Token {
+	t.Helper()
+	recorder := doJSON("POST", "/login", "", User{Username: username, Password: password})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	var token Token
+	if err := json.NewDecoder(recorder.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAccessTokenClaims(t *testing.T) {
+	setupIsolated(t)
+	createUser("alice", "correct horse", roleMember)
+	token := loginPair(t, "alice", "correct horse")
+
+	if token.RefreshToken == "" || token.ExpiresIn != int64(accessTokenTTL/time.Second) {
+		t.Errorf("Expected a refresh token and expires_in, but got %+v", token)
+	}
+
+	claims, err := parseAccessToken(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Id == "" || claims.IssuedAt == 0 || claims.ExpiresAt-claims.IssuedAt != int64(accessTokenTTL/time.Second) {
+		t.Errorf("Expected jti, iat and exp claims, but got %+v", claims)
+	}
+}
+
+func TestExpiredAccessToken(t *testing.T) {
+	setupIsolated(t)
+	user, _ := createUser("alice", "correct horse", roleMember)
+
+	realNow := now
+	now = func() time.Time { return realNow().Add(-time.Hour) }
+	expired, err := issueAccessToken(user)
+	now = realNow
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := doJSON("GET", "/api/books", expired, nil)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	setupIsolated(t)
+	createUser("alice", "correct horse", roleMember)
+	token := loginPair(t, "alice", "correct horse")
+
+	recorder := doJSON("POST", "/refresh", "", map[string]string{"refresh_token": token.RefreshToken})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var refreshed Token
+	json.NewDecoder(recorder.Body).Decode(&refreshed)
+	if refreshed.Token == "" || refreshed.RefreshToken == "" || refreshed.RefreshToken == token.RefreshToken {
+		t.Errorf("Expected a new token pair, but got %+v", refreshed)
+	}
+
+	recorder = doJSON("GET", "/api/books", refreshed.Token, nil)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	// Refresh tokens are single use, and replaying one revokes the whole family
+	recorder = doJSON("POST", "/refresh", "", map[string]string{"refresh_token": token.RefreshToken})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/refresh", "", map[string]string{"refresh_token": refreshed.RefreshToken})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/refresh", "", map[string]string{"refresh_token": "unknown"})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	setupIsolated(t)
+	createUser("alice", "correct horse", roleMember)
+	token := loginPair(t, "alice", "correct horse")
+
+	recorder := doJSON("POST", "/logout", token.Token, map[string]string{"refresh_token": token.RefreshToken})
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/refresh", "", map[string]string{"refresh_token": token.RefreshToken})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("GET", "/api/books", token.Token, nil)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+	createUser("alice", "correct horse", roleMember)
+	stolen := loginPair(t, "alice", "correct horse")
+
+	claims, _ := parseAccessToken(stolen.Token)
+	recorder := doJSON("POST", "/api/admin/tokens/revoke", admin, map[string]string{"jti": claims.Id})
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("GET", "/api/books", stolen.Token, nil)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	// Disabling the account stops it from refreshing
+	doJSON("PUT", "/api/admin/users/2/disable", admin, nil)
+	recorder = doJSON("POST", "/refresh", "", map[string]string{"refresh_token": stolen.RefreshToken})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
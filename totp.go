@@ -0,0 +1,477 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+// RFC 6238 parameters understood by every authenticator app
+const (
+	totpIssuer    = "Online Library"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1 // steps accepted either side of the current one
+	recoveryCodes = 10
+
+	mfaChallengeTTL         = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Create the TOTP secret, recovery code and login challenge tables
+func createTOTPTables() {
+	userTOTPTableSQL := `
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id INTEGER PRIMARY KEY,
+			secret TEXT NOT NULL,
+			enabled INTEGER NOT NULL DEFAULT 0,
+			last_step INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(userTOTPTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create user_totp table:", err)
+	}
+
+	recoveryCodesTableSQL := `
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(recoveryCodesTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create recovery_codes table:", err)
+	}
+
+	mfaChallengesTableSQL := `
+		CREATE TABLE IF NOT EXISTS mfa_challenges (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			challenge_hash TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);`
+	_, err = db.Exec(mfaChallengesTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create mfa_challenges table:", err)
+	}
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// HOTP value of a time step (RFC 4226 dynamic truncation)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus), nil
+}
+
+// Find the time step a code belongs to. Steps at or before lastStep were
+// already used and are refused so a code cannot be replayed.
+func verifyTOTP(secret, code string, at time.Time, lastStep int64) (int64, bool) {
+	current := at.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func isTOTPEnabled(userID interface{}) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT enabled FROM user_totp WHERE user_id = ?", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Check a TOTP code, or failing that an unused recovery code, for an
+// account and consume it
+func checkSecondFactor(userID interface{}, code string) (bool, error) {
+	var (
+		secret   string
+		lastStep int64
+	)
+	err := db.QueryRow("SELECT secret, last_step FROM user_totp WHERE user_id = ?", userID).Scan(&secret, &lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(secret, code, now(), lastStep); ok {
+		result, err := db.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		rowsAffected, _ := result.RowsAffected()
+		return rowsAffected == 1, nil
+	}
+
+	result, err := db.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		now(), userID, hashToken(strings.ToLower(code)))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// Replace an account's recovery codes, returning the new codes
+func generateRecoveryCodes(q querier, userID interface{}) ([]string, error) {
+	if _, err := q.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		random, err := randomToken(5)
+		if err != nil {
+			return nil, err
+		}
+		code := random[:5] + "-" + random[5:]
+		if _, err := q.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Answer with a challenge for /login/totp when the user has TOTP enabled,
+// reporting whether it did. Failures are answered with fallback.
+func respondMFARequired(c *gin.Context, userID uint, fallback string) bool {
+	mfa, err := isTOTPEnabled(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+		return true
+	}
+	if !mfa {
+		return false
+	}
+
+	challenge, err := createMFAChallenge(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+		return true
+	}
+	c.JSON(http.StatusOK, gin.H{"mfa_required": true, "challenge": challenge})
+	return true
+}
+
+// Start the second login step for an account with TOTP enabled
+func createMFAChallenge(userID uint) (string, error) {
+	challenge, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec("INSERT INTO mfa_challenges (challenge_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(challenge), userID, now().Add(mfaChallengeTTL))
+	return challenge, err
+}
+
+func getUserByID(id interface{}) (User, error) {
+	return queryUser(db, id)
+}
+
+func queryUser(q querier, id interface{}) (User, error) {
+	var user User
+	err := q.QueryRow("SELECT id, username, COALESCE(email, ''), role, disabled FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Disabled)
+	return user, err
+}
+
+// Handlers
+
+func enrollTOTP(c *gin.Context) {
+	if rejectAPIKeyCaller(c) {
+		return
+	}
+	userID := c.GetString("user_id")
+
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enrol authenticator"})
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	// A new enrolment replaces any unconfirmed one
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enrol authenticator"})
+		return
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO user_totp (user_id, secret, enabled, last_step, created_at) VALUES (?, ?, 0, 0, ?)",
+		userID, secret, now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enrol authenticator"})
+		return
+	}
+
+	uri := totpURI(c.GetString("username"), secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enrol authenticator"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": uri,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+func verifyTOTPEnrollment(c *gin.Context) {
+	if rejectAPIKeyCaller(c) {
+		return
+	}
+	userID := c.GetString("user_id")
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var (
+		secret   string
+		enabled  bool
+		lastStep int64
+	)
+	err := db.QueryRow("SELECT secret, enabled, last_step FROM user_totp WHERE user_id = ?", userID).Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No authenticator enrolment in progress"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	step, ok := verifyTOTP(secret, strings.TrimSpace(body.Code), now(), lastStep)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// Enabling and issuing the recovery codes happen together, so an account
+	// is never left with two factors and no way back in
+	var codes []string
+	err = withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE user_totp SET enabled = 1, last_step = ? WHERE user_id = ?", step, userID); err != nil {
+			return err
+		}
+		if codes, err = generateRecoveryCodes(tx, userID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "totp", userID, nil, gin.H{"enabled": true})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func disableTOTP(c *gin.Context) {
+	if rejectAPIKeyCaller(c) {
+		return
+	}
+	userID := c.GetString("user_id")
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ok, err := checkSecondFactor(userID, body.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// The secret and its recovery codes go together, as enabling added them
+	err = withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditDelete, "totp", userID, gin.H{"enabled": true}, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Second login step: exchange the challenge from /login and a TOTP or
+// recovery code for a token pair
+func loginTOTP(c *gin.Context) {
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var (
+		id        int64
+		userID    uint
+		attempts  int
+		expiresAt time.Time
+	)
+	err := db.QueryRow("SELECT id, user_id, attempts, expires_at FROM mfa_challenges WHERE challenge_hash = ?", hashToken(body.Challenge)).
+		Scan(&id, &userID, &attempts, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if attempts >= mfaChallengeMaxAttempts || !expiresAt.After(now()) {
+		if _, err := db.Exec("DELETE FROM mfa_challenges WHERE id = ?", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if refuseThrottledLogin(c, user.Username) {
+		return
+	}
+
+	ok, err := checkSecondFactor(userID, body.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if !ok {
+		if _, err := db.Exec("UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = ?", id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			return
+		}
+		if err := recordLoginFailure(user.Username, c.ClientIP()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM mfa_challenges WHERE id = ? OR expires_at < ?", id, now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+	if err := clearLoginFailures(user.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+
+	token, err := issueTokens(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, token)
+}
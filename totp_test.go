@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vector for the SHA-1 seed "12345678901234567890"
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	code, err := totpCode(secret, 59/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "287082" {
+		t.Errorf("Expected code 287082, but got %s", code)
+	}
+
+	step, ok := verifyTOTP(secret, "287082", time.Unix(59, 0), 0)
+	if !ok || step != 1 {
+		t.Errorf("Expected code to verify at step 1, but got %d %v", step, ok)
+	}
+	if _, ok := verifyTOTP(secret, "287082", time.Unix(59, 0), 1); ok {
+		t.Error("Expected a used step to be refused")
+	}
+}
+
+// Helper function to compute the code of a step relative to now
+func currentTOTP(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := totpCode(secret, now().Unix()/totpPeriod+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	setupIsolated(t)
+	admin := tokenFor(t, "admin", roleAdmin)
+
+	// Enrol
+	recorder := doJSON("POST", "/api/account/totp", admin, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var enrolment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+		QRCode     string `json:"qr_code"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&enrolment)
+	if !strings.HasPrefix(enrolment.OTPAuthURI, "otpauth://totp/Online%20Library:admin?") ||
+		!strings.Contains(enrolment.OTPAuthURI, "secret="+enrolment.Secret) ||
+		!strings.HasPrefix(enrolment.QRCode, "data:image/png;base64,") {
+		t.Errorf("Unexpected enrolment %+v", enrolment)
+	}
+
+	// Until verified, login needs no second step
+	loginPair(t, "admin", "admin password")
+
+	recorder = doJSON("POST", "/api/account/totp/verify", admin, map[string]string{"code": "000000"})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("POST", "/api/account/totp/verify", admin, map[string]string{"code": currentTOTP(t, enrolment.Secret, 0)})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var verified struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&verified)
+	if len(verified.RecoveryCodes) != recoveryCodes {
+		t.Errorf("Expected %d recovery codes, but got %v", recoveryCodes, verified.RecoveryCodes)
+	}
+
+	// The password step now returns a challenge instead of a token
+	recorder = doJSON("POST", "/login", "", User{Username: "admin", Password: "admin password"})
+	var step1 struct {
+		MFARequired bool   `json:"mfa_required"`
+		Challenge   string `json:"challenge"`
+		Token       string `json:"token"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&step1)
+	if !step1.MFARequired || step1.Challenge == "" || step1.Token != "" {
+		t.Fatalf("Expected a challenge, but got %+v", step1)
+	}
+
+	// The code used to verify the enrolment cannot be replayed
+	recorder = doJSON("POST", "/login/totp", "", map[string]string{"challenge": step1.Challenge, "code": currentTOTP(t, enrolment.Secret, 0)})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/login/totp", "", map[string]string{"challenge": step1.Challenge, "code": currentTOTP(t, enrolment.Secret, 1)})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+	var token Token
+	json.NewDecoder(recorder.Body).Decode(&token)
+	if _, err := parseAccessToken(token.Token); err != nil {
+		t.Errorf("Expected a valid token, but got %v", err)
+	}
+
+	// Challenges are single use
+	recorder = doJSON("POST", "/login/totp", "", map[string]string{"challenge": step1.Challenge, "code": verified.RecoveryCodes[0]})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	// A recovery code works once in place of a TOTP code
+	for i, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		recorder = doJSON("POST", "/login", "", User{Username: "admin", Password: "admin password"})
+		json.NewDecoder(recorder.Body).Decode(&step1)
+		recorder = doJSON("POST", "/login/totp", "", map[string]string{"challenge": step1.Challenge, "code": verified.RecoveryCodes[0]})
+		if recorder.Code != expected {
+			t.Errorf("Attempt %d: expected status %d, but got %d", i+1, expected, recorder.Code)
+		}
+	}
+
+	// Disabling needs a code too
+	recorder = doJSON("DELETE", "/api/account/totp", token.Token, map[string]string{"code": "000000"})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+	recorder = doJSON("DELETE", "/api/account/totp", token.Token, map[string]string{"code": verified.RecoveryCodes[1]})
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, but got %d", recorder.Code)
+	}
+	loginPair(t, "admin", "admin password")
+}
+
+func TestTOTPChallengeAttempts(t *testing.T) {
+	setupIsolated(t)
+	prevLockout := lockout
+	lockout.FreeAttempts = mfaChallengeMaxAttempts + 1
+	t.Cleanup(func() { lockout = prevLockout })
+	user, _ := createUser("alice", "correct horse", roleMember)
+	secret, _ := generateTOTPSecret()
+	db.Exec("INSERT INTO user_totp (user_id, secret, enabled, created_at) VALUES (?, ?, 1, ?)", user.ID, secret, now())
+
+	challenge, err := createMFAChallenge(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < mfaChallengeMaxAttempts; i++ {
+		doJSON("POST", "/login/totp", "", map[string]string{"challenge": challenge, "code": "000000"})
+	}
+
+	// The right code no longer helps once the attempts are used up
+	recorder := doJSON("POST", "/login/totp", "", map[string]string{"challenge": challenge, "code": currentTOTP(t, secret, 0)})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Transfer statuses. A requested transfer is shipped, which puts the copy
+// in transit, and received at the destination, which makes it the copy's
+// current branch.
+const (
+	transferRequested = "requested"
+	transferInTransit = "in_transit"
+	transferReceived  = "received"
+	transferCancelled = "cancelled"
+)
+
+var (
+	errTransferNotFound = errors.New("transfer not found")
+	errTransferExists   = errors.New("item already has an open transfer")
+	errTransferState    = errors.New("transfer is not in a state to allow this")
+	errSameBranch       = errors.New("item is already at the branch")
+)
+
+type Transfer struct {
+	ID           uint       `json:"id"`
+	ItemID       uint       `json:"item_id"`
+	Barcode      string     `json:"barcode"`
+	FromBranchID uint       `json:"from_branch_id"`
+	ToBranchID   uint       `json:"to_branch_id"`
+	Status       string     `json:"status"`
+	RequestedAt  time.Time  `json:"requested_at"`
+	ShippedAt    *time.Time `json:"shipped_at,omitempty"`
+	ClosedAt     *time.Time `json:"closed_at,omitempty"`
+}
+
+// Create the transfers table
+func createTransferTables() {
+	transfersTableSQL := `
+		CREATE TABLE IF NOT EXISTS transfers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			item_id INTEGER NOT NULL,
+			from_branch_id INTEGER NOT NULL,
+			to_branch_id INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			requested_at DATETIME NOT NULL,
+			shipped_at DATETIME,
+			closed_at DATETIME,
+			FOREIGN KEY (item_id) REFERENCES items (id),
+			FOREIGN KEY (from_branch_id) REFERENCES branches (id),
+			FOREIGN KEY (to_branch_id) REFERENCES branches (id)
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS transfers_open_item ON transfers (item_id) WHERE status IN ('requested', 'in_transit');`
+	_, err = db.Exec(transfersTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create transfers table:", err)
+	}
+}
+
+const transferColumns = `t.id, t.item_id, i.barcode, t.from_branch_id, t.to_branch_id, t.status, t.requested_at, t.shipped_at, t.closed_at
+						FROM transfers AS t INNER JOIN items AS i ON i.id = t.item_id`
+
+func scanTransfer(row interface{ Scan(...interface{}) error }) (Transfer, error) {
+	var (
+		transfer            Transfer
+		shippedAt, closedAt sql.NullTime
+	)
+	err := row.Scan(&transfer.ID, &transfer.ItemID, &transfer.Barcode, &transfer.FromBranchID, &transfer.ToBranchID,
+		&transfer.Status, &transfer.RequestedAt, &shippedAt, &closedAt)
+	transfer.ShippedAt = nullTimePtr(shippedAt)
+	transfer.ClosedAt = nullTimePtr(closedAt)
+	return transfer, err
+}
+
+func queryTransfer(q querier, id interface{}) (Transfer, error) {
+	transfer, err := scanTransfer(q.QueryRow("SELECT "+transferColumns+" WHERE t.id = ?", id))
+	if err == sql.ErrNoRows {
+		return transfer, errTransferNotFound
+	}
+	return transfer, err
+}
+
+// Ask for an available copy to be sent from its current branch to another
+func requestTransfer(tx *sql.Tx, item Item, toBranchID uint) (Transfer, error) {
+	if err := checkBranch(tx, toBranchID); err != nil {
+		return Transfer{}, err
+	}
+	if item.CurrentBranchID == toBranchID {
+		return Transfer{}, errSameBranch
+	}
+	if item.Status != itemAvailable {
+		return Transfer{}, errItemUnavailable
+	}
+
+	r, err := tx.Exec("INSERT INTO transfers (item_id, from_branch_id, to_branch_id, status, requested_at) VALUES (?, ?, ?, ?, ?)",
+		item.ID, item.CurrentBranchID, toBranchID, transferRequested, now())
+	if err != nil {
+		if isUniqueViolation(err) {
+			return Transfer{}, errTransferExists
+		}
+		return Transfer{}, err
+	}
+	id, _ := r.LastInsertId()
+
+	return queryTransfer(tx, id)
+}
+
+// Send the copy on its way, taking it off the shelf
+func shipTransfer(tx *sql.Tx, transfer Transfer) error {
+	if transfer.Status != transferRequested {
+		return errTransferState
+	}
+
+	result, err := tx.Exec("UPDATE items SET status = ? WHERE id = ? AND status = ?", itemInTransit, transfer.ItemID, itemAvailable)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errItemUnavailable
+	}
+
+	_, err = tx.Exec("UPDATE transfers SET status = ?, shipped_at = ? WHERE id = ?", transferInTransit, now(), transfer.ID)
+	return err
+}
+
+// Shelve the copy at its new branch, or set it aside for a waiting hold
+func receiveTransfer(tx *sql.Tx, transfer Transfer) error {
+	if transfer.Status != transferInTransit {
+		return errTransferState
+	}
+
+	_, err := tx.Exec("UPDATE items SET status = ?, current_branch_id = ? WHERE id = ?", itemAvailable, transfer.ToBranchID, transfer.ItemID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE transfers SET status = ?, closed_at = ? WHERE id = ?", transferReceived, now(), transfer.ID); err != nil {
+		return err
+	}
+
+	item, err := lookupItem(tx, transfer.ItemID, "")
+	if err != nil {
+		return err
+	}
+	_, err = trapItemForHold(tx, item)
+	return err
+}
+
+// Drop a transfer that has not been shipped yet
+func cancelTransfer(tx *sql.Tx, transfer Transfer) error {
+	if transfer.Status != transferRequested {
+		return errTransferState
+	}
+
+	_, err := tx.Exec("UPDATE transfers SET status = ?, closed_at = ? WHERE id = ?", transferCancelled, now(), transfer.ID)
+	return err
+}
+
+// Handlers
+
+func createTransfer(c *gin.Context) {
+	var body struct {
+		ItemID     uint   `json:"item_id"`
+		Barcode    string `json:"barcode"`
+		ToBranchID uint   `json:"to_branch_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Validate input
+	if (body.ItemID == 0 && body.Barcode == "") || body.ToBranchID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	var transfer Transfer
+	err := withTx(func(tx *sql.Tx) error {
+		item, err := lookupItem(tx, body.ItemID, body.Barcode)
+		if err != nil {
+			return err
+		}
+		if transfer, err = requestTransfer(tx, item, body.ToBranchID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditCreate, "transfer", transfer.ID, nil, transfer)
+	})
+	if err != nil {
+		respondBranchError(c, err, "Failed to request transfer")
+		return
+	}
+
+	c.JSON(http.StatusCreated, transfer)
+}
+
+// Run a change to an existing transfer and respond with the result
+func respondTransferChange(c *gin.Context, change func(tx *sql.Tx, transfer Transfer) error, fallback string) {
+	var after Transfer
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryTransfer(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		if err := change(tx, before); err != nil {
+			return err
+		}
+		if after, err = queryTransfer(tx, before.ID); err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "transfer", after.ID, before, after)
+	})
+	if err != nil {
+		respondBranchError(c, err, fallback)
+		return
+	}
+
+	c.JSON(http.StatusOK, after)
+}
+
+func shipTransferHandler(c *gin.Context) {
+	respondTransferChange(c, shipTransfer, "Failed to ship transfer")
+}
+
+func receiveTransferHandler(c *gin.Context) {
+	respondTransferChange(c, receiveTransfer, "Failed to receive transfer")
+}
+
+func cancelTransferHandler(c *gin.Context) {
+	respondTransferChange(c, cancelTransfer, "Failed to cancel transfer")
+}
+
+func getTransfer(c *gin.Context) {
+	transfer, err := queryTransfer(db, c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err, "Failed to retrieve transfer")
+		return
+	}
+
+	c.JSON(http.StatusOK, transfer)
+}
+
+// List transfers, narrowed by status and by a branch they leave or reach
+func getTransfers(c *gin.Context) {
+	where := "WHERE 1 = 1"
+	var args []interface{}
+	if status := c.Query("status"); status != "" {
+		where += " AND t.status = ?"
+		args = append(args, status)
+	}
+	if branchID := c.Query("branch_id"); branchID != "" {
+		where += " AND (t.from_branch_id = ? OR t.to_branch_id = ?)"
+		args = append(args, branchID, branchID)
+	}
+
+	rows, err := db.Query("SELECT "+transferColumns+" "+where+" ORDER BY t.id DESC", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers"})
+		return
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		transfer, err := scanTransfer(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers"})
+			return
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	c.JSON(http.StatusOK, transfers)
+}
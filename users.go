@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+var errUsernameTaken = errors.New("username or email already taken")
+
+// Create the users table
+func createUserTables() {
+	usersTableSQL := `
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			email TEXT UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'member',
+			disabled INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`
+	_, err = db.Exec(usersTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create users table:", err)
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// Validate the fields required to create an account
+func validateNewUser(user User) string {
+	if user.Username == "" || user.Password == "" {
+		return "Missing required fields"
+	}
+	if len(user.Password) < minPasswordLength {
+		return "Password must be at least 8 characters"
+	}
+	return ""
+}
+
+// Store a new account with a hashed password
+func createUser(username, password, role string) (User, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	return storeUser(User{Username: username, Role: role}, hash)
+}
+
+// Insert an account. An empty password hash never matches, for accounts
+// that sign in through an external identity provider.
+func storeUser(user User, passwordHash string) (User, error) {
+	return insertUser(db, user, passwordHash)
+}
+
+func insertUser(q querier, user User, passwordHash string) (User, error) {
+	email := sql.NullString{String: user.Email, Valid: user.Email != ""}
+	r, err := q.Exec("INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)",
+		user.Username, email, passwordHash, user.Role)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return User{}, errUsernameTaken
+		}
+		return User{}, err
+	}
+	id, _ := r.LastInsertId()
+
+	user.ID = uint(id)
+	user.Password = ""
+	return user, nil
+}
+
+// Look up an account and its password hash by username
+func getUserByUsername(username string) (User, string, error) {
+	var (
+		user User
+		hash string
+	)
+	err := db.QueryRow("SELECT id, username, COALESCE(email, ''), password_hash, role, disabled FROM users WHERE username = ?", username).
+		Scan(&user.ID, &user.Username, &user.Email, &hash, &user.Role, &user.Disabled)
+	return user, hash, err
+}
+
+// Create the bootstrap account from LIBRARY_ADMIN_USERNAME and
+// LIBRARY_ADMIN_PASSWORD when the users table is still empty
+func seedAdminUser() {
+	username := os.Getenv("LIBRARY_ADMIN_USERNAME")
+	password := os.Getenv("LIBRARY_ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		return
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		log.Fatal("Failed to count users:", err)
+	}
+	if count > 0 {
+		return
+	}
+
+	if _, err := createUser(username, password, roleAdmin); err != nil {
+		log.Fatal("Failed to create admin user:", err)
+	}
+}
+
+// Handlers
+
+func respondCreateUser(c *gin.Context, user User) {
+	if msg := validateNewUser(user); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	defer tx.Rollback()
+
+	created, err := insertUser(tx, user, hash)
+	if err != nil {
+		if err == errUsernameTaken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already taken"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	if err := recordAudit(tx, c, auditCreate, "user", created.ID, nil, created); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func register(c *gin.Context) {
+	var user User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Self-registered accounts can only borrow and browse, and cannot claim
+	// an email address an identity provider would sign them in with
+	user.Role = roleMember
+	user.Email = ""
+	respondCreateUser(c, user)
+}
+
+func createUserAccount(c *gin.Context) {
+	var user User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.Role == "" {
+		user.Role = roleMember
+	}
+	if !isValidRole(user.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	respondCreateUser(c, user)
+}
+
+func getUsers(c *gin.Context) {
+	rows, err := db.Query("SELECT id, username, COALESCE(email, ''), role, disabled FROM users")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+		return
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Disabled); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+			return
+		}
+		users = append(users, user)
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// Apply an UPDATE to a single account and respond with the result. Any
+// further changes in then run in the same transaction, once the account is
+// known to exist.
+func updateUser(c *gin.Context, then func(tx *sql.Tx, id string) error, query string, args ...interface{}) {
+	id := c.Param("id")
+
+	var user User
+	err := withTx(func(tx *sql.Tx) error {
+		before, err := queryUser(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(query, append(args, id)...); err != nil {
+			return err
+		}
+		if then != nil {
+			if err := then(tx, id); err != nil {
+				return err
+			}
+		}
+
+		user, err = queryUser(tx, id)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, c, auditUpdate, "user", user.ID, before, user)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func disableUser(c *gin.Context) {
+	// Disabled accounts must not be able to refresh their way back in
+	updateUser(c, func(tx *sql.Tx, id string) error {
+		return revokeRefreshTokensForUser(tx, id)
+	}, "UPDATE users SET disabled = ? WHERE id = ?", true)
+}
+
+func enableUser(c *gin.Context) {
+	updateUser(c, nil, "UPDATE users SET disabled = ? WHERE id = ?", false)
+}
+
+func updateUserRole(c *gin.Context) {
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !isValidRole(body.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	updateUser(c, nil, "UPDATE users SET role = ? WHERE id = ?", body.Role)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Helper function to send a JSON request through the test router
+func doJSON(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	request, _ := http.NewRequest(method, path, &buf)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRegister(t *testing.T) {
+	setupIsolated(t)
+
+	recorder := doJSON("POST", "/register", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, but got %d", recorder.Code)
+	}
+
+	expectedResponseBody := `{"id":1,"username":"alice","role":"member","disabled":false}`
+	if recorder.Body.String() != expectedResponseBody {
+		t.Errorf("Expected response body '%s', but got '%s'", expectedResponseBody, recorder.Body.String())
+	}
+
+	// Passwords are stored hashed
+	_, hash, err := getUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "correct horse" || !checkPassword(hash, "correct horse") {
+		t.Errorf("Expected a bcrypt hash, but got '%s'", hash)
+	}
+
+	// Usernames are unique
+	recorder = doJSON("POST", "/register", "", User{Username: "alice", Password: "another password"})
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, but got %d", recorder.Code)
+	}
+
+	// Short passwords are rejected
+	recorder = doJSON("POST", "/register", "", User{Username: "bob", Password: "short"})
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %d", recorder.Code)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	setupIsolated(t)
+	createUser("alice", "correct horse", roleMember)
+
+	recorder := doJSON("POST", "/login", "", User{Username: "alice", Password: "wrong password"})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/login", "", User{Username: "nobody", Password: "correct horse"})
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	var token Token
+	if err := json.NewDecoder(recorder.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "" {
+		t.Error("Expected a token")
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	setupIsolated(t)
+	createUser("admin", "admin password", roleAdmin)
+	createUser("alice", "correct horse", roleMember)
+
+	var token Token
+	recorder := doJSON("POST", "/login", "", User{Username: "admin", Password: "admin password"})
+	json.NewDecoder(recorder.Body).Decode(&token)
+
+	// Create an account through the admin endpoint
+	recorder = doJSON("POST", "/api/admin/users", token.Token, User{Username: "bob", Password: "bob password"})
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected status 201, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("PUT", "/api/admin/users/2/disable", token.Token, nil)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("PUT", "/api/admin/users/2/enable", token.Token, nil)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("POST", "/login", "", User{Username: "alice", Password: "correct horse"})
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", recorder.Code)
+	}
+
+	recorder = doJSON("PUT", "/api/admin/users/99/disable", token.Token, nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, but got %d", recorder.Code)
+	}
+}